@@ -0,0 +1,101 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// adaptiveWindow is how many latency budgets of history the arrival rate
+// of an adaptive wait is averaged over.
+const adaptiveWindow = 16
+
+// WithAdaptiveWait makes the ring's waits for any completion, such as
+// those of an Executor or a Loop, wait for a batch instead when
+// completions arrive quickly. The batch is the number expected within
+// maxDelay at the measured arrival rate, and a wait never holds a
+// completion back for longer than maxDelay: if the batch is late, the
+// wait returns with what has arrived. Under load this trades up to
+// maxDelay of latency for fewer io_uring_enter calls; at low rates
+// waits return on the first completion as usual.
+//
+// With IORING_FEAT_MIN_TIMEOUT (6.12+) the kernel does this in one call.
+// Before that the wait is bounded by a timeout and, if nothing arrived,
+// repeated for a single completion, which needs IORING_FEAT_EXT_ARG
+// (5.11+); without it waits are unchanged. It has no effect with
+// WithNetpollWait or WithPollBackend.
+func WithAdaptiveWait(maxDelay time.Duration) Option {
+	return func(p *setupConfig) {
+		p.adaptiveWait = maxDelay
+	}
+}
+
+// adaptiveWait sizes the waits of a ring set up with WithAdaptiveWait.
+type adaptiveWait struct {
+	maxDelay time.Duration
+	limit    uint32 // Largest batch to wait for
+
+	mu        sync.Mutex
+	last      time.Time // When the previous wait started
+	completed uint64    // The ring's completion count at last
+	rate      float64   // Smoothed completions per second
+}
+
+func newAdaptiveWait(maxDelay time.Duration, cqEntries uint32) *adaptiveWait {
+	return &adaptiveWait{maxDelay: maxDelay, limit: max(cqEntries/2, 1)}
+}
+
+// batch folds the completions reaped since the previous wait into the
+// arrival rate and returns how many to wait for at now.
+func (a *adaptiveWait) batch(now time.Time, completed uint64) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.last.IsZero() {
+		if dt := now.Sub(a.last); dt > 0 {
+			// Weigh the sample by how long it covers, so an idle spell
+			// resets the rate instead of being averaged away
+			w := min(float64(dt)/float64(adaptiveWindow*a.maxDelay), 1)
+			sample := float64(completed-a.completed) / dt.Seconds()
+			a.rate += (sample - a.rate) * w
+		}
+	}
+	a.last, a.completed = now, completed
+
+	n := a.rate * a.maxDelay.Seconds()
+	if n < 1 {
+		return 1
+	}
+	return uint32(min(n, float64(a.limit)))
+}
+
+// waitAdaptive waits for at least one completion, and up to maxDelay for
+// the batch the arrival rate predicts.
+func (r *Ring) waitAdaptive() error {
+	const flags = sys.IORING_ENTER_GETEVENTS
+	n := r.adapt.batch(time.Now(), r.stats.completed.Load())
+	if n == 1 || !r.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		_, err := r.enter(0, 1, flags|r.enterFlags, nil)
+		return err
+	}
+
+	if r.HasFeature(sys.IORING_FEAT_MIN_TIMEOUT) {
+		arg := sys.GetEventsArg{MinWaitUsec: uint32(max(r.adapt.maxDelay/time.Microsecond, 1))}
+		_, err := r.enterExt(0, n, flags|r.enterFlags, &arg)
+		return err
+	}
+
+	_, err := r.enterTimeout(0, n, flags|r.enterFlags, nil, r.adapt.maxDelay)
+	if err != syscall.ETIME {
+		return err
+	}
+	if r.CQReady() > 0 {
+		return nil
+	}
+	_, err = r.enter(0, 1, flags|r.enterFlags, nil)
+	return err
+}
@@ -0,0 +1,163 @@
+//go:build linux
+
+package iouring
+
+import (
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// cpuSet is the kernel's cpu_set_t, for up to 1024 CPUs.
+type cpuSet [16]uint64
+
+// LockThread locks the calling goroutine to its OS thread, as
+// runtime.LockOSThread does, and if cpus are given restricts the thread
+// to them. A ring set up with WithSingleIssuer or WithDeferTaskrun is
+// bound to one thread, and its deferred work runs on that thread, so
+// the issuer must keep its thread and benefits from keeping its CPU
+// too. The returned func restores the thread's CPUs and unlocks it; it
+// must be called on the same goroutine. On error the goroutine is left
+// unlocked.
+func LockThread(cpus ...int) (unlock func(), err error) {
+	runtime.LockOSThread()
+	if len(cpus) == 0 {
+		return runtime.UnlockOSThread, nil
+	}
+
+	var old, set cpuSet
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(set)*64 {
+			runtime.UnlockOSThread()
+			return nil, syscall.EINVAL
+		}
+		set[cpu/64] |= 1 << (cpu % 64)
+	}
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &old); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &set); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	return func() {
+		schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &old)
+		runtime.UnlockOSThread()
+	}, nil
+}
+
+// LockIssuer locks the calling goroutine to its OS thread to issue on
+// the ring, like LockThread. If the ring's SQPOLL thread is pinned with
+// WithSQPollCPU, the issuer is also restricted to the CPUs sharing a
+// cache with it, so the SQEs it writes are still in cache when the
+// SQPOLL thread reads them, without the two competing for one CPU. If
+// there are no such CPUs the thread's CPUs are left alone.
+func (r *Ring) LockIssuer() (unlock func(), err error) {
+	if r.params.Flags&(sys.IORING_SETUP_SQPOLL|sys.IORING_SETUP_SQ_AFF) != sys.IORING_SETUP_SQPOLL|sys.IORING_SETUP_SQ_AFF {
+		return LockThread()
+	}
+	cpus, err := NearCPUs(int(r.params.SQThreadCPU))
+	if err != nil {
+		return nil, err
+	}
+	return LockThread(cpus...)
+}
+
+// NearCPUs returns the CPUs that share a cache with cpu, not counting
+// cpu itself: its SMT siblings first, then the other CPUs of its last
+// level cache, as listed in /sys/devices/system/cpu. Use it to place a
+// submitter next to the SQPOLL thread or to the CPU handling a NIC's
+// interrupts; see IRQCPUs.
+func NearCPUs(cpu int) ([]int, error) {
+	dir := "/sys/devices/system/cpu/cpu" + strconv.Itoa(cpu)
+	siblings, err := readCPUList(dir + "/topology/thread_siblings_list")
+	if err != nil {
+		return nil, err
+	}
+
+	// The last level cache is the highest level listed
+	var llc []int
+	level := 0
+	for i := 0; ; i++ {
+		idx := dir + "/cache/index" + strconv.Itoa(i)
+		b, err := os.ReadFile(idx + "/level")
+		if err != nil {
+			break
+		}
+		if l, _ := strconv.Atoi(strings.TrimSpace(string(b))); l > level {
+			if shared, err := readCPUList(idx + "/shared_cpu_list"); err == nil {
+				llc, level = shared, l
+			}
+		}
+	}
+
+	var near []int
+	for _, c := range append(siblings, llc...) {
+		if c != cpu && !slices.Contains(near, c) {
+			near = append(near, c)
+		}
+	}
+	return near, nil
+}
+
+// IRQCPUs returns the CPUs that handle interrupt irq, e.g. that of a
+// NIC queue, from /proc/irq. With several, the kernel picks among them.
+func IRQCPUs(irq int) ([]int, error) {
+	dir := "/proc/irq/" + strconv.Itoa(irq)
+	cpus, err := readCPUList(dir + "/effective_affinity_list")
+	if os.IsNotExist(err) {
+		// Before 4.15, or without CONFIG_GENERIC_IRQ_EFFECTIVE_AFF_MASK
+		cpus, err = readCPUList(dir + "/smp_affinity_list")
+	}
+	return cpus, err
+}
+
+// readCPUList reads a file holding a kernel CPU list, such as "0-3,8".
+func readCPUList(path string) ([]int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parseCPUList parses a kernel CPU list, such as "0-3,8".
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return nil, err
+			}
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// schedAffinity gets or sets the calling thread's CPUs.
+func schedAffinity(trap uintptr, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
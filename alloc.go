@@ -0,0 +1,142 @@
+//go:build linux
+
+package iouring
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// allocSlabSize is the least memory a BufferAllocator maps at once.
+const allocSlabSize = 1 << 20
+
+// BufferAllocator hands out buffers of one size, aligned for O_DIRECT
+// I/O and RegisterBuffers, carved from anonymous mappings that are
+// reused rather than returned to the system. A plain make([]byte) gives
+// no alignment guarantee, which O_DIRECT rejects with EINVAL.
+//
+// The memory is not managed by the Go heap: buffers stay valid until
+// Free, which must only be called once no ring uses them. A
+// BufferAllocator is safe for concurrent use.
+type BufferAllocator struct {
+	size  int // Buffer size, a multiple of align
+	align int
+	slab  int // Bytes mapped per slab
+
+	mu    sync.Mutex
+	slabs [][]byte
+	free  [][]byte
+}
+
+// NewBufferAllocator returns an allocator of buffers of at least size
+// bytes, starting at multiples of align. An align of zero means the page
+// size; otherwise it must be a power of two, e.g. the logical block
+// size of a device. size is rounded up to a multiple of align.
+func NewBufferAllocator(size, align int) (*BufferAllocator, error) {
+	if align == 0 {
+		align = os.Getpagesize()
+	}
+	if size <= 0 || align < 0 || align&(align-1) != 0 {
+		return nil, syscall.EINVAL
+	}
+	size = alignUpInt(size, align)
+
+	slab := allocSlabSize
+	if slab < size {
+		slab = size
+	}
+	slab = alignUpInt(slab, size) // Whole buffers only
+	if align > os.Getpagesize() {
+		slab += align // Room to align the start of the slab
+	}
+	return &BufferAllocator{size: size, align: align, slab: slab}, nil
+}
+
+// Size returns the size of the buffers.
+func (a *BufferAllocator) Size() int {
+	return a.size
+}
+
+// Get returns a buffer, mapping a new slab if none is free. The buffer
+// holds whatever its previous user left in it.
+func (a *BufferAllocator) Get() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.free) == 0 {
+		if err := a.grow(); err != nil {
+			return nil, err
+		}
+	}
+	n := len(a.free)
+	b := a.free[n-1]
+	a.free = a.free[:n-1]
+	return b, nil
+}
+
+// Alloc returns n buffers, e.g. for RegisterBuffers.
+func (a *BufferAllocator) Alloc(n int) ([][]byte, error) {
+	bufs := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := a.Get()
+		if err != nil {
+			for _, b := range bufs {
+				a.Put(b)
+			}
+			return nil, err
+		}
+		bufs = append(bufs, b)
+	}
+	return bufs, nil
+}
+
+// Put returns a buffer obtained from Get for reuse. Reslicing is fine;
+// buffers of other origins are ignored.
+func (a *BufferAllocator) Put(b []byte) {
+	if cap(b) != a.size {
+		return
+	}
+	a.mu.Lock()
+	a.free = append(a.free, b[:a.size])
+	a.mu.Unlock()
+}
+
+// grow maps a slab and adds its buffers to the free list.
+// Caller must hold a.mu.
+func (a *BufferAllocator) grow() error {
+	mem, err := syscall.Mmap(-1, 0, a.slab,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return err
+	}
+	a.slabs = append(a.slabs, mem)
+
+	start := 0
+	if mis := int(uintptr(unsafe.Pointer(&mem[0])) & uintptr(a.align-1)); mis != 0 {
+		start = a.align - mis
+	}
+	for off := start; off+a.size <= len(mem); off += a.size {
+		a.free = append(a.free, mem[off:off+a.size:off+a.size])
+	}
+	return nil
+}
+
+// Free unmaps all memory of the allocator, including buffers not put
+// back, which must no longer be registered or in use by in-flight
+// requests. The allocator can be used again afterwards.
+func (a *BufferAllocator) Free() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var first error
+	for _, mem := range a.slabs {
+		if err := syscall.Munmap(mem); err != nil && first == nil {
+			first = err
+		}
+	}
+	a.slabs = nil
+	a.free = nil
+	return first
+}
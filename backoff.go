@@ -0,0 +1,63 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+	"time"
+)
+
+// Bounds of the exponential backoff of WithSubmitRetry.
+const (
+	submitBackoffMin = time.Microsecond
+	submitBackoffMax = time.Millisecond
+)
+
+// WithSubmitRetry makes Submit and SubmitAndWait, and the calls built on
+// them, retry for up to maxWait when the kernel turns a submission away
+// for lack of room, instead of returning the raw errno:
+//
+//   - EBUSY means completions are backlogged in the kernel because the
+//     CQ ring was full (see CQOverflowPending). The ring has the kernel
+//     flush the backlog into the CQ ring and retries, backing off while
+//     other goroutines reap; if the backlog is still there after maxWait
+//     it returns ErrCQOverflow.
+//   - EAGAIN means the kernel could not allocate memory for a request. It
+//     is retried with exponential backoff and, if it persists, returns
+//     ErrNoResources.
+//
+// The backoff starts at 1µs and doubles up to 1ms per attempt. A caller
+// that is also the only goroutine reaping the ring gains little from it,
+// as nothing frees the CQ while it waits.
+func WithSubmitRetry(maxWait time.Duration) Option {
+	return func(p *setupConfig) {
+		p.submitRetry = maxWait
+	}
+}
+
+// submitEnter is enter for submissions, retrying EBUSY and EAGAIN as
+// set by WithSubmitRetry.
+func (r *Ring) submitEnter(toSubmit, minComplete, flags uint32) (int, error) {
+	n, err := r.enter(toSubmit, minComplete, flags, nil)
+	if r.submitRetry <= 0 || (err != syscall.EBUSY && err != syscall.EAGAIN) {
+		return n, err
+	}
+
+	deadline := time.Now().Add(r.submitRetry)
+	delay := submitBackoffMin
+	for err == syscall.EBUSY || err == syscall.EAGAIN {
+		if !time.Now().Before(deadline) {
+			if err == syscall.EBUSY {
+				return 0, ErrCQOverflow
+			}
+			return 0, ErrNoResources
+		}
+		// Flushing the backlog may make room at once
+		if err != syscall.EBUSY || r.getEvents(0) != nil || r.CQOverflowPending() {
+			time.Sleep(min(delay, time.Until(deadline)))
+			delay = min(delay*2, submitBackoffMax)
+		}
+		n, err = r.enter(toSubmit, minComplete, flags, nil)
+	}
+	return n, err
+}
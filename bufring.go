@@ -0,0 +1,208 @@
+//go:build linux
+
+package iouring
+
+import (
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// BufRing is a ring-mapped provided buffer ring (IORING_REGISTER_PBUF_RING, 5.19+).
+//
+// Unlike PrepProvideBuffers, handing buffers to the kernel is a plain
+// memory write plus a tail update, with no SQE or syscall. Requests that
+// set IOSQE_BUFFER_SELECT with this ring's group ID (such as
+// PrepRecvMultishot) pick a buffer at completion time and report its ID
+// in the CQE flags; decode it with BufferID.
+//
+// A BufRing is not safe for concurrent use.
+type BufRing struct {
+	ring    *Ring
+	bgid    uint16
+	entries uint32
+	mask    uint16
+	tail    uint16 // Local tail, published by Advance
+
+	mem  []byte    // mmap'd ring memory shared with the kernel
+	bufs []sys.Buf // Ring entries (entry 0 overlaps the header)
+	held [][]byte  // Buffers handed to the kernel, indexed by buffer ID
+}
+
+// NewBufRing creates and registers a provided buffer ring for group bgid.
+// entries must be a power of two no larger than 32768. The ring starts
+// empty; add buffers with Add and publish them with Advance.
+func (r *Ring) NewBufRing(entries uint32, bgid uint16) (*BufRing, error) {
+	if entries == 0 || entries > 32768 || entries&(entries-1) != 0 {
+		return nil, syscall.EINVAL
+	}
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	return r.newBufRingLocked(entries, bgid)
+}
+
+// newBufRingFree is NewBufRing for the highest buffer group that has no
+// buffer ring registered through the Ring.
+func (r *Ring) newBufRingFree(entries uint32) (*BufRing, error) {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	for bgid := 1<<16 - 1; bgid >= 0; bgid-- {
+		if !slices.Contains(r.regBufRings, uint16(bgid)) {
+			return r.newBufRingLocked(entries, uint16(bgid))
+		}
+	}
+	return nil, syscall.ENOSPC
+}
+
+// newBufRingLocked registers a buffer ring. Caller must hold regMu.
+func (r *Ring) newBufRingLocked(entries uint32, bgid uint16) (*BufRing, error) {
+	size := int(entries) * int(unsafe.Sizeof(sys.Buf{}))
+	mem, err := syscall.Mmap(-1, 0, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := sys.BufRingSetup{
+		RingAddr:    uint64(uintptr(unsafe.Pointer(&mem[0]))),
+		RingEntries: entries,
+		BGid:        bgid,
+	}
+	if _, err := r.register(sys.IORING_REGISTER_PBUF_RING, unsafe.Pointer(&reg), 1); err != nil {
+		syscall.Munmap(mem)
+		return nil, err
+	}
+	r.regBufRings = append(r.regBufRings, bgid)
+
+	return newBufRing(r, mem, entries, bgid), nil
+}
+
+// newBufRing lays a buffer ring of entries over mem, which must hold
+// that many sys.Buf entries. It does not involve the kernel, so the
+// bookkeeping can be exercised on plain memory.
+func newBufRing(r *Ring, mem []byte, entries uint32, bgid uint16) *BufRing {
+	return &BufRing{
+		ring:    r,
+		bgid:    bgid,
+		entries: entries,
+		mask:    uint16(entries - 1),
+		mem:     mem,
+		bufs:    unsafe.Slice((*sys.Buf)(unsafe.Pointer(&mem[0])), entries),
+	}
+}
+
+// BGid returns the buffer group ID of the ring.
+func (b *BufRing) BGid() uint16 {
+	return b.bgid
+}
+
+// Entries returns the number of entries in the ring.
+func (b *BufRing) Entries() uint32 {
+	return b.entries
+}
+
+// Add stages buf under buffer ID bid at position offset past the current
+// tail. The buffer is not visible to the kernel until Advance is called.
+// buf must not be touched by the caller until it is returned in a CQE.
+func (b *BufRing) Add(buf []byte, bid uint16, offset int) {
+	e := &b.bufs[(b.tail+uint16(offset))&b.mask]
+	if len(buf) > 0 {
+		e.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	} else {
+		e.Addr = 0
+	}
+	e.Len = uint32(len(buf))
+	e.Bid = bid
+
+	// Keep a reference so the GC can't reclaim memory the kernel may write.
+	if int(bid) >= len(b.held) {
+		held := make([][]byte, int(bid)+1)
+		copy(held, b.held)
+		b.held = held
+	}
+	b.held[bid] = buf
+}
+
+// Advance publishes count previously added buffers to the kernel.
+func (b *BufRing) Advance(count int) {
+	b.tail += uint16(count)
+	b.publishTail()
+}
+
+// publishTail stores the tail with release semantics. Go has no 16-bit
+// atomics, so the store covers the 32-bit word the tail shares with the
+// ID field of entry 0, which only this side ever writes.
+func (b *BufRing) publishTail() {
+	word := (*uint32)(unsafe.Pointer(&b.mem[12]))
+	bid0 := uint32(*(*uint16)(unsafe.Pointer(&b.mem[12])))
+	sys.StoreRelease(word, uint32(b.tail)<<16|bid0)
+}
+
+// Buffer returns the buffer registered under bid, or nil if none was added.
+func (b *BufRing) Buffer(bid uint16) []byte {
+	if int(bid) >= len(b.held) {
+		return nil
+	}
+	return b.held[bid]
+}
+
+// Recycle hands the buffer with ID bid back to the kernel and publishes
+// it immediately. Typically called once the data from a CQE is consumed.
+func (b *BufRing) Recycle(bid uint16) {
+	b.Add(b.Buffer(bid), bid, 0)
+	b.Advance(1)
+}
+
+// Head returns the kernel's consumption head for this ring (6.8+).
+func (b *BufRing) Head() (uint16, error) {
+	return b.ring.BufRingStatus(b.bgid)
+}
+
+// Available returns how many published buffers the kernel has not yet
+// consumed (6.8+). Buffers added since the last Advance are not counted.
+// Together with the application's own count of recycled buffers this
+// tells how many are still held by in-flight requests.
+func (b *BufRing) Available() (int, error) {
+	head, err := b.Head()
+	if err != nil {
+		return 0, err
+	}
+	return int(b.tail - head), nil
+}
+
+// Close unregisters the buffer ring, unless closing the Ring already
+// has, and releases its memory. Requests still selecting from the group
+// will fail with ENOBUFS.
+func (b *BufRing) Close() error {
+	if b.mem == nil {
+		return nil
+	}
+	err := b.ring.unregisterBufRing(b.bgid)
+	syscall.Munmap(b.mem)
+	b.mem = nil
+	b.bufs = nil
+	b.held = nil
+	return err
+}
+
+// BufRingStatus returns the kernel head of the provided buffer ring
+// registered for group bgid (IORING_REGISTER_PBUF_STATUS, 6.8+).
+// The head advances by one for every buffer the kernel consumes.
+func (r *Ring) BufRingStatus(bgid uint16) (uint16, error) {
+	status := sys.BufStatus{BufGroup: uint32(bgid)}
+	if _, err := r.register(sys.IORING_REGISTER_PBUF_STATUS, unsafe.Pointer(&status), 1); err != nil {
+		return 0, err
+	}
+	return uint16(status.Head), nil
+}
+
+// BufferID extracts the selected buffer ID from CQE flags.
+// ok is false if the completion did not consume a provided buffer.
+func BufferID(flags uint32) (bid uint16, ok bool) {
+	if flags&sys.IORING_CQE_F_BUFFER == 0 {
+		return 0, false
+	}
+	return uint16(flags >> 16), true
+}
@@ -0,0 +1,175 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// CapabilityReport describes what the running kernel's io_uring supports.
+// Use it at startup to pick code paths, e.g. SEND_ZC vs SEND, or
+// DEFER_TASKRUN rings vs plain ones.
+type CapabilityReport struct {
+	// KernelRelease is the kernel release string from uname(2).
+	KernelRelease string
+
+	// KernelMajor and KernelMinor are parsed from KernelRelease.
+	KernelMajor int
+	KernelMinor int
+
+	// Features is the IORING_FEAT_* mask reported by io_uring_setup.
+	Features uint32
+
+	// SetupFlags is the mask of IORING_SETUP_* flags that a trial
+	// io_uring_setup accepted. Flags that need privileges (SQPOLL on old
+	// kernels) or special hardware are reported as the kernel answered
+	// for this process.
+	SetupFlags uint32
+
+	probe *Probe
+}
+
+var (
+	capsOnce sync.Once
+	caps     *CapabilityReport
+	capsErr  error
+)
+
+// Capabilities probes the kernel once and returns the cached
+// report on later calls. It creates a handful of short-lived rings to
+// test setup flags. An error means io_uring itself is unavailable, e.g.
+// disabled by sysctl or blocked by seccomp.
+func Capabilities() (*CapabilityReport, error) {
+	capsOnce.Do(func() {
+		caps, capsErr = detectCapabilities()
+	})
+	return caps, capsErr
+}
+
+func detectCapabilities() (*CapabilityReport, error) {
+	c := &CapabilityReport{}
+
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err == nil {
+		release := make([]byte, 0, len(uts.Release))
+		for _, b := range uts.Release {
+			if b == 0 {
+				break
+			}
+			release = append(release, byte(b))
+		}
+		c.KernelRelease = string(release)
+		c.KernelMajor, c.KernelMinor = parseKernelVersion(c.KernelRelease)
+	}
+
+	ring, err := New(1)
+	if err != nil {
+		return nil, err
+	}
+	c.Features = ring.Features()
+	c.probe, err = ring.Probe()
+	ring.Close()
+	if err != nil {
+		// IORING_REGISTER_PROBE arrived in 5.6; report no ops before that
+		c.probe = &Probe{features: c.Features}
+	}
+
+	for _, trial := range setupFlagTrials {
+		if trySetup(trial.opts...) {
+			c.SetupFlags |= trial.flag
+		}
+	}
+
+	return c, nil
+}
+
+// setupFlagTrials lists each setup flag with the options needed to test
+// it on its own. ATTACH_WQ is omitted as it needs an existing ring.
+var setupFlagTrials = []struct {
+	flag uint32
+	opts []Option
+}{
+	{sys.IORING_SETUP_IOPOLL, []Option{WithIOPoll()}},
+	{sys.IORING_SETUP_SQPOLL, []Option{WithSQPoll()}},
+	{sys.IORING_SETUP_SQ_AFF, []Option{WithSQPoll(), WithSQPollCPU(0)}},
+	{sys.IORING_SETUP_CQSIZE, []Option{WithCQSize(4)}},
+	{sys.IORING_SETUP_CLAMP, []Option{WithFlags(sys.IORING_SETUP_CLAMP)}},
+	{sys.IORING_SETUP_R_DISABLED, []Option{WithFlags(sys.IORING_SETUP_R_DISABLED)}},
+	{sys.IORING_SETUP_SUBMIT_ALL, []Option{WithSubmitAll()}},
+	{sys.IORING_SETUP_COOP_TASKRUN, []Option{WithCoopTaskrun()}},
+	{sys.IORING_SETUP_TASKRUN_FLAG, []Option{WithTaskrunFlag()}},
+	{sys.IORING_SETUP_SQE128, []Option{WithSQE128()}},
+	{sys.IORING_SETUP_CQE32, []Option{WithCQE32()}},
+	{sys.IORING_SETUP_SINGLE_ISSUER, []Option{WithSingleIssuer()}},
+	{sys.IORING_SETUP_DEFER_TASKRUN, []Option{WithDeferTaskrun()}},
+	{sys.IORING_SETUP_NO_MMAP, []Option{WithNoMmap()}},
+	{sys.IORING_SETUP_REGISTERED_FD_ONLY, []Option{WithRegisteredFdOnly()}},
+	{sys.IORING_SETUP_NO_SQARRAY, []Option{WithFlags(sys.IORING_SETUP_NO_SQARRAY)}},
+}
+
+// trySetup reports whether a ring can be created with opts.
+func trySetup(opts ...Option) bool {
+	// Registered-fd-only rings are bound to the creating thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := New(1, opts...)
+	if err != nil {
+		return false
+	}
+	ring.Close()
+	return true
+}
+
+// parseKernelVersion extracts major.minor from a release such as
+// "6.8.0-45-generic". Missing parts are returned as 0.
+func parseKernelVersion(release string) (major, minor int) {
+	var parts [2]int
+	i := 0
+	for _, ch := range release {
+		switch {
+		case ch >= '0' && ch <= '9':
+			parts[i] = parts[i]*10 + int(ch-'0')
+		case ch == '.' && i == 0:
+			i++
+		default:
+			return parts[0], parts[1]
+		}
+	}
+	return parts[0], parts[1]
+}
+
+// KernelAtLeast reports whether the running kernel is major.minor or newer.
+// Prefer SupportsOp, HasFeature and SupportsSetupFlag where they apply:
+// distribution kernels often backport io_uring features.
+func (c *CapabilityReport) KernelAtLeast(major, minor int) bool {
+	if c.KernelMajor != major {
+		return c.KernelMajor > major
+	}
+	return c.KernelMinor >= minor
+}
+
+// HasFeature reports whether io_uring_setup reported feat (IORING_FEAT_*).
+func (c *CapabilityReport) HasFeature(feat uint32) bool {
+	return c.Features&feat == feat
+}
+
+// SupportsSetupFlag reports whether a ring could be created with flag
+// (IORING_SETUP_*).
+func (c *CapabilityReport) SupportsSetupFlag(flag uint32) bool {
+	return c.SetupFlags&flag == flag
+}
+
+// SupportsOp reports whether the kernel supports op.
+func (c *CapabilityReport) SupportsOp(op sys.Op) bool {
+	return c.probe.SupportsOp(op)
+}
+
+// Probe returns the opcode probe taken during detection.
+func (c *CapabilityReport) Probe() *Probe {
+	return c.probe
+}
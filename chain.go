@@ -0,0 +1,223 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Chain builds a sequence of linked operations that is submitted
+// through an Executor as one unit. Each step starts only after the
+// previous one completes; with the default soft links a failing step
+// cancels the rest of the chain. The link flags are applied while the
+// executor holds its submission lock, so concurrent submitters cannot
+// splice SQEs into the chain.
+//
+// A Chain is a builder and is not safe for concurrent use.
+type Chain struct {
+	e       *Executor
+	steps   []func(userData uint64) error
+	link    uint8
+	timeout time.Duration
+}
+
+// NewChain starts an empty chain on the executor.
+func (e *Executor) NewChain() *Chain {
+	return &Chain{e: e, link: sys.IOSQE_IO_LINK}
+}
+
+// Add appends a step. prep must queue exactly one SQE on the executor's
+// ring using the given userData, like the prep of Executor.Submit.
+func (c *Chain) Add(prep func(userData uint64) error) *Chain {
+	c.steps = append(c.steps, prep)
+	return c
+}
+
+// Hardlink links the steps with IOSQE_IO_HARDLINK, so the chain carries
+// on after a step fails instead of canceling the remaining steps.
+func (c *Chain) Hardlink() *Chain {
+	c.link = sys.IOSQE_IO_HARDLINK
+	return c
+}
+
+// WithTimeout attaches a linked timeout (IORING_OP_LINK_TIMEOUT) to the
+// last step. If that step has not completed within d it is canceled.
+func (c *Chain) WithTimeout(d time.Duration) *Chain {
+	c.timeout = d
+	return c
+}
+
+// Submit queues and submits the whole chain in one batch. It fails with
+// ErrSQFull if the chain does not fit in the submission queue, and with
+// EINVAL if the chain is empty or a step queues other than one SQE.
+func (c *Chain) Submit() (*ChainOperation, error) {
+	e := c.e
+	if len(c.steps) == 0 {
+		return nil, syscall.EINVAL
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.usableLocked(); err != nil {
+		return nil, err
+	}
+
+	// A chain split across two submissions would be broken by the
+	// kernel, so make sure all of it fits now
+	n := uint32(len(c.steps))
+	if c.timeout > 0 {
+		n++
+	}
+	if e.ring.SQReady() > 0 {
+		if _, err := e.ring.Submit(); err != nil {
+			return nil, err
+		}
+	}
+	if e.ring.SQSpace() < n {
+		return nil, ErrSQFull
+	}
+
+	chain := &ChainOperation{
+		steps: make([]*Operation, len(c.steps)),
+		done:  make(chan struct{}),
+	}
+	chain.remaining.Store(int32(n))
+
+	newOp := func() *Operation {
+		op := &Operation{e: e, done: make(chan struct{}), chain: chain}
+		op.userData = e.ops.Register(op)
+		return op
+	}
+	mark := e.ring.sqMark()
+	abort := func(err error) (*ChainOperation, error) {
+		e.ring.discardSQEs(mark, func(userData uint64) bool {
+			op, ok := e.ops.Lookup(userData)
+			return ok && op.chain == chain
+		})
+		for _, op := range chain.steps {
+			if op != nil {
+				e.ops.Release(op.userData)
+			}
+		}
+		if chain.timeoutOp != nil {
+			e.ops.Release(chain.timeoutOp.userData)
+		}
+		return nil, err
+	}
+
+	for i, prep := range c.steps {
+		op := newOp()
+		chain.steps[i] = op
+		before := e.ring.SQReady()
+		if err := prep(op.userData); err != nil {
+			return abort(err)
+		}
+		if e.ring.SQReady() != before+1 {
+			return abort(syscall.EINVAL)
+		}
+		op.recordSQE()
+		if i < len(c.steps)-1 {
+			e.ring.SetSQEFlags(c.link)
+		}
+	}
+
+	if c.timeout > 0 {
+		chain.ts = sys.Timespec{
+			Sec:  int64(c.timeout / time.Second),
+			Nsec: int64(c.timeout % time.Second),
+		}
+		e.ring.SetSQEFlags(sys.IOSQE_IO_LINK)
+		chain.timeoutOp = newOp()
+		if err := e.ring.PrepLinkTimeout(&chain.ts, 0, chain.timeoutOp.userData); err != nil {
+			return abort(err)
+		}
+		chain.timeoutOp.recordSQE()
+	}
+	e.unpark()
+
+	_, err := e.ring.Submit()
+	runtime.KeepAlive(chain)
+	if err != nil {
+		// Already visible to the kernel; the steps complete normally
+		return nil, err
+	}
+	return chain, nil
+}
+
+// ChainOperation is the handle to a submitted Chain. Every step, and the
+// linked timeout if any, posts exactly one completion: steps canceled
+// because an earlier one failed complete with ECANCELED.
+type ChainOperation struct {
+	steps     []*Operation
+	timeoutOp *Operation
+	ts        sys.Timespec // Read by the kernel when the timeout is issued
+
+	remaining atomic.Int32
+	done      chan struct{}
+}
+
+// stepDone is called as each step or the timeout completes.
+func (c *ChainOperation) stepDone() {
+	if c.remaining.Add(-1) == 0 {
+		close(c.done)
+	}
+}
+
+// Done returns a channel that is closed once every step has completed.
+func (c *ChainOperation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Len returns the number of steps, not counting the timeout.
+func (c *ChainOperation) Len() int {
+	return len(c.steps)
+}
+
+// Step returns the operation for step i, in the order steps were added.
+func (c *ChainOperation) Step(i int) *Operation {
+	return c.steps[i]
+}
+
+// Results waits for the chain and returns each step's CQE result along
+// with the first step error, if any.
+func (c *ChainOperation) Results() ([]int32, error) {
+	<-c.done
+	results := make([]int32, len(c.steps))
+	var first error
+	for i, op := range c.steps {
+		res, err := op.Result()
+		results[i] = res
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return results, first
+}
+
+// TimedOut waits for the chain and reports whether its linked timeout
+// fired and canceled the last step.
+func (c *ChainOperation) TimedOut() bool {
+	<-c.done
+	if c.timeoutOp == nil {
+		return false
+	}
+	res, _ := c.timeoutOp.Result()
+	return res == -int32(syscall.ETIME)
+}
+
+// Cancel requests cancellation of every step that has not completed.
+func (c *ChainOperation) Cancel() error {
+	var first error
+	for _, op := range c.steps {
+		if err := op.Cancel(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// ChunkCount returns how many SQEs PrepReadChunked or PrepWriteChunked
+// prepares for n bytes.
+func ChunkCount(n int) int {
+	return (n + MaxIOSize - 1) / MaxIOSize
+}
+
+// PrepReadChunked prepares a read of buf of any size, as a chain of
+// linked reads of up to MaxIOSize bytes at consecutive offsets. Every
+// read has userData and opts apply to each. A read that comes up short
+// or fails ends the chain and the reads after it complete with
+// ECANCELED; pass the results, in order, to ChunkedResult for the total.
+// It returns the number of SQEs, see ChunkCount. If they do not all fit
+// in the SQ, or a chunk is rejected, none is prepared: the SQEs claimed
+// become NOPs with a userData of zero.
+func (r *Ring) PrepReadChunked(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) (int, error) {
+	return r.prepChunked(sys.IORING_OP_READ, fd, buf, offset, userData, opts)
+}
+
+// PrepWriteChunked is PrepReadChunked for writes.
+func (r *Ring) PrepWriteChunked(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) (int, error) {
+	return r.prepChunked(sys.IORING_OP_WRITE, fd, buf, offset, userData, opts)
+}
+
+// prepChunked claims one consecutive run of SQEs for the chunks of buf,
+// so no other request can be linked into the chain, and fills them.
+func (r *Ring) prepChunked(op sys.Op, fd int, buf []byte, offset uint64, userData uint64, opts []OpOption) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	count := uint32(ChunkCount(len(buf)))
+
+	r.sqLock.RLock()
+	defer r.sqLock.RUnlock()
+
+	pos, n := r.getSQEs(count)
+	if n < count {
+		for k := uint32(0); k < n; k++ {
+			r.sqeAt(pos + k).Opcode = uint8(sys.IORING_OP_NOP)
+		}
+		return 0, r.errNoSQE()
+	}
+
+	for k := uint32(0); k < n; k++ {
+		sqe := r.sqeAt(pos + k)
+		chunk := buf[int(k)*MaxIOSize:]
+		chunk = chunk[:min(len(chunk), MaxIOSize)]
+		sqe.Opcode = uint8(op)
+		sqe.Fd = int32(fd)
+		sqe.Addr = r.pin(sqe, unsafe.Pointer(&chunk[0]))
+		sqe.Len = uint32(len(chunk))
+		sqe.Off = offset + uint64(k)*MaxIOSize
+		sqe.UserData = userData
+		applyOpOptions(sqe, opts)
+		if k < n-1 {
+			sqe.Flags |= sys.IOSQE_IO_LINK
+		}
+		if err := r.checkSQE(sqe); err != nil {
+			// Drop the whole chain
+			for k := uint32(0); k < n; k++ {
+				r.sqeAt(pos + k).Opcode = uint8(sys.IORING_OP_NOP)
+			}
+			return 0, err
+		}
+	}
+	return int(n), nil
+}
+
+// ChunkedResult adds up the results of the CQEs of a chunked read or
+// write of size bytes, given in the order they completed. It returns the
+// bytes moved and the error of the chunk that failed, if any. Results
+// after a short chunk are ignored: the chunks it canceled are not
+// errors, the transfer just ended early, as a short read or write does.
+func ChunkedResult(size int, results []int32) (int, error) {
+	n := 0
+	for i, res := range results {
+		if res < 0 {
+			return n, syscall.Errno(-res)
+		}
+		n += int(res)
+		if want := min(size-i*MaxIOSize, MaxIOSize); int(res) < want {
+			return n, nil
+		}
+	}
+	return n, nil
+}
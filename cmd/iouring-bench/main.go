@@ -0,0 +1,506 @@
+//go:build linux
+
+// Command iouring-bench measures io_uring throughput on this machine
+// across ring configurations, to help pick one for a deployment.
+//
+// It runs NOP round trips, random file reads and writes and TCP echo
+// round trips over loopback at each queue depth, on a ring set up as
+// each configuration, and prints a table comparing them:
+//
+//	default  plain ring
+//	sqpoll   a kernel thread polls the SQ (IORING_SETUP_SQPOLL)
+//	defer    task work runs only on enter (IORING_SETUP_DEFER_TASKRUN)
+//	fixed    file I/O into registered buffers (read/write only)
+//
+// Usage:
+//
+//	iouring-bench [-bench nop,read,write,echo] [-config default,sqpoll,defer,fixed]
+//	    [-qd 1,4,16,64] [-duration 1s] [-bs 4096] [-size-mb 64] [-dir DIR]
+//	    [-direct] [-msg 64]
+//
+// For nop the queue depth is the batch size per io_uring_enter; for echo
+// it is the number of connections. The echo peer is a goroutine using
+// the net package, so the numbers cover the client ring only. Reads hit
+// the page cache unless -direct is given.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	iouring "github.com/behrlich/go-iouring"
+)
+
+// config is a ring configuration under test.
+type config struct {
+	name  string
+	opts  []iouring.Option
+	fixed bool // Use registered buffers for file I/O
+}
+
+var configs = []config{
+	{name: "default"},
+	{name: "sqpoll", opts: []iouring.Option{iouring.WithSQPoll(), iouring.WithSQPollIdle(100)}},
+	{name: "defer", opts: []iouring.Option{iouring.WithDeferTaskrun()}},
+	{name: "fixed", fixed: true},
+}
+
+// result is the outcome of one benchmark run.
+type result struct {
+	bench   string
+	config  string
+	qd      int
+	ops     uint64
+	bytes   uint64
+	lat     time.Duration // Summed latency of ops, if measured
+	elapsed time.Duration
+	err     error
+}
+
+// params are the settings shared by all runs.
+type params struct {
+	duration time.Duration
+	bs       int
+	size     int64
+	dir      string
+	direct   bool
+	msg      int
+}
+
+func main() {
+	benches := flag.String("bench", "nop,read,write,echo", "benchmarks to run")
+	names := flag.String("config", "default,sqpoll,defer,fixed", "ring configurations to compare")
+	qds := flag.String("qd", "1,4,16,64", "queue depths to sweep")
+	var p params
+	flag.DurationVar(&p.duration, "duration", time.Second, "duration of each run")
+	flag.IntVar(&p.bs, "bs", 4096, "file I/O block size in bytes")
+	sizeMB := flag.Int64("size-mb", 64, "size of the test file in MiB")
+	flag.StringVar(&p.dir, "dir", os.TempDir(), "directory for the test file")
+	flag.BoolVar(&p.direct, "direct", false, "open the test file with O_DIRECT")
+	flag.IntVar(&p.msg, "msg", 64, "echo message size in bytes")
+	flag.Parse()
+	p.size = *sizeMB << 20
+
+	depths, err := parseInts(*qds)
+	if err != nil {
+		fatal(err)
+	}
+	var cfgs []config
+	for _, name := range strings.Split(*names, ",") {
+		cfg, ok := findConfig(name)
+		if !ok {
+			fatal(errors.New("unknown config " + strconv.Quote(name)))
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	if p.bs <= 0 || p.msg <= 0 || p.size < int64(p.bs) {
+		fatal(errors.New("-bs, -msg and -size-mb must be positive, and the file at least one block"))
+	}
+
+	// Rings with DEFER_TASKRUN only take submissions from the thread
+	// that created them
+	runtime.LockOSThread()
+
+	var results []result
+	for _, bench := range strings.Split(*benches, ",") {
+		var run func(r *iouring.Ring, cfg config, qd int) result
+		switch bench {
+		case "nop":
+			run = func(r *iouring.Ring, cfg config, qd int) result { return benchNop(r, qd, p) }
+		case "read", "write":
+			f, err := openTestFile(p)
+			if err != nil {
+				fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			write := bench == "write"
+			run = func(r *iouring.Ring, cfg config, qd int) result { return benchFile(r, cfg, f, write, qd, p) }
+		case "echo":
+			addr, stop, err := startEcho()
+			if err != nil {
+				fatal(err)
+			}
+			defer stop()
+			run = func(r *iouring.Ring, cfg config, qd int) result { return benchEcho(r, addr, qd, p) }
+		default:
+			fatal(errors.New("unknown benchmark " + strconv.Quote(bench)))
+		}
+
+		for _, qd := range depths {
+			for _, cfg := range cfgs {
+				if cfg.fixed && bench != "read" && bench != "write" {
+					continue
+				}
+				res := runOne(cfg, qd, run)
+				res.bench, res.config, res.qd = bench, cfg.name, qd
+				results = append(results, res)
+			}
+		}
+	}
+	printTable(os.Stdout, results)
+}
+
+// runOne runs a benchmark on a fresh ring set up as cfg.
+func runOne(cfg config, qd int, run func(*iouring.Ring, config, int) result) result {
+	entries := uint32(64)
+	for entries < uint32(qd) {
+		entries <<= 1
+	}
+	r, err := iouring.New(entries, cfg.opts...)
+	if err != nil {
+		return result{err: err}
+	}
+	defer r.Close()
+	return run(r, cfg, qd)
+}
+
+// benchNop submits batches of qd NOPs and waits for each batch.
+func benchNop(r *iouring.Ring, qd int, p params) result {
+	var res result
+	start := time.Now()
+	deadline := start.Add(p.duration)
+	for time.Now().Before(deadline) {
+		for i := 0; i < qd; i++ {
+			if err := r.PrepNop(0); err != nil {
+				return result{err: err}
+			}
+		}
+		if _, err := r.SubmitAndWait(uint32(qd)); err != nil {
+			return result{err: err}
+		}
+		res.ops += uint64(r.ForEachCQE(func(uint64, int32, uint32) bool { return true }))
+	}
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// openTestFile creates and fills the file for the read and write
+// benchmarks.
+func openTestFile(p params) (*os.File, error) {
+	f, err := os.CreateTemp(p.dir, "iouring-bench-")
+	if err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, 1<<20)
+	for off := int64(0); off < p.size; off += int64(len(chunk)) {
+		n := min(int64(len(chunk)), p.size-off)
+		if _, err := f.Write(chunk[:n]); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if !p.direct {
+		return f, nil
+	}
+	direct, err := os.OpenFile(f.Name(), os.O_RDWR|syscall.O_DIRECT, 0)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return direct, nil
+}
+
+// benchFile keeps qd reads or writes of p.bs bytes at random offsets in
+// flight.
+func benchFile(r *iouring.Ring, cfg config, f *os.File, write bool, qd int, p params) result {
+	alloc, err := iouring.NewBufferAllocator(p.bs, 0)
+	if err != nil {
+		return result{err: err}
+	}
+	defer alloc.Free()
+	bufs, err := alloc.Alloc(qd)
+	if err != nil {
+		return result{err: err}
+	}
+	if cfg.fixed {
+		if err := r.RegisterBuffers(bufs); err != nil {
+			return result{err: err}
+		}
+	}
+
+	fd := int(f.Fd())
+	blocks := p.size / int64(p.bs)
+	started := make([]time.Time, qd)
+	prep := func(i int) error {
+		buf := bufs[i][:p.bs]
+		off := uint64(rand.Int64N(blocks) * int64(p.bs))
+		started[i] = time.Now()
+		switch {
+		case cfg.fixed && write:
+			return r.PrepWriteFixed(fd, buf, off, uint16(i), uint64(i))
+		case cfg.fixed:
+			return r.PrepReadFixed(fd, buf, off, uint16(i), uint64(i))
+		case write:
+			return r.PrepWrite(fd, buf, off, uint64(i))
+		}
+		return r.PrepRead(fd, buf, off, uint64(i))
+	}
+
+	var res result
+	start := time.Now()
+	deadline := start.Add(p.duration)
+	for i := 0; i < qd; i++ {
+		if err := prep(i); err != nil {
+			return result{err: err}
+		}
+	}
+	for inflight := qd; inflight > 0; {
+		if _, err := r.SubmitAndWait(1); err != nil {
+			return result{err: err}
+		}
+		more := time.Now().Before(deadline)
+		r.ForEachCQE(func(userData uint64, n int32, flags uint32) bool {
+			i := int(userData)
+			if n < 0 && res.err == nil {
+				res.err = iouring.ResultError(n)
+			}
+			res.ops++
+			res.bytes += uint64(max(n, 0))
+			res.lat += time.Since(started[i])
+			if more && res.err == nil && prep(i) == nil {
+				return true
+			}
+			inflight--
+			return true
+		})
+	}
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// startEcho serves TCP echo on a loopback port.
+func startEcho() (addr *net.TCPAddr, stop func(), err error) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), func() { ln.Close() }, nil
+}
+
+// echoConn is the state of one echo client connection.
+type echoConn struct {
+	fd      int
+	msg     []byte
+	buf     []byte
+	sent    int
+	got     int
+	started time.Time
+}
+
+// benchEcho runs qd connections that each send a p.msg-byte message and
+// wait for it to come back, over and over.
+func benchEcho(r *iouring.Ring, addr *net.TCPAddr, qd int, p params) result {
+	conns := make([]*echoConn, qd)
+	defer func() {
+		for _, c := range conns {
+			if c != nil {
+				syscall.Close(c.fd)
+			}
+		}
+	}()
+	for i := range conns {
+		fd, err := dial(addr)
+		if err != nil {
+			return result{err: err}
+		}
+		conns[i] = &echoConn{fd: fd, msg: make([]byte, p.msg), buf: make([]byte, p.msg)}
+	}
+
+	// The low bit of the user data tells sends from receives
+	send := func(i int) error {
+		c := conns[i]
+		return r.PrepSend(c.fd, c.msg[c.sent:], 0, uint64(i)<<1)
+	}
+	recv := func(i int) error {
+		c := conns[i]
+		return r.PrepRecv(c.fd, c.buf[c.got:], 0, uint64(i)<<1|1)
+	}
+
+	var res result
+	start := time.Now()
+	deadline := start.Add(p.duration)
+	for i, c := range conns {
+		c.started = time.Now()
+		if err := send(i); err != nil {
+			return result{err: err}
+		}
+	}
+	for inflight := qd; inflight > 0; {
+		if _, err := r.SubmitAndWait(1); err != nil {
+			return result{err: err}
+		}
+		more := time.Now().Before(deadline)
+		r.ForEachCQE(func(userData uint64, n int32, flags uint32) bool {
+			i := int(userData >> 1)
+			c := conns[i]
+			var err error
+			switch {
+			case n < 0:
+				err = iouring.ResultError(n)
+			case n == 0 && userData&1 == 1:
+				err = io.ErrUnexpectedEOF
+			case userData&1 == 0:
+				if c.sent += int(n); c.sent < len(c.msg) {
+					err = send(i)
+				} else {
+					c.got = 0
+					err = recv(i)
+				}
+			default:
+				if c.got += int(n); c.got < len(c.buf) {
+					err = recv(i)
+					break
+				}
+				res.ops++
+				res.bytes += uint64(len(c.msg))
+				res.lat += time.Since(c.started)
+				if !more {
+					inflight--
+					break
+				}
+				c.sent = 0
+				c.started = time.Now()
+				err = send(i)
+			}
+			if err != nil {
+				if res.err == nil {
+					res.err = err
+				}
+				inflight--
+			}
+			return true
+		})
+	}
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// dial opens a blocking TCP connection to addr with Nagle disabled.
+func dial(addr *net.TCPAddr) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	sa := &syscall.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// printTable writes the results, with the throughput of each run
+// relative to the default configuration at the same queue depth.
+func printTable(w io.Writer, results []result) {
+	baseline := map[string]float64{}
+	for _, res := range results {
+		if res.config == "default" && res.err == nil {
+			baseline[res.bench+"/"+strconv.Itoa(res.qd)] = rate(res)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BENCH\tCONFIG\tQD\tOPS/S\tMB/S\tAVG LAT\tVS DEFAULT\t")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t", res.bench, res.config, res.qd)
+		if res.err != nil {
+			fmt.Fprintf(tw, "-\t-\t-\t-\t  error: %v\n", res.err)
+			continue
+		}
+		mbs, lat, vs := "-", "-", "-"
+		if res.bytes > 0 {
+			mbs = strconv.FormatFloat(float64(res.bytes)/res.elapsed.Seconds()/(1<<20), 'f', 1, 64)
+		}
+		if res.lat > 0 && res.ops > 0 {
+			lat = (res.lat / time.Duration(res.ops)).Round(100 * time.Nanosecond).String()
+		}
+		if base := baseline[res.bench+"/"+strconv.Itoa(res.qd)]; base > 0 {
+			vs = strconv.FormatFloat(rate(res)/base, 'f', 2, 64) + "x"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", human(rate(res)), mbs, lat, vs)
+	}
+	tw.Flush()
+}
+
+// rate returns the operations per second of a run.
+func rate(res result) float64 {
+	if res.elapsed <= 0 {
+		return 0
+	}
+	return float64(res.ops) / res.elapsed.Seconds()
+}
+
+// human formats n with a k or M suffix.
+func human(n float64) string {
+	switch {
+	case n >= 1e6:
+		return strconv.FormatFloat(n/1e6, 'f', 2, 64) + "M"
+	case n >= 1e3:
+		return strconv.FormatFloat(n/1e3, 'f', 1, 64) + "k"
+	}
+	return strconv.FormatFloat(n, 'f', 0, 64)
+}
+
+// findConfig looks up a configuration by name.
+func findConfig(name string) (config, bool) {
+	for _, cfg := range configs {
+		if cfg.name == name {
+			return cfg, true
+		}
+	}
+	return config{}, false
+}
+
+// parseInts parses a comma-separated list of positive integers.
+func parseInts(s string) ([]int, error) {
+	var ns []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, errors.New("invalid queue depth " + strconv.Quote(f))
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "iouring-bench:", err)
+	os.Exit(1)
+}
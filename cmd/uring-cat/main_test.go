@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	iouring "github.com/behrlich/go-iouring"
+)
+
+func skipIfNoIOURing(t *testing.T) {
+	t.Helper()
+	ring, err := iouring.New(4)
+	if err == syscall.ENOSYS || err == syscall.EPERM {
+		t.Skip("io_uring not available:", err)
+	}
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	ring.Close()
+}
+
+func TestCat(t *testing.T) {
+	skipIfNoIOURing(t)
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	os.WriteFile(a, big, 0o644)
+	os.WriteFile(b, []byte("tail\n"), 0o644)
+
+	stdin, err := os.Open(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	stdout, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+
+	if err := run([]string{"-qd", "3", "-bs", "4096", a, "-", b}, stdin, stdout); err != nil {
+		t.Fatalf("run error = %v", err)
+	}
+	got, _ := os.ReadFile(stdout.Name())
+	want := append(append(big, "tail\n"...), "tail\n"...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("output is %d bytes, want %d", len(got), len(want))
+	}
+
+	if err := run([]string{filepath.Join(dir, "missing")}, stdin, stdout); err == nil {
+		t.Error("run of a missing file succeeded")
+	}
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	iouring "github.com/behrlich/go-iouring"
+)
+
+func skipIfNoIOURing(t *testing.T) {
+	t.Helper()
+	ring, err := iouring.New(4)
+	if err == syscall.ENOSYS || err == syscall.EPERM {
+		t.Skip("io_uring not available:", err)
+	}
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	ring.Close()
+}
+
+func TestCopy(t *testing.T) {
+	skipIfNoIOURing(t)
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 100000)
+	src := filepath.Join(dir, "src")
+	os.WriteFile(src, data, 0o640)
+
+	for _, qd := range []string{"1", "8"} {
+		dst := filepath.Join(dir, "dst"+qd)
+		if err := run([]string{"-qd", qd, src, dst}, io.Discard); err != nil {
+			t.Fatalf("run -qd %s error = %v", qd, err)
+		}
+		if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+			t.Errorf("copy with -qd %s is %d bytes, want %d", qd, len(got), len(data))
+		}
+	}
+
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0o755)
+	if err := run([]string{src, sub}, io.Discard); err != nil {
+		t.Fatalf("run into directory error = %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(sub, "src")); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("copy into directory = %v, %v, want mode 0640", fi, err)
+	}
+
+	if err := run([]string{src, dir}, io.Discard); err == nil {
+		t.Error("copying a file onto itself succeeded")
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Error("copying a file onto itself changed it")
+	}
+}
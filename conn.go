@@ -0,0 +1,259 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+// Conn is a net.Conn whose reads and writes run as recv and send
+// operations on an Executor's ring. Deadlines are implemented with
+// linked timeouts (IORING_OP_LINK_TIMEOUT), so a blocked Read costs no
+// goroutine or timer of its own.
+//
+// As with net.Conn, a deadline also applies to the operations already in
+// flight: their linked timeouts are moved with IORING_LINK_TIMEOUT_UPDATE
+// (5.15+; before that they keep the deadline they started with), and
+// those started without a deadline are canceled once it passes.
+type Conn struct {
+	netFD
+
+	noZC atomic.Bool // WriteZC falls back to Write
+}
+
+// NewConn wraps a connected socket. The Conn takes ownership of fd and
+// closes it on Close.
+func NewConn(e *Executor, fd int) (*Conn, error) {
+	c := &Conn{}
+	if err := c.init(e, fd); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// netFD is the socket state shared by Conn and PacketConn.
+type netFD struct {
+	e      *Executor
+	fd     int
+	sotype int
+	laddr  net.Addr
+	raddr  net.Addr // nil for unconnected sockets
+
+	deadlines // Of the operations in flight, which Close cancels
+
+	closed atomic.Bool
+}
+
+// init sets up c for socket fd.
+func (c *netFD) init(e *Executor, fd int) error {
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+	c.e = e
+	c.fd = fd
+	c.sotype = sotype
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		c.laddr = sockaddrToAddr(sa, sotype)
+	}
+	if sa, err := syscall.Getpeername(fd); err == nil {
+		c.raddr = sockaddrToAddr(sa, sotype)
+	}
+	return nil
+}
+
+// Fd returns the socket's file descriptor.
+func (c *netFD) Fd() int {
+	return c.fd
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("read", net.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	b = b[:min(len(b), MaxIOSize)] // One recv moves at most MaxIOSize
+
+	res, err := c.do(ioRead, func(ud uint64, opts ...OpOption) error {
+		return c.e.ring.PrepRecv(c.fd, b, 0, ud, opts...)
+	}, b)
+	if errors.Is(err, syscall.EIO) {
+		if _, rx := c.KTLS(); rx {
+			err = ErrTLSRecord // See ReadRecord
+		}
+	}
+	if err != nil {
+		return 0, c.opError("read", err)
+	}
+	if res == 0 && c.sotype == syscall.SOCK_STREAM {
+		return 0, io.EOF
+	}
+	return int(res), nil
+}
+
+// Write implements net.Conn. It issues further sends after a short one
+// until all of b is written.
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One send moves at most MaxIOSize
+		res, err := c.do(ioWrite, func(ud uint64, opts ...OpOption) error {
+			return c.e.ring.PrepSend(c.fd, p, syscall.MSG_NOSIGNAL, ud, opts...)
+		}, p)
+		if err != nil {
+			return n, c.opError("write", err)
+		}
+		if res == 0 {
+			return n, c.opError("write", io.ErrShortWrite)
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// do runs one operation subject to the deadline of kind and waits for
+// it.
+func (c *netFD) do(kind ioKind, prep func(ud uint64, opts ...OpOption) error, keep any) (int32, error) {
+	op, err := c.start(context.Background(), c.e, kind, prep, keep)
+	if err != nil {
+		return 0, err
+	}
+	if c.closed.Load() {
+		op.Cancel()
+	}
+
+	res, err := op.Result()
+	c.untrack(op)
+	if err != nil {
+		return 0, c.mapError(err, c.deadline(kind))
+	}
+	return res, nil
+}
+
+// mapError turns the cancellation of an operation by Close or by its
+// deadline into the errors net.Conn users expect.
+func (c *netFD) mapError(err error, deadline time.Time) error {
+	if canceled(err) && c.closed.Load() {
+		return net.ErrClosed
+	}
+	return deadlineError(err, deadline)
+}
+
+// opError wraps err the way the net package does.
+func (c *netFD) opError(op string, err error) error {
+	if err == io.EOF {
+		return err
+	}
+	network := "tcp"
+	if c.laddr != nil {
+		network = c.laddr.Network()
+	}
+	return &net.OpError{Op: op, Net: network, Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+// Close cancels the reads and writes in flight and closes the socket.
+func (c *netFD) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return c.opError("close", net.ErrClosed)
+	}
+
+	c.cancelAll()
+
+	op, err := c.e.Submit(func(ud uint64) error {
+		return c.e.ring.PrepClose(c.fd, ud)
+	})
+	if err == nil {
+		_, err = op.Result()
+	}
+	if err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn and net.PacketConn.
+func (c *netFD) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr implements net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline implements net.Conn and net.PacketConn.
+func (c *netFD) SetDeadline(t time.Time) error {
+	c.set(true, true, t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn and net.PacketConn.
+func (c *netFD) SetReadDeadline(t time.Time) error {
+	c.set(true, false, t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn and net.PacketConn.
+func (c *netFD) SetWriteDeadline(t time.Time) error {
+	c.set(false, true, t)
+	return nil
+}
+
+// deadlineKeep keeps an operation's memory and its timeout alive.
+type deadlineKeep struct {
+	keep any
+	ts   *sys.Timespec
+}
+
+// submitDeadline submits one operation, linked to a timeout that
+// cancels it at deadline unless deadline is zero. prep must queue a
+// single SQE and apply opts to it. A deadline already past fails with
+// os.ErrDeadlineExceeded without submitting anything.
+func (e *Executor) submitDeadline(prep func(ud uint64, opts ...OpOption) error, deadline time.Time, keep any) (*Operation, error) {
+	return e.submitDeadlineContext(context.Background(), prep, deadline, keep)
+}
+
+// submitDeadlineContext is submitDeadline for an operation also bound to
+// ctx, as by submitContext.
+func (e *Executor) submitDeadlineContext(ctx context.Context, prep func(ud uint64, opts ...OpOption) error, deadline time.Time, keep any) (*Operation, error) {
+	if deadline.IsZero() {
+		return e.submitContext(ctx, func(ud uint64) error { return prep(ud) }, keep)
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return nil, os.ErrDeadlineExceeded
+	}
+	ts := &sys.Timespec{
+		Sec:  int64(d / time.Second),
+		Nsec: int64(d % time.Second),
+	}
+	return e.submitContext(ctx, func(ud uint64) error {
+		// A flush between the two SQEs would break the link
+		if e.ring.SQSpace()-e.ring.SQReady() < 2 {
+			return ErrSQFull
+		}
+		if err := prep(ud, WithLink()); err != nil {
+			return err
+		}
+		return e.ring.PrepLinkTimeout(ts, 0, ud|deadlineTokenBit)
+	}, deadlineKeep{keep, ts})
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Chunking of CopyFile.
+const (
+	copyFileChunk = 128 << 10
+	copyFileDepth = 8
+)
+
+// CopyFile copies the file src to dst, which is created or truncated
+// with src's permission bits, and returns the number of bytes copied.
+// It opens and stats src in one linked submission, preallocates dst,
+// then keeps up to depth linked read/write pairs of chunks in flight
+// (a default if depth is zero) before syncing and closing dst. The
+// copy covers the size src had when it was opened.
+func CopyFile(e *Executor, dst, src string, depth int) (int64, error) {
+	if depth <= 0 {
+		depth = copyFileDepth
+	}
+
+	path, err := syscall.BytePtrFromString(src)
+	if err != nil {
+		return 0, err
+	}
+	var stx Statx
+	chain, err := e.NewChain().
+		Add(func(ud uint64) error {
+			return e.ring.PrepOpenat(sys.AT_FDCWD, path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0, ud)
+		}).
+		Add(func(ud uint64) error {
+			return e.ring.PrepStatx(sys.AT_FDCWD, path, 0, int(sys.STATX_SIZE|sys.STATX_MODE), unsafe.Pointer(&stx), ud)
+		}).
+		Submit()
+	if err != nil {
+		return 0, err
+	}
+	res, err := chain.Results()
+	runtime.KeepAlive(path)
+	if res[0] >= 0 {
+		defer NewFile(e, int(res[0]), src).Close()
+	}
+	if err != nil {
+		return 0, &os.PathError{Op: "open", Path: src, Err: err}
+	}
+	in := int(res[0])
+	size := int64(stx.Size)
+
+	out, err := OpenFile(e, dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(stx.Mode&0o777))
+	if err != nil {
+		return 0, err
+	}
+	if size > 0 {
+		op, err := e.Submit(func(ud uint64) error {
+			return e.ring.PrepFallocate(out.fd, 0, 0, uint64(size), ud)
+		})
+		if err == nil {
+			_, err = op.Result()
+		}
+		if err != nil && !errors.Is(err, syscall.EOPNOTSUPP) && !errors.Is(err, syscall.EINVAL) {
+			out.Close()
+			return 0, err
+		}
+	}
+
+	copied, err := copyChunks(e, out.fd, in, size, depth)
+	if err == nil && copied < size {
+		// src shrank; drop the preallocated tail
+		err = syscall.Ftruncate(out.fd, copied)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return copied, err
+}
+
+// copyChunk is a linked read/write pair of CopyFile.
+type copyChunk struct {
+	chain *ChainOperation
+	off   int64
+	buf   []byte
+}
+
+// copyChunks copies size bytes at the same offsets from in to out with
+// up to depth chunks in flight.
+func copyChunks(e *Executor, out, in int, size int64, depth int) (int64, error) {
+	var (
+		inflight []copyChunk
+		free     [][]byte
+		next     int64
+		copied   int64
+		err      error
+	)
+	for (next < size && err == nil) || len(inflight) > 0 {
+		for next < size && err == nil && len(inflight) < depth {
+			var buf []byte
+			if n := len(free); n > 0 {
+				buf, free = free[n-1], free[:n-1]
+			} else {
+				buf = make([]byte, copyFileChunk)
+			}
+			if rest := size - next; rest < int64(len(buf)) {
+				buf = buf[:rest]
+			}
+
+			off := uint64(next)
+			chain, serr := e.NewChain().
+				Add(func(ud uint64) error { return e.ring.PrepRead(in, buf, off, ud) }).
+				Add(func(ud uint64) error { return e.ring.PrepWrite(out, buf, off, ud) }).
+				Submit()
+			if serr == ErrSQFull && len(inflight) > 0 {
+				free = append(free, buf[:cap(buf)])
+				break // Wait for a chunk to make room
+			}
+			if serr != nil {
+				err = serr
+				break
+			}
+			inflight = append(inflight, copyChunk{chain: chain, off: next, buf: buf})
+			next += int64(len(buf))
+		}
+		if len(inflight) == 0 {
+			break
+		}
+
+		c := inflight[0]
+		inflight = inflight[1:]
+		n, cerr := finishChunk(e, out, in, c)
+		if cerr != nil {
+			if err == nil {
+				err = cerr
+			}
+			continue // Drain the rest
+		}
+		copied += int64(n)
+		if n < len(c.buf) {
+			// src shrank: nothing past this chunk counts
+			size = c.off + int64(n)
+		}
+		free = append(free, c.buf[:cap(c.buf)])
+	}
+	return copied, err
+}
+
+// finishChunk waits for a chunk and redoes it with plain reads and
+// writes if its read or write was short. It returns the bytes copied.
+func finishChunk(e *Executor, out, in int, c copyChunk) (int, error) {
+	rres, rerr := c.chain.Step(0).Result()
+	wres, werr := c.chain.Step(1).Result()
+	switch {
+	case rerr != nil:
+		return 0, rerr
+	case werr == nil && int(wres) == len(c.buf):
+		return len(c.buf), nil
+	case werr != nil && !errors.Is(werr, syscall.ECANCELED):
+		return 0, werr
+	}
+
+	// A short read breaks the link; a short write just stops early
+	n := int(rres)
+	if n < len(c.buf) {
+		k, err := NewFile(e, in, "").ReadAt(c.buf[n:], c.off+int64(n))
+		n += k
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := NewFile(e, out, "").WriteAt(c.buf[:n], c.off); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -4,6 +4,7 @@ package iouring
 
 import (
 	"context"
+	"encoding/binary"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -12,43 +13,208 @@ import (
 	"github.com/behrlich/go-iouring/internal/sys"
 )
 
+// CQEView is a copy of a completion queue entry.
+type CQEView struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// ParseCQE decodes a completion queue entry in the kernel's layout, as
+// found in CQ ring memory: 16 bytes, or 32 for a ring set up with
+// IORING_SETUP_CQE32, whose extra data it ignores. Other lengths return
+// EINVAL.
+func ParseCQE(b []byte) (CQEView, error) {
+	if len(b) != 16 && len(b) != 32 {
+		return CQEView{}, syscall.EINVAL
+	}
+	return CQEView{
+		UserData: binary.NativeEndian.Uint64(b),
+		Res:      int32(binary.NativeEndian.Uint32(b[8:])),
+		Flags:    binary.NativeEndian.Uint32(b[12:]),
+	}, nil
+}
+
+// Err returns the error carried by a negative Res, or nil.
+func (c CQEView) Err() error {
+	return ResultError(c.Res)
+}
+
+// BufferID returns the provided buffer the operation consumed, if any.
+func (c CQEView) BufferID() (bid uint16, ok bool) {
+	return BufferID(c.Flags)
+}
+
+// HasMore reports whether a multishot request will post more CQEs
+// (IORING_CQE_F_MORE). When false the request has terminated.
+func (c CQEView) HasMore() bool {
+	return c.Flags&sys.IORING_CQE_F_MORE != 0
+}
+
+// IsNotification reports whether this is the zero-copy send notification
+// that the buffer may be reused (IORING_CQE_F_NOTIF), rather than the
+// send result itself.
+func (c CQEView) IsNotification() bool {
+	return c.Flags&sys.IORING_CQE_F_NOTIF != 0
+}
+
+// SockNonEmpty reports whether the socket still had data queued after a
+// receive (IORING_CQE_F_SOCK_NONEMPTY).
+func (c CQEView) SockNonEmpty() bool {
+	return c.Flags&sys.IORING_CQE_F_SOCK_NONEMPTY != 0
+}
+
+// PeekCQEv is like PeekCQE but returns the entry as a CQEView.
+func (r *Ring) PeekCQEv() (CQEView, bool) {
+	userData, res, flags, ok := r.PeekCQE()
+	return CQEView{UserData: userData, Res: res, Flags: flags}, ok
+}
+
+// WaitCQEv is like WaitCQE but returns the entry as a CQEView.
+// Call SeenCQE after processing.
+func (r *Ring) WaitCQEv() (CQEView, error) {
+	userData, res, flags, err := r.WaitCQE()
+	return CQEView{UserData: userData, Res: res, Flags: flags}, err
+}
+
+// WaitCQETimeoutv is like WaitCQETimeout but returns the entry as a
+// CQEView. Call SeenCQE after processing.
+func (r *Ring) WaitCQETimeoutv(timeout time.Duration) (CQEView, error) {
+	userData, res, flags, err := r.WaitCQETimeout(timeout)
+	return CQEView{UserData: userData, Res: res, Flags: flags}, err
+}
+
 // PeekCQE returns the next completion queue entry without blocking.
 // Returns userData, result, flags, and whether a CQE was available.
 // This is the zero-allocation path - use this in hot loops.
+//
+// If the CQ ring is empty but completions overflowed into the kernel's
+// backlog, they are flushed into the ring first; see flushOverflow.
 func (r *Ring) PeekCQE() (userData uint64, res int32, flags uint32, ok bool) {
-	head := atomic.LoadUint32(r.cqHead)
-	tail := atomic.LoadUint32(r.cqTail)
+	if !r.hold() {
+		return 0, 0, 0, false
+	}
+	defer r.drop()
+	head := r.loadCQHead()
+	tail := sys.LoadAcquire(r.cqTail)
 
 	if head == tail {
-		return 0, 0, 0, false
+		if !r.flushOverflow() {
+			return 0, 0, 0, false
+		}
+		if tail = sys.LoadAcquire(r.cqTail); head == tail {
+			return 0, 0, 0, false
+		}
 	}
 
 	idx := head & r.cqMask
-	cqe := &r.cqes[idx]
+	cqe := &r.cqes[idx<<r.cqeShift]
 
 	return cqe.UserData, cqe.Res, cqe.Flags, true
 }
 
+// PeekCQE32 is like PeekCQE but also returns the extra 16 bytes of a
+// 32-byte CQE. big is zero on rings created without WithCQE32.
+func (r *Ring) PeekCQE32() (userData uint64, res int32, flags uint32, big [2]uint64, ok bool) {
+	if !r.hold() {
+		return 0, 0, 0, big, false
+	}
+	defer r.drop()
+	head := r.loadCQHead()
+	tail := sys.LoadAcquire(r.cqTail)
+
+	if head == tail {
+		if !r.flushOverflow() {
+			return 0, 0, 0, big, false
+		}
+		if tail = sys.LoadAcquire(r.cqTail); head == tail {
+			return 0, 0, 0, big, false
+		}
+	}
+
+	idx := head & r.cqMask
+	cqe := &r.cqes[idx<<r.cqeShift]
+	if r.cqeShift != 0 {
+		big = r.bigCQE(idx)
+	}
+
+	return cqe.UserData, cqe.Res, cqe.Flags, big, true
+}
+
+// PeekCQEBatch copies up to len(dst) available completions into dst
+// without blocking and returns how many were copied. The CQ indexes are
+// loaded once for the whole batch. Like PeekCQE it does not consume the
+// entries; call SeenCQEs with the returned count after processing.
+func (r *Ring) PeekCQEBatch(dst []CQEView) int {
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := r.loadCQHead()
+	tail := sys.LoadAcquire(r.cqTail)
+	if head == tail && r.flushOverflow() {
+		tail = sys.LoadAcquire(r.cqTail)
+	}
+
+	n := int(tail - head)
+	if n > len(dst) {
+		n = len(dst)
+	}
+
+	for i := 0; i < n; i++ {
+		if r.isWaitTimeout(head + uint32(i)) {
+			return i // Dropped by the next call
+		}
+		idx := (head + uint32(i)) & r.cqMask
+		cqe := &r.cqes[idx<<r.cqeShift]
+		dst[i] = CQEView{UserData: cqe.UserData, Res: cqe.Res, Flags: cqe.Flags}
+	}
+
+	return n
+}
+
+// bigCQE returns the extra 16 bytes of the 32-byte CQE at idx.
+func (r *Ring) bigCQE(idx uint32) [2]uint64 {
+	return *(*[2]uint64)(unsafe.Pointer(&r.cqes[idx<<1+1]))
+}
+
 // SeenCQE advances the CQ head, marking the current CQE as consumed.
 // Must be called after processing a CQE from PeekCQE.
 func (r *Ring) SeenCQE() {
-	head := atomic.LoadUint32(r.cqHead)
-	atomic.StoreUint32(r.cqHead, head+1)
+	if !r.hold() {
+		return
+	}
+	defer r.drop()
+	head := sys.LoadAcquire(r.cqHead)
+	if r.tapped {
+		r.tapCQEs(head, 1)
+	}
+	sys.StoreRelease(r.cqHead, head+1)
+	r.stats.completed.Add(1)
 }
 
 // SeenCQEs advances the CQ head by n entries.
 func (r *Ring) SeenCQEs(n uint32) {
-	head := atomic.LoadUint32(r.cqHead)
-	atomic.StoreUint32(r.cqHead, head+n)
+	if !r.hold() {
+		return
+	}
+	defer r.drop()
+	head := sys.LoadAcquire(r.cqHead)
+	if r.tapped {
+		r.tapCQEs(head, n)
+	}
+	sys.StoreRelease(r.cqHead, head+n)
+	r.stats.completed.Add(uint64(n))
 }
 
 // WaitCQE waits for at least one CQE to be available.
 // Returns userData, result, flags, or an error.
 // Does NOT automatically advance the CQ head - call SeenCQE after processing.
 func (r *Ring) WaitCQE() (userData uint64, res int32, flags uint32, err error) {
-	if r.closed.Load() {
+	if !r.hold() {
 		return 0, 0, 0, ErrRingClosed
 	}
+	defer r.drop()
 
 	// Try non-blocking first
 	if userData, res, flags, ok := r.PeekCQE(); ok {
@@ -72,41 +238,71 @@ func (r *Ring) WaitCQE() (userData uint64, res int32, flags uint32, err error) {
 
 // WaitCQETimeout waits for a CQE with a timeout.
 // Returns userData, result, flags, or an error (syscall.ETIME on timeout).
+// It does not allocate. Before 5.11 (no IORING_FEAT_EXT_ARG) the wait is
+// bounded by a timeout SQE instead, submitted along with any prepared
+// SQEs; its CQE is consumed by the ring and never seen, which reserves
+// the userData ^uint64(0)-2 on such kernels.
 func (r *Ring) WaitCQETimeout(timeout time.Duration) (userData uint64, res int32, flags uint32, err error) {
-	if r.closed.Load() {
+	return r.waitCQETimeout(timeout, nil)
+}
+
+// WaitCQETimeoutSigmask is like WaitCQETimeout but replaces the thread's
+// signal mask with mask for the duration of the wait, so a signal
+// outside mask interrupts it with syscall.EINTR. It requires
+// IORING_FEAT_EXT_ARG (5.11+) and returns ErrNotSupported without it.
+func (r *Ring) WaitCQETimeoutSigmask(timeout time.Duration, mask *Sigset) (userData uint64, res int32, flags uint32, err error) {
+	if !r.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		return 0, 0, 0, ErrNotSupported
+	}
+	return r.waitCQETimeout(timeout, mask)
+}
+
+// waitCQETimeout implements WaitCQETimeout with an optional signal mask.
+func (r *Ring) waitCQETimeout(timeout time.Duration, mask *Sigset) (userData uint64, res int32, flags uint32, err error) {
+	if !r.hold() {
 		return 0, 0, 0, ErrRingClosed
 	}
+	defer r.drop()
 
 	// Try non-blocking first
 	if userData, res, flags, ok := r.PeekCQE(); ok {
 		return userData, res, flags, nil
 	}
 
-	// Need to wait with timeout
-	if !r.HasFeature(sys.IORING_FEAT_EXT_ARG) {
-		// Fallback: poll in a loop (less efficient)
-		return r.waitCQETimeoutPoll(timeout)
+	if r.notify != nil && mask == nil {
+		if _, err := r.Submit(); err != nil {
+			return 0, 0, 0, err
+		}
+		if err := r.waitNotify(1, timeout, nil); err != nil {
+			return 0, 0, 0, err
+		}
+		if userData, res, flags, ok := r.PeekCQE(); ok {
+			return userData, res, flags, nil
+		}
+		return 0, 0, 0, syscall.EAGAIN
 	}
 
-	ts := sys.Timespec{
-		Sec:  int64(timeout / time.Second),
-		Nsec: int64(timeout % time.Second),
+	if r.iopoll {
+		if _, err := r.Submit(); err != nil {
+			return 0, 0, 0, err
+		}
+		if err := r.iopollWait(1, time.Now().Add(timeout)); err != nil {
+			return 0, 0, 0, err
+		}
+		if userData, res, flags, ok := r.PeekCQE(); ok {
+			return userData, res, flags, nil
+		}
+		return 0, 0, 0, syscall.EAGAIN
 	}
 
-	arg := sys.GetEventsArg{
-		Ts: uint64(uintptr(unsafe.Pointer(&ts))),
+	// Need to wait with timeout
+	if !r.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		return r.waitCQETimeoutSQE(timeout)
 	}
 
-	r.sqLock.Lock()
-	submitted := r.sqPending
-	if submitted > 0 {
-		tail := atomic.LoadUint32(r.sqTail)
-		atomic.StoreUint32(r.sqTail, tail+submitted)
-		r.sqPending = 0
-	}
-	r.sqLock.Unlock()
+	submitted := r.flushSQ()
 
-	_, err = sys.EnterExt(r.fd, submitted, 1, sys.IORING_ENTER_GETEVENTS, &arg)
+	_, err = r.enterTimeout(submitted, 1, sys.IORING_ENTER_GETEVENTS|r.enterFlags, mask, timeout)
 	if err != nil {
 		return 0, 0, 0, err
 	}
@@ -118,48 +314,90 @@ func (r *Ring) WaitCQETimeout(timeout time.Duration) (userData uint64, res int32
 	return 0, 0, 0, syscall.ETIME
 }
 
-// waitCQETimeoutPoll is a fallback for kernels without EXT_ARG support.
-func (r *Ring) waitCQETimeoutPoll(timeout time.Duration) (userData uint64, res int32, flags uint32, err error) {
-	deadline := time.Now().Add(timeout)
-
-	for {
-		if userData, res, flags, ok := r.PeekCQE(); ok {
-			return userData, res, flags, nil
-		}
-
-		remaining := time.Until(deadline)
-		if remaining <= 0 {
-			return 0, 0, 0, syscall.ETIME
+// waitTimeoutToken is the userData of the timeout SQEs that bound
+// WaitCQETimeout on kernels without IORING_FEAT_EXT_ARG. Their CQEs are
+// dropped once they reach the head of the CQ.
+const waitTimeoutToken = ^uint64(0) - 2
+
+// waitCQETimeoutSQE is waitCQETimeout for kernels without EXT_ARG: the
+// wait is bounded by a timeout SQE with a count of one, which the kernel
+// completes as soon as any other request does.
+func (r *Ring) waitCQETimeoutSQE(timeout time.Duration) (userData uint64, res int32, flags uint32, err error) {
+	r.waitMu.Lock()
+	r.waitTimeouts.Store(true)
+	r.waitTs = sys.Timespec{
+		Sec:  int64(timeout / time.Second),
+		Nsec: int64(timeout % time.Second),
+	}
+	err = r.PrepTimeout(&r.waitTs, 1, 0, waitTimeoutToken)
+	if err == ErrSQFull {
+		if _, err = r.Submit(); err == nil {
+			err = r.PrepTimeout(&r.waitTs, 1, 0, waitTimeoutToken)
 		}
+	}
+	if err == nil {
+		_, err = r.SubmitAndWait(1)
+	}
+	r.waitMu.Unlock()
+	if err != nil {
+		return 0, 0, 0, err
+	}
 
-		// Short sleep to avoid busy-waiting
-		sleepTime := remaining
-		if sleepTime > 10*time.Millisecond {
-			sleepTime = 10 * time.Millisecond
-		}
+	// Only the timeout's own CQE, dropped by PeekCQE, leaves nothing
+	if userData, res, flags, ok := r.PeekCQE(); ok {
+		return userData, res, flags, nil
+	}
+	return 0, 0, 0, syscall.ETIME
+}
 
-		_, err := r.SubmitAndWait(1)
-		if err == nil {
-			continue
-		}
-		if err == syscall.EINTR {
-			continue
+// loadCQHead loads the CQ head, first consuming the CQEs of
+// WaitCQETimeout's timeout SQEs at it.
+func (r *Ring) loadCQHead() uint32 {
+	head := sys.LoadAcquire(r.cqHead)
+	if !r.waitTimeouts.Load() {
+		return head
+	}
+	for tail := sys.LoadAcquire(r.cqTail); head != tail && r.isWaitTimeout(head); {
+		if r.tapped {
+			r.tapCQEs(head, 1)
 		}
-		return 0, 0, 0, err
+		head++
+		sys.StoreRelease(r.cqHead, head)
 	}
+	return head
+}
+
+// isWaitTimeout reports whether the CQE at CQ position pos is that of a
+// WaitCQETimeout timeout SQE.
+func (r *Ring) isWaitTimeout(pos uint32) bool {
+	return r.waitTimeouts.Load() && r.cqes[(pos&r.cqMask)<<r.cqeShift].UserData == waitTimeoutToken
 }
 
 // WaitCQEContext waits for a CQE with context cancellation support.
 func (r *Ring) WaitCQEContext(ctx context.Context) (userData uint64, res int32, flags uint32, err error) {
-	if r.closed.Load() {
+	if !r.hold() {
 		return 0, 0, 0, ErrRingClosed
 	}
+	defer r.drop()
 
 	// Try non-blocking first
 	if userData, res, flags, ok := r.PeekCQE(); ok {
 		return userData, res, flags, nil
 	}
 
+	if r.notify != nil {
+		if _, err := r.Submit(); err != nil {
+			return 0, 0, 0, err
+		}
+		if err := r.waitNotify(1, 0, ctx); err != nil {
+			return 0, 0, 0, err
+		}
+		if userData, res, flags, ok := r.PeekCQE(); ok {
+			return userData, res, flags, nil
+		}
+		return 0, 0, 0, syscall.EAGAIN
+	}
+
 	// Poll in a loop checking context
 	for {
 		select {
@@ -180,40 +418,197 @@ func (r *Ring) WaitCQEContext(ctx context.Context) (userData uint64, res int32,
 // ForEachCQE iterates over all available CQEs.
 // The callback receives userData, result, and flags for each CQE.
 // Returns the number of CQEs processed.
-// The CQ head is advanced after all processing is complete.
+// CQEs that arrive while fn runs, e.g. further multishot completions,
+// are processed in the same call.
+// The CQ head is advanced after all processing is complete, or earlier
+// if overflowed completions have to be flushed into the ring.
 func (r *Ring) ForEachCQE(fn func(userData uint64, res int32, flags uint32) bool) int {
-	head := atomic.LoadUint32(r.cqHead)
-	tail := atomic.LoadUint32(r.cqTail)
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := r.loadCQHead()
+	tail := sys.LoadAcquire(r.cqTail)
 	count := 0
 
-	for head != tail {
+	for {
+		if head == tail {
+			// Pick up completions posted during the iteration, then
+			// make room for and pull in any overflowed ones
+			if tail = sys.LoadAcquire(r.cqTail); head == tail {
+				sys.StoreRelease(r.cqHead, head)
+				if !r.flushOverflow() {
+					break
+				}
+				if tail = sys.LoadAcquire(r.cqTail); head == tail {
+					break
+				}
+			}
+		}
+
+		if r.isWaitTimeout(head) {
+			if r.tapped {
+				r.tapCQEs(head, 1)
+			}
+			head++
+			sys.StoreRelease(r.cqHead, head)
+			continue
+		}
 		idx := head & r.cqMask
-		cqe := &r.cqes[idx]
+		cqe := &r.cqes[idx<<r.cqeShift]
 
 		if !fn(cqe.UserData, cqe.Res, cqe.Flags) {
 			break
 		}
+		if r.tapped {
+			r.tapCQEs(head, 1)
+		}
+
+		head++
+		count++
+	}
+
+	if count > 0 {
+		sys.StoreRelease(r.cqHead, head)
+		r.stats.completed.Add(uint64(count))
+	}
+
+	return count
+}
+
+// ForEachCQE32 is like ForEachCQE but also passes the extra 16 bytes of
+// each 32-byte CQE. big is zero on rings created without WithCQE32.
+func (r *Ring) ForEachCQE32(fn func(userData uint64, res int32, flags uint32, big [2]uint64) bool) int {
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := r.loadCQHead()
+	tail := sys.LoadAcquire(r.cqTail)
+	count := 0
+
+	for {
+		if head == tail {
+			// Pick up completions posted during the iteration, then
+			// make room for and pull in any overflowed ones
+			if tail = sys.LoadAcquire(r.cqTail); head == tail {
+				sys.StoreRelease(r.cqHead, head)
+				if !r.flushOverflow() {
+					break
+				}
+				if tail = sys.LoadAcquire(r.cqTail); head == tail {
+					break
+				}
+			}
+		}
+
+		if r.isWaitTimeout(head) {
+			if r.tapped {
+				r.tapCQEs(head, 1)
+			}
+			head++
+			sys.StoreRelease(r.cqHead, head)
+			continue
+		}
+		idx := head & r.cqMask
+		cqe := &r.cqes[idx<<r.cqeShift]
+
+		var big [2]uint64
+		if r.cqeShift != 0 {
+			big = r.bigCQE(idx)
+		}
+		if !fn(cqe.UserData, cqe.Res, cqe.Flags, big) {
+			break
+		}
+		if r.tapped {
+			r.tapCQEs(head, 1)
+		}
 
 		head++
 		count++
 	}
 
 	if count > 0 {
-		atomic.StoreUint32(r.cqHead, head)
+		sys.StoreRelease(r.cqHead, head)
+		r.stats.completed.Add(uint64(count))
+	}
+
+	return count
+}
+
+// DrainLoop is like ForEachCQE, but when runTaskWork is set and the CQ
+// runs dry it also enters the kernel to run task work that may post
+// more completions, and keeps going until none appear. Rings created
+// with WithDeferTaskrun or WithCoopTaskrun need this to see completions
+// without waiting. With WithTaskrunFlag the kernel is only entered while
+// HasPendingTaskWork reports work.
+func (r *Ring) DrainLoop(runTaskWork bool, fn func(userData uint64, res int32, flags uint32) bool) int {
+	stopped := false
+	wrapped := func(userData uint64, res int32, flags uint32) bool {
+		if !fn(userData, res, flags) {
+			stopped = true
+			return false
+		}
+		return true
 	}
 
+	count := r.ForEachCQE(wrapped)
+	for runTaskWork && !stopped {
+		if r.params.Flags&sys.IORING_SETUP_TASKRUN_FLAG != 0 && !r.HasPendingTaskWork() {
+			break
+		}
+		if r.GetEvents() != nil || r.CQReady() == 0 {
+			break
+		}
+		count += r.ForEachCQE(wrapped)
+	}
 	return count
 }
 
+// Reap is ForEachCQE for rings whose completions may not have been
+// posted yet. On a ring set up with WithDeferTaskrun the kernel only
+// runs the task work that posts completions when the issuer enters it,
+// so when the CQ is empty Reap enters with a non-blocking GETEVENTS
+// first; with WithTaskrunFlag only if HasPendingTaskWork reports work.
+// On a WithIOPoll ring that enter polls the device once. Completions
+// that overflowed are flushed the same way on any ring.
+// It must be called from the issuer's thread: elsewhere the kernel
+// refuses to run the work and Reap returns ErrNotIssuer.
+func (r *Ring) Reap(fn func(userData uint64, res int32, flags uint32) bool) (int, error) {
+	if r.CQReady() == 0 && (r.iopoll || r.deferredTaskWork() || r.CQOverflowPending()) {
+		if err := r.getEvents(0); err != nil && err != syscall.EINTR {
+			return 0, err
+		}
+	}
+	return r.ForEachCQE(fn), nil
+}
+
+// deferredTaskWork reports whether a DEFER_TASKRUN ring may have task
+// work to run.
+func (r *Ring) deferredTaskWork() bool {
+	if r.params.Flags&sys.IORING_SETUP_DEFER_TASKRUN == 0 {
+		return false
+	}
+	return r.params.Flags&sys.IORING_SETUP_TASKRUN_FLAG == 0 || r.HasPendingTaskWork()
+}
+
 // DrainCQEs processes all available CQEs and advances the head.
 // Returns the number of CQEs drained.
 func (r *Ring) DrainCQEs() int {
-	head := atomic.LoadUint32(r.cqHead)
-	tail := atomic.LoadUint32(r.cqTail)
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := sys.LoadAcquire(r.cqHead)
+	tail := sys.LoadAcquire(r.cqTail)
 	count := int(tail - head)
 
 	if count > 0 {
-		atomic.StoreUint32(r.cqHead, tail)
+		if r.tapped {
+			r.tapCQEs(head, uint32(count))
+		}
+		sys.StoreRelease(r.cqHead, tail)
+		r.stats.completed.Add(uint64(count))
 	}
 
 	return count
@@ -221,14 +616,34 @@ func (r *Ring) DrainCQEs() int {
 
 // CQOverflow returns the number of CQE overflows (dropped completions).
 func (r *Ring) CQOverflow() uint32 {
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
 	return atomic.LoadUint32(r.cqOverflow)
 }
 
-// ResultError converts a CQE result to an error if negative.
-// Returns nil if the result is non-negative.
-func ResultError(res int32) error {
-	if res >= 0 {
+// CheckCQOverflow returns ErrCQOverflow if completions were dropped
+// since the previous call, as counted by CQOverflow. Kernels without
+// IORING_FEAT_NODROP drop CQEs whenever the CQ ring is full; newer ones
+// only do so if they cannot allocate the overflow backlog. A dropped
+// completion means some request will never report back.
+func (r *Ring) CheckCQOverflow() error {
+	if !r.hold() {
 		return nil
 	}
-	return syscall.Errno(-res)
+	defer r.drop()
+	n := atomic.LoadUint32(r.cqOverflow)
+	if atomic.SwapUint32(&r.cqOverflowSeen, n) != n {
+		return ErrCQOverflow
+	}
+	return nil
+}
+
+// flushOverflow has the kernel move completions from its overflow
+// backlog into the CQ ring (IORING_SQ_CQ_OVERFLOW), and reports whether
+// it did. Only the CQ ring's free space is filled, so callers must
+// publish the head of everything they consumed first.
+func (r *Ring) flushOverflow() bool {
+	return r.CQOverflowPending() && r.getEvents(0) == nil
 }
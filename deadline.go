@@ -0,0 +1,203 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// deadlineTokenBit marks the userData of the linked timeout of an
+// operation: it is the operation's own with the top bit set, which
+// Registry tokens never have, so the reaper ignores its CQE and a
+// deadline update can find it.
+const deadlineTokenBit = 1 << 63
+
+// ioKind is the deadline an operation in flight is subject to.
+type ioKind uint8
+
+const (
+	ioNone  ioKind = iota // No deadline, e.g. the request of a stream
+	ioRead                // The read deadline
+	ioWrite               // The write deadline
+)
+
+// deadlines holds the read and write deadlines of a socket or File, and
+// the operations in flight on it, which a change of deadline applies to.
+// The zero value has no deadlines.
+type deadlines struct {
+	mu       sync.Mutex
+	read     time.Time
+	write    time.Time
+	inflight map[*Operation]*pendingIO // Canceled by cancelAll
+}
+
+// pendingIO is an operation in flight.
+type pendingIO struct {
+	kind   ioKind
+	linked bool        // It has a linked timeout, see deadlineTokenBit
+	timer  *time.Timer // Cancels it at a deadline set after it started
+	moves  uint64      // Deadline changes applied, to spot stale updates
+}
+
+// deadlineLocked returns the deadline of kind. Caller must hold mu.
+func (d *deadlines) deadlineLocked(kind ioKind) time.Time {
+	switch kind {
+	case ioRead:
+		return d.read
+	case ioWrite:
+		return d.write
+	}
+	return time.Time{}
+}
+
+// deadline returns the deadline of kind.
+func (d *deadlines) deadline(kind ioKind) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deadlineLocked(kind)
+}
+
+// set changes the read deadline, the write deadline or both to t and
+// applies it to the operations in flight subject to it.
+func (d *deadlines) set(read, write bool, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if read {
+		d.read = t
+	}
+	if write {
+		d.write = t
+	}
+	for op, p := range d.inflight {
+		if p.kind == ioRead && read || p.kind == ioWrite && write {
+			d.applyLocked(op, p, t)
+		}
+	}
+}
+
+// start submits an operation subject to the deadline of kind, like
+// submitDeadline, bound to ctx like submitContext, and tracks it until
+// untrack.
+func (d *deadlines) start(ctx context.Context, e *Executor, kind ioKind, prep func(ud uint64, opts ...OpOption) error, keep any) (*Operation, error) {
+	deadline := d.deadline(kind)
+	op, err := e.submitDeadlineContext(ctx, prep, deadline, keep)
+	if err != nil {
+		return nil, err
+	}
+	d.track(op, kind, deadline)
+	return op, nil
+}
+
+// track adds op, submitted with deadline, to the operations in flight,
+// and applies the deadline of kind if it changed meanwhile.
+func (d *deadlines) track(op *Operation, kind ioKind, deadline time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inflight == nil {
+		d.inflight = make(map[*Operation]*pendingIO)
+	}
+	p := &pendingIO{kind: kind, linked: !deadline.IsZero()}
+	d.inflight[op] = p
+	if t := d.deadlineLocked(kind); !t.Equal(deadline) {
+		d.applyLocked(op, p, t)
+	}
+}
+
+// untrack drops op, which is done.
+func (d *deadlines) untrack(op *Operation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p := d.inflight[op]; p != nil && p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(d.inflight, op)
+}
+
+// cancelAll cancels the operations in flight.
+func (d *deadlines) cancelAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for op := range d.inflight {
+		op.Cancel()
+	}
+}
+
+// applyLocked moves the deadline of op, tracked as p, to t, zero for
+// none. A linked timeout is updated in place (IORING_LINK_TIMEOUT_UPDATE,
+// 5.15+); an operation without one, or whose update fails, is canceled
+// at t. The update fails if the kernel lacks it, if op is done, or if
+// the linked timeout is not armed yet, as may happen with SQPOLL; the
+// deadline op started with then still applies too. Caller must hold mu.
+func (d *deadlines) applyLocked(op *Operation, p *pendingIO, t time.Time) {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.moves++
+
+	if p.linked {
+		ts := timespecOf(math.MaxInt64) // A timeout cannot be unset
+		if !t.IsZero() {
+			ts = timespecUntil(t)
+		}
+		e := op.e
+		upd, err := e.submit(func(ud uint64) error {
+			return e.ring.PrepTimeoutUpdate(&ts, op.userData|deadlineTokenBit, sys.IORING_LINK_TIMEOUT_UPDATE, ud)
+		}, &ts)
+		if err == nil {
+			go d.checkUpdate(op, p, p.moves, upd, t)
+			return
+		}
+	}
+	p.cancelAtLocked(op, t)
+}
+
+// checkUpdate waits for upd, the update of the linked timeout of op to
+// t, and cancels op at t instead if it failed, unless op is done or its
+// deadline moved again meanwhile.
+func (d *deadlines) checkUpdate(op *Operation, p *pendingIO, moves uint64, upd *Operation, t time.Time) {
+	if _, err := upd.Result(); err == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inflight[op] == p && p.moves == moves {
+		p.cancelAtLocked(op, t)
+	}
+}
+
+// cancelAtLocked cancels op at t, at once if t has passed; zero means
+// never. Caller must hold the mutex of the deadlines.
+func (p *pendingIO) cancelAtLocked(op *Operation, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if d := time.Until(t); d > 0 {
+		p.timer = time.AfterFunc(d, func() { op.Cancel() })
+	} else {
+		op.Cancel()
+	}
+}
+
+// canceled reports whether err is the cancellation of an operation,
+// which most report as ECANCELED and some, such as connect, as EINTR.
+func canceled(err error) bool {
+	return errors.Is(err, syscall.ECANCELED) || errors.Is(err, syscall.EINTR)
+}
+
+// deadlineError turns the cancellation of an operation past deadline,
+// which the deadline caused, into os.ErrDeadlineExceeded.
+func deadlineError(err error, deadline time.Time) error {
+	if !canceled(err) || deadline.IsZero() || time.Now().Before(deadline) {
+		return err
+	}
+	return os.ErrDeadlineExceeded
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// DirectFd is a direct descriptor: a file that lives only in a slot of
+// the ring's registered file table, with no entry in the process's
+// descriptor table (5.19+). It saves the fget/fput of every request and
+// the descriptor table contention of a busy accept loop, at the cost of
+// only being usable through the ring; InstallFd hands out a regular
+// descriptor when something else needs the file.
+//
+// AcceptDirect, OpenDirect and SocketDirect let the kernel pick a free
+// slot, so the ring needs a sparse file table, e.g. from
+// RegisterFilesSparse. Don't mix them with a FileTable on the same ring:
+// it does not see slots the kernel fills and may hand them out again.
+//
+// Methods are safe for concurrent use.
+type DirectFd struct {
+	e      *Executor
+	slot   int
+	closed atomic.Bool
+}
+
+// AcceptDirect accepts a connection on the listening socket fd into a
+// free slot of the file table.
+func AcceptDirect(e *Executor, fd int) (*DirectFd, error) {
+	return newDirect(e, func(ud uint64) error {
+		return e.ring.PrepAccept(fd, nil, nil, 0, ud, WithFileIndex(FileIndexAlloc))
+	})
+}
+
+// OpenDirect opens the named file into a free slot of the file table,
+// with the same flag and perm semantics as os.OpenFile. Direct
+// descriptors are never inherited, so flag must not have O_CLOEXEC.
+func OpenDirect(e *Executor, name string, flag int, perm os.FileMode) (*DirectFd, error) {
+	path, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDirect(e, func(ud uint64) error {
+		return e.ring.PrepOpenat(sys.AT_FDCWD, path, flag, uint32(perm.Perm()), ud, WithFileIndex(FileIndexAlloc))
+	})
+	runtime.KeepAlive(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return d, nil
+}
+
+// SocketDirect creates a socket into a free slot of the file table
+// (5.19+). typ must not have SOCK_CLOEXEC.
+func SocketDirect(e *Executor, domain, typ, proto int) (*DirectFd, error) {
+	return newDirect(e, func(ud uint64) error {
+		return e.ring.PrepSocket(domain, typ, proto, ud, WithFileIndex(FileIndexAlloc))
+	})
+}
+
+// NewDirectFd wraps the direct descriptor in slot, e.g. one installed
+// with WithFileIndex or sent by PrepMsgRingFd. The DirectFd takes
+// ownership of the slot and closes it on Close.
+func NewDirectFd(e *Executor, slot int) *DirectFd {
+	return &DirectFd{e: e, slot: slot}
+}
+
+// newDirect runs an operation allocating a slot, which is its result.
+func newDirect(e *Executor, prep func(ud uint64) error) (*DirectFd, error) {
+	op, err := e.Submit(prep)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := op.Result()
+	if err != nil {
+		return nil, err
+	}
+	return &DirectFd{e: e, slot: int(slot)}, nil
+}
+
+// Slot returns the index of the descriptor in the file table, for use
+// with WithFixedFile.
+func (d *DirectFd) Slot() int {
+	return d.slot
+}
+
+// Recv receives up to len(b) bytes from a socket and returns the number
+// received; zero means the peer closed the connection.
+func (d *DirectFd) Recv(b []byte, flags int) (int, error) {
+	if d.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return d.do(func(ud uint64) error {
+		return d.e.ring.PrepRecv(d.slot, b, flags, ud, WithFixedFile(d.slot))
+	}, b)
+}
+
+// Send sends b on a socket and returns the number of bytes sent, which
+// may be short.
+func (d *DirectFd) Send(b []byte, flags int) (int, error) {
+	if d.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return d.do(func(ud uint64) error {
+		return d.e.ring.PrepSend(d.slot, b, flags, ud, WithFixedFile(d.slot))
+	}, b)
+}
+
+// ReadAt reads len(b) bytes at offset off, looping over short reads. It
+// returns io.EOF if the file ends first.
+func (d *DirectFd) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		if d.closed.Load() {
+			return n, os.ErrClosed
+		}
+		res, err := d.do(func(ud uint64) error {
+			return d.e.ring.PrepRead(d.slot, b[n:], uint64(off+int64(n)), ud, WithFixedFile(d.slot))
+		}, b)
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += res
+	}
+	return n, nil
+}
+
+// WriteAt writes b at offset off, looping over short writes.
+func (d *DirectFd) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		if d.closed.Load() {
+			return n, os.ErrClosed
+		}
+		res, err := d.do(func(ud uint64) error {
+			return d.e.ring.PrepWrite(d.slot, b[n:], uint64(off+int64(n)), ud, WithFixedFile(d.slot))
+		}, b)
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += res
+	}
+	return n, nil
+}
+
+// InstallFd returns a regular descriptor for the file, with O_CLOEXEC
+// set (6.8+). The descriptor is independent of the DirectFd: closing
+// either leaves the other open.
+func (d *DirectFd) InstallFd() (int, error) {
+	if d.closed.Load() {
+		return -1, os.ErrClosed
+	}
+	fd, err := d.do(func(ud uint64) error {
+		return d.e.ring.PrepFixedFdInstall(d.slot, 0, ud)
+	}, nil)
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// Close closes the direct descriptor, freeing its slot. Requests already
+// submitted against the slot keep the file until they complete.
+func (d *DirectFd) Close() error {
+	if !d.closed.CompareAndSwap(false, true) {
+		return os.ErrClosed
+	}
+	_, err := d.do(func(ud uint64) error {
+		return d.e.ring.PrepClose(0, ud, WithFileIndex(uint32(d.slot)))
+	}, nil)
+	return err
+}
+
+// do runs one operation, keeping keep alive until it completes, and
+// returns its result.
+func (d *DirectFd) do(prep func(ud uint64) error, keep any) (int, error) {
+	op, err := d.e.submit(prep, keep)
+	if err != nil {
+		return 0, err
+	}
+	res, err := op.Result()
+	return int(res), err
+}
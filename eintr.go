@@ -0,0 +1,84 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithEINTR makes calls that enter the kernel fail with syscall.EINTR
+// when a signal interrupts io_uring_enter, as the syscall itself does.
+// By default the ring retries the call instead: the Go runtime signals
+// its threads all the time, e.g. SIGURG to preempt goroutines and
+// SIGPROF while profiling, so otherwise every caller of Submit or
+// WaitCQE needs a retry loop of its own. A retried wait with a timeout
+// only waits for what is left of it.
+//
+// Waits with a signal mask, SubmitAndWaitSigmask and
+// WaitCQETimeoutSigmask, always return EINTR, as being interrupted is
+// their point, and so does Enter with a timeout in its argument.
+func WithEINTR() Option {
+	return func(p *setupConfig) {
+		p.eintr = true
+	}
+}
+
+// retryIntr reports whether an io_uring_enter call that failed with err
+// is to be repeated.
+func (r *Ring) retryIntr(err error) bool {
+	return err == syscall.EINTR && !r.eintr
+}
+
+// enterArg is the extended argument of a wait with a timeout, with the
+// timespec and signal mask it holds the addresses of. The kernel reads
+// them after the stack of the waiting goroutine may have moved, so they
+// live in heap memory, which does not.
+type enterArg struct {
+	arg  sys.GetEventsArg
+	ts   sys.Timespec
+	mask uint64
+}
+
+// enterTimeout is enterExt with the wait bounded by timeout, and with
+// the signal mask replaced by mask if it is not nil. A wait retried
+// after EINTR gets what is left of the timeout, and fails with
+// syscall.ETIME if nothing is.
+//
+// The argument is the ring's own while no other wait uses it, so that
+// waits do not allocate; concurrent waits allocate theirs.
+func (r *Ring) enterTimeout(toSubmit, minComplete, flags uint32, mask *Sigset, timeout time.Duration) (int, error) {
+	a := &r.waitArg
+	if r.waitArgMu.TryLock() {
+		defer r.waitArgMu.Unlock()
+		*a = enterArg{}
+	} else {
+		a = new(enterArg)
+	}
+	if mask != nil {
+		a.mask = mask.val
+		a.arg.Sigmask = uint64(uintptr(unsafe.Pointer(&a.mask)))
+		a.arg.SigmaskSz = sys.SigsetSize
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		a.ts = sys.Timespec{
+			Sec:  int64(timeout / time.Second),
+			Nsec: int64(timeout % time.Second),
+		}
+		a.arg.Ts = uint64(uintptr(unsafe.Pointer(&a.ts)))
+		n, err := r.enterExt(toSubmit, minComplete, flags, &a.arg)
+		runtime.KeepAlive(a)
+		if mask != nil || !r.retryIntr(err) {
+			return n, err
+		}
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return 0, syscall.ETIME
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package iouring
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// MaxIOSize is the most bytes one read, write, send or receive moves:
+// the kernel's MAX_RW_COUNT, INT_MAX rounded down to a page. It caps
+// longer transfers there, and an SQE cannot describe 4GiB or more at
+// all, so Prep calls given a larger buffer return ErrIOTooLarge.
+const MaxIOSize = 1<<31 - 4096
+
+// Common errors
+var (
+	ErrRingClosed        = errors.New("iouring: ring closed")
+	ErrSQFull            = errors.New("iouring: submission queue full")
+	ErrQueueFull         = errors.New("iouring: submitter queue full")
+	ErrCQOverflow        = errors.New("iouring: completion queue overflow")
+	ErrNotSupported      = errors.New("iouring: operation not supported on this kernel")
+	ErrExecutorClosed    = errors.New("iouring: executor closed")
+	ErrLoopRunning       = errors.New("iouring: loop is running")
+	ErrTLSRecord         = errors.New("iouring: TLS control record pending")
+	ErrConcurrentIssuer  = errors.New("iouring: concurrent use of a single-issuer ring")
+	ErrFixedFileRequired = errors.New("iouring: SQPOLL ring needs fixed files on this kernel")
+	ErrNotIssuer         = errors.New("iouring: single-issuer ring entered from another thread")
+	ErrDirectIORequired  = errors.New("iouring: IOPOLL ring needs files opened with O_DIRECT")
+	ErrNoResources       = errors.New("iouring: kernel out of memory for requests")
+	ErrIOTooLarge        = errors.New("iouring: buffer larger than MaxIOSize")
+)
+
+// OpError describes a failed operation: which request it was and what
+// it was doing, wrapping the errno from its CQE. errors.Is and errors.As
+// see through it to the syscall.Errno, e.g.
+//
+//	if errors.Is(err, syscall.ECONNRESET) { ... }
+type OpError struct {
+	Op       string // Operation name, e.g. "recv"
+	Fd       int    // File descriptor or fixed file slot; -1 if none
+	Fixed    bool   // Fd is a registered file slot (IOSQE_FIXED_FILE)
+	UserData uint64
+	Err      error // Usually a syscall.Errno
+}
+
+func (e *OpError) Error() string {
+	s := "iouring: " + e.Op
+	if e.Fd >= 0 {
+		if e.Fixed {
+			s += " on fixed file " + strconv.Itoa(e.Fd)
+		} else {
+			s += " on fd " + strconv.Itoa(e.Fd)
+		}
+	}
+	s += " (userData " + strconv.FormatUint(e.UserData, 10) + "): "
+	return s + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// ResultError converts a CQE result to an error if negative.
+// Returns nil if the result is non-negative.
+func ResultError(res int32) error {
+	if res >= 0 {
+		return nil
+	}
+	return syscall.Errno(-res)
+}
+
+// opError builds the OpError for a failed CQE result of an SQE with the
+// given opcode, SQE flags and fd.
+func opError(opcode, sqeFlags uint8, fd int32, userData uint64, res int32) error {
+	err := ResultError(res)
+	if err == nil {
+		return nil
+	}
+	e := &OpError{Op: opName(opcode), Fd: -1, UserData: userData, Err: err}
+	if int(opcode) < len(opInfos) && opInfos[opcode].usesFd {
+		e.Fd = int(fd)
+		e.Fixed = sqeFlags&sys.IOSQE_FIXED_FILE != 0
+	}
+	return e
+}
+
+// opInfo describes an opcode for error messages.
+type opInfo struct {
+	name   string
+	usesFd bool // sqe.fd names the file operated on
+}
+
+var opInfos = [...]opInfo{
+	sys.IORING_OP_NOP:              {"nop", false},
+	sys.IORING_OP_READV:            {"readv", true},
+	sys.IORING_OP_WRITEV:           {"writev", true},
+	sys.IORING_OP_FSYNC:            {"fsync", true},
+	sys.IORING_OP_READ_FIXED:       {"read_fixed", true},
+	sys.IORING_OP_WRITE_FIXED:      {"write_fixed", true},
+	sys.IORING_OP_POLL_ADD:         {"poll_add", true},
+	sys.IORING_OP_POLL_REMOVE:      {"poll_remove", false},
+	sys.IORING_OP_SYNC_FILE_RANGE:  {"sync_file_range", true},
+	sys.IORING_OP_SENDMSG:          {"sendmsg", true},
+	sys.IORING_OP_RECVMSG:          {"recvmsg", true},
+	sys.IORING_OP_TIMEOUT:          {"timeout", false},
+	sys.IORING_OP_TIMEOUT_REMOVE:   {"timeout_remove", false},
+	sys.IORING_OP_ACCEPT:           {"accept", true},
+	sys.IORING_OP_ASYNC_CANCEL:     {"async_cancel", false},
+	sys.IORING_OP_LINK_TIMEOUT:     {"link_timeout", false},
+	sys.IORING_OP_CONNECT:          {"connect", true},
+	sys.IORING_OP_FALLOCATE:        {"fallocate", true},
+	sys.IORING_OP_OPENAT:           {"openat", false},
+	sys.IORING_OP_CLOSE:            {"close", true},
+	sys.IORING_OP_FILES_UPDATE:     {"files_update", false},
+	sys.IORING_OP_STATX:            {"statx", false},
+	sys.IORING_OP_READ:             {"read", true},
+	sys.IORING_OP_WRITE:            {"write", true},
+	sys.IORING_OP_FADVISE:          {"fadvise", true},
+	sys.IORING_OP_MADVISE:          {"madvise", false},
+	sys.IORING_OP_SEND:             {"send", true},
+	sys.IORING_OP_RECV:             {"recv", true},
+	sys.IORING_OP_OPENAT2:          {"openat2", false},
+	sys.IORING_OP_EPOLL_CTL:        {"epoll_ctl", true},
+	sys.IORING_OP_SPLICE:           {"splice", true},
+	sys.IORING_OP_PROVIDE_BUFFERS:  {"provide_buffers", false},
+	sys.IORING_OP_REMOVE_BUFFERS:   {"remove_buffers", false},
+	sys.IORING_OP_TEE:              {"tee", true},
+	sys.IORING_OP_SHUTDOWN:         {"shutdown", true},
+	sys.IORING_OP_RENAMEAT:         {"renameat", false},
+	sys.IORING_OP_UNLINKAT:         {"unlinkat", false},
+	sys.IORING_OP_MKDIRAT:          {"mkdirat", false},
+	sys.IORING_OP_SYMLINKAT:        {"symlinkat", false},
+	sys.IORING_OP_LINKAT:           {"linkat", false},
+	sys.IORING_OP_MSG_RING:         {"msg_ring", true},
+	sys.IORING_OP_FSETXATTR:        {"fsetxattr", true},
+	sys.IORING_OP_SETXATTR:         {"setxattr", false},
+	sys.IORING_OP_FGETXATTR:        {"fgetxattr", true},
+	sys.IORING_OP_GETXATTR:         {"getxattr", false},
+	sys.IORING_OP_SOCKET:           {"socket", false},
+	sys.IORING_OP_URING_CMD:        {"uring_cmd", true},
+	sys.IORING_OP_SEND_ZC:          {"send_zc", true},
+	sys.IORING_OP_SENDMSG_ZC:       {"sendmsg_zc", true},
+	sys.IORING_OP_READ_MULTISHOT:   {"read_multishot", true},
+	sys.IORING_OP_WAITID:           {"waitid", false},
+	sys.IORING_OP_FUTEX_WAIT:       {"futex_wait", false},
+	sys.IORING_OP_FUTEX_WAKE:       {"futex_wake", false},
+	sys.IORING_OP_FUTEX_WAITV:      {"futex_waitv", false},
+	sys.IORING_OP_FIXED_FD_INSTALL: {"fixed_fd_install", true},
+	sys.IORING_OP_FTRUNCATE:        {"ftruncate", true},
+	sys.IORING_OP_BIND:             {"bind", true},
+	sys.IORING_OP_LISTEN:           {"listen", true},
+}
+
+// opName returns the lower-case name of an opcode.
+func opName(opcode uint8) string {
+	if int(opcode) < len(opInfos) {
+		return opInfos[opcode].name
+	}
+	return "op " + strconv.Itoa(int(opcode))
+}
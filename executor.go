@@ -0,0 +1,486 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"runtime/trace"
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Reserved userData values used by the executor itself. Registry tokens
+// never have the top bit set, so these cannot collide with operations.
+const (
+	execWakeToken   = ^uint64(0)     // NOP that wakes the reaper on Close
+	execCancelToken = ^uint64(0) - 1 // ASYNC_CANCEL issued by Operation.Cancel
+)
+
+// Executor runs operations on a ring and reaps their completions on a
+// background goroutine, so callers can await individual operations
+// instead of draining the CQ themselves. It suits request/response
+// style code; tight event loops should keep using Ring directly.
+//
+// The Executor owns the ring's completion queue: nothing else may
+// consume CQEs from it while the Executor is running.
+type Executor struct {
+	ring *Ring
+
+	mu     sync.Mutex           // Serializes submission and guards below
+	ops    Registry[*Operation] // In-flight operations by userData
+	closed bool                 // Close was called
+	err    error                // Why the reaper stopped, if it did
+
+	exited chan struct{} // Closed when the reaper returns
+	wake   chan struct{} // Unparks the idle reaper of an IOPOLL ring; nil otherwise
+}
+
+// Operation is a handle to a single operation submitted through an
+// Executor. Its methods are safe for concurrent use.
+type Operation struct {
+	e        *Executor
+	userData uint64
+	done     chan struct{}
+
+	// What the SQE carrying userData was, for OpError
+	opcode   uint8
+	sqeFlags uint8
+	fd       int32
+
+	// Set by the reaper before done is closed
+	res   int32
+	flags uint32
+	err   error
+
+	sendRes int32 // Res of a zero-copy send, whose final CQE is the notification
+
+	chain *ChainOperation               // Chain this operation is a step of, if any
+	task  *trace.Task                   // Execution trace task (WithTrace)
+	keep  any                           // Memory the kernel uses until completion, or an FdRef
+	each  func(res int32, flags uint32) // Sees every CQE; see submitEach
+
+	// Set by SubmitContext while the operation is in flight
+	ctx  context.Context
+	stop func() bool // Unregisters the cancellation on ctx
+}
+
+// NewExecutor starts an executor on ring. The ring must outlive the
+// executor; call Close on the executor before closing the ring.
+func NewExecutor(ring *Ring) *Executor {
+	e := &Executor{
+		ring:   ring,
+		exited: make(chan struct{}),
+	}
+	if ring.iopoll {
+		e.wake = make(chan struct{}, 1)
+	}
+	go e.runReaper()
+	return e
+}
+
+// Submit prepares and submits one operation. prep must queue exactly the
+// SQEs for the operation on the executor's ring using the given
+// userData, e.g.
+//
+//	op, err := e.Submit(func(ud uint64) error {
+//		return ring.PrepRead(fd, buf, 0, ud)
+//	})
+//
+// Only the CQE carrying userData completes the operation, so with linked
+// SQEs prep should give the others a userData of zero. Buffers referenced
+// by the SQEs must stay alive until the operation is done. A zero-copy
+// send is done once its notification arrives, so its buffer can be
+// reused, and its result is the send's.
+func (e *Executor) Submit(prep func(userData uint64) error) (*Operation, error) {
+	return e.submit(prep, nil)
+}
+
+// submit is Submit, keeping keep reachable until the operation is done.
+func (e *Executor) submit(prep func(userData uint64) error, keep any) (*Operation, error) {
+	return e.submitIn(context.Background(), prep, keep, nil)
+}
+
+// submitEach is submit for a multishot request: each is called with
+// every CQE of the operation, on the reaper goroutine and before the
+// final one completes the operation. It must not block or call into the
+// executor.
+func (e *Executor) submitEach(prep func(userData uint64) error, each func(res int32, flags uint32)) (*Operation, error) {
+	return e.submitIn(context.Background(), prep, nil, each)
+}
+
+// submitIn is submit, tracing the operation as a task within ctx.
+func (e *Executor) submitIn(ctx context.Context, prep func(userData uint64) error, keep any, each func(res int32, flags uint32)) (*Operation, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.usableLocked(); err != nil {
+		return nil, err
+	}
+
+	op := &Operation{e: e, done: make(chan struct{}), keep: keep, each: each}
+	op.userData = e.ops.Register(op)
+	if err := e.prepLocked(func() error { return prep(op.userData) }, op.ownsSQE); err != nil {
+		e.ops.Release(op.userData)
+		releaseFd(keep)
+		return nil, err
+	}
+	op.recordSQE()
+	op.startTrace(ctx)
+	e.unpark()
+
+	if _, err := e.ring.Submit(); err != nil {
+		// The SQEs are already visible to the kernel and may still run,
+		// so the token stays reserved until their CQE arrives
+		return nil, err
+	}
+	return op, nil
+}
+
+// SubmitContext is Submit for an operation bound to ctx: once ctx is
+// done, the operation is canceled as by Cancel, and if that cancels it,
+// Result returns ctx.Err() rather than ECANCELED. The operation still
+// has to complete, so its buffers must stay alive until Result returns
+// as usual. If ctx is already done, nothing is submitted.
+func (e *Executor) SubmitContext(ctx context.Context, prep func(userData uint64) error) (*Operation, error) {
+	return e.submitContext(ctx, prep, nil)
+}
+
+// submitContext is SubmitContext, keeping keep reachable until the
+// operation is done.
+func (e *Executor) submitContext(ctx context.Context, prep func(userData uint64) error, keep any) (*Operation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	op, err := e.submitIn(ctx, prep, keep, nil)
+	if err != nil || ctx.Done() == nil {
+		return op, err
+	}
+
+	// finish runs under e.mu, so it sees stop if the operation is not
+	// done yet and the two cannot race
+	e.mu.Lock()
+	select {
+	case <-op.done:
+	default:
+		op.ctx = ctx
+		op.stop = context.AfterFunc(ctx, func() { op.Cancel() })
+	}
+	e.mu.Unlock()
+	return op, nil
+}
+
+// usableLocked returns why no operations can be submitted, if so.
+// Caller must hold e.mu.
+func (e *Executor) usableLocked() error {
+	if e.closed {
+		return ErrExecutorClosed
+	}
+	return e.err
+}
+
+// prepLocked runs prep, flushing the SQ and retrying once if it is full.
+// If owns is not nil, the SQEs a failed attempt left that owns reports
+// as prep's are discarded; see discardSQEs. Caller must hold e.mu.
+func (e *Executor) prepLocked(prep func() error, owns func(userData uint64) bool) error {
+	mark := e.ring.sqMark()
+	err := prep()
+	if err == ErrSQFull {
+		if owns != nil {
+			e.ring.discardSQEs(mark, owns)
+		}
+		if _, err := e.ring.Submit(); err != nil {
+			return err
+		}
+		mark = e.ring.sqMark()
+		err = prep()
+	}
+	if err != nil && owns != nil {
+		e.ring.discardSQEs(mark, owns)
+	}
+	return err
+}
+
+// reap consumes completions until the executor is closed and all
+// operations have finished, or the ring fails.
+func (e *Executor) reap() {
+	defer close(e.exited)
+
+	complete := func(userData uint64, res int32, flags uint32) bool {
+		op, ok := e.ops.Complete(userData, flags)
+		if !ok {
+			return true // Reserved token or stray CQE
+		}
+		if op.each != nil {
+			op.each(res, flags)
+		}
+		if flags&sys.IORING_CQE_F_MORE != 0 {
+			// Not yet the final CQE of a multishot request, or a
+			// zero-copy send whose notification follows
+			op.sendRes = res
+			return true
+		}
+		if flags&sys.IORING_CQE_F_NOTIF != 0 {
+			res = op.sendRes
+		}
+		op.finish(res, flags, nil)
+		return true
+	}
+
+	for {
+		e.mu.Lock()
+		e.ring.ForEachCQE(complete)
+		finished := e.closed && e.ops.Len() == 0
+		idle := e.ops.Len() == 0
+		e.mu.Unlock()
+		if finished {
+			return
+		}
+
+		// Polling an IOPOLL ring with nothing in flight would spin
+		if e.wake != nil && idle {
+			<-e.wake
+			continue
+		}
+
+		// A dropped CQE leaves some operation waiting forever, and there
+		// is no telling which one
+		if err := e.ring.CheckCQOverflow(); err != nil {
+			e.fail(err)
+			return
+		}
+
+		err := e.ring.getEvents(1)
+		switch err {
+		case nil, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+		default:
+			e.fail(err)
+			return
+		}
+	}
+}
+
+// unpark wakes the reaper if it parked with nothing in flight.
+func (e *Executor) unpark() {
+	if e.wake == nil {
+		return
+	}
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fail completes every in-flight operation with err and stops accepting
+// new ones.
+func (e *Executor) fail(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.err = err
+	var ops []*Operation
+	e.ops.Range(func(_ uint64, op *Operation) bool {
+		ops = append(ops, op)
+		return true
+	})
+	for _, op := range ops {
+		e.ops.Release(op.userData)
+		op.finish(0, 0, err)
+	}
+}
+
+// Close stops accepting operations, cancels the ones still in flight and
+// waits for all of them to complete before the reaper exits. Operations
+// that cannot be canceled, such as a read already running in an
+// io-wq worker, are waited for.
+func (e *Executor) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		<-e.exited
+		return nil
+	}
+	e.closed = true
+	e.unpark()
+
+	select {
+	case <-e.exited:
+		// The reaper already stopped on a ring error
+		e.mu.Unlock()
+		return nil
+	default:
+	}
+
+	e.ops.Range(func(userData uint64, _ *Operation) bool {
+		e.prepLocked(func() error {
+			return e.ring.PrepCancel(userData, 0, execCancelToken)
+		}, nil)
+		return true
+	})
+	// Wake the reaper even when nothing is in flight
+	err := e.prepLocked(func() error { return e.ring.PrepNop(execWakeToken) }, nil)
+	if err == nil {
+		_, err = e.ring.Submit()
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	<-e.exited
+	return nil
+}
+
+// recordSQE remembers the opcode and fd of the operation's SQE, which
+// must still be pending. Caller must hold e.mu.
+func (op *Operation) recordSQE() {
+	op.opcode = uint8(sys.IORING_OP_LAST)
+	if sqe, ok := op.e.ring.pendingSQE(op.userData); ok {
+		op.opcode = sqe.Opcode
+		op.sqeFlags = sqe.Flags
+		op.fd = sqe.Fd
+	}
+}
+
+// ownsSQE reports whether an SQE with userData is the operation's, its
+// linked timeout's (see deadlineTokenBit) or another SQE of its prep,
+// which has a userData of zero.
+func (op *Operation) ownsSQE(userData uint64) bool {
+	return userData == 0 || userData&^deadlineTokenBit == op.userData
+}
+
+// finish records the outcome of the operation and wakes its waiters.
+func (op *Operation) finish(res int32, flags uint32, err error) {
+	op.res = res
+	op.flags = flags
+	op.err = err
+	if op.stop != nil {
+		op.stop()
+	}
+	releaseFd(op.keep)
+	if op.task != nil {
+		op.task.End()
+	}
+	close(op.done)
+	if op.chain != nil {
+		op.chain.stepDone()
+	}
+}
+
+// Done returns a channel that is closed once the operation completes.
+func (op *Operation) Done() <-chan struct{} {
+	return op.done
+}
+
+// Result waits for the operation to complete and returns its CQE result.
+// A negative result is also returned as an *OpError wrapping the
+// syscall.Errno; if the ring failed before the operation completed, err
+// is that failure. An operation of SubmitContext canceled because its
+// context is done returns the context's error.
+func (op *Operation) Result() (int32, error) {
+	<-op.done
+	if op.err != nil {
+		return 0, op.err
+	}
+	if op.ctx != nil && (op.res == -int32(syscall.ECANCELED) || op.res == -int32(syscall.EINTR)) {
+		if err := op.ctx.Err(); err != nil {
+			return op.res, err
+		}
+	}
+	return op.res, opError(op.opcode, op.sqeFlags, op.fd, op.userData, op.res)
+}
+
+// Flags waits for the operation to complete and returns its CQE flags,
+// e.g. to extract the buffer ID with BufferID.
+func (op *Operation) Flags() uint32 {
+	<-op.done
+	return op.flags
+}
+
+// Cancel requests cancellation of the operation (IORING_OP_ASYNC_CANCEL).
+// It does not wait: the operation still completes, usually with
+// -ECANCELED, or with its normal result if it finished first. Canceling
+// a completed operation is a no-op.
+func (op *Operation) Cancel() error {
+	e := op.e
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if cur, ok := e.ops.Lookup(op.userData); !ok || cur != op {
+		return nil
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	err := e.prepLocked(func() error {
+		return e.ring.PrepCancel(op.userData, 0, execCancelToken)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = e.ring.Submit()
+	return err
+}
+
+// eventQueue hands events, such as the CQEs of a request of submitEach,
+// from the Executor's reaper to the goroutines consuming them.
+type eventQueue[T any] struct {
+	mu    sync.Mutex // Taken by the reaper; never held while taking others
+	queue []T
+	ready chan struct{}
+}
+
+func newEventQueue[T any]() eventQueue[T] {
+	return eventQueue[T]{ready: make(chan struct{}, 1)}
+}
+
+// push queues an event. It does not block.
+func (q *eventQueue[T]) push(v T) {
+	q.mu.Lock()
+	q.queue = append(q.queue, v)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the oldest event until ctx is done.
+func (q *eventQueue[T]) next(ctx context.Context) (T, error) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) > 0 {
+			v := q.queue[0]
+			q.queue = q.queue[1:]
+			more := len(q.queue) > 0
+			q.mu.Unlock()
+			if more {
+				// Pass the wakeup on to another consumer
+				select {
+				case q.ready <- struct{}{}:
+				default:
+				}
+			}
+			return v, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// drain removes and returns the events queued.
+func (q *eventQueue[T]) drain() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	v := q.queue
+	q.queue = nil
+	return v
+}
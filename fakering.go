@@ -0,0 +1,541 @@
+package iouring
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// FakeOp is an operation submitted to a FakeRing.
+type FakeOp struct {
+	SQE       sys.SQE       // As prepared, with its OpOptions applied
+	Buf       []byte        // Buffer of a read, write, send or receive
+	Submitted time.Duration // Virtual time of submission
+
+	ts *Timespec // Of a timeout
+}
+
+// FakeResult is the outcome of a FakeOp, as chosen by a FakeRing's
+// handler.
+type FakeResult struct {
+	Res   int32         // CQE result; a negative errno fails the operation
+	Flags uint32        // CQE flags
+	Delay time.Duration // Virtual time from start to completion
+}
+
+// FakeRing is an in-memory Ringer for unit tests of code built on the
+// package. It performs no I/O: a handler function decides the result
+// and latency of each submitted operation, and may fill read buffers.
+// Time is virtual, so the same submissions always complete in the same
+// order and waits return at once with the clock moved forward. This
+// makes tests deterministic, fast, and runnable on any OS.
+//
+// The fake follows the kernel where that is cheap: linked SQEs start
+// when their predecessor completes and are canceled with ECANCELED if
+// it fails, WithCQESkip suppresses successful CQEs, timeouts complete
+// with ETIME once their duration has passed (count is ignored), and
+// PrepCancel cancels an operation still in flight by user data.
+// Operations the handler is not set up for complete at once: reads,
+// writes, sends and receives transfer their whole buffer, leaving read
+// buffers unchanged, and all others return 0.
+//
+// A wait that could only end with completions that will never come,
+// such as SubmitAndWait(1) with nothing in flight, returns
+// syscall.EDEADLK instead of blocking the test forever.
+type FakeRing struct {
+	mu       sync.Mutex
+	entries  uint32
+	handler  func(op *FakeOp) FakeResult
+	failures []error   // Returned by the next submits
+	replay   *Replayer // Recorded outcomes; nil if not replaying
+
+	sq       []FakeOp      // Prepared, not yet submitted
+	inflight []fakePending // Submitted, not yet completed
+	cq       []fakeCQE     // Completed, not yet seen
+	history  []FakeOp
+	now      time.Duration
+	seq      uint64
+	closed   bool
+}
+
+// fakePending is a submitted operation with its outcome decided.
+type fakePending struct {
+	cqe  fakeCQE
+	skip bool          // Post no CQE (IOSQE_CQE_SKIP_SUCCESS)
+	due  time.Duration // When it completes
+	seq  uint64        // Submission order, breaking ties of due
+}
+
+// fakeCQE is a completion in the fake CQ.
+type fakeCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// NewFakeRing creates a FakeRing with room for entries prepared SQEs,
+// rounded up to a power of two as the kernel does.
+func NewFakeRing(entries uint32) (*FakeRing, error) {
+	if entries == 0 || entries > 32768 {
+		return nil, syscall.EINVAL
+	}
+	n := uint32(1)
+	for n < entries {
+		n <<= 1
+	}
+	return &FakeRing{entries: n}, nil
+}
+
+// SetHandler makes h decide the outcome of submitted operations other
+// than timeouts and cancels. h runs with the fake locked, at submission
+// in submission order, and must not call the FakeRing. A nil h restores
+// the default outcomes.
+func (f *FakeRing) SetHandler(h func(op *FakeOp) FakeResult) {
+	f.mu.Lock()
+	f.handler = h
+	f.mu.Unlock()
+}
+
+// FailSubmit makes the next len(errs) calls that submit fail with the
+// given errors, one each, without consuming any SQE, as a failed
+// io_uring_enter would.
+func (f *FakeRing) FailSubmit(errs ...error) {
+	f.mu.Lock()
+	f.failures = append(f.failures, errs...)
+	f.mu.Unlock()
+}
+
+// Now returns the virtual time, which starts at zero.
+func (f *FakeRing) Now() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the virtual clock forward by d, completing the
+// operations that become due.
+func (f *FakeRing) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.now += d
+	f.collectLocked()
+	f.mu.Unlock()
+}
+
+// History returns the operations submitted so far, in order.
+func (f *FakeRing) History() []FakeOp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeOp(nil), f.history...)
+}
+
+// Inflight returns the number of submitted operations not yet complete.
+func (f *FakeRing) Inflight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.inflight)
+}
+
+// prep queues an SQE.
+func (f *FakeRing) prep(op FakeOp, opts []OpOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrRingClosed
+	}
+	if uint32(len(f.sq)) >= f.entries {
+		return ErrSQFull
+	}
+	for _, opt := range opts {
+		opt(&op.SQE)
+	}
+	f.sq = append(f.sq, op)
+	return nil
+}
+
+// prepBuf queues an SQE of opcode on fd's data buffer buf.
+func (f *FakeRing) prepBuf(opcode sys.Op, fd int, buf []byte, off uint64, opFlags uint32, userData uint64, opts []OpOption) error {
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
+	op := FakeOp{Buf: buf}
+	op.SQE.Opcode = uint8(opcode)
+	op.SQE.Fd = int32(fd)
+	if len(buf) > 0 {
+		op.SQE.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	}
+	op.SQE.Len = uint32(len(buf))
+	op.SQE.Off = off
+	op.SQE.OpFlags = opFlags
+	op.SQE.UserData = userData
+	return f.prep(op, opts)
+}
+
+// PrepNop prepares a NOP operation.
+func (f *FakeRing) PrepNop(userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{Opcode: uint8(sys.IORING_OP_NOP), Fd: -1, UserData: userData}}
+	return f.prep(op, opts)
+}
+
+// PrepRead prepares a read of buf from fd at offset.
+func (f *FakeRing) PrepRead(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error {
+	return f.prepBuf(sys.IORING_OP_READ, fd, buf, offset, 0, userData, opts)
+}
+
+// PrepWrite prepares a write of buf to fd at offset.
+func (f *FakeRing) PrepWrite(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error {
+	return f.prepBuf(sys.IORING_OP_WRITE, fd, buf, offset, 0, userData, opts)
+}
+
+// PrepFsync prepares an fsync of fd.
+func (f *FakeRing) PrepFsync(fd int, flags uint32, userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{Opcode: uint8(sys.IORING_OP_FSYNC), Fd: int32(fd), OpFlags: flags, UserData: userData}}
+	return f.prep(op, opts)
+}
+
+// PrepTimeout prepares a timeout of ts in virtual time. With
+// IORING_TIMEOUT_ABS in flags, ts is a virtual time rather than a
+// duration.
+func (f *FakeRing) PrepTimeout(ts *Timespec, count uint64, flags uint32, userData uint64, opts ...OpOption) error {
+	op := FakeOp{ts: ts}
+	op.SQE = sys.SQE{
+		Opcode:   uint8(sys.IORING_OP_TIMEOUT),
+		Fd:       -1,
+		Addr:     uint64(uintptr(unsafe.Pointer(ts))),
+		Len:      1,
+		Off:      count,
+		OpFlags:  flags,
+		UserData: userData,
+	}
+	return f.prep(op, opts)
+}
+
+// PrepCancel prepares the cancellation of the operation submitted with
+// targetUserData. flags are recorded but not interpreted.
+func (f *FakeRing) PrepCancel(targetUserData uint64, flags uint32, userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{
+		Opcode:   uint8(sys.IORING_OP_ASYNC_CANCEL),
+		Fd:       -1,
+		Addr:     targetUserData,
+		OpFlags:  flags,
+		UserData: userData,
+	}}
+	return f.prep(op, opts)
+}
+
+// PrepAccept prepares an accept on listening socket fd. addr and
+// addrLen are recorded but not written.
+func (f *FakeRing) PrepAccept(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{
+		Opcode:   uint8(sys.IORING_OP_ACCEPT),
+		Fd:       int32(fd),
+		Addr:     uint64(uintptr(addr)),
+		Off:      uint64(uintptr(unsafe.Pointer(addrLen))),
+		OpFlags:  flags,
+		UserData: userData,
+	}}
+	return f.prep(op, opts)
+}
+
+// PrepConnect prepares a connect of socket fd to addr.
+func (f *FakeRing) PrepConnect(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{
+		Opcode:   uint8(sys.IORING_OP_CONNECT),
+		Fd:       int32(fd),
+		Addr:     uint64(uintptr(addr)),
+		Off:      uint64(addrLen),
+		UserData: userData,
+	}}
+	return f.prep(op, opts)
+}
+
+// PrepSend prepares a send of buf on socket fd.
+func (f *FakeRing) PrepSend(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error {
+	return f.prepBuf(sys.IORING_OP_SEND, fd, buf, 0, uint32(flags), userData, opts)
+}
+
+// PrepRecv prepares a receive into buf from socket fd.
+func (f *FakeRing) PrepRecv(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error {
+	return f.prepBuf(sys.IORING_OP_RECV, fd, buf, 0, uint32(flags), userData, opts)
+}
+
+// PrepClose prepares a close of fd.
+func (f *FakeRing) PrepClose(fd int, userData uint64, opts ...OpOption) error {
+	op := FakeOp{SQE: sys.SQE{Opcode: uint8(sys.IORING_OP_CLOSE), Fd: int32(fd), UserData: userData}}
+	return f.prep(op, opts)
+}
+
+// Submit submits the prepared SQEs and returns how many there were.
+// Operations without delay complete at once.
+func (f *FakeRing) Submit() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.submitLocked()
+}
+
+// SubmitAndWait submits the prepared SQEs and waits for at least n
+// completions, advancing the virtual clock as far as needed.
+func (f *FakeRing) SubmitAndWait(n uint32) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	submitted, err := f.submitLocked()
+	if err != nil {
+		return 0, err
+	}
+	if !f.waitLocked(n, -1) {
+		return submitted, syscall.EDEADLK
+	}
+	return submitted, nil
+}
+
+// SubmitAndWaitTimeout is SubmitAndWait, advancing the virtual clock by
+// at most timeout. If nothing was submitted and fewer than n operations
+// completed in time, it returns syscall.ETIME (ETIMEDOUT where there
+// is no ETIME).
+func (f *FakeRing) SubmitAndWaitTimeout(n uint32, timeout time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	submitted, err := f.submitLocked()
+	if err != nil {
+		return 0, err
+	}
+	if !f.waitLocked(n, timeout) && submitted == 0 {
+		return 0, fakeETIME
+	}
+	return submitted, nil
+}
+
+// SQSpace returns the number of SQEs that can still be prepared.
+func (f *FakeRing) SQSpace() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.entries - uint32(len(f.sq))
+}
+
+// CQReady returns the number of completions not yet seen.
+func (f *FakeRing) CQReady() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint32(len(f.cq))
+}
+
+// PeekCQE returns the oldest completion without consuming it.
+func (f *FakeRing) PeekCQE() (userData uint64, res int32, flags uint32, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cq) == 0 {
+		return 0, 0, 0, false
+	}
+	c := f.cq[0]
+	return c.userData, c.res, c.flags, true
+}
+
+// WaitCQE returns the oldest completion, submitting and waiting for one
+// if there is none. Call SeenCQE after processing it.
+func (f *FakeRing) WaitCQE() (userData uint64, res int32, flags uint32, err error) {
+	if userData, res, flags, ok := f.PeekCQE(); ok {
+		return userData, res, flags, nil
+	}
+	if _, err := f.SubmitAndWait(1); err != nil {
+		return 0, 0, 0, err
+	}
+	userData, res, flags, _ = f.PeekCQE()
+	return userData, res, flags, nil
+}
+
+// WaitCQETimeout is WaitCQE, advancing the virtual clock by at most
+// timeout; it returns syscall.ETIME, as SubmitAndWaitTimeout does, if
+// no completion arrives.
+func (f *FakeRing) WaitCQETimeout(timeout time.Duration) (userData uint64, res int32, flags uint32, err error) {
+	if userData, res, flags, ok := f.PeekCQE(); ok {
+		return userData, res, flags, nil
+	}
+	f.mu.Lock()
+	_, err = f.submitLocked()
+	if err == nil && !f.waitLocked(1, timeout) {
+		err = fakeETIME
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	userData, res, flags, _ = f.PeekCQE()
+	return userData, res, flags, nil
+}
+
+// SeenCQE consumes the oldest completion.
+func (f *FakeRing) SeenCQE() {
+	f.mu.Lock()
+	if len(f.cq) > 0 {
+		f.cq = f.cq[1:]
+	}
+	f.mu.Unlock()
+}
+
+// ForEachCQE calls fn on each completion, consuming it, until fn returns
+// false or none are left, and returns how many were consumed. fn may
+// call the FakeRing, e.g. to prepare further operations.
+func (f *FakeRing) ForEachCQE(fn func(userData uint64, res int32, flags uint32) bool) int {
+	count := 0
+	for {
+		userData, res, flags, ok := f.PeekCQE()
+		if !ok || !fn(userData, res, flags) {
+			return count
+		}
+		f.SeenCQE()
+		count++
+	}
+}
+
+// Close closes the fake. Operations in flight are dropped.
+func (f *FakeRing) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.inflight = nil
+	f.mu.Unlock()
+	return nil
+}
+
+// submitLocked moves the prepared SQEs in flight, deciding their
+// outcomes. Caller must hold f.mu.
+func (f *FakeRing) submitLocked() (int, error) {
+	if f.closed {
+		return 0, ErrRingClosed
+	}
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return 0, err
+	}
+
+	var (
+		linked  bool          // The previous SQE links to this one
+		failed  bool          // and its failure cancels this one
+		prevDue time.Duration // and this one starts when it completes
+	)
+	for i := range f.sq {
+		op := &f.sq[i]
+		op.Submitted = f.now
+		f.history = append(f.history, *op)
+		if f.replay != nil && f.replayLocked(op) {
+			linked = false
+			continue
+		}
+
+		p := fakePending{cqe: fakeCQE{userData: op.SQE.UserData}, seq: f.seq}
+		f.seq++
+		start := f.now
+		if linked {
+			start = prevDue
+		}
+		switch {
+		case linked && failed:
+			p.cqe.res = -int32(syscall.ECANCELED)
+			p.due = start
+		case op.SQE.Opcode == uint8(sys.IORING_OP_TIMEOUT):
+			p.cqe.res, p.due = f.timeout(op, start)
+		case op.SQE.Opcode == uint8(sys.IORING_OP_ASYNC_CANCEL):
+			p.cqe.res = f.cancelLocked(op.SQE.Addr, start)
+			p.due = start
+		default:
+			res := f.handle(op)
+			p.cqe.res, p.cqe.flags = res.Res, res.Flags
+			p.due = start + max(res.Delay, 0)
+		}
+		p.skip = op.SQE.Flags&sys.IOSQE_CQE_SKIP_SUCCESS != 0 && p.cqe.res >= 0
+		f.inflight = append(f.inflight, p)
+
+		linked = op.SQE.Flags&(sys.IOSQE_IO_LINK|sys.IOSQE_IO_HARDLINK) != 0
+		failed = p.cqe.res < 0 && op.SQE.Flags&sys.IOSQE_IO_HARDLINK == 0
+		prevDue = p.due
+	}
+	n := len(f.sq)
+	f.sq = f.sq[:0]
+	f.collectLocked()
+	return n, nil
+}
+
+// handle decides the outcome of op with the handler or the defaults.
+func (f *FakeRing) handle(op *FakeOp) FakeResult {
+	if f.handler != nil {
+		return f.handler(op)
+	}
+	switch sys.Op(op.SQE.Opcode) {
+	case sys.IORING_OP_READ, sys.IORING_OP_WRITE, sys.IORING_OP_SEND, sys.IORING_OP_RECV:
+		return FakeResult{Res: int32(len(op.Buf))}
+	}
+	return FakeResult{}
+}
+
+// timeout returns the result and completion time of a timeout started
+// at start.
+func (f *FakeRing) timeout(op *FakeOp, start time.Duration) (int32, time.Duration) {
+	d := time.Duration(op.ts.Sec)*time.Second + time.Duration(op.ts.Nsec)
+	due := start + d
+	if op.SQE.OpFlags&sys.IORING_TIMEOUT_ABS != 0 {
+		due = max(d, start)
+	}
+	if op.SQE.OpFlags&sys.IORING_TIMEOUT_ETIME_SUCCESS != 0 {
+		return 0, due
+	}
+	return -int32(fakeETIME), due
+}
+
+// cancelLocked cancels the operation in flight with userData at time
+// now, returning the result of the cancel. Caller must hold f.mu.
+func (f *FakeRing) cancelLocked(userData uint64, now time.Duration) int32 {
+	for i := range f.inflight {
+		p := &f.inflight[i]
+		if p.cqe.userData == userData && p.due > now {
+			p.cqe.res = -int32(syscall.ECANCELED)
+			p.cqe.flags = 0
+			p.skip = false
+			p.due = now
+			return 0
+		}
+	}
+	return -int32(syscall.ENOENT)
+}
+
+// collectLocked posts the completions of the operations due by now.
+// Caller must hold f.mu.
+func (f *FakeRing) collectLocked() {
+	sort.SliceStable(f.inflight, func(i, j int) bool {
+		a, b := f.inflight[i], f.inflight[j]
+		return a.due < b.due || a.due == b.due && a.seq < b.seq
+	})
+	i := 0
+	for ; i < len(f.inflight) && f.inflight[i].due <= f.now; i++ {
+		if !f.inflight[i].skip {
+			f.cq = append(f.cq, f.inflight[i].cqe)
+		}
+	}
+	f.inflight = append(f.inflight[:0], f.inflight[i:]...)
+}
+
+// waitLocked advances the virtual clock until n completions are ready,
+// by at most timeout if it is not negative, and reports whether they
+// are. Caller must hold f.mu.
+func (f *FakeRing) waitLocked(n uint32, timeout time.Duration) bool {
+	deadline := f.now + timeout
+	for uint32(len(f.cq)) < n {
+		if len(f.inflight) == 0 {
+			if timeout >= 0 {
+				f.now = deadline
+			}
+			return false
+		}
+		next := f.inflight[0].due // Sorted by collectLocked
+		if timeout >= 0 && next > deadline {
+			f.now = deadline
+			f.collectLocked()
+			return false
+		}
+		f.now = next
+		f.collectLocked()
+	}
+	return true
+}
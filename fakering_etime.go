@@ -0,0 +1,8 @@
+//go:build !(freebsd || openbsd || dragonfly || wasip1)
+
+package iouring
+
+import "syscall"
+
+// fakeETIME is the error of a FakeRing wait that timed out.
+const fakeETIME = syscall.ETIME
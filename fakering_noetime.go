@@ -0,0 +1,9 @@
+//go:build freebsd || openbsd || dragonfly || wasip1
+
+package iouring
+
+import "syscall"
+
+// fakeETIME is the error of a FakeRing wait that timed out. There is no
+// ETIME here, so it is the closest errno.
+const fakeETIME = syscall.ETIMEDOUT
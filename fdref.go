@@ -0,0 +1,133 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"syscall"
+)
+
+// FdRef is a reference to the descriptor of an *os.File, net.Conn or
+// other syscall.Conn, taken through its syscall.RawConn. While the
+// reference is held the runtime keeps the descriptor open: Close on the
+// file or connection waits for Release, and the object cannot be
+// collected and finalized. Prefer it to calling Fd, which switches the
+// descriptor to blocking mode and lets the garbage collector close it
+// under an operation still in flight.
+//
+// Holding a reference parks a goroutine inside RawConn.Control, so it
+// suits operations on descriptors the runtime owns rather than hot
+// paths on descriptors the caller manages.
+type FdRef struct {
+	fd      int
+	err     error
+	held    chan struct{} // Closed once fd or err is set
+	release chan struct{}
+	once    sync.Once
+}
+
+// HoldFd takes a reference to the descriptor of c. It fails if c is
+// already closed.
+func HoldFd(c syscall.Conn) (*FdRef, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ref := &FdRef{fd: -1, held: make(chan struct{}), release: make(chan struct{})}
+	go func() {
+		err := rc.Control(func(fd uintptr) {
+			ref.fd = int(fd)
+			close(ref.held)
+			<-ref.release
+		})
+		if ref.fd < 0 {
+			ref.err = err
+			close(ref.held)
+		}
+	}()
+	<-ref.held
+	if ref.fd < 0 {
+		return nil, ref.err
+	}
+	return ref, nil
+}
+
+// Fd returns the descriptor, valid until Release.
+func (ref *FdRef) Fd() int {
+	return ref.fd
+}
+
+// Release drops the reference. Call it once the operations using the
+// descriptor have completed. Release may be called more than once.
+func (ref *FdRef) Release() {
+	ref.once.Do(func() { close(ref.release) })
+}
+
+// PrepConn prepares an operation on the descriptor of c, e.g. an
+// *os.File or *net.TCPConn: prep is called with the descriptor and must
+// queue the SQEs. The returned reference keeps the descriptor open; the
+// caller releases it after reaping the operation's CQE. If prep fails,
+// nothing stays held.
+func (r *Ring) PrepConn(c syscall.Conn, prep func(fd int) error) (*FdRef, error) {
+	ref, err := HoldFd(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := prep(ref.fd); err != nil {
+		ref.Release()
+		return nil, err
+	}
+	return ref, nil
+}
+
+// PrepReadConn is PrepRead on the descriptor of c; see PrepConn.
+func (r *Ring) PrepReadConn(c syscall.Conn, buf []byte, offset uint64, userData uint64, opts ...OpOption) (*FdRef, error) {
+	return r.PrepConn(c, func(fd int) error {
+		return r.PrepRead(fd, buf, offset, userData, opts...)
+	})
+}
+
+// PrepWriteConn is PrepWrite on the descriptor of c; see PrepConn.
+func (r *Ring) PrepWriteConn(c syscall.Conn, buf []byte, offset uint64, userData uint64, opts ...OpOption) (*FdRef, error) {
+	return r.PrepConn(c, func(fd int) error {
+		return r.PrepWrite(fd, buf, offset, userData, opts...)
+	})
+}
+
+// PrepRecvConn is PrepRecv on the socket of c; see PrepConn.
+func (r *Ring) PrepRecvConn(c syscall.Conn, buf []byte, flags int, userData uint64, opts ...OpOption) (*FdRef, error) {
+	return r.PrepConn(c, func(fd int) error {
+		return r.PrepRecv(fd, buf, flags, userData, opts...)
+	})
+}
+
+// PrepSendConn is PrepSend on the socket of c; see PrepConn.
+func (r *Ring) PrepSendConn(c syscall.Conn, buf []byte, flags int, userData uint64, opts ...OpOption) (*FdRef, error) {
+	return r.PrepConn(c, func(fd int) error {
+		return r.PrepSend(fd, buf, flags, userData, opts...)
+	})
+}
+
+// SubmitConn is Submit for an operation on the descriptor of c, such as
+// an *os.File or net.Conn: prep queues the SQEs for the descriptor, which
+// stays open until the operation is done, e.g.
+//
+//	op, err := e.SubmitConn(f, func(fd int, ud uint64) error {
+//		return ring.PrepRead(fd, buf, 0, ud)
+//	})
+func (e *Executor) SubmitConn(c syscall.Conn, prep func(fd int, userData uint64) error) (*Operation, error) {
+	ref, err := HoldFd(c)
+	if err != nil {
+		return nil, err
+	}
+	// The operation releases ref when it finishes, or submit does if
+	// nothing was queued
+	return e.submit(func(ud uint64) error { return prep(ref.fd, ud) }, ref)
+}
+
+// releaseFd releases keep if it is the descriptor of a SubmitConn.
+func releaseFd(keep any) {
+	if ref, ok := keep.(*FdRef); ok {
+		ref.Release()
+	}
+}
@@ -0,0 +1,268 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// File is an open file whose I/O runs on an Executor's ring. Each method
+// has a blocking form that waits for the result and an Async form that
+// returns the in-flight Operation. Methods are safe for concurrent use.
+//
+// Deadlines bound the blocking reads and writes, as for a Conn, which
+// matters for files that can block, such as pipes, FIFOs and terminals.
+type File struct {
+	e      *Executor
+	fd     int
+	name   string
+	closed atomic.Bool
+
+	deadlines // Of the blocking reads and writes in flight
+}
+
+// OpenFile opens the named file through IORING_OP_OPENAT on e, with the
+// same flag and perm semantics as os.OpenFile. The descriptor is opened
+// with O_CLOEXEC.
+func OpenFile(e *Executor, name string, flag int, perm os.FileMode) (*File, error) {
+	path, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := e.Submit(func(ud uint64) error {
+		return e.ring.PrepOpenat(sys.AT_FDCWD, path, flag|syscall.O_CLOEXEC, uint32(perm.Perm()), ud)
+	})
+	if err != nil {
+		return nil, err
+	}
+	fd, err := op.Result()
+	runtime.KeepAlive(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &File{e: e, fd: int(fd), name: name}, nil
+}
+
+// NewFile wraps an already open descriptor. The File takes ownership of
+// fd and closes it on Close.
+func NewFile(e *Executor, fd int, name string) *File {
+	return &File{e: e, fd: fd, name: name}
+}
+
+// Fd returns the file descriptor.
+func (f *File) Fd() int {
+	return f.fd
+}
+
+// Name returns the name the file was opened with.
+func (f *File) Name() string {
+	return f.name
+}
+
+// ReadAt reads len(b) bytes at offset off, issuing further reads after a
+// short one. Like io.ReaderAt it returns io.EOF if the file ends first.
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	return f.ReadAtContext(context.Background(), b, off)
+}
+
+// ReadAtContext is ReadAt, canceling the read in flight and returning
+// ctx.Err() once ctx is done. Past the read deadline it fails with
+// os.ErrDeadlineExceeded.
+func (f *File) ReadAtContext(ctx context.Context, b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One read moves at most MaxIOSize
+		if err := f.checkIO(p, off+int64(n)); err != nil {
+			return n, err
+		}
+		res, err := f.do(ctx, ioRead, func(ud uint64, opts ...OpOption) error {
+			return f.e.ring.PrepRead(f.fd, p, uint64(off+int64(n)), ud, opts...)
+		}, b)
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// ReadAtAsync issues a single read of up to len(b) bytes at offset off.
+// The operation's result is the number of bytes read, which may be
+// short; zero means end of file. b must not be empty.
+func (f *File) ReadAtAsync(b []byte, off int64) (*Operation, error) {
+	if err := f.checkIO(b, off); err != nil {
+		return nil, err
+	}
+	return f.read(b, uint64(off))
+}
+
+// read issues a read at off, which may be curPosOffset.
+func (f *File) read(b []byte, off uint64) (*Operation, error) {
+	return f.e.submit(func(ud uint64) error {
+		return f.e.ring.PrepRead(f.fd, b, off, ud)
+	}, b)
+}
+
+// WriteAt writes len(b) bytes at offset off, issuing further writes
+// after a short one.
+func (f *File) WriteAt(b []byte, off int64) (int, error) {
+	return f.WriteAtContext(context.Background(), b, off)
+}
+
+// WriteAtContext is WriteAt, canceling the write in flight and
+// returning ctx.Err() once ctx is done. Past the write deadline it fails
+// with os.ErrDeadlineExceeded.
+func (f *File) WriteAtContext(ctx context.Context, b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One write moves at most MaxIOSize
+		if err := f.checkIO(p, off+int64(n)); err != nil {
+			return n, err
+		}
+		res, err := f.do(ctx, ioWrite, func(ud uint64, opts ...OpOption) error {
+			return f.e.ring.PrepWrite(f.fd, p, uint64(off+int64(n)), ud, opts...)
+		}, b)
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// do runs one operation bound to ctx and subject to the deadline of
+// kind, and waits for it.
+func (f *File) do(ctx context.Context, kind ioKind, prep func(ud uint64, opts ...OpOption) error, keep any) (int32, error) {
+	op, err := f.start(ctx, f.e, kind, prep, keep)
+	if err != nil {
+		return 0, err
+	}
+	res, err := op.Result()
+	f.untrack(op)
+	if err != nil {
+		return 0, deadlineError(err, f.deadline(kind))
+	}
+	return res, nil
+}
+
+// WriteAtAsync issues a single write of up to len(b) bytes at offset
+// off. The operation's result is the number of bytes written, which may
+// be short. b must not be empty.
+func (f *File) WriteAtAsync(b []byte, off int64) (*Operation, error) {
+	if err := f.checkIO(b, off); err != nil {
+		return nil, err
+	}
+	return f.write(b, uint64(off))
+}
+
+// write issues a write at off, which may be curPosOffset.
+func (f *File) write(b []byte, off uint64) (*Operation, error) {
+	return f.e.submit(func(ud uint64) error {
+		return f.e.ring.PrepWrite(f.fd, b, off, ud)
+	}, b)
+}
+
+// Sync commits the file's contents to stable storage (fsync).
+func (f *File) Sync() error {
+	op, err := f.SyncAsync()
+	if err != nil {
+		return err
+	}
+	_, err = op.Result()
+	return err
+}
+
+// SyncAsync issues an fsync of the file.
+func (f *File) SyncAsync() (*Operation, error) {
+	if f.closed.Load() {
+		return nil, os.ErrClosed
+	}
+	return f.e.Submit(func(ud uint64) error {
+		return f.e.ring.PrepFsync(f.fd, 0, ud)
+	})
+}
+
+// Close closes the file descriptor through IORING_OP_CLOSE. Operations
+// still in flight are not canceled. Closing twice returns os.ErrClosed.
+func (f *File) Close() error {
+	op, err := f.CloseAsync()
+	if err != nil {
+		return err
+	}
+	_, err = op.Result()
+	return err
+}
+
+// CloseAsync issues the close of the file descriptor.
+func (f *File) CloseAsync() (*Operation, error) {
+	if !f.closed.CompareAndSwap(false, true) {
+		return nil, os.ErrClosed
+	}
+	return f.e.Submit(func(ud uint64) error {
+		return f.e.ring.PrepClose(f.fd, ud)
+	})
+}
+
+// SetDeadline sets the read and write deadlines, as for a net.Conn: a
+// blocking read or write past its deadline, including one in flight,
+// fails with os.ErrDeadlineExceeded. A zero t means no deadline. The
+// Async methods have no deadline.
+func (f *File) SetDeadline(t time.Time) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	f.set(true, true, t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of ReadAt and ReadAtContext.
+func (f *File) SetReadDeadline(t time.Time) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	f.set(true, false, t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of WriteAt and WriteAtContext.
+func (f *File) SetWriteDeadline(t time.Time) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	f.set(false, true, t)
+	return nil
+}
+
+// checkIO validates the arguments of a read or write.
+func (f *File) checkIO(b []byte, off int64) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	if len(b) == 0 || off < 0 {
+		return syscall.EINVAL
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+var (
+	_ io.ReaderAt = (*File)(nil)
+	_ io.WriterAt = (*File)(nil)
+	_ io.Closer   = (*File)(nil)
+	_ io.ReaderAt = (*FileIO)(nil)
+	_ io.WriterAt = (*FileIO)(nil)
+	_ io.Closer   = (*FileIO)(nil)
+)
+
+// fileIOTokenBit marks the userData of requests issued by FileIO.
+const fileIOTokenBit = 1 << 62
+
+// fileIOTokens numbers FileIO requests across all rings.
+var fileIOTokens atomic.Uint64
+
+// FileIO adapts a file descriptor to io.ReaderAt, io.WriterAt and
+// io.Closer by issuing positional reads and writes on a Ring, so
+// existing libraries such as archive/zip do their I/O through io_uring.
+// Each call submits its request and waits for it with WaitFor, which
+// makes FileIO safe for concurrent use and lets it share the ring with
+// other WaitFor callers. userData values with bit 62 set are reserved
+// for its requests.
+//
+// For rings driven by an Executor, use File instead.
+type FileIO struct {
+	ring   *Ring
+	fd     int
+	closed atomic.Bool
+}
+
+// NewFileIO returns an adapter for fd on ring. It takes ownership of fd
+// and closes it on Close.
+func NewFileIO(ring *Ring, fd int) *FileIO {
+	return &FileIO{ring: ring, fd: fd}
+}
+
+// Fd returns the file descriptor.
+func (a *FileIO) Fd() int {
+	return a.fd
+}
+
+// ReadAt reads len(b) bytes at offset off, issuing further reads after a
+// short one, and returns io.EOF if the file ends first.
+func (a *FileIO) ReadAt(b []byte, off int64) (int, error) {
+	if a.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One read moves at most MaxIOSize
+		res, err := a.do(sys.IORING_OP_READ, func(ud uint64) error {
+			return a.ring.PrepRead(a.fd, p, uint64(off)+uint64(n), ud)
+		})
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// WriteAt writes len(b) bytes at offset off, issuing further writes
+// after a short one.
+func (a *FileIO) WriteAt(b []byte, off int64) (int, error) {
+	if a.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One write moves at most MaxIOSize
+		res, err := a.do(sys.IORING_OP_WRITE, func(ud uint64) error {
+			return a.ring.PrepWrite(a.fd, p, uint64(off)+uint64(n), ud)
+		})
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// Close closes the file descriptor through IORING_OP_CLOSE. Closing
+// twice returns os.ErrClosed.
+func (a *FileIO) Close() error {
+	if !a.closed.CompareAndSwap(false, true) {
+		return os.ErrClosed
+	}
+	_, err := a.do(sys.IORING_OP_CLOSE, func(ud uint64) error {
+		return a.ring.PrepClose(a.fd, ud)
+	})
+	return err
+}
+
+// do queues one request with prep, submits it and waits for its result.
+func (a *FileIO) do(opcode sys.Op, prep func(userData uint64) error) (int32, error) {
+	ud := fileIOTokenBit | fileIOTokens.Add(1)&(fileIOTokenBit-1)
+
+	err := prep(ud)
+	if err == ErrSQFull {
+		if _, err := a.ring.Submit(); err != nil {
+			return 0, err
+		}
+		err = prep(ud)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := a.ring.Submit(); err != nil {
+		return 0, err
+	}
+
+	cqe, err := a.ring.WaitFor(ud, 0)
+	if err != nil {
+		return 0, err
+	}
+	return cqe.Res, opError(uint8(opcode), 0, int32(a.fd), ud, cqe.Res)
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// FileTable manages a sparse registered file table (5.19+): it hands
+// out slots, installs descriptors in them and remembers which
+// descriptor occupies which slot, so code can adopt IOSQE_FIXED_FILE
+// without keeping its own index bookkeeping, e.g.
+//
+//	if _, err := files.Register(fd); err != nil { ... }
+//	ring.PrepRecv(fd, buf, 0, ud, files.UseFixed(fd))
+//
+// The FileTable assumes it owns the whole table: slots filled by the
+// kernel with FileIndexAlloc, or by RegisterFilesUpdate directly, are
+// not tracked and may be handed out again.
+//
+// A FileTable is safe for concurrent use.
+type FileTable struct {
+	ring *Ring
+
+	mu    sync.Mutex
+	slots []int         // Descriptor in each slot; -1 if free
+	free  []uint32      // Free slots, lowest last
+	byFd  map[int]int32 // Slot of each registered descriptor
+}
+
+// NewFileTable registers a sparse file table of n slots on ring and
+// returns its manager. The ring must not have a file table yet.
+func NewFileTable(ring *Ring, n uint32) (*FileTable, error) {
+	if err := ring.RegisterFilesSparse(n); err != nil {
+		return nil, err
+	}
+	t := &FileTable{
+		ring:  ring,
+		slots: make([]int, n),
+		free:  make([]uint32, n),
+		byFd:  make(map[int]int32),
+	}
+	for i := range t.slots {
+		t.slots[i] = -1
+		t.free[i] = n - 1 - uint32(i)
+	}
+	return t, nil
+}
+
+// Register installs fd in the lowest free slot and returns the slot.
+// It returns ENFILE if the table is full and EEXIST if fd already has a
+// slot. The table holds its own reference to the file, but fd should
+// stay open until Unregister, as the mapping is by descriptor number.
+func (t *FileTable) Register(fd int) (int, error) {
+	if fd < 0 {
+		return 0, syscall.EBADF
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.byFd[fd]; ok {
+		return 0, syscall.EEXIST
+	}
+	n := len(t.free)
+	if n == 0 {
+		return 0, syscall.ENFILE
+	}
+	slot := t.free[n-1]
+	if _, err := t.ring.RegisterFilesUpdate(slot, []int{fd}); err != nil {
+		return 0, err
+	}
+	t.free = t.free[:n-1]
+	t.slots[slot] = fd
+	t.byFd[fd] = int32(slot)
+	return int(slot), nil
+}
+
+// Unregister clears slot and makes it available again. Requests already
+// submitted against the slot keep the file until they complete. It
+// returns EINVAL if the slot is out of range or free.
+func (t *FileTable) Unregister(slot int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if slot < 0 || slot >= len(t.slots) || t.slots[slot] < 0 {
+		return syscall.EINVAL
+	}
+	if _, err := t.ring.RegisterFilesUpdate(uint32(slot), []int{-1}); err != nil {
+		return err
+	}
+	delete(t.byFd, t.slots[slot])
+	t.slots[slot] = -1
+	t.free = append(t.free, uint32(slot))
+	// Keep handing out the lowest slots, which keeps the used part of
+	// the table dense
+	for i := len(t.free) - 1; i > 0 && t.free[i] > t.free[i-1]; i-- {
+		t.free[i], t.free[i-1] = t.free[i-1], t.free[i]
+	}
+	return nil
+}
+
+// UnregisterFd is Unregister for the slot holding fd.
+func (t *FileTable) UnregisterFd(fd int) error {
+	slot, ok := t.Slot(fd)
+	if !ok {
+		return syscall.EINVAL
+	}
+	return t.Unregister(slot)
+}
+
+// Slot returns the slot holding fd.
+func (t *FileTable) Slot(fd int) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot, ok := t.byFd[fd]
+	return int(slot), ok
+}
+
+// Fd returns the descriptor in slot.
+func (t *FileTable) Fd(slot int) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if slot < 0 || slot >= len(t.slots) || t.slots[slot] < 0 {
+		return -1, false
+	}
+	return t.slots[slot], true
+}
+
+// UseFixed returns the option that targets fd's slot with WithFixedFile,
+// or an option that leaves the SQE alone if fd has no slot, so Prep
+// calls can pass it unconditionally and fall back to the plain fd.
+func (t *FileTable) UseFixed(fd int) OpOption {
+	if slot, ok := t.Slot(fd); ok {
+		return WithFixedFile(slot)
+	}
+	return func(*sys.SQE) {}
+}
+
+// Len returns the number of slots in use.
+func (t *FileTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.slots) - len(t.free)
+}
+
+// Cap returns the number of slots in the table.
+func (t *FileTable) Cap() int {
+	return len(t.slots)
+}
@@ -0,0 +1,349 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// FS is a read-only file system of the tree below a directory, like
+// os.DirFS, whose opens, stats and reads run on an Executor's ring. It
+// implements fs.FS, fs.StatFS and fs.ReadFileFS, and its files
+// implement io.ReaderAt, io.Seeker and fs.ReadDirFile, so it can back
+// http.FS or template parsing unchanged.
+//
+// Names are resolved with openat2 and RESOLVE_BENEATH against the root
+// directory opened by NewFS: neither ".." nor symlinks can leave the
+// tree, and renaming the root does not move the FS. Opens need Linux
+// 5.6 or later.
+type FS struct {
+	e      *Executor
+	root   string
+	rootFd int
+}
+
+// NewFS opens root as the root of an FS on e. Close the FS to release
+// the root directory.
+func NewFS(e *Executor, root string) (*FS, error) {
+	fd, err := syscall.Open(root, sys.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: root, Err: err}
+	}
+	return &FS{e: e, root: root, rootFd: fd}, nil
+}
+
+// Close releases the root directory. Files already open stay usable.
+func (fsys *FS) Close() error {
+	return syscall.Close(fsys.rootFd)
+}
+
+// Open implements fs.FS.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	fd, err := fsys.open(name, syscall.O_RDONLY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{f: NewFile(fsys.e, fd, name), name: name}, nil
+}
+
+// Stat implements fs.StatFS, not following a final symlink out of the
+// tree any more than Open does.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	fd, err := fsys.open(name, sys.O_PATH)
+	if err == nil {
+		var st Statx
+		st, err = statFd(fsys.e, fd)
+		NewFile(fsys.e, fd, name).Close()
+		if err == nil {
+			return &statxInfo{name: path.Base(name), st: st}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+}
+
+// ReadFile implements fs.ReadFileFS: it opens, sizes and reads the file
+// with one read when the size is right.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	fd, err := fsys.open(name, syscall.O_RDONLY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := NewFile(fsys.e, fd, name)
+	defer f.Close()
+
+	size := 512
+	if st, err := statFd(fsys.e, fd); err == nil && st.Size > 0 {
+		size = int(st.Size) + 1 // One more to see the end in the same read
+	}
+	data := make([]byte, 0, size)
+	for {
+		n, err := f.ReadAt(data[len(data):cap(data)], int64(len(data)))
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+		data = append(data, 0)[:len(data)] // Grow
+	}
+}
+
+// open opens name below the root through IORING_OP_OPENAT2.
+func (fsys *FS) open(name string, flags int) (int, error) {
+	if !fs.ValidPath(name) {
+		return -1, fs.ErrInvalid
+	}
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return -1, fs.ErrInvalid
+	}
+	how := &OpenHow{
+		Flags:   uint64(flags | syscall.O_CLOEXEC),
+		Resolve: sys.RESOLVE_BENEATH | sys.RESOLVE_NO_MAGICLINKS,
+	}
+	op, err := fsys.e.Submit(func(ud uint64) error {
+		return fsys.e.ring.PrepOpenat2(fsys.rootFd, p, how, ud)
+	})
+	if err != nil {
+		return -1, err
+	}
+	fd, err := op.Result()
+	runtime.KeepAlive(p)
+	runtime.KeepAlive(how)
+	if err != nil {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// statFd states fd itself through IORING_OP_STATX.
+func statFd(e *Executor, fd int) (Statx, error) {
+	var st Statx
+	empty := new(byte) // ""
+	op, err := e.Submit(func(ud uint64) error {
+		return e.ring.PrepStatx(fd, empty, sys.AT_EMPTY_PATH, int(sys.STATX_BASIC_STATS), unsafe.Pointer(&st), ud)
+	})
+	if err != nil {
+		return st, err
+	}
+	_, err = op.Result()
+	runtime.KeepAlive(empty)
+	return st, err
+}
+
+// fsFile is a file opened by an FS.
+type fsFile struct {
+	f    *File
+	name string
+
+	mu   sync.Mutex
+	off  int64    // Read and Seek position
+	dir  []string // Entries not yet returned by ReadDir
+	eod  bool     // All entries were read from the directory
+	dbuf []byte
+}
+
+// Stat implements fs.File.
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	st, err := statFd(f.f.e, f.f.fd)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	return &statxInfo{name: path.Base(f.name), st: st}, nil
+}
+
+// Read implements fs.File, reading at the current position.
+func (f *fsFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.ReadAt(b, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // Reported by the next Read
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *fsFile) ReadAt(b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := f.f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		st, err := statFd(f.f.e, f.f.fd)
+		if err != nil {
+			return 0, &fs.PathError{Op: "seek", Path: f.name, Err: err}
+		}
+		offset += int64(st.Size)
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// ReadDir implements fs.ReadDirFile. Entries come in directory order and
+// are stated together, with one statx each on the ring.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for !f.eod && (n <= 0 || len(f.dir) < n) {
+		if f.dbuf == nil {
+			f.dbuf = make([]byte, walkDirentBuf)
+		}
+		k, err := syscall.ReadDirent(f.f.fd, f.dbuf)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		if k <= 0 {
+			f.eod = true
+			break
+		}
+		_, _, f.dir = syscall.ParseDirent(f.dbuf[:k], -1, f.dir)
+	}
+
+	names := f.dir
+	if n > 0 && len(names) > n {
+		names = names[:n]
+	}
+	f.dir = f.dir[len(names):]
+	if len(names) == 0 {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return []fs.DirEntry{}, nil
+	}
+	return f.statEntries(names)
+}
+
+// statEntries states names in the directory, all in flight at once.
+// Entries removed meanwhile are left out.
+func (f *fsFile) statEntries(names []string) ([]fs.DirEntry, error) {
+	e := f.f.e
+	type entry struct {
+		path *byte
+		st   Statx
+		op   *Operation
+	}
+	ents := make([]entry, len(names))
+	var err error
+	for i, name := range names {
+		ent := &ents[i]
+		if ent.path, err = syscall.BytePtrFromString(name); err != nil {
+			break
+		}
+		ent.op, err = e.Submit(func(ud uint64) error {
+			return e.ring.PrepStatx(f.f.fd, ent.path, sys.AT_SYMLINK_NOFOLLOW, int(sys.STATX_BASIC_STATS), unsafe.Pointer(&ent.st), ud)
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	list := make([]fs.DirEntry, 0, len(names))
+	for i := range ents {
+		ent := &ents[i]
+		if ent.op == nil {
+			continue
+		}
+		_, serr := ent.op.Result()
+		switch {
+		case serr == nil:
+			list = append(list, &statxInfo{name: names[i], st: ent.st})
+		case err == nil && !errors.Is(serr, syscall.ENOENT):
+			err = serr
+		}
+	}
+	runtime.KeepAlive(ents)
+	if err != nil {
+		return list, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+	}
+	return list, nil
+}
+
+// Close implements fs.File.
+func (f *fsFile) Close() error {
+	if err := f.f.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// statxInfo is the fs.FileInfo and fs.DirEntry of a statx result.
+type statxInfo struct {
+	name string
+	st   Statx
+}
+
+func (fi *statxInfo) Name() string               { return fi.name }
+func (fi *statxInfo) Size() int64                { return int64(fi.st.Size) }
+func (fi *statxInfo) IsDir() bool                { return fi.Mode().IsDir() }
+func (fi *statxInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi *statxInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// Sys returns the *Statx.
+func (fi *statxInfo) Sys() any { return &fi.st }
+
+func (fi *statxInfo) ModTime() time.Time {
+	return time.Unix(fi.st.Mtime.Sec, int64(fi.st.Mtime.Nsec))
+}
+
+// Mode converts the statx mode as os.Stat does.
+func (fi *statxInfo) Mode() fs.FileMode {
+	m := uint32(fi.st.Mode)
+	mode := fs.FileMode(m & 0o777)
+	switch m & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= fs.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= fs.ModeDir
+	case syscall.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if m&syscall.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&syscall.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&syscall.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
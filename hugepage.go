@@ -0,0 +1,98 @@
+//go:build linux
+
+package iouring
+
+import (
+	"os"
+	"syscall"
+)
+
+// HugeMem is anonymous memory for registered buffers or ring memory,
+// backed by huge pages when the system has them reserved. Large buffer
+// sets on huge pages need far fewer TLB entries, and the kernel can
+// register each huge page as a single segment (6.3+).
+type HugeMem struct {
+	mem  []byte
+	huge bool
+}
+
+// AllocHugeMem allocates at least size bytes of zeroed memory.
+// It first tries MAP_HUGETLB, rounding size up to the huge page size.
+// If no huge pages are available it falls back to regular pages with a
+// transparent huge page hint (MADV_HUGEPAGE); Huge reports which one
+// was used. The memory is not managed by the Go heap and must be
+// released with Free once no ring uses it.
+func AllocHugeMem(size int) (*HugeMem, error) {
+	mem, huge, err := allocHugeMem(size)
+	if err != nil {
+		return nil, err
+	}
+	return &HugeMem{mem: mem, huge: huge}, nil
+}
+
+// allocHugeMem maps size bytes, preferring MAP_HUGETLB.
+func allocHugeMem(size int) (mem []byte, huge bool, err error) {
+	if size <= 0 {
+		return nil, false, syscall.EINVAL
+	}
+
+	const prot = syscall.PROT_READ | syscall.PROT_WRITE
+	const flags = syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS
+
+	mem, err = syscall.Mmap(-1, 0, alignUpInt(size, hugePageSize), prot,
+		flags|syscall.MAP_HUGETLB|syscall.MAP_POPULATE)
+	if err == nil {
+		return mem, true, nil
+	}
+
+	mem, err = syscall.Mmap(-1, 0, alignUpInt(size, os.Getpagesize()), prot, flags)
+	if err != nil {
+		return nil, false, err
+	}
+	// Best effort: fails harmlessly if THP is disabled
+	syscall.Madvise(mem, syscall.MADV_HUGEPAGE)
+	return mem, false, nil
+}
+
+// Bytes returns the whole allocation.
+func (m *HugeMem) Bytes() []byte {
+	return m.mem
+}
+
+// Huge reports whether the memory is backed by MAP_HUGETLB pages.
+func (m *HugeMem) Huge() bool {
+	return m.huge
+}
+
+// Buffers carves n consecutive buffers of size bytes out of the
+// allocation, ready for RegisterBuffers. It returns EINVAL if they
+// do not fit. The buffers share the lifetime of m.
+func (m *HugeMem) Buffers(n, size int) ([][]byte, error) {
+	if n <= 0 || size <= 0 || n > len(m.mem)/size {
+		return nil, syscall.EINVAL
+	}
+
+	bufs := make([][]byte, n)
+	for i := range bufs {
+		off := i * size
+		bufs[i] = m.mem[off : off+size : off+size]
+	}
+	return bufs, nil
+}
+
+// Free unmaps the memory. Buffers carved from it must no longer be
+// registered or in use by in-flight requests.
+func (m *HugeMem) Free() error {
+	if m.mem == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.mem)
+	m.mem = nil
+	return err
+}
+
+// alignUpInt rounds v up to a multiple of align, which must be a power
+// of two.
+func alignUpInt(v, align int) int {
+	return (v + align - 1) &^ (align - 1)
+}
@@ -0,0 +1,32 @@
+package sys
+
+import "sync/atomic"
+
+// The heads and tails of the SQ, the CQ and buffer rings are shared with
+// the kernel, which accesses them with smp_load_acquire and
+// smp_store_release. Our side must pair with that: a tail is stored with
+// release ordering after the entries it publishes are written, and a
+// head or tail is loaded with acquire ordering before the entries it
+// covers are read; a head is stored with release ordering once the
+// entries before it are no longer read. Flags, dropped and overflow
+// counters carry no entries and are plain atomic loads.
+//
+// Go's atomics are sequentially consistent, which implies acquire and
+// release ordering (LDAR and STLR on arm64), so the helpers wrap them;
+// they exist to name the ordering each ring access relies on. Being
+// sequentially consistent, a StoreRelease followed by an atomic load of
+// another word is not reordered either, which SQPOLL relies on when it
+// checks IORING_SQ_NEED_WAKEUP after publishing the SQ tail (liburing
+// issues a full barrier there).
+
+// LoadAcquire loads *p. Loads and stores after it are not reordered
+// before it.
+func LoadAcquire(p *uint32) uint32 {
+	return atomic.LoadUint32(p)
+}
+
+// StoreRelease stores v in *p. Loads and stores before it are not
+// reordered after it.
+func StoreRelease(p *uint32, v uint32) {
+	atomic.StoreUint32(p, v)
+}
@@ -122,6 +122,7 @@ const (
 	IORING_FEAT_CQE_SKIP        uint32 = 1 << 11 // CQE skip supported
 	IORING_FEAT_LINKED_FILE     uint32 = 1 << 12 // File slot linking
 	IORING_FEAT_REG_REG_RING    uint32 = 1 << 13 // Can register ring fd
+	IORING_FEAT_MIN_TIMEOUT     uint32 = 1 << 15 // min_wait_usec in GetEventsArg
 )
 
 // Enter flags (IORING_ENTER_*)
@@ -161,6 +162,63 @@ const (
 	IORING_UNREGISTER_PBUF_RING       uint32 = 23
 	IORING_REGISTER_SYNC_CANCEL       uint32 = 24
 	IORING_REGISTER_FILE_ALLOC_RANGE  uint32 = 25
+	IORING_REGISTER_PBUF_STATUS       uint32 = 26
+	IORING_REGISTER_NAPI              uint32 = 27
+	IORING_UNREGISTER_NAPI            uint32 = 28
+	IORING_REGISTER_CLOCK             uint32 = 29
+	IORING_REGISTER_CLONE_BUFFERS     uint32 = 30
+	IORING_REGISTER_SEND_MSG_RING     uint32 = 31
+	IORING_REGISTER_ZCRX_IFQ          uint32 = 32
+	IORING_REGISTER_RESIZE_RINGS      uint32 = 33
+	IORING_REGISTER_MEM_REGION        uint32 = 34
+)
+
+// IORING_REGISTER_USE_REGISTERED_RING is OR'd into a register opcode when
+// the fd argument is a registered ring index rather than a file descriptor.
+const IORING_REGISTER_USE_REGISTERED_RING uint32 = 1 << 31
+
+// Clock IDs accepted by IORING_REGISTER_CLOCK
+const (
+	CLOCK_REALTIME  int32 = 0
+	CLOCK_MONOTONIC int32 = 1
+	CLOCK_BOOTTIME  int32 = 7
+)
+
+// Resource registration flags (IORING_RSRC_REGISTER_*)
+const (
+	IORING_RSRC_REGISTER_SPARSE uint32 = 1 << 0 // Register empty slots
+)
+
+// IORING_REGISTER_FILES_SKIP leaves a slot unchanged in a files update.
+const IORING_REGISTER_FILES_SKIP int32 = -2
+
+// AT_FDCWD makes the *at operations resolve relative paths against the
+// current working directory.
+const AT_FDCWD = -100
+
+// AT_SYMLINK_NOFOLLOW makes statx report on a symlink itself.
+const AT_SYMLINK_NOFOLLOW = 0x100
+
+// AT_EMPTY_PATH makes statx report on dirfd itself when path is "".
+const AT_EMPTY_PATH = 0x1000
+
+// O_PATH opens a file for use as a dirfd or with AT_EMPTY_PATH only.
+const O_PATH = 0x200000
+
+// openat2 resolve flags (RESOLVE_*)
+const (
+	RESOLVE_NO_XDEV       uint64 = 0x01
+	RESOLVE_NO_MAGICLINKS uint64 = 0x02
+	RESOLVE_NO_SYMLINKS   uint64 = 0x04
+	RESOLVE_BENEATH       uint64 = 0x08
+	RESOLVE_IN_ROOT       uint64 = 0x10
+	RESOLVE_CACHED        uint64 = 0x20
+)
+
+// eventfd flags (EFD_*)
+const (
+	EFD_NONBLOCK = 0x800
+	EFD_CLOEXEC  = 0x80000
 )
 
 // CQE flags (IORING_CQE_F_*)
@@ -184,6 +242,7 @@ const (
 	IORING_TIMEOUT_UPDATE        uint32 = 1 << 1
 	IORING_TIMEOUT_BOOTTIME      uint32 = 1 << 2
 	IORING_TIMEOUT_REALTIME      uint32 = 1 << 3
+	IORING_LINK_TIMEOUT_UPDATE   uint32 = 1 << 4
 	IORING_TIMEOUT_ETIME_SUCCESS uint32 = 1 << 5
 	IORING_TIMEOUT_MULTISHOT     uint32 = 1 << 6
 )
@@ -239,3 +298,58 @@ const (
 const (
 	IORING_FILE_INDEX_ALLOC uint32 = 0xffffffff - 1
 )
+
+// IORING_OP_FIXED_FD_INSTALL flags (install_fd_flags)
+const (
+	IORING_FIXED_FD_NO_CLOEXEC uint32 = 1 << 0
+)
+
+// Splice flags (SPLICE_F_*)
+const (
+	SPLICE_F_MOVE     uint32 = 1 << 0
+	SPLICE_F_NONBLOCK uint32 = 1 << 1
+)
+
+// statx mask bits (STATX_*)
+const (
+	STATX_TYPE        uint32 = 0x0001
+	STATX_MODE        uint32 = 0x0002
+	STATX_NLINK       uint32 = 0x0004
+	STATX_UID         uint32 = 0x0008
+	STATX_GID         uint32 = 0x0010
+	STATX_ATIME       uint32 = 0x0020
+	STATX_MTIME       uint32 = 0x0040
+	STATX_CTIME       uint32 = 0x0080
+	STATX_INO         uint32 = 0x0100
+	STATX_SIZE        uint32 = 0x0200
+	STATX_BLOCKS      uint32 = 0x0400
+	STATX_BASIC_STATS uint32 = 0x07ff
+	STATX_BTIME       uint32 = 0x0800
+)
+
+// NVMe passthrough commands for IORING_OP_URING_CMD on /dev/ngXnY
+// (NVME_URING_CMD_*, _IOWR('N', nr, struct nvme_uring_cmd))
+const (
+	NVME_URING_CMD_IO        uint32 = 0xc0484e80
+	NVME_URING_CMD_IO_VEC    uint32 = 0xc0484e81
+	NVME_URING_CMD_ADMIN     uint32 = 0xc0484e82
+	NVME_URING_CMD_ADMIN_VEC uint32 = 0xc0484e83
+)
+
+// Socket commands for IORING_OP_URING_CMD (SOCKET_URING_OP_*)
+const (
+	SOCKET_URING_OP_SIOCINQ    uint32 = 0
+	SOCKET_URING_OP_SIOCOUTQ   uint32 = 1
+	SOCKET_URING_OP_GETSOCKOPT uint32 = 2
+	SOCKET_URING_OP_SETSOCKOPT uint32 = 3
+)
+
+// Kernel TLS socket options
+const (
+	TCP_ULP             = 31
+	SOL_TLS             = 282
+	TLS_TX              = 1 // SOL_TLS options
+	TLS_RX              = 2
+	TLS_SET_RECORD_TYPE = 1 // SOL_TLS cmsg types
+	TLS_GET_RECORD_TYPE = 2
+)
@@ -26,7 +26,8 @@ func Setup(entries uint32, params *Params) (int, error) {
 // toSubmit: number of SQEs to submit
 // minComplete: minimum CQEs to wait for (if flags includes IORING_ENTER_GETEVENTS)
 // flags: IORING_ENTER_* flags
-// sig: optional signal mask (can be nil, pass unsafe.Pointer to sigset_t)
+// sig: optional signal mask to apply during the wait (can be nil,
+// otherwise points to SigsetSize bytes)
 //
 // Uses Syscall6 (not RawSyscall) to properly integrate with Go scheduler.
 func Enter(fd int, toSubmit, minComplete, flags uint32, sig unsafe.Pointer) (int, error) {
@@ -34,7 +35,7 @@ func Enter(fd int, toSubmit, minComplete, flags uint32, sig unsafe.Pointer) (int
 	var sigSz uintptr
 	if sig != nil {
 		sigPtr = uintptr(sig)
-		sigSz = 8 // sizeof(sigset_t) on Linux x86_64 is 128 bytes / 8 = 16 uint64s, but we pass size in bytes
+		sigSz = SigsetSize
 	}
 
 	n, _, errno := syscall.Syscall6(
@@ -74,7 +75,14 @@ func EnterExt(fd int, toSubmit, minComplete, flags uint32, arg *GetEventsArg) (i
 // arg: operation-specific argument (can be nil)
 // nrArgs: number of arguments
 func Register(fd int, opcode uint32, arg unsafe.Pointer, nrArgs uint32) error {
-	_, _, errno := syscall.Syscall6(
+	_, err := RegisterResult(fd, opcode, arg, nrArgs)
+	return err
+}
+
+// RegisterResult is like Register but also returns the syscall result.
+// Some opcodes (e.g. the FILES_UPDATE family) return a count on success.
+func RegisterResult(fd int, opcode uint32, arg unsafe.Pointer, nrArgs uint32) (int, error) {
+	n, _, errno := syscall.Syscall6(
 		SYS_IO_URING_REGISTER,
 		uintptr(fd),
 		uintptr(opcode),
@@ -84,60 +92,9 @@ func Register(fd int, opcode uint32, arg unsafe.Pointer, nrArgs uint32) error {
 		0,
 	)
 	if errno != 0 {
-		return errno
-	}
-	return nil
-}
-
-// RegisterBuffers registers fixed buffers for I/O.
-func RegisterBuffers(fd int, iovecs []syscall.Iovec) error {
-	if len(iovecs) == 0 {
-		return syscall.EINVAL
-	}
-	return Register(fd, IORING_REGISTER_BUFFERS,
-		unsafe.Pointer(&iovecs[0]), uint32(len(iovecs)))
-}
-
-// UnregisterBuffers removes registered buffers.
-func UnregisterBuffers(fd int) error {
-	return Register(fd, IORING_UNREGISTER_BUFFERS, nil, 0)
-}
-
-// RegisterFiles registers fixed file descriptors.
-func RegisterFiles(fd int, fds []int32) error {
-	if len(fds) == 0 {
-		return syscall.EINVAL
+		return 0, errno
 	}
-	return Register(fd, IORING_REGISTER_FILES,
-		unsafe.Pointer(&fds[0]), uint32(len(fds)))
-}
-
-// UnregisterFiles removes registered files.
-func UnregisterFiles(fd int) error {
-	return Register(fd, IORING_UNREGISTER_FILES, nil, 0)
-}
-
-// RegisterEventfd registers an eventfd for completion notification.
-func RegisterEventfd(fd int, eventfd int) error {
-	efd := int32(eventfd)
-	return Register(fd, IORING_REGISTER_EVENTFD, unsafe.Pointer(&efd), 1)
-}
-
-// UnregisterEventfd removes the registered eventfd.
-func UnregisterEventfd(fd int) error {
-	return Register(fd, IORING_UNREGISTER_EVENTFD, nil, 0)
-}
-
-// RegisterEventfdAsync registers eventfd for async completion only.
-func RegisterEventfdAsync(fd int, eventfd int) error {
-	efd := int32(eventfd)
-	return Register(fd, IORING_REGISTER_EVENTFD_ASYNC, unsafe.Pointer(&efd), 1)
-}
-
-// RegisterProbe queries supported operations.
-func RegisterProbe(fd int, probe *Probe) error {
-	return Register(fd, IORING_REGISTER_PROBE,
-		unsafe.Pointer(probe), uint32(IORING_OP_LAST))
+	return int(n), nil
 }
 
 // Mmap wraps the mmap syscall for mapping ring buffers.
@@ -153,3 +110,23 @@ func Mmap(fd int, offset uint64, length int, prot, flags int) ([]byte, error) {
 func Munmap(data []byte) error {
 	return syscall.Munmap(data)
 }
+
+// Getcpu returns the CPU the calling thread is running on.
+func Getcpu() (int, error) {
+	var cpu uint32
+	_, _, errno := syscall.RawSyscall(SYS_GETCPU, uintptr(unsafe.Pointer(&cpu)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(cpu), nil
+}
+
+// Eventfd creates an eventfd with the given initial value and EFD_*
+// flags.
+func Eventfd(initval uint32, flags int) (int, error) {
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, uintptr(initval), uintptr(flags), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(fd), nil
+}
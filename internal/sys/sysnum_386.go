@@ -0,0 +1,9 @@
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (i386)
+const (
+	SYS_GETCPU  = 318
+	SYS_STATX   = 383
+	SYS_OPENAT2 = 437
+)
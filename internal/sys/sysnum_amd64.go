@@ -0,0 +1,9 @@
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (x86_64)
+const (
+	SYS_GETCPU  = 309
+	SYS_STATX   = 332
+	SYS_OPENAT2 = 437
+)
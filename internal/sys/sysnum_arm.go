@@ -0,0 +1,9 @@
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (arm)
+const (
+	SYS_GETCPU  = 345
+	SYS_STATX   = 397
+	SYS_OPENAT2 = 437
+)
@@ -0,0 +1,11 @@
+//go:build arm64 || riscv64 || loong64
+
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (arm64, riscv64, loong64)
+const (
+	SYS_GETCPU  = 168
+	SYS_STATX   = 291
+	SYS_OPENAT2 = 437
+)
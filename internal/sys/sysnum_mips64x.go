@@ -0,0 +1,11 @@
+//go:build mips64 || mips64le
+
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (mips64 n64)
+const (
+	SYS_GETCPU  = 5271
+	SYS_STATX   = 5326
+	SYS_OPENAT2 = 5437
+)
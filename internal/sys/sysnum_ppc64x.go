@@ -0,0 +1,11 @@
+//go:build ppc64 || ppc64le
+
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (ppc64)
+const (
+	SYS_GETCPU  = 302
+	SYS_STATX   = 383
+	SYS_OPENAT2 = 437
+)
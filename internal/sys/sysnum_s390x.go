@@ -0,0 +1,9 @@
+package sys
+
+// Syscall numbers missing from package syscall that vary by architecture
+// (s390x)
+const (
+	SYS_GETCPU  = 311
+	SYS_STATX   = 379
+	SYS_OPENAT2 = 437
+)
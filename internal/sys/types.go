@@ -1,5 +1,7 @@
 package sys
 
+import "unsafe"
+
 // SQE is the Submission Queue Entry (64 bytes).
 // This matches struct io_uring_sqe from the kernel.
 // The struct uses unions extensively; we represent the full 64 bytes
@@ -21,6 +23,13 @@ type SQE struct {
 	_pad2       [1]uint64
 }
 
+// Sizes of the uring_cmd payload area, which starts at Addr3 and runs to
+// the end of the SQE (64-byte SQE) or of its second half (128-byte SQE).
+const (
+	SQECmdSize    = 16
+	SQE128CmdSize = 80
+)
+
 // CQE is the Completion Queue Entry (16 bytes).
 // This matches struct io_uring_cqe from the kernel.
 type CQE struct {
@@ -102,13 +111,79 @@ type Timespec struct {
 	Nsec int64
 }
 
-// FilesUpdate is used with IORING_REGISTER_FILES_UPDATE.
+// StatxTimestamp matches struct statx_timestamp.
+type StatxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// Statx matches struct statx.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          StatxTimestamp
+	Btime          StatxTimestamp
+	Ctime          StatxTimestamp
+	Mtime          StatxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	MntID          uint64
+	DioMemAlign    uint32
+	DioOffsetAlign uint32
+	_              [12]uint64
+}
+
+// NvmeUringCmd matches struct nvme_uring_cmd, the command area of an
+// NVMe passthrough SQE.
+type NvmeUringCmd struct {
+	Opcode      uint8
+	Flags       uint8
+	Rsvd1       uint16
+	Nsid        uint32
+	Cdw2        uint32
+	Cdw3        uint32
+	Metadata    uint64 // Metadata buffer address
+	Addr        uint64 // Data buffer address, or iovec array for _VEC
+	MetadataLen uint32
+	DataLen     uint32 // Data length, or iovec count for _VEC
+	Cdw10       uint32
+	Cdw11       uint32
+	Cdw12       uint32
+	Cdw13       uint32
+	Cdw14       uint32
+	Cdw15       uint32
+	TimeoutMs   uint32
+	Rsvd2       uint32
+}
+
+// FilesUpdate is used with IORING_REGISTER_FILES_UPDATE and, with Fds
+// unused, IORING_(UN)REGISTER_RING_FDS (struct io_uring_rsrc_update).
 type FilesUpdate struct {
 	Offset uint32
 	Resv   uint32
 	Fds    uint64 // Pointer to fd array
 }
 
+// OpenHow matches struct open_how, the argument of openat2.
+type OpenHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64 // RESOLVE_* flags
+}
+
 // RsrcRegister is used with IORING_REGISTER_BUFFERS2/FILES2.
 type RsrcRegister struct {
 	Nr    uint32
@@ -128,21 +203,52 @@ type RsrcUpdate struct {
 	Resv2  uint32
 }
 
+// SigsetSize is the size in bytes of the kernel's sigset_t (_NSIG / 8),
+// which io_uring_enter expects as the sigmask size. It is not the
+// 128-byte sigset_t of glibc.
+const SigsetSize = 8
+
 // GetEventsArg is used with IORING_ENTER_EXT_ARG.
 type GetEventsArg struct {
-	Sigmask   uint64
-	SigmaskSz uint32
-	Pad       uint32
-	Ts        uint64
+	Sigmask     uint64
+	SigmaskSz   uint32
+	MinWaitUsec uint32 // Wait this long for minComplete, then for any (IORING_FEAT_MIN_TIMEOUT)
+	Ts          uint64
 }
 
 // BufRingSetup is used with IORING_REGISTER_PBUF_RING.
+// This matches struct io_uring_buf_reg from the kernel.
 type BufRingSetup struct {
-	BGid    uint16
-	Nentries uint16
+	RingAddr    uint64
+	RingEntries uint32
+	BGid        uint16
+	Flags       uint16
+	Resv        [3]uint64
+}
+
+// SyncCancelReg is used with IORING_REGISTER_SYNC_CANCEL.
+// This matches struct io_uring_sync_cancel_reg from the kernel.
+type SyncCancelReg struct {
+	Addr    uint64
+	Fd      int32
 	Flags   uint32
-	Resv    [3]uint64
-	RingAddr uint64
+	Timeout Timespec // Sec and Nsec of -1 wait indefinitely
+	Opcode  uint8
+	Pad     [7]uint8
+	Pad2    [3]uint64
+}
+
+// ClockRegister is used with IORING_REGISTER_CLOCK.
+type ClockRegister struct {
+	ClockID uint32
+	Resv    [3]uint32
+}
+
+// BufStatus is used with IORING_REGISTER_PBUF_STATUS.
+type BufStatus struct {
+	BufGroup uint32
+	Head     uint32
+	Resv     [8]uint32
 }
 
 // Buf describes a provided buffer.
@@ -184,6 +290,22 @@ func (s *SQE) SetFileIndex(index int32) {
 	s.SpliceFdIn = index
 }
 
+// SetCmdOp sets the cmd_op field used by IORING_OP_URING_CMD (low half of Off).
+func (s *SQE) SetCmdOp(op uint32) {
+	s.Off = uint64(op)
+}
+
+// Cmd returns the uring_cmd payload area. When big is true the SQE must
+// be the first half of a 128-byte SQE and the returned slice spans into
+// the second half.
+func (s *SQE) Cmd(big bool) []byte {
+	n := SQECmdSize
+	if big {
+		n = SQE128CmdSize
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&s.Addr3)), n)
+}
+
 // Reset clears the SQE to zero values.
 func (s *SQE) Reset() {
 	*s = SQE{}
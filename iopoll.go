@@ -0,0 +1,62 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// CheckIOPollFd reports whether fd can be read and written on a ring set
+// up with WithIOPoll. Regular files and block devices must have been
+// opened with O_DIRECT, or it returns ErrDirectIORequired; character
+// devices, such as NVMe generic devices for PrepNvmeCmd, are accepted as
+// they are. Anything else returns syscall.EOPNOTSUPP, the error its
+// requests would complete with. Whether the device actually has poll
+// queues is not checked: without them requests fall back to interrupts.
+func CheckIOPollFd(fd int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		return nil
+	case syscall.S_IFREG, syscall.S_IFBLK:
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	fl, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if fl&syscall.O_DIRECT == 0 {
+		return ErrDirectIORequired
+	}
+	return nil
+}
+
+// iopollWait polls for n completions on an IOPOLL ring until deadline,
+// or without one if it is zero. The kernel's poll returns early when
+// none of the requests in flight are on the device's poll list, e.g.
+// while one is punted to io-wq, so it is repeated until n are ready.
+// With a deadline each poll is a single pass, as the kernel ignores
+// timeouts on IOPOLL rings.
+func (r *Ring) iopollWait(n uint32, deadline time.Time) error {
+	want := n
+	if !deadline.IsZero() {
+		want = 0
+	}
+	for r.CQReady() < n {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return syscall.ETIME
+		}
+		if _, err := r.enter(0, want, sys.IORING_ENTER_GETEVENTS|r.enterFlags, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
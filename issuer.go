@@ -0,0 +1,96 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sqMutex guards the SQ of a ring. Prep calls take it shared and claim
+// their SQE slots with a CAS on the ring's sqReserved, so concurrent
+// producers fill SQEs in parallel; publishing them to the kernel,
+// discarding them and other whole-SQ work take it exclusively, which
+// waits for the SQEs being filled. Rings with WithAutoFlush, whose Prep
+// calls may have to submit, take it exclusively throughout.
+//
+// On a ring set up with WithSingleIssuer only one goroutine prepares
+// and submits, so the mutex is skipped and Prep calls take no lock at
+// all. In check mode, set by WithIssuerCheck or the iouring_issuercheck
+// build tag, a single-issuer ring instead claims the SQ with an atomic
+// flag and panics with ErrConcurrentIssuer if another goroutine holds
+// it.
+type sqMutex struct {
+	mu     sync.RWMutex
+	shared bool        // RLock may share mu
+	single bool        // Single-issuer ring: mu is not taken
+	check  bool        // Assert the single issuer with held
+	held   atomic.Bool // A goroutine is in the SQ, in check mode
+}
+
+// Lock takes the SQ exclusively.
+func (m *sqMutex) Lock() {
+	if !m.single {
+		m.mu.Lock()
+		return
+	}
+	m.claim()
+}
+
+// Unlock releases Lock.
+func (m *sqMutex) Unlock() {
+	if !m.single {
+		m.mu.Unlock()
+		return
+	}
+	m.release()
+}
+
+// RLock takes the SQ to claim and fill SQEs with getSQE.
+func (m *sqMutex) RLock() {
+	switch {
+	case m.single:
+		m.claim()
+	case m.shared:
+		m.mu.RLock()
+	default:
+		m.mu.Lock()
+	}
+}
+
+// RUnlock releases RLock.
+func (m *sqMutex) RUnlock() {
+	switch {
+	case m.single:
+		m.release()
+	case m.shared:
+		m.mu.RUnlock()
+	default:
+		m.mu.Unlock()
+	}
+}
+
+// claim asserts the single issuer in check mode.
+func (m *sqMutex) claim() {
+	if m.check && !m.held.CompareAndSwap(false, true) {
+		panic(ErrConcurrentIssuer)
+	}
+}
+
+// release ends claim.
+func (m *sqMutex) release() {
+	if m.check {
+		m.held.Store(false)
+	}
+}
+
+// WithIssuerCheck makes a ring set up with WithSingleIssuer or
+// WithDeferTaskrun panic with ErrConcurrentIssuer when two goroutines
+// use its SQ at once, instead of silently corrupting it. The check costs
+// an atomic operation per Prep call; building with the
+// iouring_issuercheck tag turns it on for all rings, e.g. in tests.
+func WithIssuerCheck() Option {
+	return func(p *setupConfig) {
+		p.issuerCheck = true
+	}
+}
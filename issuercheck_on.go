@@ -0,0 +1,6 @@
+//go:build linux && iouring_issuercheck
+
+package iouring
+
+// issuerCheckAll turns on WithIssuerCheck for every ring.
+const issuerCheckAll = true
@@ -0,0 +1,128 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithKeepAlive makes the ring hold on to the Go memory each request
+// refers to, such as its buffer, iovec array, Msghdr, Timespec, socket
+// address or path, from the Prep call until its final CQE is consumed,
+// so the caller may drop its own references as soon as the request is
+// prepared. Memory reachable from what the ring holds, such as the
+// buffers of an iovec array or a Msghdr, is kept as well.
+//
+// The Go heap never moves objects, and memory passed to a Prep call is
+// always moved off the goroutine stack, so holding the references is
+// all it takes; runtime.Pinner would add nothing. It costs a table
+// update per request and a lookup per CQE. Requests prepared through
+// GetSQE or with WithCQESkip are not covered, as the ring cannot see
+// their memory or tell when they finish, and neither is the memory a
+// raw command passed to PrepUringCmd or PrepNvmeCmd points to.
+func WithKeepAlive() Option {
+	return func(p *setupConfig) {
+		p.keepAlive = true
+	}
+}
+
+// keepSet is the memory one request refers to.
+type keepSet [3]unsafe.Pointer
+
+// keepRef is the memory of the in-flight requests sharing a userData,
+// released once the last of them has completed.
+type keepRef struct {
+	keepSet
+	more []keepSet // Of further requests
+	n    int       // Requests in flight
+}
+
+// keepTable holds the memory of requests for WithKeepAlive.
+type keepTable struct {
+	slots []keepSet // By SQE index, from the Prep call until published
+
+	mu       sync.Mutex
+	inflight map[uint64]keepRef // Published requests by userData
+}
+
+func newKeepTable(sqEntries uint32) *keepTable {
+	return &keepTable{
+		slots:    make([]keepSet, sqEntries),
+		inflight: make(map[uint64]keepRef),
+	}
+}
+
+// pin returns the address of p for an SQE field, and on WithKeepAlive
+// rings holds p until sqe's request finishes. Passing p to pin also
+// makes the compiler move the memory it points to off the stack, where
+// it could move while the kernel uses it. Caller must hold sqLock and
+// have claimed sqe.
+func (r *Ring) pin(sqe *sys.SQE, p unsafe.Pointer) uint64 {
+	if r.keep != nil && p != nil {
+		idx := (uintptr(unsafe.Pointer(sqe)) - uintptr(unsafe.Pointer(&r.sqes[0]))) / unsafe.Sizeof(*sqe) >> r.sqeShift
+		set := &r.keep.slots[idx]
+		for i := range set {
+			if set[i] == nil {
+				set[i] = p
+				break
+			}
+		}
+	}
+	return uint64(uintptr(p))
+}
+
+// publish moves the memory of n SQEs published from SQ position tail to
+// the in-flight table. Caller must hold sqLock exclusively.
+func (k *keepTable) publish(r *Ring, tail, n uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i := uint32(0); i < n; i++ {
+		idx := (tail + i) & r.sqMask
+		set := k.slots[idx]
+		if set[0] == nil {
+			continue
+		}
+		k.slots[idx] = keepSet{}
+		sqe := &r.sqes[idx<<r.sqeShift]
+		if sqe.Flags&sys.IOSQE_CQE_SKIP_SUCCESS != 0 {
+			continue
+		}
+
+		ref, ok := k.inflight[sqe.UserData]
+		if !ok {
+			ref.keepSet = set
+		} else {
+			ref.more = append(ref.more, set)
+		}
+		ref.n++
+		k.inflight[sqe.UserData] = ref
+	}
+}
+
+// release drops the memory of the requests finished by n CQEs from CQ
+// position head on, which must not have been released to the kernel.
+func (k *keepTable) release(r *Ring, head, n uint32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.inflight) == 0 {
+		return
+	}
+	for i := uint32(0); i < n; i++ {
+		cqe := &r.cqes[((head+i)&r.cqMask)<<r.cqeShift]
+		if cqe.Flags&sys.IORING_CQE_F_MORE != 0 {
+			continue
+		}
+		ref, ok := k.inflight[cqe.UserData]
+		if !ok {
+			continue
+		}
+		if ref.n--; ref.n == 0 {
+			delete(k.inflight, cqe.UserData)
+		} else {
+			k.inflight[cqe.UserData] = ref
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// TLS record content types, for ReadRecord and WriteRecord.
+const (
+	TLSRecordChangeCipherSpec = 20
+	TLSRecordAlert            = 21
+	TLSRecordHandshake        = 22
+	TLSRecordApplicationData  = 23
+)
+
+// KTLSState reports whether kernel TLS is set up on socket fd for
+// sending (tx) and receiving (rx): the "tls" upper layer protocol is
+// attached and keys for that direction were installed with SOL_TLS.
+func KTLSState(fd int) (tx, rx bool, err error) {
+	var ulp [16]byte
+	n := uint32(len(ulp))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.IPPROTO_TCP, sys.TCP_ULP,
+		uintptr(unsafe.Pointer(&ulp[0])), uintptr(unsafe.Pointer(&n)), 0)
+	switch {
+	case errno == syscall.ENOPROTOOPT || errno == syscall.EOPNOTSUPP:
+		return false, false, nil // Not TCP
+	case errno != 0:
+		return false, false, errno
+	case string(ulp[:min(n, 3)]) != "tls":
+		return false, false, nil
+	}
+	// The crypto info of a direction is readable once its keys are set
+	return tlsConfigured(fd, sys.TLS_TX), tlsConfigured(fd, sys.TLS_RX), nil
+}
+
+// tlsConfigured reports whether SOL_TLS keys are set for dir.
+func tlsConfigured(fd, dir int) bool {
+	var info [64]byte // Larger than any tls12_crypto_info_*
+	n := uint32(len(info))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), sys.SOL_TLS, uintptr(dir),
+		uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&n)), 0)
+	return errno == 0
+}
+
+// KTLS reports whether the connection sends and receives through kernel
+// TLS; see KTLSState.
+func (c *Conn) KTLS() (tx, rx bool) {
+	tx, rx, _ = KTLSState(c.fd)
+	return tx, rx
+}
+
+// WriteZC is Write with zero-copy sends (IORING_OP_SEND_ZC): the kernel
+// transmits from b rather than from a copy, and each send completes only
+// once the kernel no longer needs b. Kernel TLS does not take zero-copy
+// sends, as records are encrypted from the data; on such sockets, and
+// on kernels without SEND_ZC, WriteZC writes with plain sends instead.
+// Use Sendfile to splice file data into a kernel TLS socket without
+// copying it through user space.
+func (c *Conn) WriteZC(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if c.noZC.Load() {
+		return c.Write(b)
+	}
+
+	n := 0
+	for n < len(b) {
+		p := b[n:min(len(b), n+MaxIOSize)] // One send moves at most MaxIOSize
+		res, err := c.do(ioWrite, func(ud uint64, opts ...OpOption) error {
+			return c.e.ring.PrepSendZC(c.fd, p, syscall.MSG_NOSIGNAL, ud, opts...)
+		}, p)
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EINVAL) {
+			// Kernel TLS, or no SEND_ZC: nothing was sent
+			c.noZC.Store(true)
+			m, err := c.Write(p)
+			return n + m, err
+		}
+		if err != nil {
+			return n, c.opError("write", err)
+		}
+		if res == 0 {
+			return n, c.opError("write", io.ErrShortWrite)
+		}
+		n += int(res)
+	}
+	return n, nil
+}
+
+// tlsMsg is the message header of a record read or write, with room
+// for the record type control message.
+type tlsMsg struct {
+	msg syscall.Msghdr
+	iov syscall.Iovec
+	oob [24]byte // CmsgSpace(1)
+	buf []byte
+}
+
+// newTLSMsg points a message header at buf and the control buffer.
+func newTLSMsg(buf []byte) *tlsMsg {
+	m := &tlsMsg{buf: buf}
+	if len(buf) > 0 {
+		m.iov.Base = &buf[0]
+		m.iov.SetLen(len(buf))
+	}
+	m.msg.Iov = &m.iov
+	m.msg.Iovlen = 1
+	m.msg.Control = &m.oob[0]
+	m.msg.SetControllen(len(m.oob))
+	return m
+}
+
+// ReadRecord reads from a kernel TLS connection like Read, and also
+// returns the content type of the record the data came from. Read
+// fails with ErrTLSRecord when the next record is not application data,
+// such as an alert or a post-handshake message (KeyUpdate,
+// NewSessionTicket); ReadRecord returns those to be handled in user
+// space. One call never returns data of two record types.
+func (c *Conn) ReadRecord(b []byte) (n int, typ uint8, err error) {
+	if c.closed.Load() {
+		return 0, 0, c.opError("read", net.ErrClosed)
+	}
+
+	m := newTLSMsg(b)
+	res, err := c.do(ioRead, func(ud uint64, opts ...OpOption) error {
+		return c.e.ring.PrepRecvmsg(c.fd, &m.msg, 0, ud, opts...)
+	}, m)
+	if err != nil {
+		return 0, 0, c.opError("read", err)
+	}
+	if res == 0 {
+		return 0, 0, io.EOF
+	}
+
+	typ = TLSRecordApplicationData
+	msgs, _ := syscall.ParseSocketControlMessage(m.oob[:m.msg.Controllen])
+	for _, cm := range msgs {
+		if cm.Header.Level == sys.SOL_TLS && cm.Header.Type == sys.TLS_GET_RECORD_TYPE && len(cm.Data) > 0 {
+			typ = cm.Data[0]
+		}
+	}
+	return int(res), typ, nil
+}
+
+// WriteRecord sends b on a kernel TLS connection as records of content
+// type typ, e.g. a TLSRecordAlert before closing or a KeyUpdate
+// handshake message. Data written with Write is application data.
+func (c *Conn) WriteRecord(typ uint8, b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	m := newTLSMsg(b)
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&m.oob[0]))
+	h.Level = sys.SOL_TLS
+	h.Type = sys.TLS_SET_RECORD_TYPE
+	h.SetLen(syscall.CmsgLen(1))
+	m.oob[syscall.CmsgLen(0)] = typ
+
+	res, err := c.do(ioWrite, func(ud uint64, opts ...OpOption) error {
+		return c.e.ring.PrepSendmsg(c.fd, &m.msg, syscall.MSG_NOSIGNAL, ud, opts...)
+	}, m)
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	return int(res), nil
+}
@@ -0,0 +1,232 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+var _ net.Listener = (*Listener)(nil)
+
+// Backoff of an AcceptStream out of descriptors, as in net/http.
+const (
+	acceptMinDelay = 5 * time.Millisecond
+	acceptMaxDelay = time.Second
+)
+
+// Listener is a net.Listener whose accepts run as accept operations on
+// an Executor's ring, returning Conns on the same Executor. A read
+// deadline, from SetDeadline or SetReadDeadline, bounds Accept as it
+// bounds a Conn's Read.
+type Listener struct {
+	netFD
+}
+
+// NewListener wraps a listening socket. The Listener takes ownership of
+// fd and closes it on Close.
+func NewListener(e *Executor, fd int) (*Listener, error) {
+	l := &Listener{}
+	if err := l.init(e, fd); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Accept implements net.Listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	if l.closed.Load() {
+		return nil, l.opError("accept", net.ErrClosed)
+	}
+
+	fd, err := l.do(ioRead, func(ud uint64, opts ...OpOption) error {
+		return l.e.ring.PrepAccept(l.fd, nil, nil, syscall.SOCK_CLOEXEC, ud, opts...)
+	}, nil)
+	if err != nil {
+		return nil, l.opError("accept", err)
+	}
+	c, err := NewConn(l.e, int(fd))
+	if err != nil {
+		syscall.Close(int(fd))
+		return nil, l.opError("accept", err)
+	}
+	return c, nil
+}
+
+// Addr implements net.Listener.
+func (l *Listener) Addr() net.Addr {
+	return l.laddr
+}
+
+// AcceptStream accepts connections on a Listener with a multishot accept,
+// see Listener.AcceptStream.
+type AcceptStream struct {
+	l       *Listener
+	ctx     context.Context
+	direct  bool
+	started bool
+	err     error
+
+	cqes eventQueue[streamCQE]
+	op   *Operation // The accept in flight; nil if none
+}
+
+// AcceptStream returns a stream that accepts connections with a
+// multishot accept (5.19+), one request that keeps accepting until the
+// kernel ends it. Its All method yields the descriptor of each accepted
+// connection, which the caller owns, e.g. to pass to NewConn. The
+// accept is rearmed whenever the kernel ends it; when the process or
+// the file table runs out of descriptors, after a delay growing from
+// 5ms to 1s, so that a server at its limit does not spin.
+//
+// Iteration ends on an error, once ctx is done, when the Listener is
+// closed, or when the caller breaks out of it; Err reports why.
+// Connections accepted but not yet yielded by then are closed.
+func (l *Listener) AcceptStream(ctx context.Context) *AcceptStream {
+	return &AcceptStream{l: l, ctx: ctx, cqes: newEventQueue[streamCQE]()}
+}
+
+// Direct makes the stream accept into free slots of the ring's
+// registered file table, which must be sparse, e.g. from
+// RegisterFilesSparse, and yield the slots instead of descriptors, for
+// NewDirectFd or WithFixedFile; see DirectFd. A connection that arrives
+// while the table is full is accepted and dropped by the kernel. Direct
+// must be called before iterating.
+func (s *AcceptStream) Direct() *AcceptStream {
+	s.direct = true
+	return s
+}
+
+// All yields the connections accepted. A stream can be iterated once.
+func (s *AcceptStream) All() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		if s.started {
+			s.err = errors.New("iouring: accept stream already iterated")
+			return
+		}
+		s.started = true
+		s.err = s.run(yield)
+	}
+}
+
+// Err returns the error that ended the iteration, or nil if the caller
+// stopped iterating.
+func (s *AcceptStream) Err() error {
+	return s.err
+}
+
+// run accepts until the stream ends and returns why it did.
+func (s *AcceptStream) run(yield func(int) bool) error {
+	l := s.l
+	if l.closed.Load() {
+		return l.opError("accept", net.ErrClosed)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	defer s.stop()
+
+	if err := s.arm(); err != nil {
+		return l.opError("accept", err)
+	}
+	var delay time.Duration
+	for {
+		cqe, err := s.cqes.next(s.ctx)
+		if err != nil {
+			return err
+		}
+		more := cqe.flags&sys.IORING_CQE_F_MORE != 0
+		if !more {
+			s.forget()
+		}
+
+		if cqe.res >= 0 {
+			delay = 0
+			if !yield(int(cqe.res)) {
+				return nil
+			}
+		} else {
+			switch err := syscall.Errno(-cqe.res); err {
+			case syscall.ECONNABORTED:
+				// The connection went away before it was accepted
+			case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+				delay = min(max(2*delay, acceptMinDelay), acceptMaxDelay)
+				if more {
+					break
+				}
+				select {
+				case <-time.After(delay):
+				case <-s.ctx.Done():
+					return s.ctx.Err()
+				}
+			default:
+				return l.opError("accept", l.mapError(err, time.Time{}))
+			}
+		}
+
+		if !more {
+			if err := s.arm(); err != nil {
+				return l.opError("accept", err)
+			}
+		}
+	}
+}
+
+// arm submits the multishot accept.
+func (s *AcceptStream) arm() error {
+	l := s.l
+	op, err := l.e.submitEach(func(ud uint64) error {
+		if s.direct {
+			return l.e.ring.PrepAcceptMultishot(l.fd, nil, nil, 0, ud, WithFileIndex(FileIndexAlloc))
+		}
+		return l.e.ring.PrepAcceptMultishot(l.fd, nil, nil, syscall.SOCK_CLOEXEC, ud)
+	}, func(res int32, flags uint32) {
+		s.cqes.push(streamCQE{res, flags})
+	})
+	if err != nil {
+		return err
+	}
+	s.op = op
+
+	// Close cancels it like the Listener's other operations
+	l.track(op, ioNone, time.Time{})
+	if l.closed.Load() {
+		op.Cancel()
+	}
+	return nil
+}
+
+// forget drops the accept, which has ended.
+func (s *AcceptStream) forget() {
+	if s.op == nil {
+		return
+	}
+	s.l.untrack(s.op)
+	s.op = nil
+}
+
+// stop cancels the accept, waits for it to end and closes the
+// connections it accepted that were not yielded.
+func (s *AcceptStream) stop() {
+	if op := s.op; op != nil {
+		s.forget()
+		op.Cancel()
+		<-op.Done()
+	}
+	for _, cqe := range s.cqes.drain() {
+		if cqe.res < 0 {
+			continue
+		}
+		if s.direct {
+			NewDirectFd(s.l.e, int(cqe.res)).Close()
+		} else {
+			syscall.Close(int(cqe.res))
+		}
+	}
+}
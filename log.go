@@ -0,0 +1,92 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"log/slog"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithLogger logs the ring's traffic to l at Debug level: every SQE as
+// it is published to the kernel ("iouring sqe"), every io_uring_enter
+// call with its batch size and result ("iouring enter"), and every CQE
+// as it is consumed ("iouring cqe"). Fields are structured, e.g.
+//
+//	level=DEBUG msg="iouring sqe" op=read fd=5 sqe_flags=4 user_data=7 off=0 len=4096
+//	level=DEBUG msg="iouring cqe" user_data=7 res=-9 flags=0 err="bad file descriptor"
+//
+// which shows how a chain was linked and where it broke without
+// strace. Without WithLogger nothing is logged and the hooks cost a nil
+// check; with it, records below the handler's level are skipped early.
+func WithLogger(l *slog.Logger) Option {
+	return func(p *setupConfig) {
+		p.log = l
+	}
+}
+
+// logEnabled reports whether Debug records are wanted. The logger must
+// be non-nil.
+func (r *Ring) logEnabled() bool {
+	return r.log.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logSQEs logs n SQEs being published from SQ position tail on. Caller
+// must hold sqLock.
+func (r *Ring) logSQEs(tail, n uint32) {
+	if !r.logEnabled() {
+		return
+	}
+	for i := uint32(0); i < n; i++ {
+		sqe := &r.sqes[((tail+i)&r.sqMask)<<r.sqeShift]
+		r.log.LogAttrs(context.Background(), slog.LevelDebug, "iouring sqe",
+			slog.String("op", opName(sqe.Opcode)),
+			slog.Int("fd", int(sqe.Fd)),
+			slog.Uint64("sqe_flags", uint64(sqe.Flags)),
+			slog.Uint64("user_data", sqe.UserData),
+			slog.Uint64("off", sqe.Off),
+			slog.Uint64("len", uint64(sqe.Len)))
+	}
+}
+
+// logEnter logs an io_uring_enter call and its outcome.
+func (r *Ring) logEnter(toSubmit, minComplete, flags uint32, n int, err error) {
+	if !r.logEnabled() {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.Uint64("to_submit", uint64(toSubmit)),
+		slog.Uint64("min_complete", uint64(minComplete)),
+		slog.Uint64("flags", uint64(flags)),
+		slog.Int("submitted", n),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+	r.log.LogAttrs(context.Background(), slog.LevelDebug, "iouring enter", attrs...)
+}
+
+// logCQEs logs n CQEs from CQ position head on, which must not have been
+// released to the kernel yet.
+func (r *Ring) logCQEs(head, n uint32) {
+	if !r.logEnabled() {
+		return
+	}
+	for i := uint32(0); i < n; i++ {
+		cqe := &r.cqes[((head+i)&r.cqMask)<<r.cqeShift]
+		attrs := []slog.Attr{
+			slog.Uint64("user_data", cqe.UserData),
+			slog.Int("res", int(cqe.Res)),
+			slog.Uint64("flags", uint64(cqe.Flags)),
+		}
+		if cqe.Res < 0 {
+			attrs = append(attrs, slog.String("err", syscall.Errno(-cqe.Res).Error()))
+		}
+		if cqe.Flags&sys.IORING_CQE_F_MORE != 0 {
+			attrs = append(attrs, slog.Bool("more", true))
+		}
+		r.log.LogAttrs(context.Background(), slog.LevelDebug, "iouring cqe", attrs...)
+	}
+}
@@ -0,0 +1,320 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// loopWakeToken is the userData of the NOP or MSG_RING CQE that wakes a
+// Loop. Registry tokens never have the top bit set.
+const loopWakeToken = ^uint64(0)
+
+// Callback handles a completion on a Loop's goroutine. Callbacks of
+// multishot requests run once per CQE.
+type Callback func(cqe CQEView)
+
+// Loop is an event loop that owns a ring: Run reaps completions and
+// dispatches them to the callbacks given to Submit, all on one
+// goroutine, while Submit and Post may be called from any goroutine.
+//
+// Requests from other goroutines are queued and prepared by Run, which
+// is woken by a NOP on the ring or, for single-issuer rings that only
+// Run's thread may submit to, by an IORING_OP_MSG_RING from a small
+// helper ring.
+type Loop struct {
+	ring         *Ring
+	singleIssuer bool
+
+	waker   *Ring      // Sends MSG_RING wakeups; nil if NOPs do
+	wakerMu sync.Mutex // Guards waker
+	subMu   sync.Mutex // Keeps wakeup NOPs out of Run's linked SQEs
+
+	callbacks Registry[Callback]
+
+	mu     sync.Mutex
+	queue  []loopRequest // Not yet prepared by Run
+	closed bool
+
+	awake   atomic.Bool // Run is not blocked, or a wakeup is on its way
+	running atomic.Bool
+	enabled bool // The single-issuer ring was enabled on Run's thread
+
+	nextBgid uint16 // Last buffer group taken by a Server
+
+	noTimeoutMultishot bool // The kernel rejected a multishot timeout; owned by Run
+}
+
+// loopRequest is a Submit or Post waiting for Run.
+type loopRequest struct {
+	prep func(userData uint64) error
+	cb   Callback
+	fn   func()
+}
+
+// NewLoop creates a ring with the given options and a Loop that owns it.
+// With WithSingleIssuer or WithDeferTaskrun the ring starts disabled and
+// is enabled by Run on its locked OS thread; such a Loop can run only
+// once. WithRegisteredFdOnly is not supported. Where io_uring is
+// unavailable the ring is emulated, see WithPollFallback.
+func NewLoop(entries uint32, opts ...Option) (*Loop, error) {
+	var cfg setupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.Flags&sys.IORING_SETUP_REGISTERED_FD_ONLY != 0 {
+		return nil, syscall.EINVAL
+	}
+
+	l := &Loop{singleIssuer: cfg.Flags&sys.IORING_SETUP_SINGLE_ISSUER != 0}
+	opts = append(opts[:len(opts):len(opts)], WithPollFallback())
+	if l.singleIssuer {
+		opts = append(opts, WithFlags(sys.IORING_SETUP_R_DISABLED))
+	}
+	ring, err := New(entries, opts...)
+	if err != nil {
+		return nil, err
+	}
+	l.ring = ring
+
+	if l.singleIssuer && !ring.PollBackend() {
+		if l.waker, err = New(4); err != nil {
+			ring.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Ring returns the loop's ring, e.g. to register buffers or files.
+// Submit requests through the Loop, not directly on the ring.
+func (l *Loop) Ring() *Ring {
+	return l.ring
+}
+
+// Submit queues a request for Run to prepare and submit. prep must queue
+// the SQEs of the request using the given userData; cb, if not nil, is
+// called with each CQE carrying that userData, until the final one. If
+// prep queues nothing, cb is never called. As with
+// Executor.Submit, linked SQEs other than the last should use a userData
+// of zero, and buffers must stay alive until the request completes.
+//
+// Submit returns before prep runs; an error from prep is delivered to
+// cb as a CQE with a negative Res: the syscall.Errno it wraps, if any,
+// such as that of an *OpError, and EINVAL otherwise, e.g. for
+// ErrIOTooLarge.
+func (l *Loop) Submit(prep func(userData uint64) error, cb Callback) error {
+	return l.enqueue(loopRequest{prep: prep, cb: cb})
+}
+
+// Post queues fn to run on Run's goroutine.
+func (l *Loop) Post(fn func()) error {
+	return l.enqueue(loopRequest{fn: fn})
+}
+
+// enqueue adds req to the queue and wakes Run if it may be blocked.
+func (l *Loop) enqueue(req loopRequest) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrRingClosed
+	}
+	l.queue = append(l.queue, req)
+	l.mu.Unlock()
+
+	if l.awake.Swap(true) {
+		return nil
+	}
+	return l.wake()
+}
+
+// wake interrupts Run's wait for completions.
+func (l *Loop) wake() error {
+	if l.waker == nil {
+		l.subMu.Lock()
+		defer l.subMu.Unlock()
+		err := l.ring.PrepNop(loopWakeToken)
+		if err == ErrSQFull {
+			if _, err = l.ring.Submit(); err != nil {
+				return err
+			}
+			err = l.ring.PrepNop(loopWakeToken)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = l.ring.Submit()
+		return err
+	}
+
+	l.wakerMu.Lock()
+	defer l.wakerMu.Unlock()
+	l.waker.DrainCQEs() // Completions of earlier messages
+	if err := l.waker.PrepMsgRing(l.ring.Fd(), 0, loopWakeToken, 0); err != nil {
+		return err
+	}
+	_, err := l.waker.Submit()
+	return err
+}
+
+// Run dispatches completions until ctx is done, then returns ctx.Err().
+// It returns early if the ring fails, e.g. with ErrCQOverflow. Requests
+// still in flight keep their callbacks for the next Run.
+func (l *Loop) Run(ctx context.Context) error {
+	if !l.running.CompareAndSwap(false, true) {
+		return ErrLoopRunning
+	}
+	defer l.running.Store(false)
+
+	if l.singleIssuer {
+		// The kernel binds the ring to the thread that enables it
+		if l.enabled {
+			return ErrLoopRunning
+		}
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if _, err := l.ring.register(sys.IORING_REGISTER_ENABLE_RINGS, nil, 0); err != nil {
+			return err
+		}
+		l.enabled = true
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		if !l.awake.Swap(true) {
+			l.wake()
+		}
+	})
+	defer stop()
+
+	dispatch := func(userData uint64, res int32, flags uint32) bool {
+		if userData == loopWakeToken {
+			return true
+		}
+		if cb, ok := l.callbacks.Complete(userData, flags); ok && cb != nil {
+			cb(CQEView{UserData: userData, Res: res, Flags: flags})
+		}
+		return true
+	}
+
+	for {
+		l.awake.Store(true)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l.runQueue()
+		l.ring.ForEachCQE(dispatch)
+		if err := l.ring.CheckCQOverflow(); err != nil {
+			return err
+		}
+
+		// Anything queued from now on wakes the wait below
+		l.awake.Store(false)
+		l.mu.Lock()
+		queued := len(l.queue) > 0
+		l.mu.Unlock()
+		if queued || ctx.Err() != nil {
+			continue
+		}
+
+		// runQueue submitted everything, so the wait need not hold subMu
+		switch err := l.ring.getEvents(1); err {
+		case nil, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.ETIME:
+		default:
+			return err
+		}
+	}
+}
+
+// runQueue prepares and submits the queued requests and runs the posted
+// functions.
+func (l *Loop) runQueue() {
+	l.mu.Lock()
+	queue := l.queue
+	l.queue = nil
+	l.mu.Unlock()
+
+	l.subMu.Lock()
+	for i, req := range queue {
+		if req.fn != nil {
+			l.subMu.Unlock()
+			req.fn()
+			l.subMu.Lock()
+		} else {
+			l.prep(req)
+		}
+		queue[i] = loopRequest{}
+	}
+	l.ring.Submit()
+	l.subMu.Unlock()
+}
+
+// prep queues the SQEs of req, flushing the SQ and retrying once if it
+// is full. A failure is reported to the callback. Caller must hold
+// l.subMu.
+func (l *Loop) prep(req loopRequest) {
+	userData := l.callbacks.Register(req.cb)
+	owns := func(ud uint64) bool { return ud == userData }
+	mark := l.ring.sqMark()
+	err := req.prep(userData)
+	if err == ErrSQFull {
+		l.ring.discardSQEs(mark, owns)
+		l.ring.Submit()
+		mark = l.ring.sqMark()
+		err = req.prep(userData)
+	}
+	if err == nil {
+		if l.ring.sqMark() == mark {
+			l.callbacks.Release(userData)
+		}
+		return
+	}
+
+	l.ring.discardSQEs(mark, owns)
+	l.callbacks.Release(userData)
+	if req.cb != nil {
+		errno := syscall.EINVAL
+		errors.As(err, &errno)
+		req.cb(CQEView{UserData: userData, Res: -int32(errno)})
+	}
+}
+
+// cancel cancels the request whose userData is in *target when Run
+// prepares the cancel, unless that is zero by then.
+func (l *Loop) cancel(target *uint64) {
+	l.Submit(func(ud uint64) error {
+		if *target == 0 {
+			return nil
+		}
+		return l.ring.PrepCancel(*target, 0, ud)
+	}, nil)
+}
+
+// Close closes the ring. Run must have returned; callbacks of requests
+// still in flight are dropped.
+func (l *Loop) Close() error {
+	if l.running.Load() {
+		return ErrLoopRunning
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrRingClosed
+	}
+	l.closed = true
+	l.queue = nil
+	l.mu.Unlock()
+
+	l.wakerMu.Lock()
+	if l.waker != nil {
+		l.waker.Close()
+	}
+	l.wakerMu.Unlock()
+	return l.ring.Close()
+}
@@ -0,0 +1,255 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// BalanceMode selects how a MultiRing picks the ring for a submission.
+type BalanceMode int
+
+const (
+	// BalanceRoundRobin takes the rings in turn.
+	BalanceRoundRobin BalanceMode = iota
+
+	// BalanceLeastLoaded takes the ring with the fewest operations in
+	// flight, counted as SQEs submitted through the MultiRing minus
+	// final CQEs (without IORING_CQE_F_MORE) consumed through it.
+	// SQEs that post no CQE, such as with IOSQE_CQE_SKIP_SUCCESS, skew
+	// the count of their ring upwards.
+	BalanceLeastLoaded
+)
+
+// MultiRing spreads submissions over several rings and merges their
+// completions into one consumer, for workloads whose queue depth
+// outgrows what one ring's SQ and CQ sizing handles well. Unlike
+// ShardedRing, which ties rings to CPUs or threads, a MultiRing picks a
+// ring per submission and has a single place to reap from.
+//
+// One eventfd is registered with all rings, and Wait parks the caller
+// in the Go netpoller until any of them has completions, so completions
+// must be posted without the waiter entering the kernel: NewMultiRing
+// returns EINVAL for rings set up with WithDeferTaskrun or WithIOPoll.
+//
+// User data is passed through unchanged; completions report the index
+// of their ring, so user data only needs to be unique per ring.
+// Submissions are safe for concurrent use; reaping is serialized.
+type MultiRing struct {
+	mode   BalanceMode
+	shards []*multiShard
+	next   atomic.Uint32 // Round-robin cursor
+	reap   sync.Mutex    // Serializes CQ consumption
+	start  int           // Ring ForEachCQE starts at, for fairness; guarded by reap
+	notify *notifier
+	closed atomic.Bool
+}
+
+// multiShard is one ring of a MultiRing.
+type multiShard struct {
+	mu       sync.Mutex // Serializes preparing and submitting
+	ring     *Ring
+	inflight atomic.Int64
+}
+
+// NewMultiRing creates n rings with the given entries and options.
+func NewMultiRing(n int, mode BalanceMode, entries uint32, opts ...Option) (*MultiRing, error) {
+	if n <= 0 || (mode != BalanceRoundRobin && mode != BalanceLeastLoaded) {
+		return nil, syscall.EINVAL
+	}
+	notify, err := newNotifier()
+	if err != nil {
+		return nil, err
+	}
+	m := &MultiRing{mode: mode, notify: notify}
+	for i := 0; i < n; i++ {
+		ring, err := New(entries, opts...)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.shards = append(m.shards, &multiShard{ring: ring})
+		if ring.params.Flags&(sys.IORING_SETUP_DEFER_TASKRUN|sys.IORING_SETUP_IOPOLL) != 0 {
+			err = syscall.EINVAL
+		} else {
+			notify.rc.Control(func(fd uintptr) {
+				err = ring.RegisterEventfd(int(fd))
+			})
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Submit picks a ring, calls prep to queue SQEs on it and submits them.
+// It returns the index of the ring. prep runs under the ring's
+// submission lock, so the SQEs it queues are submitted together. If it
+// fails, the SQEs it queued are submitted as NOPs with a user data of
+// zero, whose completions are reaped like any other.
+func (m *MultiRing) Submit(prep func(r *Ring) error) (int, error) {
+	if m.closed.Load() {
+		return 0, ErrRingClosed
+	}
+	i := m.pick()
+	sh := m.shards[i]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	mark := sh.ring.sqMark()
+	if err := prep(sh.ring); err != nil {
+		sh.ring.discardSQEs(mark, nil)
+		n, _ := sh.ring.Submit()
+		sh.inflight.Add(int64(n))
+		return i, err
+	}
+	n, err := sh.ring.Submit()
+	sh.inflight.Add(int64(n))
+	return i, err
+}
+
+// pick returns the index of the ring for the next submission.
+func (m *MultiRing) pick() int {
+	start := int(m.next.Add(1)-1) % len(m.shards)
+	if m.mode == BalanceRoundRobin {
+		return start
+	}
+	// Ties go to the ring after the last one picked
+	best, load := start, m.shards[start].inflight.Load()
+	for k := 1; k < len(m.shards) && load > 0; k++ {
+		i := (start + k) % len(m.shards)
+		if l := m.shards[i].inflight.Load(); l < load {
+			best, load = i, l
+		}
+	}
+	return best
+}
+
+// ForEachCQE calls fn for each available completion of all rings, with
+// the index of its ring, until fn returns false, and returns the number
+// of completions consumed. The entry fn returned false for is not
+// consumed. Reaping starts at a different ring on each call, so a busy
+// ring cannot starve the others.
+func (m *MultiRing) ForEachCQE(fn func(ring int, cqe CQEView) bool) int {
+	m.reap.Lock()
+	defer m.reap.Unlock()
+	if m.closed.Load() {
+		return 0
+	}
+
+	count := 0
+	stopped := false
+	first := m.start
+	m.start = (m.start + 1) % len(m.shards)
+	for k := 0; k < len(m.shards) && !stopped; k++ {
+		i := (first + k) % len(m.shards)
+		sh := m.shards[i]
+		count += sh.ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			if !fn(i, CQEView{UserData: userData, Res: res, Flags: flags}) {
+				stopped = true
+				return false
+			}
+			if flags&sys.IORING_CQE_F_MORE == 0 {
+				sh.inflight.Add(-1)
+			}
+			return true
+		})
+	}
+	return count
+}
+
+// CQReady returns the number of completions ready on all rings.
+func (m *MultiRing) CQReady() uint32 {
+	var n uint32
+	for _, sh := range m.shards {
+		n += sh.ring.CQReady()
+	}
+	return n
+}
+
+// Wait waits in the netpoller until at least n completions are ready
+// on the rings combined. It returns syscall.ETIME once timeout expires,
+// if positive, and ErrRingClosed if the MultiRing is closed meanwhile.
+func (m *MultiRing) Wait(n uint32, timeout time.Duration) error {
+	var expired atomic.Bool
+	if timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			expired.Store(true)
+			m.notify.poke()
+		})
+		defer t.Stop()
+	}
+
+	var buf [8]byte
+	for {
+		if m.closed.Load() {
+			return ErrRingClosed
+		}
+		for _, sh := range m.shards {
+			if sh.ring.CQOverflowPending() || sh.ring.HasPendingTaskWork() {
+				if err := sh.ring.getEvents(0); err != nil && err != syscall.EINTR {
+					return err
+				}
+			}
+		}
+		if m.CQReady() >= n {
+			return nil
+		}
+		if expired.Load() {
+			return syscall.ETIME
+		}
+
+		err := m.notify.rc.Read(func(fd uintptr) bool {
+			if m.closed.Load() || m.CQReady() >= n {
+				return true
+			}
+			_, err := syscall.Read(int(fd), buf[:])
+			return err != syscall.EAGAIN
+		})
+		if err != nil {
+			return ErrRingClosed
+		}
+	}
+}
+
+// Load returns the number of operations in flight on ring i, as counted
+// for BalanceLeastLoaded.
+func (m *MultiRing) Load(i int) int {
+	return int(max(m.shards[i].inflight.Load(), 0))
+}
+
+// Rings returns the rings, e.g. to register files or buffers with each.
+// Their completions must only be consumed through the MultiRing.
+func (m *MultiRing) Rings() []*Ring {
+	rings := make([]*Ring, len(m.shards))
+	for i, sh := range m.shards {
+		rings[i] = sh.ring
+	}
+	return rings
+}
+
+// Close closes all rings, waking callers blocked in Wait.
+func (m *MultiRing) Close() error {
+	if m.closed.Swap(true) {
+		return nil
+	}
+	m.notify.f.Close()
+	m.reap.Lock()
+	defer m.reap.Unlock()
+	var first error
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		if err := sh.ring.Close(); err != nil && first == nil {
+			first = err
+		}
+		sh.mu.Unlock()
+	}
+	return first
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithNetpollWait makes the ring's blocking waits park the calling
+// goroutine in the Go netpoller rather than its OS thread in
+// io_uring_enter. An eventfd registered with the ring is signaled for
+// every completion; waits read it through an os.File and then reap the
+// CQ without blocking, so any number of goroutines can wait on rings
+// without holding threads. Submission is unchanged.
+//
+// Completions must be posted without the waiter entering the kernel,
+// so New returns EINVAL when combined with WithDeferTaskrun or
+// WithIOPoll. The Sigmask variants of the waits still block in
+// io_uring_enter, as they exist for their signal handling.
+func WithNetpollWait() Option {
+	return func(p *setupConfig) {
+		p.netpoll = true
+	}
+}
+
+// notifier is the eventfd of a ring created with WithNetpollWait.
+type notifier struct {
+	f  *os.File
+	rc syscall.RawConn
+}
+
+// setupNotifier creates and registers the ring's eventfd.
+func (r *Ring) setupNotifier() error {
+	if r.params.Flags&(sys.IORING_SETUP_DEFER_TASKRUN|sys.IORING_SETUP_IOPOLL) != 0 {
+		return syscall.EINVAL
+	}
+	n, err := newNotifier()
+	if err != nil {
+		return err
+	}
+	n.rc.Control(func(fd uintptr) {
+		err = r.RegisterEventfd(int(fd))
+	})
+	if err != nil {
+		n.f.Close()
+		return err
+	}
+	r.notify = n
+	return nil
+}
+
+// newNotifier creates an eventfd in the netpoller.
+func newNotifier() (*notifier, error) {
+	fd, err := sys.Eventfd(0, sys.EFD_NONBLOCK|sys.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	// A non-blocking descriptor joins the netpoller
+	f := os.NewFile(uintptr(fd), "iouring-eventfd")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &notifier{f: f, rc: rc}, nil
+}
+
+// poke signals the eventfd to wake a waiter, e.g. on a timeout. It is
+// safe to call after the ring is closed.
+func (n *notifier) poke() {
+	one := [8]byte{1}
+	n.f.Write(one[:])
+}
+
+// waitNotify waits in the netpoller until n CQEs are ready. It returns
+// syscall.ETIME once timeout expires, if positive, and ctx.Err() once
+// ctx is done, if not nil.
+func (r *Ring) waitNotify(n uint32, timeout time.Duration, ctx context.Context) error {
+	var expired atomic.Bool
+	if timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			expired.Store(true)
+			r.notify.poke()
+		})
+		defer t.Stop()
+	}
+	if ctx != nil {
+		defer context.AfterFunc(ctx, r.notify.poke)()
+	}
+
+	var buf [8]byte
+	for {
+		if r.closed.Load() {
+			return ErrRingClosed
+		}
+		if r.CQOverflowPending() || r.HasPendingTaskWork() {
+			// Flushing overflow and running task work need the kernel,
+			// but not a blocking wait
+			if err := r.getEvents(0); err != nil && err != syscall.EINTR {
+				return err
+			}
+		}
+		if r.CQReady() >= n {
+			return nil
+		}
+		if expired.Load() {
+			return syscall.ETIME
+		}
+		if ctx != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := r.notify.rc.Read(func(fd uintptr) bool {
+			if r.closed.Load() || r.CQReady() >= n {
+				return true
+			}
+			_, err := syscall.Read(int(fd), buf[:])
+			return err != syscall.EAGAIN
+		})
+		if err != nil {
+			return ErrRingClosed
+		}
+	}
+}
@@ -0,0 +1,180 @@
+//go:build linux
+
+package iouring
+
+import (
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// NvmeCmd is an NVMe passthrough command (struct nvme_uring_cmd). Addr
+// and Metadata hold buffer addresses, which must stay alive until the
+// command completes.
+type NvmeCmd = sys.NvmeUringCmd
+
+// Passthrough command ops for PrepNvmeCmd, submitted to an NVMe generic
+// character device (/dev/ngXnY). The _VEC forms take an iovec array in
+// Addr and its length in DataLen.
+const (
+	NvmeURingCmdIO       = sys.NVME_URING_CMD_IO
+	NvmeURingCmdIOVec    = sys.NVME_URING_CMD_IO_VEC
+	NvmeURingCmdAdmin    = sys.NVME_URING_CMD_ADMIN
+	NvmeURingCmdAdminVec = sys.NVME_URING_CMD_ADMIN_VEC
+)
+
+// NVMe opcodes used by the helpers.
+const (
+	NvmeOpFlush = 0x00 // I/O command set
+	NvmeOpWrite = 0x01
+	NvmeOpRead  = 0x02
+
+	NvmeAdminGetLogPage = 0x02 // Admin command set
+	NvmeAdminIdentify   = 0x06
+)
+
+// Identify CNS values.
+const (
+	NvmeIdentifyNamespace  = 0x00
+	NvmeIdentifyController = 0x01
+)
+
+// nvmeIdentifySize is the size of an Identify data structure.
+const nvmeIdentifySize = 4096
+
+// PrepNvmeCmd prepares an NVMe passthrough command (IORING_OP_URING_CMD
+// with an nvme_uring_cmd, 5.19+) on fd, an open NVMe generic device.
+// cmdOp is one of the NvmeURingCmd constants. The ring must be created
+// with WithSQE128 and WithCQE32, and returns EINVAL otherwise: the
+// command needs the big SQE, and its result comes back in the big CQE.
+// Read the completion with NvmeResult.
+func (r *Ring) PrepNvmeCmd(fd int, cmdOp uint32, cmd *NvmeCmd, userData uint64, opts ...OpOption) error {
+	return r.prepNvmeCmd(fd, cmdOp, cmd, nil, userData, opts)
+}
+
+// prepNvmeCmd is PrepNvmeCmd for a command transferring the memory at
+// data, which is held with the request.
+func (r *Ring) prepNvmeCmd(fd int, cmdOp uint32, cmd *NvmeCmd, data unsafe.Pointer, userData uint64, opts []OpOption) error {
+	if r.sqeShift == 0 || r.cqeShift == 0 {
+		return syscall.EINVAL
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(cmd)), unsafe.Sizeof(*cmd))
+	return r.prepUringCmd(fd, cmdOp, b, data, userData, opts)
+}
+
+// PrepNvmeRead prepares an NVMe Read of len(buf) bytes from namespace
+// nsid into buf, starting at logical block slba. lbaShift is log2 of
+// the namespace's block size (see NvmeLBAShift); len(buf) must be a
+// non-zero multiple of it, of at most 65536 blocks.
+func (r *Ring) PrepNvmeRead(fd int, nsid uint32, buf []byte, slba uint64, lbaShift uint, userData uint64, opts ...OpOption) error {
+	return r.prepNvmeRW(fd, NvmeOpRead, nsid, buf, slba, lbaShift, userData, opts)
+}
+
+// PrepNvmeWrite prepares an NVMe Write of buf to namespace nsid at
+// logical block slba, like PrepNvmeRead.
+func (r *Ring) PrepNvmeWrite(fd int, nsid uint32, buf []byte, slba uint64, lbaShift uint, userData uint64, opts ...OpOption) error {
+	return r.prepNvmeRW(fd, NvmeOpWrite, nsid, buf, slba, lbaShift, userData, opts)
+}
+
+// prepNvmeRW prepares a Read or Write command.
+func (r *Ring) prepNvmeRW(fd int, opcode uint8, nsid uint32, buf []byte, slba uint64, lbaShift uint, userData uint64, opts []OpOption) error {
+	blocks := len(buf) >> lbaShift
+	if blocks == 0 || blocks<<lbaShift != len(buf) || blocks > 1<<16 {
+		return syscall.EINVAL
+	}
+	cmd := NvmeCmd{
+		Opcode:  opcode,
+		Nsid:    nsid,
+		Addr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		DataLen: uint32(len(buf)),
+		Cdw10:   uint32(slba),
+		Cdw11:   uint32(slba >> 32),
+		Cdw12:   uint32(blocks - 1), // Zero-based block count
+	}
+	return r.prepNvmeCmd(fd, NvmeURingCmdIO, &cmd, unsafe.Pointer(&buf[0]), userData, opts)
+}
+
+// PrepNvmeFlush prepares an NVMe Flush of namespace nsid's volatile
+// write cache.
+func (r *Ring) PrepNvmeFlush(fd int, nsid uint32, userData uint64, opts ...OpOption) error {
+	cmd := NvmeCmd{Opcode: NvmeOpFlush, Nsid: nsid}
+	return r.PrepNvmeCmd(fd, NvmeURingCmdIO, &cmd, userData, opts...)
+}
+
+// PrepNvmeIdentify prepares an admin Identify command returning the
+// data structure selected by cns (e.g. NvmeIdentifyNamespace for nsid)
+// in buf, which must hold 4096 bytes.
+func (r *Ring) PrepNvmeIdentify(fd int, cns uint8, nsid uint32, buf []byte, userData uint64, opts ...OpOption) error {
+	if len(buf) < nvmeIdentifySize {
+		return syscall.EINVAL
+	}
+	cmd := NvmeCmd{
+		Opcode:  NvmeAdminIdentify,
+		Nsid:    nsid,
+		Addr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		DataLen: nvmeIdentifySize,
+		Cdw10:   uint32(cns),
+	}
+	return r.prepNvmeCmd(fd, NvmeURingCmdAdmin, &cmd, unsafe.Pointer(&buf[0]), userData, opts)
+}
+
+// NvmeResult interprets the CQE of an NVMe passthrough command, as
+// passed to ForEachCQE32: it returns Dword 0 of the NVMe completion,
+// and an error for a negative errno or a non-zero NVMe status, which
+// the kernel reports as a positive Res.
+func NvmeResult(res int32, big [2]uint64) (uint64, error) {
+	switch {
+	case res < 0:
+		return 0, syscall.Errno(-res)
+	case res > 0:
+		return big[0], &NvmeStatusError{Status: uint16(res)}
+	}
+	return big[0], nil
+}
+
+// NvmeStatusError is a command the device completed with an error
+// status.
+type NvmeStatusError struct {
+	Status uint16 // Status field of the completion, without the phase bit
+}
+
+func (e *NvmeStatusError) Error() string {
+	return "iouring: nvme status 0x" + strconv.FormatUint(uint64(e.Status), 16) +
+		" (type " + strconv.Itoa(int(e.Type())) + ", code 0x" + strconv.FormatUint(uint64(e.Code()), 16) + ")"
+}
+
+// Type returns the Status Code Type, e.g. 0 for generic and 2 for media
+// errors.
+func (e *NvmeStatusError) Type() uint8 {
+	return uint8(e.Status>>8) & 0x7
+}
+
+// Code returns the Status Code within its type.
+func (e *NvmeStatusError) Code() uint8 {
+	return uint8(e.Status)
+}
+
+// DoNotRetry reports whether the device says retrying will fail too.
+func (e *NvmeStatusError) DoNotRetry() bool {
+	return e.Status&(1<<14) != 0
+}
+
+// NvmeLBAShift returns log2 of the block size of the namespace
+// described by id, an Identify Namespace data structure, in its current
+// format.
+func NvmeLBAShift(id []byte) (uint, error) {
+	if len(id) < nvmeIdentifySize {
+		return 0, syscall.EINVAL
+	}
+	// FLBAS bits 3:0 and 6:5 index the LBA formats at byte 128; LBADS
+	// is byte 2 of each 4-byte format
+	flbas := id[26]
+	idx := int(flbas&0xf) | int(flbas>>5&0x3)<<4
+	shift := uint(id[128+4*idx+2])
+	if shift < 9 {
+		return 0, syscall.EINVAL
+	}
+	return shift, nil
+}
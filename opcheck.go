@@ -0,0 +1,35 @@
+//go:build linux
+
+package iouring
+
+import "github.com/behrlich/go-iouring/internal/sys"
+
+// WithOpCheck makes Prep calls check their opcode against the kernel's
+// probe, taken once by New, and fail at once with an *OpError wrapping
+// ErrNotSupported for one the kernel lacks. The SQE left in its place
+// fails with EBADF under the same userData, and cancels the rest of a
+// chain it links to. Without it such a request is only
+// rejected when it completes, with EINVAL in its CQE, which is easily
+// mistaken for a bad argument. It takes IORING_REGISTER_PROBE (5.6+):
+// on older kernels New fails. It has no effect with WithPollBackend,
+// whose ring cannot be probed. SQEs filled through GetSQE are not
+// checked.
+func WithOpCheck() Option {
+	return func(p *setupConfig) {
+		p.opCheck = true
+	}
+}
+
+// checkOp returns the error of an SQE whose opcode the kernel does not
+// support, or nil.
+func (r *Ring) checkOp(sqe *sys.SQE) error {
+	if r.ops.SupportsOp(sys.Op(sqe.Opcode)) {
+		return nil
+	}
+	e := &OpError{Op: opName(sqe.Opcode), Fd: -1, UserData: sqe.UserData, Err: ErrNotSupported}
+	if int(sqe.Opcode) < len(opInfos) && opInfos[sqe.Opcode].usesFd {
+		e.Fd = int(sqe.Fd)
+		e.Fixed = sqe.Flags&sys.IOSQE_FIXED_FILE != 0
+	}
+	return e
+}
@@ -0,0 +1,113 @@
+package iouring
+
+import "github.com/behrlich/go-iouring/internal/sys"
+
+// OpOption adjusts the SQE built by a Prep call before it becomes
+// visible to Submit. Because it is applied while the SQ lock is held, it
+// always targets the SQE that call created, unlike SetSQEFlags.
+type OpOption func(sqe *sys.SQE)
+
+// WithSQEFlags sets IOSQE_* flags on the SQE.
+func WithSQEFlags(flags uint8) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= flags
+	}
+}
+
+// WithLink links the SQE to the next one prepared (IOSQE_IO_LINK).
+// The next SQE does not start until this one completes, and is
+// canceled if this one fails.
+func WithLink() OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_IO_LINK
+	}
+}
+
+// WithHardlink is like WithLink but the chain continues even if this
+// SQE fails (IOSQE_IO_HARDLINK).
+func WithHardlink() OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_IO_HARDLINK
+	}
+}
+
+// WithAsync forces async execution of the SQE (IOSQE_ASYNC).
+func WithAsync() OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_ASYNC
+	}
+}
+
+// WithDrain starts the SQE only after all previously submitted SQEs
+// have completed (IOSQE_IO_DRAIN).
+func WithDrain() OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_IO_DRAIN
+	}
+}
+
+// WithFixedFile targets slot in the registered file table instead of a
+// file descriptor (IOSQE_FIXED_FILE). The fd argument of the Prep call
+// is ignored.
+func WithFixedFile(slot int) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Fd = int32(slot)
+		sqe.Flags |= sys.IOSQE_FIXED_FILE
+	}
+}
+
+// WithFileIndex makes an accept, open or socket operation install the
+// new file in slot of the registered file table instead of returning a
+// descriptor (a direct descriptor, 5.15+), with FileIndexAlloc letting
+// the kernel pick a free slot and return it as the result (5.19+). On a
+// close it closes the direct descriptor in slot; the fd argument must
+// then be zero.
+func WithFileIndex(slot uint32) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.SetFileIndex(int32(slot + 1))
+	}
+}
+
+// WithOpFlags ORs op-specific flags into the SQE, such as RWF_* flags
+// for reads and writes or MSG_* flags for sends and receives.
+func WithOpFlags(flags uint32) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.OpFlags |= flags
+	}
+}
+
+// WithIoprio sets the I/O priority of the request, in ioprio_set(2)
+// encoding. Some operations reuse this field for their own flags.
+func WithIoprio(prio uint16) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Ioprio = prio
+	}
+}
+
+// WithPersonality runs the request with the credentials registered
+// under id by RegisterPersonality instead of the submitter's.
+func WithPersonality(id uint16) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Personality = id
+	}
+}
+
+// WithBufferGroup makes the kernel pick the buffer from provided buffer
+// group bgid (IOSQE_BUFFER_SELECT). The buffer passed to the Prep call
+// only sets the maximum length and is never written; find the chosen
+// buffer with BufferID on the CQE flags.
+func WithBufferGroup(bgid uint16) OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_BUFFER_SELECT
+		sqe.BufIndex = bgid
+		sqe.Addr = 0
+	}
+}
+
+// WithCQESkip suppresses the CQE if the operation succeeds
+// (IOSQE_CQE_SKIP_SUCCESS, 5.17+). Failures still post a CQE.
+func WithCQESkip() OpOption {
+	return func(sqe *sys.SQE) {
+		sqe.Flags |= sys.IOSQE_CQE_SKIP_SUCCESS
+	}
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// ReadTimeout reads from fd at offset into buf, as PrepRead, and waits
+// for the read, which a linked timeout cancels if it takes longer than
+// timeout. It returns the bytes read, zero at end of file.
+//
+// The Timeout methods queue the operation with IOSQE_IO_LINK followed by
+// an IORING_OP_LINK_TIMEOUT, and fail with an *OpError wrapping
+// os.ErrDeadlineExceeded if the timeout canceled it. A timeout that is
+// not positive fails that way without submitting anything.
+func (e *Executor) ReadTimeout(fd int, buf []byte, offset uint64, timeout time.Duration) (int, error) {
+	return e.doTimeout(sys.IORING_OP_READ, fd, func(ud uint64, opts ...OpOption) error {
+		return e.ring.PrepRead(fd, buf, offset, ud, opts...)
+	}, timeout, buf)
+}
+
+// WriteTimeout writes buf to fd at offset, as PrepWrite, with a timeout
+// like ReadTimeout. It returns the bytes written.
+func (e *Executor) WriteTimeout(fd int, buf []byte, offset uint64, timeout time.Duration) (int, error) {
+	return e.doTimeout(sys.IORING_OP_WRITE, fd, func(ud uint64, opts ...OpOption) error {
+		return e.ring.PrepWrite(fd, buf, offset, ud, opts...)
+	}, timeout, buf)
+}
+
+// RecvTimeout receives from socket fd into buf, as PrepRecv, with a
+// timeout like ReadTimeout. It returns the bytes received.
+func (e *Executor) RecvTimeout(fd int, buf []byte, flags int, timeout time.Duration) (int, error) {
+	return e.doTimeout(sys.IORING_OP_RECV, fd, func(ud uint64, opts ...OpOption) error {
+		return e.ring.PrepRecv(fd, buf, flags, ud, opts...)
+	}, timeout, buf)
+}
+
+// SendTimeout sends buf on socket fd, as PrepSend, with a timeout like
+// ReadTimeout. It returns the bytes sent.
+func (e *Executor) SendTimeout(fd int, buf []byte, flags int, timeout time.Duration) (int, error) {
+	return e.doTimeout(sys.IORING_OP_SEND, fd, func(ud uint64, opts ...OpOption) error {
+		return e.ring.PrepSend(fd, buf, flags, ud, opts...)
+	}, timeout, buf)
+}
+
+// AcceptTimeout accepts a connection on listening socket fd, as
+// PrepAccept with flags such as SOCK_CLOEXEC, with a timeout like
+// ReadTimeout. It returns the descriptor of the connection.
+func (e *Executor) AcceptTimeout(fd int, flags uint32, timeout time.Duration) (int, error) {
+	return e.doTimeout(sys.IORING_OP_ACCEPT, fd, func(ud uint64, opts ...OpOption) error {
+		return e.ring.PrepAccept(fd, nil, nil, flags, ud, opts...)
+	}, timeout, nil)
+}
+
+// doTimeout submits the operation prep queues, an opcode on fd, linked
+// to a timeout, and waits for its result.
+func (e *Executor) doTimeout(opcode sys.Op, fd int, prep func(ud uint64, opts ...OpOption) error, timeout time.Duration, keep any) (int, error) {
+	if timeout <= 0 {
+		return 0, &OpError{Op: opName(uint8(opcode)), Fd: fd, Err: os.ErrDeadlineExceeded}
+	}
+	deadline := time.Now().Add(timeout)
+	op, err := e.submitDeadline(prep, deadline, keep)
+	if err == os.ErrDeadlineExceeded {
+		// The deadline passed before the submission
+		return 0, &OpError{Op: opName(uint8(opcode)), Fd: fd, Err: err}
+	}
+	if err != nil {
+		return 0, err
+	}
+	res, err := op.Result()
+	if err != nil {
+		return 0, timeoutError(err, deadline)
+	}
+	return int(res), nil
+}
+
+// timeoutError turns the cancellation of an operation by its linked
+// timeout into an *OpError wrapping os.ErrDeadlineExceeded. The kernel
+// reports it to the operation as ECANCELED, or EINTR for some, and to
+// the timeout as ETIME; a cancellation before deadline came from
+// elsewhere. Result reports both as an *OpError.
+func timeoutError(err error, deadline time.Time) error {
+	var oe *OpError
+	if !canceled(err) || time.Now().Before(deadline) || !errors.As(err, &oe) {
+		return err
+	}
+	return &OpError{Op: oe.Op, Fd: oe.Fd, Fixed: oe.Fixed, UserData: oe.UserData, Err: os.ErrDeadlineExceeded}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package iouring
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+// PacketConn is a net.PacketConn whose ReadFrom and WriteTo run as
+// recvmsg and sendmsg operations on an Executor's ring, for UDP and
+// other datagram sockets. Deadlines work as for Conn.
+type PacketConn struct {
+	netFD
+	family int // AF_INET, AF_INET6 or AF_UNIX
+}
+
+// NewPacketConn wraps a datagram socket. The PacketConn takes ownership
+// of fd and closes it on Close.
+func NewPacketConn(e *Executor, fd int) (*PacketConn, error) {
+	family, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	c := &PacketConn{family: family}
+	if err := c.init(e, fd); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// packetMsg is the message header of a recvmsg or sendmsg, which the
+// kernel reads and updates until the operation completes.
+type packetMsg struct {
+	msg syscall.Msghdr
+	iov syscall.Iovec
+	sa  Sockaddr
+	buf []byte
+}
+
+// newPacketMsg points a message header at buf and the address storage.
+func newPacketMsg(buf []byte) *packetMsg {
+	m := &packetMsg{buf: buf}
+	if len(buf) > 0 {
+		m.iov.Base = &buf[0]
+		m.iov.SetLen(len(buf))
+	}
+	m.msg.Name = (*byte)(unsafe.Pointer(&m.sa.raw))
+	m.msg.Iov = &m.iov
+	m.msg.Iovlen = 1
+	return m
+}
+
+// ReadFrom implements net.PacketConn. A datagram larger than b is
+// truncated.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.closed.Load() {
+		return 0, nil, c.opError("read", net.ErrClosed)
+	}
+
+	m := newPacketMsg(b)
+	m.sa.reset()
+	m.msg.Namelen = m.sa.len
+	res, err := c.do(ioRead, func(ud uint64, opts ...OpOption) error {
+		return c.e.ring.PrepRecvmsg(c.fd, &m.msg, 0, ud, opts...)
+	}, m)
+	if err != nil {
+		return 0, nil, c.opError("read", err)
+	}
+	m.sa.len = m.msg.Namelen
+	return int(res), m.sa.addr(c.sotype), nil
+}
+
+// WriteTo implements net.PacketConn.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	sa, err := addrToSockaddr(addr, c.family)
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	m := newPacketMsg(b)
+	if err := m.sa.set(sa); err != nil {
+		return 0, c.opError("write", err)
+	}
+	m.msg.Namelen = m.sa.len
+
+	res, err := c.do(ioWrite, func(ud uint64, opts ...OpOption) error {
+		return c.e.ring.PrepSendmsg(c.fd, &m.msg, 0, ud, opts...)
+	}, m)
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	return int(res), nil
+}
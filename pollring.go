@@ -0,0 +1,987 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithPollBackend makes New create a ring emulated with epoll and
+// regular syscalls even if io_uring is available; WithPollFallback only
+// when it is not.
+//
+// An emulated ring keeps the ring API: SQEs are executed at Submit and
+// their CQEs are posted to CQ rings in process memory, so File, Conn,
+// Executor and Loop run unchanged. Socket operations wait for readiness
+// through epoll, and file operations run as blocking syscalls on other
+// threads. It supports NOP, READ, WRITE, READV, WRITEV, FSYNC,
+// FALLOCATE, OPENAT, OPENAT2, CLOSE, STATX, SPLICE, SEND, RECV, SENDMSG,
+// RECVMSG, ACCEPT, CONNECT, SHUTDOWN, POLL_ADD, POLL_REMOVE, TIMEOUT,
+// TIMEOUT_REMOVE, LINK_TIMEOUT and ASYNC_CANCEL, with links and CQE
+// skipping. Other opcodes, multishot requests, registered files and
+// provided buffers complete with -EINVAL, register calls other than
+// enabling the ring return ErrNotSupported, and so do Enter and
+// SubmitAndWaitSigmask. Waits behave as with WithNetpollWait, and a
+// Loop needs no MSG_RING to be woken from other goroutines. Server,
+// built on multishot receives, does not work on an emulated ring.
+func WithPollBackend() Option {
+	return func(p *setupConfig) {
+		p.pollBackend = true
+	}
+}
+
+// WithPollFallback makes New create a ring emulated as with
+// WithPollBackend when io_uring_setup fails with ENOSYS or EPERM, as on
+// kernels without io_uring or where seccomp or the io_uring_disabled
+// sysctl block it, unless the options ask for something the emulation
+// cannot provide (SQPOLL, IOPOLL, NO_MMAP, a registered ring fd, big
+// SQEs or CQEs). Without it New returns that error. NewLoop implies it.
+func WithPollFallback() Option {
+	return func(p *setupConfig) {
+		p.pollFallback = true
+	}
+}
+
+// pollBackendFlags are the setup flags an emulated ring accepts; it
+// ignores all of them.
+const pollBackendFlags = sys.IORING_SETUP_CQSIZE | sys.IORING_SETUP_CLAMP |
+	sys.IORING_SETUP_ATTACH_WQ | sys.IORING_SETUP_R_DISABLED |
+	sys.IORING_SETUP_SUBMIT_ALL | sys.IORING_SETUP_COOP_TASKRUN |
+	sys.IORING_SETUP_TASKRUN_FLAG | sys.IORING_SETUP_SINGLE_ISSUER |
+	sys.IORING_SETUP_DEFER_TASKRUN
+
+// PollBackend reports whether the ring is emulated with epoll; see
+// WithPollBackend.
+func (r *Ring) PollBackend() bool {
+	return r.emu != nil
+}
+
+// States of a pollOp.
+const (
+	opStarting = iota // Not yet issued
+	opRunning         // In a syscall, or about to retry one; cannot be canceled
+	opWaiting         // Waiting for readiness in epoll
+	opTimer           // Waiting for a timer
+	opDone
+)
+
+// pollRing executes the SQEs of an emulated ring.
+type pollRing struct {
+	r    *Ring
+	epfd int
+	stop int // Eventfd in the epoll set that stops the poller
+
+	mu      sync.Mutex // Guards below and the state of all ops
+	pending map[uint64][]*pollOp
+	fds     map[int32]*pollFd
+	closed  bool
+
+	subMu sync.Mutex // Serializes consuming the SQ
+
+	cqMu     sync.Mutex
+	overflow []sys.CQE // CQEs that did not fit the CQ ring
+	posting  bool      // Cleared by close, so nothing touches the rings
+
+	poller sync.WaitGroup
+}
+
+// pollOp is one SQE being executed.
+type pollOp struct {
+	sqe   sys.SQE
+	state int
+
+	next    *pollOp // Linked successor, if any
+	timeout *pollOp // LINK_TIMEOUT guarding this op, if any
+	timer   *time.Timer
+
+	events uint32               // Readiness waited for (EPOLL*)
+	try    func() (int32, bool) // Attempts the op; false if it must wait
+	block  func() int32         // Blocking form, for fds epoll rejects
+}
+
+// pollFd is the epoll registration of a descriptor.
+type pollFd struct {
+	waiters []*pollOp
+	armed   bool // In the epoll set
+}
+
+// newPollRing sets up an emulated ring with the given SQ size and
+// setup config.
+func newPollRing(entries uint32, cfg *setupConfig) (*Ring, error) {
+	if cfg.Flags&^pollBackendFlags != 0 {
+		return nil, syscall.EINVAL
+	}
+	if entries > 32768 {
+		if cfg.Flags&sys.IORING_SETUP_CLAMP == 0 {
+			return nil, syscall.EINVAL
+		}
+		entries = 32768
+	}
+	sqEntries := uint32(1)
+	for sqEntries < entries {
+		sqEntries <<= 1
+	}
+	cqEntries := 2 * sqEntries
+	if cfg.Flags&sys.IORING_SETUP_CQSIZE != 0 {
+		if cfg.CQEntries == 0 {
+			return nil, syscall.EINVAL
+		}
+		for cqEntries = 1; cqEntries < cfg.CQEntries && cqEntries < 65536; cqEntries <<= 1 {
+		}
+		if cqEntries < sqEntries || cqEntries < cfg.CQEntries && cfg.Flags&sys.IORING_SETUP_CLAMP == 0 {
+			return nil, syscall.EINVAL
+		}
+	}
+
+	// One region holds the SQ ring, then the CQ ring, as with
+	// IORING_FEAT_SINGLE_MMAP
+	p := cfg.Params
+	p.SQEntries = sqEntries
+	p.CQEntries = cqEntries
+	p.Features = sys.IORING_FEAT_SINGLE_MMAP | sys.IORING_FEAT_NODROP |
+		sys.IORING_FEAT_SUBMIT_STABLE | sys.IORING_FEAT_RW_CUR_POS | sys.IORING_FEAT_CQE_SKIP
+	p.SQOff = sys.SQRingOffsets{Head: 0, Tail: 4, RingMask: 8, RingEntries: 12, Flags: 16, Dropped: 20, Array: 64}
+	cqOff := uint32(alignUpInt(int(64+4*sqEntries), 64))
+	p.CQOff = sys.CQRingOffsets{Head: cqOff, Tail: cqOff + 4, RingMask: cqOff + 8, RingEntries: cqOff + 12,
+		Overflow: cqOff + 16, Flags: cqOff + 20, CQEs: cqOff + 64}
+	size := int(p.CQOff.CQEs) + int(cqEntries)*int(unsafe.Sizeof(sys.CQE{}))
+
+	r := &Ring{fd: -1, enterFd: -1, params: p, features: p.Features, autoFlush: cfg.autoFlush}
+	r.users.Store(1) // Dropped by Close
+	r.setHooks(cfg)
+	r.sqLock.shared = !cfg.autoFlush
+	var err error
+	prot, flags := syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS
+	if r.sqRing, err = syscall.Mmap(-1, 0, size, prot, flags); err != nil {
+		return nil, err
+	}
+	if r.sqesMmap, err = syscall.Mmap(-1, 0, int(sqEntries)*int(unsafe.Sizeof(sys.SQE{})), prot, flags); err != nil {
+		syscall.Munmap(r.sqRing)
+		return nil, err
+	}
+	r.cqRing = r.sqRing
+	*(*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.RingEntries])) = sqEntries
+	*(*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.RingMask])) = sqEntries - 1
+	*(*uint32)(unsafe.Pointer(&r.sqRing[p.CQOff.RingEntries])) = cqEntries
+	*(*uint32)(unsafe.Pointer(&r.sqRing[p.CQOff.RingMask])) = cqEntries - 1
+	r.setupPointers()
+
+	e := &pollRing{r: r, pending: make(map[uint64][]*pollOp), fds: make(map[int32]*pollFd)}
+	if err := e.init(); err != nil {
+		syscall.Munmap(r.sqesMmap)
+		syscall.Munmap(r.sqRing)
+		return nil, err
+	}
+	r.emu = e
+	return r, nil
+}
+
+// init creates the epoll instance and the notifier and starts the
+// poller.
+func (e *pollRing) init() error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	e.epfd = epfd
+	if e.stop, err = sys.Eventfd(0, sys.EFD_NONBLOCK|sys.EFD_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(e.stop)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, e.stop, &ev); err != nil {
+		syscall.Close(e.stop)
+		syscall.Close(epfd)
+		return err
+	}
+	if e.r.notify, err = newNotifier(); err != nil {
+		syscall.Close(e.stop)
+		syscall.Close(epfd)
+		return err
+	}
+	e.posting = true
+	e.poller.Add(1)
+	go e.poll()
+	return nil
+}
+
+// close stops the poller and drops the CQEs of ops still running, whose
+// rings are about to be unmapped. Ops waiting in epoll are abandoned.
+func (e *pollRing) close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	for _, ops := range e.pending {
+		for _, op := range ops {
+			if op.timer != nil {
+				op.timer.Stop()
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	e.cqMu.Lock()
+	e.posting = false
+	e.cqMu.Unlock()
+
+	one := [8]byte{1}
+	syscall.Write(e.stop, one[:])
+	e.poller.Wait()
+	syscall.Close(e.stop)
+	syscall.Close(e.epfd)
+}
+
+// register handles io_uring_register calls of an emulated ring.
+func (e *pollRing) register(opcode uint32) (int, error) {
+	if opcode == sys.IORING_REGISTER_ENABLE_RINGS {
+		return 0, nil
+	}
+	return 0, ErrNotSupported
+}
+
+// submit consumes the published SQEs and starts them, chain by chain.
+// Like the kernel, it copies each SQE before returning, drops those with
+// an invalid index and stops after one with an unknown opcode unless
+// the ring was set up with IORING_SETUP_SUBMIT_ALL.
+func (e *pollRing) submit() (int, error) {
+	r := e.r
+	e.subMu.Lock()
+	head := sys.LoadAcquire(r.sqHead)
+	n := sys.LoadAcquire(r.sqTail) - head
+	var heads []*pollOp
+	var prev *pollOp // Last op, if it links to the next SQE
+	var guarded *pollOp
+	submitAll := r.params.Flags&sys.IORING_SETUP_SUBMIT_ALL != 0
+	consumed := uint32(0)
+	for consumed < n {
+		idx := r.sqArray[(head+consumed)&r.sqMask]
+		consumed++
+		if idx >= r.sqEntries {
+			atomic.AddUint32(r.sqDropped, 1)
+			continue
+		}
+		op := &pollOp{sqe: r.sqes[idx<<r.sqeShift]}
+		if op.sqe.Opcode >= uint8(sys.IORING_OP_LAST) && !submitAll {
+			n = consumed // Fails with -EINVAL when started
+		}
+		switch {
+		case op.sqe.Opcode == uint8(sys.IORING_OP_LINK_TIMEOUT) && guarded != nil:
+			guarded.timeout = op
+			guarded = nil
+			if op.sqe.Flags&(sys.IOSQE_IO_LINK|sys.IOSQE_IO_HARDLINK) == 0 {
+				prev = nil
+			}
+			continue
+		case prev != nil:
+			prev.next = op
+		default:
+			heads = append(heads, op)
+		}
+		prev, guarded = nil, nil
+		if op.sqe.Flags&(sys.IOSQE_IO_LINK|sys.IOSQE_IO_HARDLINK) != 0 {
+			prev, guarded = op, op
+		}
+	}
+	sys.StoreRelease(r.sqHead, head+n)
+	e.subMu.Unlock()
+
+	for _, op := range heads {
+		e.start(op)
+	}
+	return int(n), nil
+}
+
+// start issues op.
+func (e *pollRing) start(op *pollOp) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	ud := op.sqe.UserData
+	e.pending[ud] = append(e.pending[ud], op)
+	op.state = opRunning
+	if lt := op.timeout; lt != nil {
+		if d, ok := sqeTimeout(&lt.sqe); ok {
+			lt.state = opTimer
+			lt.timer = time.AfterFunc(d, func() { e.linkTimeout(op) })
+		}
+	}
+	e.mu.Unlock()
+
+	if op.sqe.Flags&(sys.IOSQE_FIXED_FILE|sys.IOSQE_BUFFER_SELECT) != 0 {
+		e.complete(op, -int32(syscall.EINVAL))
+		return
+	}
+	e.issue(op)
+}
+
+// issue executes op according to its opcode.
+func (e *pollRing) issue(op *pollOp) {
+	s := &op.sqe
+	fd := uintptr(s.Fd)
+	switch sys.Op(s.Opcode) {
+	case sys.IORING_OP_NOP:
+		e.complete(op, 0)
+
+	case sys.IORING_OP_READ, sys.IORING_OP_WRITE, sys.IORING_OP_READV, sys.IORING_OP_WRITEV:
+		nr, pnr := uintptr(syscall.SYS_READ), uintptr(syscall.SYS_PREAD64)
+		events := uint32(syscall.EPOLLIN)
+		switch sys.Op(s.Opcode) {
+		case sys.IORING_OP_WRITE:
+			nr, pnr = syscall.SYS_WRITE, syscall.SYS_PWRITE64
+			events = syscall.EPOLLOUT
+		case sys.IORING_OP_READV:
+			nr, pnr = syscall.SYS_READV, syscall.SYS_PREADV
+		case sys.IORING_OP_WRITEV:
+			nr, pnr = syscall.SYS_WRITEV, syscall.SYS_PWRITEV
+			events = syscall.EPOLLOUT
+		}
+		do := func() int32 {
+			if s.Off == ^uint64(0) {
+				return sysResult(syscall.Syscall(nr, fd, uintptr(s.Addr), uintptr(s.Len)))
+			}
+			return sysResult(syscall.Syscall6(pnr, fd, uintptr(s.Addr), uintptr(s.Len), uintptr(s.Off), 0, 0))
+		}
+		if !pollable(int(s.Fd)) {
+			e.goBlocking(op, do)
+			return
+		}
+		// Streams ignore the offset; wait until the syscall will not
+		// block and do it then
+		op.events = events
+		op.try = func() (int32, bool) {
+			res := sysResult(syscall.Syscall(nr, fd, uintptr(s.Addr), uintptr(s.Len)))
+			return res, res != -int32(syscall.EAGAIN)
+		}
+		op.block = do
+		e.wait(op)
+
+	case sys.IORING_OP_RECV, sys.IORING_OP_SEND:
+		if s.Ioprio != 0 {
+			e.complete(op, -int32(syscall.EINVAL)) // Multishot or buffer selection
+			return
+		}
+		nr, events := uintptr(syscall.SYS_RECVFROM), uint32(syscall.EPOLLIN)
+		if s.Opcode == uint8(sys.IORING_OP_SEND) {
+			nr, events = syscall.SYS_SENDTO, syscall.EPOLLOUT
+		}
+		e.tryFirst(op, events, func(flags uintptr) int32 {
+			return sysResult(syscall.Syscall6(nr, fd, uintptr(s.Addr), uintptr(s.Len), uintptr(s.OpFlags)|flags, 0, 0))
+		})
+
+	case sys.IORING_OP_RECVMSG, sys.IORING_OP_SENDMSG:
+		if s.Ioprio != 0 {
+			e.complete(op, -int32(syscall.EINVAL))
+			return
+		}
+		nr, events := uintptr(syscall.SYS_RECVMSG), uint32(syscall.EPOLLIN)
+		if s.Opcode == uint8(sys.IORING_OP_SENDMSG) {
+			nr, events = syscall.SYS_SENDMSG, syscall.EPOLLOUT
+		}
+		e.tryFirst(op, events, func(flags uintptr) int32 {
+			return sysResult(syscall.Syscall(nr, fd, uintptr(s.Addr), uintptr(s.OpFlags)|flags))
+		})
+
+	case sys.IORING_OP_ACCEPT:
+		if s.Ioprio != 0 {
+			e.complete(op, -int32(syscall.EINVAL))
+			return
+		}
+		accept := func() int32 {
+			return sysResult(syscall.Syscall6(syscall.SYS_ACCEPT4, fd, uintptr(s.Addr), uintptr(s.Off), uintptr(s.OpFlags), 0, 0))
+		}
+		op.events = syscall.EPOLLIN
+		op.try = func() (int32, bool) { return accept(), true }
+		op.block = accept
+		e.wait(op)
+
+	case sys.IORING_OP_CONNECT:
+		connect := func() int32 {
+			return sysResult(syscall.Syscall(syscall.SYS_CONNECT, fd, uintptr(s.Addr), uintptr(s.Off)))
+		}
+		if !nonblocking(int(s.Fd)) {
+			e.goBlocking(op, connect)
+			return
+		}
+		res := connect()
+		if res != -int32(syscall.EINPROGRESS) {
+			e.complete(op, res)
+			return
+		}
+		// Writable once connected or failed
+		soError := func() int32 {
+			soerr, err := syscall.GetsockoptInt(int(s.Fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+			if err != nil {
+				return -int32(err.(syscall.Errno))
+			}
+			return -int32(soerr)
+		}
+		op.events = syscall.EPOLLOUT
+		op.try = func() (int32, bool) { return soError(), true }
+		op.block = soError
+		e.wait(op)
+
+	case sys.IORING_OP_POLL_ADD:
+		if s.Len&sys.IORING_POLL_ADD_MULTI != 0 {
+			e.complete(op, -int32(syscall.EINVAL))
+			return
+		}
+		op.events = s.OpFlags
+		op.try = func() (int32, bool) {
+			pfd := []pollFdT{{fd: s.Fd, events: int16(s.OpFlags)}}
+			var ts syscall.Timespec // Zero: do not wait
+			syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd[0])), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+			return int32(uint16(pfd[0].revents)), pfd[0].revents != 0
+		}
+		op.block = func() int32 { return int32(s.OpFlags) } // Like files: always ready
+		e.wait(op)
+
+	case sys.IORING_OP_SHUTDOWN:
+		e.complete(op, sysResult(syscall.Syscall(syscall.SYS_SHUTDOWN, fd, uintptr(s.Len), 0)))
+
+	case sys.IORING_OP_CLOSE:
+		e.goBlocking(op, func() int32 { return sysResult(syscall.Syscall(syscall.SYS_CLOSE, fd, 0, 0)) })
+
+	case sys.IORING_OP_FSYNC:
+		nr := uintptr(syscall.SYS_FSYNC)
+		if s.OpFlags&sys.IORING_FSYNC_DATASYNC != 0 {
+			nr = syscall.SYS_FDATASYNC
+		}
+		e.goBlocking(op, func() int32 { return sysResult(syscall.Syscall(nr, fd, 0, 0)) })
+
+	case sys.IORING_OP_FALLOCATE:
+		e.goBlocking(op, func() int32 {
+			return sysResult(syscall.Syscall6(syscall.SYS_FALLOCATE, fd, uintptr(s.Len), uintptr(s.Off), uintptr(s.Addr), 0, 0))
+		})
+
+	case sys.IORING_OP_OPENAT:
+		e.goBlocking(op, func() int32 {
+			return sysResult(syscall.Syscall6(syscall.SYS_OPENAT, fd, uintptr(s.Addr), uintptr(s.OpFlags), uintptr(s.Len), 0, 0))
+		})
+
+	case sys.IORING_OP_OPENAT2:
+		e.goBlocking(op, func() int32 {
+			return sysResult(syscall.Syscall6(sys.SYS_OPENAT2, fd, uintptr(s.Addr), uintptr(s.Off), uintptr(s.Len), 0, 0))
+		})
+
+	case sys.IORING_OP_STATX:
+		e.goBlocking(op, func() int32 {
+			return sysResult(syscall.Syscall6(sys.SYS_STATX, fd, uintptr(s.Addr), uintptr(s.OpFlags), uintptr(s.Len), uintptr(s.Off), 0))
+		})
+
+	case sys.IORING_OP_SPLICE:
+		e.goBlocking(op, func() int32 {
+			offIn, offOut := int64(s.Addr), int64(s.Off)
+			var pin, pout uintptr
+			if offIn != -1 {
+				pin = uintptr(unsafe.Pointer(&offIn))
+			}
+			if offOut != -1 {
+				pout = uintptr(unsafe.Pointer(&offOut))
+			}
+			return sysResult(syscall.Syscall6(syscall.SYS_SPLICE, uintptr(s.SpliceFdIn), pin, fd, pout, uintptr(s.Len), uintptr(s.OpFlags)))
+		})
+
+	case sys.IORING_OP_TIMEOUT:
+		d, ok := sqeTimeout(s)
+		if !ok {
+			e.complete(op, -int32(syscall.EINVAL))
+			return
+		}
+		e.mu.Lock()
+		if op.state == opRunning {
+			op.state = opTimer
+			op.timer = time.AfterFunc(d, func() { e.expire(op) })
+		}
+		e.mu.Unlock()
+
+	case sys.IORING_OP_TIMEOUT_REMOVE:
+		e.complete(op, e.timeoutRemove(s))
+
+	case sys.IORING_OP_ASYNC_CANCEL, sys.IORING_OP_POLL_REMOVE:
+		e.complete(op, e.cancel(op))
+
+	default:
+		e.complete(op, -int32(syscall.EINVAL))
+	}
+}
+
+// pollFdT is struct pollfd.
+type pollFdT struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// goBlocking runs the blocking syscall do on its own goroutine.
+func (e *pollRing) goBlocking(op *pollOp, do func() int32) {
+	go func() { e.complete(op, do()) }()
+}
+
+// tryFirst attempts a socket op without blocking and waits for
+// readiness if it would block. do is given the extra MSG_* flags.
+func (e *pollRing) tryFirst(op *pollOp, events uint32, do func(flags uintptr) int32) {
+	op.events = events
+	op.try = func() (int32, bool) {
+		res := do(syscall.MSG_DONTWAIT)
+		return res, res != -int32(syscall.EAGAIN)
+	}
+	op.block = func() int32 { return do(0) }
+	if res, ok := op.try(); ok {
+		e.complete(op, res)
+		return
+	}
+	e.wait(op)
+}
+
+// wait parks op until its fd reports op.events, then retries it on a
+// new goroutine. Descriptors epoll rejects, such as regular files, get
+// the blocking form instead.
+func (e *pollRing) wait(op *pollOp) {
+	fd := op.sqe.Fd
+	e.mu.Lock()
+	if op.state != opRunning || e.closed {
+		e.mu.Unlock()
+		return // Canceled meanwhile
+	}
+	pf := e.fds[fd]
+	if pf == nil {
+		pf = &pollFd{}
+		e.fds[fd] = pf
+	}
+	pf.waiters = append(pf.waiters, op)
+	op.state = opWaiting
+	err := e.arm(fd, pf)
+	if err != nil {
+		pf.waiters = pf.waiters[:len(pf.waiters)-1]
+		if len(pf.waiters) == 0 {
+			delete(e.fds, fd)
+		}
+		op.state = opRunning
+	}
+	e.mu.Unlock()
+
+	switch err {
+	case nil:
+	case syscall.EPERM:
+		e.goBlocking(op, op.block)
+	default:
+		e.complete(op, -int32(err.(syscall.Errno)))
+	}
+}
+
+// arm (re)registers fd with the union of its waiters' events. Caller
+// must hold e.mu.
+func (e *pollRing) arm(fd int32, pf *pollFd) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLONESHOT, Fd: fd}
+	for _, w := range pf.waiters {
+		ev.Events |= w.events
+	}
+	if pf.armed {
+		err := syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_MOD, int(fd), &ev)
+		if err != syscall.ENOENT {
+			return err
+		}
+		// fd was closed, and maybe reused, since
+	}
+	err := syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+	if err == syscall.EEXIST {
+		err = syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_MOD, int(fd), &ev)
+	}
+	if err == nil {
+		pf.armed = true
+	}
+	return err
+}
+
+// poll dispatches readiness events until close.
+func (e *pollRing) poll() {
+	defer e.poller.Done()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(e.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd == int32(e.stop) {
+				return
+			}
+			var ready []*pollOp
+			e.mu.Lock()
+			if pf := e.fds[ev.Fd]; pf != nil {
+				pf.armed = false // EPOLLONESHOT
+				keep := pf.waiters[:0]
+				for _, w := range pf.waiters {
+					if w.events&ev.Events != 0 || ev.Events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
+						w.state = opRunning
+						ready = append(ready, w)
+					} else {
+						keep = append(keep, w)
+					}
+				}
+				pf.waiters = keep
+				if len(keep) == 0 || e.arm(ev.Fd, pf) != nil {
+					delete(e.fds, ev.Fd)
+					syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_DEL, int(ev.Fd), nil)
+				}
+			}
+			e.mu.Unlock()
+			for _, w := range ready {
+				go e.retry(w)
+			}
+		}
+	}
+}
+
+// retry attempts a ready op again, waiting anew if it would still block.
+func (e *pollRing) retry(op *pollOp) {
+	if res, ok := op.try(); ok {
+		e.complete(op, res)
+		return
+	}
+	e.wait(op)
+}
+
+// unwait removes a waiting op from its fd. Caller must hold e.mu.
+func (e *pollRing) unwait(op *pollOp) {
+	fd := op.sqe.Fd
+	pf := e.fds[fd]
+	if pf == nil {
+		return
+	}
+	for i, w := range pf.waiters {
+		if w == op {
+			pf.waiters = append(pf.waiters[:i], pf.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(pf.waiters) == 0 {
+		delete(e.fds, fd)
+		syscall.EpollCtl(e.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	} else if pf.armed {
+		e.arm(fd, pf)
+	}
+}
+
+// expire completes a timeout op whose timer fired.
+func (e *pollRing) expire(op *pollOp) {
+	e.mu.Lock()
+	fired := op.state == opTimer
+	if fired {
+		op.state = opRunning
+	}
+	e.mu.Unlock()
+	if fired {
+		e.complete(op, -int32(syscall.ETIME))
+	}
+}
+
+// linkTimeout cancels op because its LINK_TIMEOUT fired.
+func (e *pollRing) linkTimeout(op *pollOp) {
+	lt := op.timeout
+	e.mu.Lock()
+	if lt.state != opTimer {
+		e.mu.Unlock()
+		return
+	}
+	lt.state = opDone
+	canceled := e.cancelLocked(op)
+	e.mu.Unlock()
+
+	if canceled {
+		e.post(lt, -int32(syscall.ETIME))
+		e.complete(op, -int32(syscall.ECANCELED))
+	} else {
+		e.post(lt, -int32(syscall.EALREADY))
+	}
+}
+
+// cancelLocked takes op out of its wait, if it is waiting for readiness
+// or a timer, and reports whether it did; op must then be completed.
+// Caller must hold e.mu.
+func (e *pollRing) cancelLocked(op *pollOp) bool {
+	switch op.state {
+	case opWaiting:
+		e.unwait(op)
+	case opTimer:
+		op.timer.Stop()
+	default:
+		return false
+	}
+	op.state = opRunning
+	return true
+}
+
+// cancel executes an ASYNC_CANCEL or POLL_REMOVE and returns its result.
+func (e *pollRing) cancel(c *pollOp) int32 {
+	s := &c.sqe
+	all := s.OpFlags&sys.IORING_ASYNC_CANCEL_ALL != 0
+	if s.OpFlags&sys.IORING_ASYNC_CANCEL_FD_FIXED != 0 {
+		return -int32(syscall.EINVAL)
+	}
+	match := func(op *pollOp) bool {
+		switch {
+		case s.Opcode == uint8(sys.IORING_OP_POLL_REMOVE):
+			return op.sqe.UserData == s.Addr && op.sqe.Opcode == uint8(sys.IORING_OP_POLL_ADD)
+		case s.OpFlags&sys.IORING_ASYNC_CANCEL_ANY != 0:
+			return true
+		case s.OpFlags&sys.IORING_ASYNC_CANCEL_FD != 0:
+			return op.sqe.Fd == s.Fd
+		}
+		return op.sqe.UserData == s.Addr
+	}
+
+	var canceled []*pollOp
+	found := false
+	e.mu.Lock()
+	for _, ops := range e.pending {
+		for _, op := range ops {
+			if op == c || op.state == opDone || !match(op) {
+				continue
+			}
+			found = true
+			if e.cancelLocked(op) {
+				canceled = append(canceled, op)
+			}
+			if !all {
+				break
+			}
+		}
+		if found && !all {
+			break
+		}
+	}
+	e.mu.Unlock()
+
+	for _, op := range canceled {
+		e.complete(op, -int32(syscall.ECANCELED))
+	}
+	switch {
+	case all:
+		return int32(len(canceled))
+	case len(canceled) > 0:
+		return 0
+	case found:
+		return -int32(syscall.EALREADY)
+	}
+	return -int32(syscall.ENOENT)
+}
+
+// timeoutRemove executes a TIMEOUT_REMOVE, or with IORING_TIMEOUT_UPDATE
+// a timeout update, and returns its result.
+func (e *pollRing) timeoutRemove(s *sys.SQE) int32 {
+	var d time.Duration
+	update := s.OpFlags&sys.IORING_TIMEOUT_UPDATE != 0
+	if update {
+		ts := (*sys.Timespec)(sqePointer(&s.Off))
+		if s.OpFlags&^sys.IORING_TIMEOUT_UPDATE != 0 || ts == nil {
+			return -int32(syscall.EINVAL)
+		}
+		d = time.Duration(ts.Sec)*time.Second + time.Duration(ts.Nsec)
+	}
+
+	e.mu.Lock()
+	var target *pollOp
+	for _, op := range e.pending[s.Addr] {
+		if op.sqe.Opcode == uint8(sys.IORING_OP_TIMEOUT) && op.state == opTimer {
+			target = op
+			break
+		}
+	}
+	if target != nil && update {
+		target.timer.Reset(d)
+		target = nil
+		e.mu.Unlock()
+		return 0
+	}
+	if target != nil {
+		target.timer.Stop()
+		target.state = opRunning
+	}
+	e.mu.Unlock()
+
+	if target == nil {
+		return -int32(syscall.ENOENT)
+	}
+	e.complete(target, -int32(syscall.ECANCELED))
+	return 0
+}
+
+// complete finishes op with res: it posts the CQEs of op and its link
+// timeout, then starts or cancels what is linked after it.
+func (e *pollRing) complete(op *pollOp, res int32) {
+	e.mu.Lock()
+	if op.state == opDone {
+		e.mu.Unlock()
+		return
+	}
+	op.state = opDone
+	e.dropPending(op)
+	lt := op.timeout
+	ltPending := lt != nil && lt.state == opTimer
+	if ltPending {
+		lt.timer.Stop()
+		lt.state = opDone
+	}
+	e.mu.Unlock()
+
+	e.post(op, res)
+	if ltPending {
+		e.post(lt, -int32(syscall.ECANCELED))
+	}
+
+	next := op.next
+	if next == nil {
+		return
+	}
+	if failed(&op.sqe, res) && op.sqe.Flags&sys.IOSQE_IO_HARDLINK == 0 {
+		for ; next != nil; next = next.next {
+			e.post(next, -int32(syscall.ECANCELED))
+			if next.timeout != nil {
+				e.post(next.timeout, -int32(syscall.ECANCELED))
+			}
+		}
+		return
+	}
+	e.start(next)
+}
+
+// dropPending forgets a finished op. Caller must hold e.mu.
+func (e *pollRing) dropPending(op *pollOp) {
+	ud := op.sqe.UserData
+	ops := e.pending[ud]
+	for i, o := range ops {
+		if o == op {
+			ops = append(ops[:i], ops[i+1:]...)
+			break
+		}
+	}
+	if len(ops) == 0 {
+		delete(e.pending, ud)
+	} else {
+		e.pending[ud] = ops
+	}
+}
+
+// failed reports whether res breaks the link after s, as errors and
+// short reads and writes do.
+func failed(s *sys.SQE, res int32) bool {
+	if res < 0 {
+		return true
+	}
+	switch sys.Op(s.Opcode) {
+	case sys.IORING_OP_READ, sys.IORING_OP_WRITE, sys.IORING_OP_SPLICE:
+		return uint32(res) < s.Len
+	}
+	return false
+}
+
+// post adds the CQE of op to the CQ ring, or to the overflow list if the
+// ring is full, and wakes the waiters.
+func (e *pollRing) post(op *pollOp, res int32) {
+	if res >= 0 && op.sqe.Flags&sys.IOSQE_CQE_SKIP_SUCCESS != 0 {
+		return
+	}
+	cqe := sys.CQE{UserData: op.sqe.UserData, Res: res}
+
+	e.cqMu.Lock()
+	if !e.posting {
+		e.cqMu.Unlock()
+		return
+	}
+	if len(e.overflow) > 0 || !e.postLocked(cqe) {
+		e.overflow = append(e.overflow, cqe)
+		atomic.OrUint32(e.r.sqFlags, sys.IORING_SQ_CQ_OVERFLOW)
+	}
+	e.cqMu.Unlock()
+	e.r.notify.poke()
+}
+
+// postLocked writes cqe to the CQ ring if there is room. Caller must
+// hold e.cqMu.
+func (e *pollRing) postLocked(cqe sys.CQE) bool {
+	r := e.r
+	tail := sys.LoadAcquire(r.cqTail)
+	if tail-sys.LoadAcquire(r.cqHead) >= r.cqEntries {
+		return false
+	}
+	r.cqes[(tail&r.cqMask)<<r.cqeShift] = cqe
+	sys.StoreRelease(r.cqTail, tail+1)
+	return true
+}
+
+// flushOverflow moves overflowed CQEs into the CQ ring as far as they
+// fit, as io_uring_enter with GETEVENTS does.
+func (e *pollRing) flushOverflow() {
+	e.cqMu.Lock()
+	defer e.cqMu.Unlock()
+	if !e.posting {
+		return
+	}
+	n := 0
+	for n < len(e.overflow) && e.postLocked(e.overflow[n]) {
+		n++
+	}
+	e.overflow = e.overflow[n:]
+	if len(e.overflow) == 0 {
+		e.overflow = nil
+		atomic.AndUint32(e.r.sqFlags, ^sys.IORING_SQ_CQ_OVERFLOW)
+	}
+}
+
+// sqeTimeout returns the relative timeout of a TIMEOUT or LINK_TIMEOUT
+// SQE; absolute and clock-selecting flags are not supported.
+func sqeTimeout(s *sys.SQE) (time.Duration, bool) {
+	ts := (*sys.Timespec)(sqePointer(&s.Addr))
+	if ts == nil || s.OpFlags != 0 {
+		return 0, false
+	}
+	return time.Duration(ts.Sec)*time.Second + time.Duration(ts.Nsec), true
+}
+
+// sqePointer reads an SQE address field as the pointer it holds.
+func sqePointer(field *uint64) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(field))
+}
+
+// sysResult turns a raw syscall result into a CQE result.
+func sysResult(r1, _ uintptr, errno syscall.Errno) int32 {
+	if errno != 0 {
+		return -int32(errno)
+	}
+	return int32(r1)
+}
+
+// nonblocking reports whether fd has O_NONBLOCK set.
+func nonblocking(fd int) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFL, 0)
+	return errno == 0 && flags&syscall.O_NONBLOCK != 0
+}
+
+// pollable reports whether fd is a stream whose readiness epoll can
+// report, as opposed to a file that is always ready.
+func pollable(fd int) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return false
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG, syscall.S_IFBLK, syscall.S_IFDIR:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// RingPoolConfig describes the rings of a RingPool.
+type RingPoolConfig struct {
+	Rings   int      // Number of rings; zero means runtime.NumCPU()
+	Entries uint32   // SQ entries of each ring
+	Files   uint32   // Size of each ring's registered file table, for Distribute; zero disables Distribute
+	ShareWQ bool     // Attach all rings to the first ring's io-wq (IORING_SETUP_ATTACH_WQ)
+	Options []Option // Setup options of each ring
+}
+
+// RingPool is a set of rings for spreading work across cores, typically
+// one ring per goroutine that drives it. Accepted connections are handed
+// to the rings with Distribute, which passes them as registered files
+// through IORING_OP_MSG_RING, so each ring serves its connections
+// without touching the others.
+//
+// The pool's own methods are safe for concurrent use; each Ring is used
+// as usual by whoever drives it.
+type RingPool struct {
+	rings []*Ring
+	next  atomic.Uint32 // Round-robin position
+
+	distMu sync.Mutex
+	dist   *Ring // Sends fds to the rings; its file table has one slot
+}
+
+// NewRingPool creates the rings of a pool.
+func NewRingPool(cfg RingPoolConfig) (*RingPool, error) {
+	n := cfg.Rings
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	p := &RingPool{}
+	for i := 0; i < n; i++ {
+		opts := cfg.Options
+		if cfg.ShareWQ && i > 0 {
+			opts = append(opts[:len(opts):len(opts)], WithAttachWQ(p.rings[0].Fd()))
+		}
+		ring, err := New(cfg.Entries, opts...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.rings = append(p.rings, ring)
+		if cfg.Files > 0 {
+			if err := ring.RegisterFilesSparse(cfg.Files); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.Files > 0 {
+		dist, err := New(4)
+		if err == nil {
+			err = dist.RegisterFilesSparse(1)
+		}
+		if err != nil {
+			if dist != nil {
+				dist.Close()
+			}
+			p.Close()
+			return nil, err
+		}
+		p.dist = dist
+	}
+	return p, nil
+}
+
+// Len returns the number of rings.
+func (p *RingPool) Len() int {
+	return len(p.rings)
+}
+
+// Ring returns ring i.
+func (p *RingPool) Ring(i int) *Ring {
+	return p.rings[i]
+}
+
+// Rings returns all rings of the pool.
+func (p *RingPool) Rings() []*Ring {
+	return p.rings
+}
+
+// Next returns the index of the next ring in round-robin order.
+func (p *RingPool) Next() int {
+	return int((p.next.Add(1) - 1) % uint32(len(p.rings)))
+}
+
+// Distribute hands fd to the next ring in round-robin order and closes
+// it. The ring receives a CQE carrying userData data whose res is the
+// slot of its registered file table now holding the file (or a negative
+// errno), to be used with WithFixedFile. It returns the ring's index.
+// The pool must have been created with Files set.
+func (p *RingPool) Distribute(fd int, data uint64) (int, error) {
+	i := p.Next()
+	return i, p.SendFd(i, fd, data)
+}
+
+// SendFd is Distribute to ring i.
+func (p *RingPool) SendFd(i, fd int, data uint64) error {
+	if p.dist == nil {
+		return ErrNotSupported
+	}
+
+	p.distMu.Lock()
+	defer p.distMu.Unlock()
+
+	if _, err := p.dist.RegisterFilesUpdate(0, []int{fd}); err != nil {
+		return err
+	}
+	err := p.dist.PrepMsgRingFd(p.rings[i].Fd(), 0, FileIndexAlloc, data, 0)
+	if err == nil {
+		_, err = p.dist.SubmitAndWait(1)
+	}
+	if err == nil {
+		var res int32
+		_, res, _, err = p.dist.WaitCQE()
+		p.dist.SeenCQE()
+		if err == nil {
+			err = ResultError(res)
+		}
+	}
+	// The ring holds its own reference to the file now
+	p.dist.RegisterFilesUpdate(0, []int{-1})
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+// Submit submits the pending SQEs of every ring and returns the total
+// consumed. It stops at the first ring that fails.
+func (p *RingPool) Submit() (int, error) {
+	total := 0
+	for _, ring := range p.rings {
+		n, err := ring.Submit()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ForEachCQE calls fn for the ready CQEs of every ring, with the ring's
+// index, and advances each ring's CQ head, as Ring.ForEachCQE does. It
+// returns the number of CQEs processed.
+func (p *RingPool) ForEachCQE(fn func(ring int, userData uint64, res int32, flags uint32) bool) int {
+	total := 0
+	stop := false
+	for i, ring := range p.rings {
+		total += ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			if !fn(i, userData, res, flags) {
+				stop = true
+			}
+			return !stop
+		})
+		if stop {
+			break
+		}
+	}
+	return total
+}
+
+// Close closes all rings of the pool.
+func (p *RingPool) Close() error {
+	var first error
+	for _, ring := range p.rings {
+		if err := ring.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if p.dist != nil {
+		p.dist.Close()
+	}
+	return first
+}
@@ -0,0 +1,260 @@
+//go:build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Extent is a byte range of a file.
+type Extent struct {
+	Off int64
+	Len int
+}
+
+// AccessPattern yields the extents a Prefetcher reads, in the order they
+// are consumed. Next returns false once there are no more.
+type AccessPattern interface {
+	Next() (Extent, bool)
+}
+
+// SequentialAccess reads chunk-sized extents from off up to end, or up
+// to end of file if end is negative.
+func SequentialAccess(off int64, chunk int, end int64) AccessPattern {
+	return &strided{off: off, chunk: chunk, stride: int64(chunk), end: end, count: -1}
+}
+
+// StridedAccess reads count extents of chunk bytes, stride bytes apart,
+// starting at off, such as one column of fixed-size records. A negative
+// count reads up to end of file.
+func StridedAccess(off int64, chunk int, stride int64, count int) AccessPattern {
+	return &strided{off: off, chunk: chunk, stride: stride, end: -1, count: count}
+}
+
+// strided is the pattern of SequentialAccess and StridedAccess.
+type strided struct {
+	off    int64
+	chunk  int
+	stride int64
+	end    int64 // Negative for none
+	count  int   // Negative for no limit
+}
+
+func (s *strided) Next() (Extent, bool) {
+	if s.count == 0 || (s.end >= 0 && s.off >= s.end) {
+		return Extent{}, false
+	}
+	ext := Extent{Off: s.off, Len: s.chunk}
+	if s.end >= 0 && s.end-s.off < int64(ext.Len) {
+		ext.Len = int(s.end - s.off)
+	}
+	s.off += s.stride
+	if s.count > 0 {
+		s.count--
+	}
+	return ext, true
+}
+
+// ExtentAccess reads the given extents in order, e.g. the row groups of
+// a columnar file that a query needs.
+func ExtentAccess(extents []Extent) AccessPattern {
+	return &extentList{extents: extents}
+}
+
+// extentList is the pattern of ExtentAccess.
+type extentList struct {
+	extents []Extent
+}
+
+func (l *extentList) Next() (Extent, bool) {
+	if len(l.extents) == 0 {
+		return Extent{}, false
+	}
+	ext := l.extents[0]
+	l.extents = l.extents[1:]
+	return ext, true
+}
+
+// Prefetcher reads the extents of an access pattern from a descriptor,
+// keeping the reads of the next few extents in flight while the
+// consumer works on the current one, so scans are bound by the device
+// rather than by the latency of each read. Where a Reader only reads a
+// File front to back, a Prefetcher follows any pattern known in
+// advance and hands out whole extents.
+//
+// A short read is finished before its extent is served. Reading nothing
+// means end of file: the extent is served truncated, if anything was
+// read, and the Prefetcher then returns io.EOF.
+//
+// A Prefetcher is not safe for concurrent use.
+type Prefetcher struct {
+	e       *Executor
+	fd      int
+	pattern AccessPattern
+	depth   int
+	ahead   []prefetch // In-flight reads, oldest first
+	cur     []byte     // Buffer of the extent last served
+	buf     []byte     // Unread part of cur, for Read
+	free    [][]byte   // Buffers no longer used by any read
+	err     error      // Why no further reads are issued, returned once ahead drains
+	closed  bool
+}
+
+// prefetch is a read issued by a Prefetcher.
+type prefetch struct {
+	op  *Operation
+	ext Extent
+	buf []byte
+}
+
+// NewPrefetcher returns a Prefetcher reading fd along pattern with up to
+// depth reads in flight; zero picks a default. It does not own fd.
+func NewPrefetcher(e *Executor, fd int, pattern AccessPattern, depth int) *Prefetcher {
+	if depth <= 0 {
+		depth = defaultReadDepth
+	}
+	return &Prefetcher{e: e, fd: fd, pattern: pattern, depth: depth}
+}
+
+// Next waits for the next extent and returns it with its data. The data
+// is only valid until the next call to Next, Read or Close. Next returns
+// io.EOF once the pattern or the file is exhausted.
+func (p *Prefetcher) Next() (Extent, []byte, error) {
+	if p.closed {
+		return Extent{}, nil, os.ErrClosed
+	}
+	if p.cur != nil {
+		p.free = append(p.free, p.cur)
+		p.cur, p.buf = nil, nil
+	}
+	p.fill()
+	if len(p.ahead) == 0 {
+		return Extent{}, nil, p.err
+	}
+
+	pf := p.ahead[0]
+	p.ahead = p.ahead[1:]
+	p.cur = pf.buf
+	n, err := p.complete(pf)
+	if err != nil {
+		p.err = err
+		p.discard()
+		return Extent{}, nil, err
+	}
+	if n < pf.ext.Len {
+		p.err = io.EOF
+		p.discard()
+		if n == 0 {
+			return Extent{}, nil, io.EOF
+		}
+	}
+	return Extent{Off: pf.ext.Off, Len: n}, pf.buf[:n], nil
+}
+
+// Read implements io.Reader over the extents' data, back to back. Don't
+// mix it with Next.
+func (p *Prefetcher) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(p.buf) == 0 {
+		_, data, err := p.Next()
+		if err != nil {
+			return 0, err
+		}
+		p.buf = data
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// fill issues reads until depth of them are in flight or the pattern
+// ends.
+func (p *Prefetcher) fill() {
+	for p.err == nil && len(p.ahead) < p.depth {
+		ext, ok := p.pattern.Next()
+		if !ok {
+			p.err = io.EOF
+			return
+		}
+		if ext.Off < 0 || ext.Len <= 0 {
+			p.err = syscall.EINVAL
+			return
+		}
+
+		buf := p.buffer(ext.Len)
+		op, err := p.read(buf, ext.Off)
+		if err != nil {
+			p.free = append(p.free, buf)
+			p.err = err
+			return
+		}
+		p.ahead = append(p.ahead, prefetch{op: op, ext: ext, buf: buf})
+	}
+}
+
+// buffer returns a buffer of n bytes, reusing a free one if possible.
+func (p *Prefetcher) buffer(n int) []byte {
+	for i, buf := range p.free {
+		if cap(buf) >= n {
+			last := len(p.free) - 1
+			p.free[i] = p.free[last]
+			p.free = p.free[:last]
+			return buf[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// complete waits for a read, finishing it if it is short, and returns
+// the number of bytes read.
+func (p *Prefetcher) complete(pf prefetch) (int, error) {
+	op := pf.op
+	n := 0
+	for {
+		res, err := op.Result()
+		if err != nil || res == 0 {
+			return n, err
+		}
+		n += int(res)
+		if n == pf.ext.Len {
+			return n, nil
+		}
+		if op, err = p.read(pf.buf[n:], pf.ext.Off+int64(n)); err != nil {
+			return n, err
+		}
+	}
+}
+
+// read issues a single read of b at off.
+func (p *Prefetcher) read(b []byte, off int64) (*Operation, error) {
+	return p.e.submit(func(ud uint64) error {
+		return p.e.ring.PrepRead(p.fd, b, uint64(off), ud)
+	}, b)
+}
+
+// discard cancels the reads in flight; their buffers stay with them.
+func (p *Prefetcher) discard() {
+	for _, pf := range p.ahead {
+		pf.op.Cancel()
+	}
+	p.ahead = p.ahead[:0]
+}
+
+// Close cancels the reads in flight and waits for them to finish. It
+// does not close the descriptor.
+func (p *Prefetcher) Close() error {
+	if p.closed {
+		return os.ErrClosed
+	}
+	p.closed = true
+	ahead := p.ahead
+	p.discard()
+	for _, pf := range ahead {
+		<-pf.op.Done()
+	}
+	return nil
+}
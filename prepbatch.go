@@ -0,0 +1,102 @@
+//go:build linux
+
+package iouring
+
+import (
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// IORequest is one read or write of a PrepReadBatch or PrepWriteBatch.
+type IORequest struct {
+	Fd       int
+	Buf      []byte
+	Offset   uint64
+	UserData uint64
+}
+
+// PrepReadBatch prepares a read for each request, as PrepRead does, but
+// takes the SQ lock once and claims the SQEs in as few steps as the free
+// space allows, for workloads that queue many I/Os at a time. opts apply
+// to every SQE. Unlike PrepRead, a request with an empty Buf is still
+// issued and completes with 0. It returns the number of requests
+// prepared, in order, and ErrSQFull if the SQ filled up first or
+// ErrIOTooLarge at a Buf of more than MaxIOSize bytes.
+func (r *Ring) PrepReadBatch(reqs []IORequest, opts ...OpOption) (int, error) {
+	return r.prepBatch(len(reqs), opts, func(sqe *sys.SQE, i int) error {
+		return r.prepRW(sqe, sys.IORING_OP_READ, &reqs[i])
+	})
+}
+
+// PrepWriteBatch is PrepReadBatch for writes.
+func (r *Ring) PrepWriteBatch(reqs []IORequest, opts ...OpOption) (int, error) {
+	return r.prepBatch(len(reqs), opts, func(sqe *sys.SQE, i int) error {
+		return r.prepRW(sqe, sys.IORING_OP_WRITE, &reqs[i])
+	})
+}
+
+// PrepNopBatch prepares a NOP for each of userData, like PrepReadBatch.
+func (r *Ring) PrepNopBatch(userData []uint64, opts ...OpOption) (int, error) {
+	return r.prepBatch(len(userData), opts, func(sqe *sys.SQE, i int) error {
+		sqe.Opcode = uint8(sys.IORING_OP_NOP)
+		sqe.UserData = userData[i]
+		return nil
+	})
+}
+
+// prepRW fills sqe with a read or write request.
+func (r *Ring) prepRW(sqe *sys.SQE, op sys.Op, req *IORequest) error {
+	if len(req.Buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
+	sqe.Opcode = uint8(op)
+	sqe.Fd = int32(req.Fd)
+	if len(req.Buf) > 0 {
+		sqe.Addr = r.pin(sqe, unsafe.Pointer(&req.Buf[0]))
+		sqe.Len = uint32(len(req.Buf))
+	}
+	sqe.Off = req.Offset
+	sqe.UserData = req.UserData
+	return nil
+}
+
+// prepBatch claims SQEs for count requests and calls fill for each in
+// order, then applies opts. It returns how many it filled. If a request
+// is rejected, the SQEs claimed after it become NOPs with a userData of
+// zero, and so does its own if fill rejected it; one the ring rejected
+// fails instead, see rejectSQE.
+func (r *Ring) prepBatch(count int, opts []OpOption, fill func(sqe *sys.SQE, i int) error) (int, error) {
+	r.sqLock.RLock()
+	defer r.sqLock.RUnlock()
+
+	done := 0
+	for done < count {
+		pos, n := r.getSQEs(uint32(count - done))
+		if n == 0 {
+			return done, r.errNoSQE()
+		}
+		var err error
+		for k := uint32(0); k < n; k++ {
+			sqe := r.sqeAt(pos + k)
+			if err != nil {
+				// Claimed behind a rejected request
+				sqe.Opcode = uint8(sys.IORING_OP_NOP)
+				continue
+			}
+			if err = fill(sqe, done); err != nil {
+				sqe.Reset()
+				sqe.Opcode = uint8(sys.IORING_OP_NOP)
+				continue
+			}
+			applyOpOptions(sqe, opts)
+			if err = r.checkSQE(sqe); err == nil {
+				done++
+			}
+		}
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
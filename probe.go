@@ -3,6 +3,8 @@
 package iouring
 
 import (
+	"unsafe"
+
 	"github.com/behrlich/go-iouring/internal/sys"
 )
 
@@ -18,7 +20,8 @@ func (r *Ring) Probe() (*Probe, error) {
 	p := &Probe{
 		features: r.features,
 	}
-	err := sys.RegisterProbe(r.fd, &p.probe)
+	_, err := r.register(sys.IORING_REGISTER_PROBE,
+		unsafe.Pointer(&p.probe), uint32(sys.IORING_OP_LAST))
 	if err != nil {
 		return nil, err
 	}
@@ -27,7 +30,7 @@ func (r *Ring) Probe() (*Probe, error) {
 
 // SupportsOp returns true if the kernel supports the given operation.
 func (p *Probe) SupportsOp(op sys.Op) bool {
-	if uint8(op) > p.probe.LastOp {
+	if uint8(op) > p.probe.LastOp || int(op) >= len(p.probe.Ops) {
 		return false
 	}
 	return p.probe.Ops[op].Flags&sys.IO_URING_OP_SUPPORTED != 0
@@ -0,0 +1,157 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Proxy forwards data both ways between two connected sockets without
+// passing it through user space, as the core of a TCP proxy or load
+// balancer. Each direction waits for data with a poll, splices it from
+// the source socket into a pipe and from the pipe into the other
+// socket, all through an Executor's ring. When one side reaches end of
+// file, the other side's write half is shut down and the opposite
+// direction carries on until it ends too.
+//
+// The Proxy does not own the sockets; close them after Run returns.
+type Proxy struct {
+	e    *Executor
+	fds  [2]int
+	idle time.Duration
+
+	sent [2]atomic.Int64 // Bytes forwarded from fds[i] to the other side
+	last atomic.Int64    // Time of the last transfer, in Unix nanoseconds
+}
+
+// NewProxy returns a Proxy between the sockets a and b.
+func NewProxy(e *Executor, a, b int) *Proxy {
+	return &Proxy{e: e, fds: [2]int{a, b}}
+}
+
+// SetIdleTimeout makes Run fail with syscall.ETIMEDOUT once no data has
+// moved either way for d; zero turns the timeout off. It must be called
+// before Run.
+func (p *Proxy) SetIdleTimeout(d time.Duration) {
+	p.idle = d
+}
+
+// Transferred returns the bytes forwarded so far from a to b and from b
+// to a. It is safe to call while Run is running.
+func (p *Proxy) Transferred() (aToB, bToA int64) {
+	return p.sent[0].Load(), p.sent[1].Load()
+}
+
+// Run forwards data until both directions have reached end of file,
+// which returns nil, or until one of them fails, the idle timeout
+// expires or ctx is done, which cancels the other direction and
+// returns the cause.
+func (p *Proxy) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	p.last.Store(time.Now().UnixNano())
+	if p.idle > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(p.idle, func() {
+			// Transfers do not touch the timer; it checks when it fires
+			if left := p.idle - time.Since(time.Unix(0, p.last.Load())); left > 0 {
+				t.Reset(left)
+				return
+			}
+			cancel(syscall.ETIMEDOUT)
+		})
+		defer t.Stop()
+	}
+
+	var wg sync.WaitGroup
+	for dir := range p.fds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.forward(ctx, dir); err != nil {
+				cancel(err) // The first cause sticks
+			}
+		}()
+	}
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// forward moves data from fds[dir] to the other socket until end of
+// file, then shuts down the other socket's write half.
+func (p *Proxy) forward(ctx context.Context, dir int) error {
+	src, dst := p.fds[dir], p.fds[1-dir]
+	pipe, err := getPipe()
+	if err != nil {
+		return err
+	}
+	empty := true
+	defer func() { putPipe(pipe, empty) }()
+
+	for {
+		// Wait for data in the poll, not in a worker blocked in splice
+		if err := p.do(ctx, func(ud uint64) error {
+			return p.e.ring.PrepPollAdd(src, syscall.EPOLLIN, ud)
+		}); err != nil {
+			return err
+		}
+		in, err := p.submit(ctx, func(ud uint64) error {
+			return p.e.ring.PrepSplice(src, -1, pipe[1], -1, spliceChunk, sys.SPLICE_F_NONBLOCK, ud)
+		})
+		if errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if in == 0 {
+			err := p.do(ctx, func(ud uint64) error {
+				return p.e.ring.PrepShutdown(dst, syscall.SHUT_WR, ud)
+			})
+			if errors.Is(err, syscall.ENOTCONN) {
+				err = nil // The peer is gone already
+			}
+			return err
+		}
+
+		empty = false
+		for out := int32(0); out < in; {
+			n, err := p.submit(ctx, func(ud uint64) error {
+				return p.e.ring.PrepSplice(pipe[0], -1, dst, -1, uint32(in-out), 0, ud)
+			})
+			if err == nil && n == 0 {
+				err = syscall.EPIPE
+			}
+			if err != nil {
+				return err
+			}
+			out += n
+			p.sent[dir].Add(int64(n))
+			p.last.Store(time.Now().UnixNano())
+		}
+		empty = true
+	}
+}
+
+// submit runs one operation bound to ctx and returns its result.
+func (p *Proxy) submit(ctx context.Context, prep func(ud uint64) error) (int32, error) {
+	op, err := p.e.SubmitContext(ctx, prep)
+	if err != nil {
+		return 0, err
+	}
+	return op.Result()
+}
+
+// do is submit for operations whose result is only an error.
+func (p *Proxy) do(ctx context.Context, prep func(ud uint64) error) error {
+	_, err := p.submit(ctx, prep)
+	return err
+}
@@ -0,0 +1,243 @@
+package iouring
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// A recording starts with recordMagic, followed by records of a kind
+// byte, the int64 nanoseconds since the recording started, and a
+// payload: the 64-byte SQE in kernel layout, or the user data, result
+// and flags of a CQE. Integers are little-endian.
+const (
+	recordMagic = "IOURREC\x01"
+	recordSQE   = 1
+	recordCQE   = 2
+
+	recordSQESize = int(unsafe.Sizeof(sys.SQE{}))
+	recordCQESize = 16
+)
+
+// errNotRecording is returned for input that is not a recording.
+var errNotRecording = errors.New("iouring: not a ring recording")
+
+// Recorder captures the SQEs and CQEs of a ring created with
+// WithRecorder, for a Replayer to play back in a test. Only the first
+// 64 bytes of 128-byte SQEs and the first 16 bytes of 32-byte CQEs are
+// kept, and no buffer contents. After a write error the Recorder stops
+// writing and Flush returns the error.
+type Recorder struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	start time.Time
+	buf   [1 + 8 + recordSQESize]byte
+	err   error
+}
+
+// NewRecorder starts a recording on w, e.g. a file. Times in the
+// recording count from this call.
+func NewRecorder(w io.Writer) *Recorder {
+	rec := &Recorder{w: bufio.NewWriter(w), start: time.Now()}
+	_, rec.err = rec.w.WriteString(recordMagic)
+	return rec
+}
+
+// Flush writes out buffered records.
+func (rec *Recorder) Flush() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.err == nil {
+		rec.err = rec.w.Flush()
+	}
+	return rec.err
+}
+
+// recordSQE appends a submitted SQE.
+func (rec *Recorder) recordSQE(sqe *sys.SQE) {
+	rec.mu.Lock()
+	b := rec.header(recordSQE)
+	copy(b, unsafe.Slice((*byte)(unsafe.Pointer(sqe)), recordSQESize))
+	rec.write(len(b))
+	rec.mu.Unlock()
+}
+
+// recordCQE appends a consumed CQE.
+func (rec *Recorder) recordCQE(userData uint64, res int32, flags uint32) {
+	rec.mu.Lock()
+	b := rec.header(recordCQE)
+	binary.LittleEndian.PutUint64(b, userData)
+	binary.LittleEndian.PutUint32(b[8:], uint32(res))
+	binary.LittleEndian.PutUint32(b[12:], flags)
+	rec.write(recordCQESize)
+	rec.mu.Unlock()
+}
+
+// header fills in the kind and time of a record and returns the room
+// for its payload. Caller must hold rec.mu.
+func (rec *Recorder) header(kind byte) []byte {
+	rec.buf[0] = kind
+	binary.LittleEndian.PutUint64(rec.buf[1:], uint64(time.Since(rec.start)))
+	return rec.buf[9:]
+}
+
+// write writes the record with a payload of n bytes. Caller must hold
+// rec.mu.
+func (rec *Recorder) write(n int) {
+	if rec.err == nil {
+		_, rec.err = rec.w.Write(rec.buf[:9+n])
+	}
+}
+
+// Replayer plays a recording back through a FakeRing: each operation
+// submitted to the ring takes the outcome of the operation at the same
+// position in the recording, posting the CQEs recorded for it, with the
+// recorded user data replaced by the replayed one and at the recorded
+// delays in virtual time. Multishot requests get all their CQEs.
+// Operations that had not completed when the recording ended never
+// complete.
+//
+// Replaying expects the code under test to submit the same sequence of
+// opcodes. Once it diverges, Err reports where, and the ring handles
+// the rest of the operations as a plain FakeRing.
+type Replayer struct {
+	mu   sync.Mutex
+	ops  []replayOp
+	next int   // Position of the next operation submitted
+	err  error // Why replay stopped, if it did
+}
+
+// replayOp is a recorded operation.
+type replayOp struct {
+	sqe  sys.SQE
+	at   time.Duration
+	cqes []replayCQE
+}
+
+// replayCQE is a recorded completion.
+type replayCQE struct {
+	at    time.Duration
+	res   int32
+	flags uint32
+}
+
+// NewReplayer reads a recording made with a Recorder.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+		return nil, errNotRecording
+	}
+
+	rp := &Replayer{}
+	waiting := map[uint64][]int{} // Operations without final CQE by user data
+	var b [1 + 8 + recordSQESize]byte
+	for {
+		if _, err := io.ReadFull(br, b[:9]); err == io.EOF {
+			return rp, nil
+		} else if err != nil {
+			return nil, err
+		}
+		at := time.Duration(binary.LittleEndian.Uint64(b[1:]))
+		switch b[0] {
+		case recordSQE:
+			op := replayOp{at: at}
+			if _, err := io.ReadFull(br, unsafe.Slice((*byte)(unsafe.Pointer(&op.sqe)), recordSQESize)); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			waiting[op.sqe.UserData] = append(waiting[op.sqe.UserData], len(rp.ops))
+			rp.ops = append(rp.ops, op)
+		case recordCQE:
+			p := b[9 : 9+recordCQESize]
+			if _, err := io.ReadFull(br, p); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			userData := binary.LittleEndian.Uint64(p)
+			c := replayCQE{at: at, res: int32(binary.LittleEndian.Uint32(p[8:])), flags: binary.LittleEndian.Uint32(p[12:])}
+			// The oldest operation with the user data gets the CQE;
+			// one submitted before the recording started gets none
+			idx := waiting[userData]
+			if len(idx) == 0 {
+				continue
+			}
+			rp.ops[idx[0]].cqes = append(rp.ops[idx[0]].cqes, c)
+			if c.flags&sys.IORING_CQE_F_MORE == 0 {
+				waiting[userData] = idx[1:]
+			}
+		default:
+			return nil, errNotRecording
+		}
+	}
+}
+
+// NewRing creates the FakeRing to replay on, as NewFakeRing does. A
+// Replayer drives a single ring.
+func (rp *Replayer) NewRing(entries uint32) (*FakeRing, error) {
+	f, err := NewFakeRing(entries)
+	if err != nil {
+		return nil, err
+	}
+	f.replay = rp
+	return f, nil
+}
+
+// Err returns how the submitted operations diverged from the
+// recording, or nil.
+func (rp *Replayer) Err() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.err
+}
+
+// Remaining returns the number of recorded operations not yet replayed.
+func (rp *Replayer) Remaining() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return len(rp.ops) - rp.next
+}
+
+// take returns the recording of the next submitted operation, op, or
+// nil once replay has stopped.
+func (rp *Replayer) take(op *FakeOp) *replayOp {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return nil
+	}
+	pos := "iouring: replayed operation " + strconv.Itoa(rp.next) + " (" + opName(op.SQE.Opcode) + ") "
+	switch {
+	case rp.next == len(rp.ops):
+		rp.err = errors.New(pos + "is past the end of the recording")
+		return nil
+	case rp.ops[rp.next].sqe.Opcode != op.SQE.Opcode:
+		rp.err = errors.New(pos + "was recorded as " + opName(rp.ops[rp.next].sqe.Opcode))
+		return nil
+	}
+	rp.next++
+	return &rp.ops[rp.next-1]
+}
+
+// replayLocked puts the recorded completions of op in flight, and
+// reports whether there was a recording for it. Caller must hold f.mu.
+func (f *FakeRing) replayLocked(op *FakeOp) bool {
+	rec := f.replay.take(op)
+	if rec == nil {
+		return false
+	}
+	for _, c := range rec.cqes {
+		f.inflight = append(f.inflight, fakePending{
+			cqe: fakeCQE{userData: op.SQE.UserData, res: c.res, flags: c.flags},
+			due: f.now + c.at - rec.at,
+			seq: f.seq,
+		})
+		f.seq++
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Buffers of a RecvStream.
+const (
+	recvStreamBuffers    = 64
+	recvStreamBufferSize = 16 << 10
+)
+
+// RecvStream receives from a Conn with a multishot recv into a provided
+// buffer ring, both managed for the caller; see Conn.ReceiveStream.
+type RecvStream struct {
+	c       *Conn
+	ctx     context.Context
+	started bool
+	err     error
+
+	cqes eventQueue[streamCQE]
+
+	mu      sync.Mutex
+	bufs    *BufRing
+	slab    []byte
+	op      *Operation // The recv in flight; nil if none
+	out     int        // Buffers the kernel filled that are not back yet
+	starved bool       // The recv ran out of buffers; rearm on release
+	done    bool       // Iteration ended
+}
+
+// streamCQE is a CQE of the multishot request of a stream.
+type streamCQE struct {
+	res   int32
+	flags uint32
+}
+
+// ReceiveStream returns a stream that receives from the connection with
+// a multishot recv (5.19+), which keeps receiving into buffers the
+// kernel picks from a provided buffer ring without a request per read.
+// Its All method yields each segment as it arrives, a datagram on a
+// datagram socket, with a release func that hands the buffer back; the
+// data is valid until then. The recv is rearmed whenever the kernel ends
+// it, including when it runs out of buffers, which happens while the
+// caller holds on to all of them: iteration then waits for a release.
+//
+// Iteration ends at the end of the stream, on an error, once ctx is done,
+// or when the caller breaks out of it; Err reports why. On sockets other
+// than datagram sockets, receiving zero bytes ends the stream.
+func (c *Conn) ReceiveStream(ctx context.Context) *RecvStream {
+	return &RecvStream{c: c, ctx: ctx, cqes: newEventQueue[streamCQE]()}
+}
+
+// All yields the segments received. A stream can be iterated once.
+func (s *RecvStream) All() iter.Seq2[[]byte, func()] {
+	return func(yield func([]byte, func()) bool) {
+		if s.started {
+			s.err = errors.New("iouring: receive stream already iterated")
+			return
+		}
+		s.started = true
+		s.err = s.run(yield)
+	}
+}
+
+// Err returns the error that ended the iteration, or nil if the stream
+// ended or the caller stopped iterating.
+func (s *RecvStream) Err() error {
+	return s.err
+}
+
+// run receives until the stream ends and returns why it did.
+func (s *RecvStream) run(yield func([]byte, func()) bool) error {
+	c := s.c
+	if c.closed.Load() {
+		return c.opError("read", net.ErrClosed)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	bufs, err := c.e.ring.newBufRingFree(recvStreamBuffers)
+	if err != nil {
+		return c.opError("read", err)
+	}
+	s.bufs = bufs
+	s.slab = make([]byte, recvStreamBuffers*recvStreamBufferSize)
+	for i := 0; i < recvStreamBuffers; i++ {
+		bufs.Add(s.buffer(uint16(i)), uint16(i), i)
+	}
+	bufs.Advance(recvStreamBuffers)
+	defer s.stop()
+
+	s.mu.Lock()
+	err = s.armLocked()
+	s.mu.Unlock()
+	if err != nil {
+		return c.opError("read", err)
+	}
+
+	for {
+		cqe, err := s.cqes.next(s.ctx)
+		if err != nil {
+			return err
+		}
+		if cqe.flags&sys.IORING_CQE_F_MORE == 0 {
+			s.mu.Lock()
+			s.forget()
+			s.mu.Unlock()
+		}
+
+		if bid, ok := BufferID(cqe.flags); ok {
+			s.mu.Lock()
+			s.out++
+			s.mu.Unlock()
+			if cqe.res == 0 && c.sotype != syscall.SOCK_DGRAM {
+				s.release(bid)
+			} else if !yield(s.buffer(bid)[:cqe.res], s.releaser(bid)) {
+				return nil
+			}
+		}
+
+		switch {
+		case cqe.res == 0 && c.sotype != syscall.SOCK_DGRAM:
+			return nil // End of stream
+		case cqe.res == -int32(syscall.ENOBUFS):
+			// Rearmed below, or by a release once there are buffers
+		case cqe.res < 0:
+			return c.opError("read", c.mapError(syscall.Errno(-cqe.res), time.Time{}))
+		}
+		if cqe.flags&sys.IORING_CQE_F_MORE == 0 {
+			s.mu.Lock()
+			if cqe.res == -int32(syscall.ENOBUFS) && s.out == recvStreamBuffers {
+				s.starved = true
+			} else {
+				err = s.armLocked()
+			}
+			s.mu.Unlock()
+			if err != nil {
+				return c.opError("read", err)
+			}
+		}
+	}
+}
+
+// buffer returns the buffer with ID bid.
+func (s *RecvStream) buffer(bid uint16) []byte {
+	off := int(bid) * recvStreamBufferSize
+	return s.slab[off : off+recvStreamBufferSize : off+recvStreamBufferSize]
+}
+
+// armLocked submits the multishot recv. Caller must hold mu.
+func (s *RecvStream) armLocked() error {
+	c := s.c
+	op, err := c.e.submitEach(func(ud uint64) error {
+		return c.e.ring.PrepRecvMultishot(c.fd, s.bufs.BGid(), 0, ud)
+	}, s.push)
+	if err != nil {
+		return err
+	}
+	s.op = op
+
+	// Close cancels it like the Conn's other operations
+	c.track(op, ioNone, time.Time{})
+	if c.closed.Load() {
+		op.Cancel()
+	}
+	return nil
+}
+
+// forget drops the recv, which has ended. Caller must hold mu.
+func (s *RecvStream) forget() {
+	if s.op == nil {
+		return
+	}
+	s.c.untrack(s.op)
+	s.op = nil
+}
+
+// push queues a CQE of the recv.
+func (s *RecvStream) push(res int32, flags uint32) {
+	s.cqes.push(streamCQE{res, flags})
+}
+
+// releaser returns the release func of buffer bid.
+func (s *RecvStream) releaser(bid uint16) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { s.release(bid) })
+	}
+}
+
+// release hands buffer bid back to the kernel, and rearms the recv if it
+// was waiting for one.
+func (s *RecvStream) release(bid uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.bufs.Recycle(bid)
+	s.out--
+	if s.starved {
+		s.starved = false
+		if err := s.armLocked(); err != nil {
+			// Have the iteration retry, and fail if that fails too
+			s.push(-int32(syscall.ENOBUFS), 0)
+		}
+	}
+}
+
+// stop cancels the recv, waits for it to end and unregisters the buffer
+// ring. Buffers the caller still holds stay valid.
+func (s *RecvStream) stop() {
+	s.mu.Lock()
+	s.done = true
+	op := s.op
+	s.forget()
+	s.mu.Unlock()
+
+	if op != nil {
+		op.Cancel()
+		<-op.Done()
+	}
+	s.bufs.Close()
+}
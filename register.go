@@ -0,0 +1,418 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// register issues an io_uring_register call against this ring, using the
+// registered ring index for rings created with WithRegisteredFdOnly.
+// Some opcodes return a count on success. It returns ErrRingClosed once
+// the ring is closed, as the fd may already name another file.
+func (r *Ring) register(opcode uint32, arg unsafe.Pointer, nrArgs uint32) (int, error) {
+	if !r.hold() {
+		return 0, ErrRingClosed
+	}
+	defer r.drop()
+	return r.registerClosing(opcode, arg, nrArgs)
+}
+
+// registerClosing is register for Close and release, which run on a
+// closed ring whose fd they still own.
+func (r *Ring) registerClosing(opcode uint32, arg unsafe.Pointer, nrArgs uint32) (int, error) {
+	if r.emu != nil {
+		return r.emu.register(opcode)
+	}
+	r.stats.syscalls.Add(1)
+	return sys.RegisterResult(r.enterFd, opcode|r.registerFlags, arg, nrArgs)
+}
+
+// RegisterEventfd registers an eventfd for completion notification.
+func (r *Ring) RegisterEventfd(eventfd int) error {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	efd := int32(eventfd)
+	_, err := r.register(sys.IORING_REGISTER_EVENTFD, unsafe.Pointer(&efd), 1)
+	if err == nil {
+		r.regEventfd, r.hasEventfd = eventfd, true
+	}
+	return err
+}
+
+// UnregisterEventfd removes the registered eventfd. It does nothing if
+// none is registered.
+func (r *Ring) UnregisterEventfd() error {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	if !r.hasEventfd {
+		return nil
+	}
+	_, err := r.register(sys.IORING_UNREGISTER_EVENTFD, nil, 0)
+	if unregistered(err) {
+		r.hasEventfd = false
+		return nil
+	}
+	return err
+}
+
+// RegisterBuffers registers fixed buffers for I/O operations. The ring
+// keeps the buffers reachable until they are unregistered or replaced,
+// so the caller need not hold on to them, and reuses its copy of the
+// table on later registrations, which then don't allocate.
+func (r *Ring) RegisterBuffers(bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return syscall.EINVAL
+	}
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	iovecs := r.buffersToIovecs(bufs)
+	_, err := r.register(sys.IORING_REGISTER_BUFFERS,
+		unsafe.Pointer(&iovecs[0]), uint32(len(iovecs)))
+	clear(iovecs)
+	if err == nil {
+		r.retainBuffers(bufs)
+	}
+	return err
+}
+
+// buffersToIovecs builds the iovec array describing bufs in the ring's
+// reusable scratch array, which the caller clears once the kernel has
+// read it so it does not hold on to the buffers. Empty buffers produce
+// a zero iovec, which marks an empty table slot. Caller must hold bufMu.
+func (r *Ring) buffersToIovecs(bufs [][]byte) []syscall.Iovec {
+	r.bufIovecs = slices.Grow(r.bufIovecs[:0], len(bufs))[:len(bufs)]
+	for i, buf := range bufs {
+		r.bufIovecs[i] = syscall.Iovec{}
+		if len(buf) > 0 {
+			r.bufIovecs[i].Base = &buf[0]
+			r.bufIovecs[i].Len = uint64(len(buf))
+		}
+	}
+	return r.bufIovecs
+}
+
+// retainBuffers makes bufs the registered buffer table. Caller must hold
+// bufMu.
+func (r *Ring) retainBuffers(bufs [][]byte) {
+	clear(r.regBufs)
+	r.regBufs = append(r.regBufs[:0], bufs...)
+}
+
+// UnregisterBuffers removes registered buffers and drops the ring's
+// references to them. Requests still in flight keep using them, so
+// they must have completed before the memory is reused. It does nothing
+// if no buffers are registered.
+func (r *Ring) UnregisterBuffers() error {
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	if len(r.regBufs) == 0 {
+		return nil
+	}
+	_, err := r.register(sys.IORING_UNREGISTER_BUFFERS, nil, 0)
+	if unregistered(err) {
+		clear(r.regBufs)
+		r.regBufs = r.regBufs[:0]
+		return nil
+	}
+	return err
+}
+
+// RegisterFiles registers fixed file descriptors.
+func (r *Ring) RegisterFiles(fds []int) error {
+	if len(fds) == 0 {
+		return syscall.EINVAL
+	}
+
+	fds32 := make([]int32, len(fds))
+	for i, fd := range fds {
+		fds32[i] = int32(fd)
+	}
+
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	_, err := r.register(sys.IORING_REGISTER_FILES,
+		unsafe.Pointer(&fds32[0]), uint32(len(fds32)))
+	if err == nil {
+		r.regFiles = len(fds)
+	}
+	return err
+}
+
+// UnregisterFiles removes registered files. It does nothing if no files
+// are registered.
+func (r *Ring) UnregisterFiles() error {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	if r.regFiles == 0 {
+		return nil
+	}
+	_, err := r.register(sys.IORING_UNREGISTER_FILES, nil, 0)
+	if unregistered(err) {
+		r.regFiles = 0
+		return nil
+	}
+	return err
+}
+
+// RegisterFilesSparse registers a fixed file table of n empty slots (5.19+).
+// Slots are populated later with RegisterFilesUpdate or by direct
+// descriptor operations, so a server can pre-size a large table once
+// instead of re-registering every time a connection comes or goes.
+func (r *Ring) RegisterFilesSparse(n uint32) error {
+	if n == 0 {
+		return syscall.EINVAL
+	}
+
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	rr := sys.RsrcRegister{
+		Nr:    n,
+		Flags: sys.IORING_RSRC_REGISTER_SPARSE,
+	}
+	_, err := r.register(sys.IORING_REGISTER_FILES2,
+		unsafe.Pointer(&rr), uint32(unsafe.Sizeof(rr)))
+	if err == nil {
+		r.regFiles = int(n)
+	}
+	return err
+}
+
+// RegisterFilesUpdate installs fds into the registered file table
+// starting at slot offset, replacing whatever occupied those slots.
+// An fd of -1 clears a slot; -2 (IORING_REGISTER_FILES_SKIP) leaves it
+// unchanged. Returns the number of slots updated.
+func (r *Ring) RegisterFilesUpdate(offset uint32, fds []int) (int, error) {
+	if len(fds) == 0 {
+		return 0, nil
+	}
+
+	return r.RegisterFilesUpdateTags(offset, fds, nil)
+}
+
+// RegisterFilesTags registers fixed file descriptors with a per-slot
+// resource tag (5.13+). tags must be nil or the same length as fds.
+//
+// When a slot with a non-zero tag is later released, whether by
+// RegisterFilesUpdate replacing it or by UnregisterFiles, the kernel
+// posts a CQE with UserData set to the tag, Res 0 and no flags once the
+// file is no longer in use by any in-flight request. Only then is it
+// safe to reclaim resources tied to that file. Tags share the userData
+// namespace, so pick values that cannot collide with operation userData.
+func (r *Ring) RegisterFilesTags(fds []int, tags []uint64) error {
+	if len(fds) == 0 || (tags != nil && len(tags) != len(fds)) {
+		return syscall.EINVAL
+	}
+
+	fds32 := make([]int32, len(fds))
+	for i, fd := range fds {
+		fds32[i] = int32(fd)
+	}
+
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	rr := sys.RsrcRegister{
+		Nr:   uint32(len(fds32)),
+		Data: uint64(uintptr(unsafe.Pointer(&fds32[0]))),
+	}
+	if tags != nil {
+		rr.Tags = uint64(uintptr(unsafe.Pointer(&tags[0])))
+	}
+	_, err := r.register(sys.IORING_REGISTER_FILES2,
+		unsafe.Pointer(&rr), uint32(unsafe.Sizeof(rr)))
+	runtime.KeepAlive(fds32)
+	runtime.KeepAlive(tags)
+	if err == nil {
+		r.regFiles = len(fds)
+	}
+	return err
+}
+
+// RegisterFilesUpdateTags is like RegisterFilesUpdate but also assigns a
+// resource tag to each updated slot (see RegisterFilesTags). tags must be
+// nil or the same length as fds. The tag of the slot being replaced, if
+// any, is posted as a CQE once the old file is released.
+func (r *Ring) RegisterFilesUpdateTags(offset uint32, fds []int, tags []uint64) (int, error) {
+	if len(fds) == 0 {
+		return 0, nil
+	}
+	if tags != nil && len(tags) != len(fds) {
+		return 0, syscall.EINVAL
+	}
+
+	fds32 := make([]int32, len(fds))
+	for i, fd := range fds {
+		fds32[i] = int32(fd)
+	}
+
+	up := sys.RsrcUpdate{
+		Offset: offset,
+		Data:   uint64(uintptr(unsafe.Pointer(&fds32[0]))),
+		Nr:     uint32(len(fds32)),
+	}
+	if tags != nil {
+		up.Tags = uint64(uintptr(unsafe.Pointer(&tags[0])))
+	}
+	n, err := r.register(sys.IORING_REGISTER_FILES_UPDATE2,
+		unsafe.Pointer(&up), uint32(unsafe.Sizeof(up)))
+	runtime.KeepAlive(fds32)
+	runtime.KeepAlive(tags)
+	return n, err
+}
+
+// RegisterBuffersSparse registers a fixed buffer table of n empty slots
+// (5.19+). Slots are filled later with RegisterBuffersUpdate.
+func (r *Ring) RegisterBuffersSparse(n uint32) error {
+	if n == 0 {
+		return syscall.EINVAL
+	}
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	rr := sys.RsrcRegister{
+		Nr:    n,
+		Flags: sys.IORING_RSRC_REGISTER_SPARSE,
+	}
+	_, err := r.register(sys.IORING_REGISTER_BUFFERS2,
+		unsafe.Pointer(&rr), uint32(unsafe.Sizeof(rr)))
+	if err == nil {
+		clear(r.regBufs)
+		r.regBufs = slices.Grow(r.regBufs[:0], int(n))[:n]
+	}
+	return err
+}
+
+// RegisterBuffersTags registers fixed buffers with a per-slot resource tag
+// (5.13+). tags must be nil or the same length as bufs. An empty buffer
+// leaves its slot unset.
+//
+// As with RegisterFilesTags, releasing a slot with a non-zero tag posts a
+// CQE carrying the tag as UserData once no in-flight request still uses
+// the buffer, after which its memory may be reused or freed.
+func (r *Ring) RegisterBuffersTags(bufs [][]byte, tags []uint64) error {
+	if len(bufs) == 0 || (tags != nil && len(tags) != len(bufs)) {
+		return syscall.EINVAL
+	}
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	iovecs := r.buffersToIovecs(bufs)
+	rr := sys.RsrcRegister{
+		Nr:   uint32(len(iovecs)),
+		Data: uint64(uintptr(unsafe.Pointer(&iovecs[0]))),
+	}
+	if tags != nil {
+		rr.Tags = uint64(uintptr(unsafe.Pointer(&tags[0])))
+	}
+	_, err := r.register(sys.IORING_REGISTER_BUFFERS2,
+		unsafe.Pointer(&rr), uint32(unsafe.Sizeof(rr)))
+	clear(iovecs)
+	runtime.KeepAlive(tags)
+	if err == nil {
+		r.retainBuffers(bufs)
+	}
+	return err
+}
+
+// RegisterBuffersUpdate replaces the registered buffers starting at slot
+// offset (5.13+). An empty buffer clears its slot. Returns the number of
+// slots updated. Requests already using a replaced buffer keep it until
+// they complete, but the ring drops its reference to it, so its memory
+// must not be reused before then; a tag tells when.
+func (r *Ring) RegisterBuffersUpdate(offset uint32, bufs [][]byte) (int, error) {
+	return r.RegisterBuffersUpdateTags(offset, bufs, nil)
+}
+
+// RegisterBuffersUpdateTags is like RegisterBuffersUpdate but also assigns
+// a resource tag to each updated slot. tags must be nil or the same
+// length as bufs.
+func (r *Ring) RegisterBuffersUpdateTags(offset uint32, bufs [][]byte, tags []uint64) (int, error) {
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+	if tags != nil && len(tags) != len(bufs) {
+		return 0, syscall.EINVAL
+	}
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	iovecs := r.buffersToIovecs(bufs)
+	up := sys.RsrcUpdate{
+		Offset: offset,
+		Data:   uint64(uintptr(unsafe.Pointer(&iovecs[0]))),
+		Nr:     uint32(len(iovecs)),
+	}
+	if tags != nil {
+		up.Tags = uint64(uintptr(unsafe.Pointer(&tags[0])))
+	}
+	n, err := r.register(sys.IORING_REGISTER_BUFFERS_UPDATE,
+		unsafe.Pointer(&up), uint32(unsafe.Sizeof(up)))
+	clear(iovecs)
+	runtime.KeepAlive(tags)
+	for i := 0; i < n && int(offset)+i < len(r.regBufs); i++ {
+		r.regBufs[int(offset)+i] = bufs[i]
+	}
+	return n, err
+}
+
+// Clock IDs accepted by RegisterClock.
+const (
+	ClockMonotonic = sys.CLOCK_MONOTONIC
+	ClockBoottime  = sys.CLOCK_BOOTTIME
+)
+
+// RegisterClock selects the clock that CQE wait timeouts are measured
+// against (6.12+). The default is CLOCK_MONOTONIC, which stops while the
+// system is suspended; ClockBoottime keeps counting across suspend/resume.
+// The kernel rejects clocks other than ClockMonotonic and ClockBoottime
+// with EINVAL. This affects waits such as WaitCQETimeout, not timeout
+// SQEs, which select their clock per request via IORING_TIMEOUT_* flags.
+func (r *Ring) RegisterClock(clockid int32) error {
+	clk := sys.ClockRegister{ClockID: uint32(clockid)}
+	_, err := r.register(sys.IORING_REGISTER_CLOCK, unsafe.Pointer(&clk), 0)
+	return err
+}
+
+// RegisterPersonality registers the credentials of the calling thread
+// and returns their ID, so requests prepared later, from any thread, can
+// run with them through WithPersonality.
+func (r *Ring) RegisterPersonality() (uint16, error) {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	id, err := r.register(sys.IORING_REGISTER_PERSONALITY, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	r.regPersonalities = append(r.regPersonalities, uint16(id))
+	return uint16(id), nil
+}
+
+// UnregisterPersonality removes the credentials registered under id. It
+// does nothing if id is not registered.
+func (r *Ring) UnregisterPersonality(id uint16) error {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	i := slices.Index(r.regPersonalities, id)
+	if i < 0 {
+		return nil
+	}
+	_, err := r.register(sys.IORING_UNREGISTER_PERSONALITY, nil, uint32(id))
+	if unregistered(err) || err == syscall.EINVAL {
+		r.regPersonalities = slices.Delete(r.regPersonalities, i, i+1)
+		return nil
+	}
+	return err
+}
+
+// unregistered reports whether an unregister call left the resource
+// unregistered: it succeeded, the kernel had none registered, or Close
+// got there first.
+func unregistered(err error) bool {
+	return err == nil || err == syscall.ENXIO || err == ErrRingClosed
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Registry maps userData tokens to Go values such as connection objects
+// or buffers. It hands out tokens itself, so callers never encode
+// pointers into userData, which the garbage collector cannot see, and
+// never maintain their own maps.
+//
+// Tokens combine a slot index with a generation counter, so a stale
+// token from a released entry does not resolve to the value that reuses
+// its slot. Tokens are never zero and never have the top bit set, which
+// leaves those values free for the caller's own reserved userData.
+//
+// A Registry is safe for concurrent use. The zero value is ready to use.
+type Registry[T any] struct {
+	mu    sync.Mutex
+	slots []registrySlot[T]
+	free  []uint32 // Indexes of unused slots
+	live  int
+}
+
+type registrySlot[T any] struct {
+	gen   uint32 // Bumped on release; part of the token
+	inUse bool
+	val   T
+}
+
+// registryGenMask keeps the top bit of every token clear.
+const registryGenMask = 1<<31 - 1
+
+// Register stores v and returns the token to use as userData.
+func (g *Registry[T]) Register(v T) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var idx uint32
+	if n := len(g.free); n > 0 {
+		idx = g.free[n-1]
+		g.free = g.free[:n-1]
+	} else {
+		idx = uint32(len(g.slots))
+		g.slots = append(g.slots, registrySlot[T]{})
+	}
+
+	slot := &g.slots[idx]
+	slot.inUse = true
+	slot.val = v
+	g.live++
+	return uint64(slot.gen)<<32 | uint64(idx+1)
+}
+
+// slot returns the live slot for token, or nil. Caller must hold g.mu.
+func (g *Registry[T]) slot(token uint64) *registrySlot[T] {
+	idx := uint32(token) - 1
+	if token == 0 || uint64(idx) >= uint64(len(g.slots)) {
+		return nil
+	}
+	slot := &g.slots[idx]
+	if !slot.inUse || uint64(slot.gen) != token>>32 {
+		return nil
+	}
+	return slot
+}
+
+// Lookup returns the value registered under token.
+func (g *Registry[T]) Lookup(token uint64) (v T, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if slot := g.slot(token); slot != nil {
+		return slot.val, true
+	}
+	return v, false
+}
+
+// Release removes token and returns its value. The token becomes stale
+// and may be reissued only after its slot has cycled through every
+// generation.
+func (g *Registry[T]) Release(token uint64) (v T, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	slot := g.slot(token)
+	if slot == nil {
+		return v, false
+	}
+	v = slot.val
+	var zero T
+	slot.val = zero // Drop the reference for the GC
+	slot.inUse = false
+	slot.gen = (slot.gen + 1) & registryGenMask
+	g.free = append(g.free, uint32(token)-1)
+	g.live--
+	return v, true
+}
+
+// Complete resolves the token of a CQE. The entry is released unless
+// the CQE has IORING_CQE_F_MORE set, so multishot requests keep their
+// token until the final completion.
+func (g *Registry[T]) Complete(userData uint64, flags uint32) (v T, ok bool) {
+	if flags&sys.IORING_CQE_F_MORE != 0 {
+		return g.Lookup(userData)
+	}
+	return g.Release(userData)
+}
+
+// Len returns the number of registered entries.
+func (g *Registry[T]) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.live
+}
+
+// Range calls fn for each registered entry until fn returns false.
+// fn must not call back into the registry.
+func (g *Registry[T]) Range(fn func(token uint64, v T) bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i := range g.slots {
+		slot := &g.slots[i]
+		if slot.inUse && !fn(uint64(slot.gen)<<32|uint64(i+1), slot.val) {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+package iouring
+
+import (
+	"slices"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// RegistrationState lists the resources registered with a ring, as a
+// debugging aid for finding registrations that are never undone.
+type RegistrationState struct {
+	Buffers       int      // Slots of the registered buffer table; 0 if none
+	Files         int      // Slots of the registered file table; 0 if none
+	Eventfd       int      // Registered eventfd; -1 if none
+	BufRings      []uint16 // Buffer groups of the provided buffer rings
+	Personalities []uint16 // IDs of the registered credentials
+}
+
+// RegistrationState returns a snapshot of what is registered with the
+// ring through its methods. Raw io_uring_register calls on Fd are not
+// seen. Close unregisters everything, leaving it empty, except that the
+// buffers stay listed, and referenced, if CloseTimeout gave up on
+// requests that may still use them.
+func (r *Ring) RegistrationState() RegistrationState {
+	r.bufMu.Lock()
+	st := RegistrationState{Buffers: len(r.regBufs), Eventfd: -1}
+	r.bufMu.Unlock()
+
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	st.Files = r.regFiles
+	if r.hasEventfd {
+		st.Eventfd = r.regEventfd
+	}
+	st.BufRings = slices.Clone(r.regBufRings)
+	st.Personalities = slices.Clone(r.regPersonalities)
+	return st
+}
+
+// unregisterBufRing unregisters the provided buffer ring of group bgid,
+// unless Close already has.
+func (r *Ring) unregisterBufRing(bgid uint16) error {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	i := slices.Index(r.regBufRings, bgid)
+	if i < 0 {
+		return nil
+	}
+	reg := sys.BufRingSetup{BGid: bgid}
+	_, err := r.register(sys.IORING_UNREGISTER_PBUF_RING, unsafe.Pointer(&reg), 1)
+	if unregistered(err) {
+		r.regBufRings = slices.Delete(r.regBufRings, i, i+1)
+		return nil
+	}
+	return err
+}
+
+// unregisterAll unregisters what is still registered, for Close, so the
+// files and memory it pins are let go even while calls racing with Close
+// keep the ring open. The registered buffers stay reachable unless the
+// requests that might use them are known to be done. Errors are ignored:
+// the ring's teardown releases whatever is left.
+func (r *Ring) unregisterAll(drained bool) {
+	r.regMu.Lock()
+	for _, id := range r.regPersonalities {
+		r.registerClosing(sys.IORING_UNREGISTER_PERSONALITY, nil, uint32(id))
+	}
+	for _, bgid := range r.regBufRings {
+		reg := sys.BufRingSetup{BGid: bgid}
+		r.registerClosing(sys.IORING_UNREGISTER_PBUF_RING, unsafe.Pointer(&reg), 1)
+	}
+	if r.hasEventfd {
+		r.registerClosing(sys.IORING_UNREGISTER_EVENTFD, nil, 0)
+	}
+	if r.regFiles > 0 {
+		r.registerClosing(sys.IORING_UNREGISTER_FILES, nil, 0)
+	}
+	r.regPersonalities, r.regBufRings = nil, nil
+	r.hasEventfd, r.regFiles = false, 0
+	r.regMu.Unlock()
+
+	r.bufMu.Lock()
+	defer r.bufMu.Unlock()
+	if len(r.regBufs) > 0 {
+		r.registerClosing(sys.IORING_UNREGISTER_BUFFERS, nil, 0)
+		if drained {
+			clear(r.regBufs)
+			r.regBufs = r.regBufs[:0]
+		}
+	}
+}
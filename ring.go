@@ -5,25 +5,18 @@
 package iouring
 
 import (
-	"errors"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/behrlich/go-iouring/internal/sys"
 )
 
-// Common errors
-var (
-	ErrRingClosed   = errors.New("iouring: ring closed")
-	ErrSQFull       = errors.New("iouring: submission queue full")
-	ErrCQOverflow   = errors.New("iouring: completion queue overflow")
-	ErrNotSupported = errors.New("iouring: operation not supported on this kernel")
-)
-
-// Timespec is a time specification for timeout operations.
-type Timespec = sys.Timespec
+// Statx is the result buffer of PrepStatx (struct statx).
+type Statx = sys.Statx
 
 // Ring represents an io_uring instance.
 type Ring struct {
@@ -39,9 +32,10 @@ type Ring struct {
 	sqTail    *uint32      // Pointer into mmap'd region
 	sqFlags   *uint32      // Pointer into mmap'd region
 	sqDropped *uint32      // Pointer into mmap'd region
-	sqArray   []uint32     // SQ index array (into sqes)
+	sqArray   []uint32     // SQ index array (into sqes), identity-mapped; nil with NO_SQARRAY
 	sqes      []sys.SQE    // SQE array
 	sqesMmap  []byte       // mmap'd SQE region
+	sqeShift  uint32       // 1 if SQEs are 128 bytes (two sys.SQE slots)
 
 	// Completion queue
 	cqRing    []byte       // mmap'd CQ ring (may share with sqRing)
@@ -52,21 +46,113 @@ type Ring struct {
 	cqFlags   *uint32      // Pointer into mmap'd region
 	cqOverflow *uint32     // Pointer into mmap'd region
 	cqes      []sys.CQE    // CQE array (view into mmap)
+	cqeShift  uint32       // 1 if CQEs are 32 bytes (two sys.CQE slots)
+	cqOverflowSeen uint32  // CQOverflow as of the last CheckCQOverflow
+
+	// NO_MMAP memory
+	ringMem      []byte    // SQEs followed by the SQ/CQ rings
+	ringMemOwned bool      // ringMem was allocated by us and must be freed
+	ringMemHuge  bool      // ringMem is backed by MAP_HUGETLB pages
+	sqesSize     uint32    // Bytes of ringMem holding the SQE array
+
+	// Syscall target
+	enterFd       int    // Ring fd, or registered ring index
+	enterFlags    uint32 // IORING_ENTER_REGISTERED_RING if enterFd is an index
+	registerFlags uint32 // IORING_REGISTER_USE_REGISTERED_RING likewise
 
 	// Internal state
-	sqLock    sync.Mutex   // Protects SQ access for concurrent use
-	sqPending uint32       // Number of SQEs pending submission
-	closed    atomic.Bool
+	sqLock      sqMutex    // Shared to claim SQEs, exclusive to publish them
+	sqReserved  atomic.Uint32 // SQ tail including claimed, unpublished SQEs
+	sqPublished uint64     // Total SQEs ever made visible to the kernel
+	autoFlush   bool       // Prep calls submit when the SQ is full
+	sqpollFixed bool       // SQPOLL without SQPOLL_NONFIXED: fds must be fixed files
+	iopoll      bool       // Completions are found by polling in io_uring_enter (IOPOLL without SQPOLL)
+	trace       bool       // Annotate execution traces (WithTrace)
+	log         *slog.Logger // Debug log (WithLogger); nil if none
+	rec         *Recorder    // Capture (WithRecorder); nil if none
+	keep        *keepTable   // Memory of in-flight requests (WithKeepAlive); nil otherwise
+	tapped      bool         // log, rec or keep sees SQEs and CQEs
+	closed      atomic.Bool
+	users       atomic.Int64 // Calls using the ring memory, plus one until Close; see hold
+	released    atomic.Bool  // Ring memory and fd released
+
+	// Registered buffer table, kept reachable while the kernel uses it
+	bufMu     sync.Mutex
+	regBufs   [][]byte        // Buffers by slot; nil for an empty slot
+	bufIovecs []syscall.Iovec // Registration scratch, reused
+
+	// Other registered resources, for RegistrationState and Close
+	regMu            sync.Mutex
+	regFiles         int      // Slots of the file table; 0 if none
+	regEventfd       int      // Valid if hasEventfd
+	hasEventfd       bool
+	regBufRings      []uint16 // Groups of the provided buffer rings
+	regPersonalities []uint16
+
+	// Timeout SQE of WaitCQETimeout without EXT_ARG
+	waitMu       sync.Mutex
+	waitTs       sys.Timespec
+	waitTimeouts atomic.Bool // Such SQEs were issued; drop their CQEs
+
+	// Extended argument of waits with a timeout, see enterTimeout
+	waitArgMu sync.Mutex
+	waitArg   enterArg
+
+	// Completions reaped by WaitFor for other requests
+	stashMu     sync.Mutex
+	stash       map[uint64][]CQEView
+	stashReaper bool          // A WaitFor waits in the kernel for the others
+	stashWake   chan struct{} // Closed when the stash or its reaper changes
+
+	stats ringStats // Counters for Stats
+
+	notify *notifier // Eventfd waits (WithNetpollWait); nil otherwise
+	adapt  *adaptiveWait // Batch sizing of waits (WithAdaptiveWait); nil otherwise
+	spin   time.Duration // How long waits spin on the CQ first (WithSpinWait)
+	eintr  bool          // Enters fail with EINTR instead of retrying (WithEINTR)
+
+	submitRetry time.Duration // How long submissions retry EBUSY and EAGAIN (WithSubmitRetry)
+	ops         *Probe        // Opcodes Prep calls may use (WithOpCheck); nil if unchecked
+	emu    *pollRing // Epoll emulation (WithPollBackend); nil otherwise
 }
 
+var _ Ringer = (*Ring)(nil)
+
 // Option configures ring setup.
-type Option func(*sys.Params)
+type Option func(*setupConfig)
+
+// setupConfig collects option state before io_uring_setup.
+// Params is embedded so options can set kernel parameters directly.
+type setupConfig struct {
+	sys.Params
+
+	ringMem   []byte // App-provided memory for IORING_SETUP_NO_MMAP
+	hugePages bool   // Back library-allocated NO_MMAP memory with huge pages
+	autoFlush bool   // Submit instead of failing with ErrSQFull
+	netpoll   bool   // Wait through an eventfd in the netpoller
+	pollBackend bool // Emulate the ring with epoll
+	pollFallback bool // Emulate the ring if io_uring is unavailable
+	trace       bool // Annotate execution traces
+	log         *slog.Logger // Debug log of SQEs, enters and CQEs
+	rec         *Recorder    // Capture of SQEs and CQEs
+	issuerCheck bool         // Assert the single issuer (WithIssuerCheck)
+	keepAlive   bool         // Hold the memory of in-flight requests (WithKeepAlive)
+	adaptiveWait time.Duration // Latency budget of adaptive waits (WithAdaptiveWait)
+	spinWait     time.Duration // Spin before blocking waits (WithSpinWait)
+	eintr        bool          // Return EINTR from enters (WithEINTR)
+	submitRetry  time.Duration // Retry EBUSY and EAGAIN from submissions (WithSubmitRetry)
+	opCheck      bool          // Check Prep opcodes against the probe (WithOpCheck)
+}
 
 // WithSQPoll enables kernel-side SQ polling.
 // This eliminates syscalls for submission but requires CAP_SYS_NICE
-// or a recent kernel with io_uring permissions.
+// or a recent kernel with io_uring permissions. Submit only enters the
+// kernel when the thread has gone idle and needs a wakeup. Before 5.11
+// (no IORING_FEAT_SQPOLL_NONFIXED) the thread can only use registered
+// files, so Prep calls on such a ring fail with ErrFixedFileRequired for
+// an fd that is not a fixed file. See SQPollStats.
 func WithSQPoll() Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_SQPOLL
 	}
 }
@@ -74,7 +160,7 @@ func WithSQPoll() Option {
 // WithSQPollCPU pins the SQPOLL kernel thread to a specific CPU.
 // Must be used with WithSQPoll.
 func WithSQPollCPU(cpu uint32) Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_SQ_AFF
 		p.SQThreadCPU = cpu
 	}
@@ -82,15 +168,22 @@ func WithSQPollCPU(cpu uint32) Option {
 
 // WithSQPollIdle sets the idle timeout (milliseconds) for SQPOLL thread.
 func WithSQPollIdle(ms uint32) Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.SQThreadIdle = ms
 	}
 }
 
 // WithIOPoll enables I/O polling for completions.
 // Only works with file descriptors that support polling (e.g., NVMe).
+// Completions are not signaled but found by polling the device while
+// entering the kernel, so the ring's waits poll rather than sleep and
+// Reap polls once if the CQ is empty; PeekCQE and ForEachCQE alone never
+// see them. A wait with nothing in flight spins, though an Executor
+// parks its reaper while idle. The kernel only accepts reads, writes,
+// NOPs and uring commands on such a ring, and files must be opened with
+// O_DIRECT; see CheckIOPollFd.
 func WithIOPoll() Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_IOPOLL
 	}
 }
@@ -98,38 +191,165 @@ func WithIOPoll() Option {
 // WithCQSize sets a custom completion queue size.
 // By default CQ size is 2x SQ size.
 func WithCQSize(size uint32) Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_CQSIZE
 		p.CQEntries = size
 	}
 }
 
 // WithSingleIssuer indicates only one task will submit to this ring.
+// The ring then takes no lock when preparing and submitting SQEs, so it
+// must only be used from one goroutine, locked to its OS thread; that
+// includes Submitted, Pending and Stats. See WithIssuerCheck to catch
+// misuse, and LockIssuer to lock the goroutine.
 // Enables optimizations in the kernel.
 func WithSingleIssuer() Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_SINGLE_ISSUER
 	}
 }
 
 // WithDeferTaskrun defers task work until the next io_uring_enter call.
-// Useful for batching completions. Requires SINGLE_ISSUER.
+// Useful for batching completions. Implies WithSingleIssuer.
+// Completions are only posted when the issuing thread enters the kernel,
+// so reap them from that thread, holding runtime.LockOSThread, with the
+// waiting calls or with Reap; ForEachCQE and PeekCQE alone see nothing.
+// Executor, MultiRing and WithNetpollWait reap from other goroutines and
+// do not work with it.
 func WithDeferTaskrun() Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_DEFER_TASKRUN | sys.IORING_SETUP_SINGLE_ISSUER
 	}
 }
 
 // WithCoopTaskrun enables cooperative task running.
 func WithCoopTaskrun() Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= sys.IORING_SETUP_COOP_TASKRUN
 	}
 }
 
+// WithTaskrunFlag enables cooperative task running and has the kernel
+// set IORING_SQ_TASKRUN in the SQ flags whenever task work is pending
+// (IORING_SETUP_TASKRUN_FLAG, 5.19+). Since cooperative task running
+// no longer interrupts the submitter, event loops should check
+// HasPendingTaskWork and enter the kernel to have completions posted.
+// Combined with WithDeferTaskrun the flag reports deferred work instead.
+func WithTaskrunFlag() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_COOP_TASKRUN | sys.IORING_SETUP_TASKRUN_FLAG
+	}
+}
+
+// WithNoMmap places the SQ/CQ rings and SQE array in memory allocated by
+// this package instead of kernel memory mapped from the ring fd
+// (IORING_SETUP_NO_MMAP, 6.5+). On kernels before 6.15 each region must
+// be physically contiguous, which in practice limits small-page
+// allocations to rings that fit in a single page; use WithHugePageRings
+// for larger rings there.
+func WithNoMmap() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_NO_MMAP
+	}
+}
+
+// WithHugePageRings is like WithNoMmap but backs the ring memory with a
+// huge page (MAP_HUGETLB) when the system has huge pages reserved, e.g.
+// via /proc/sys/vm/nr_hugepages. Otherwise it falls back to regular
+// pages as AllocHugeMem does, which on kernels before 6.15 limits the
+// ring to what fits in one page; HugePages reports the outcome.
+func WithHugePageRings() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_NO_MMAP
+		p.hugePages = true
+	}
+}
+
+// WithRingMemory places the rings in application-provided memory
+// (IORING_SETUP_NO_MMAP, 6.5+), e.g. pre-faulted, NUMA-local or huge page
+// memory. mem must be page aligned and at least RingMemorySize bytes; it
+// is pinned by the kernel and must outlive the ring. The SQE array is
+// placed at the start of mem, followed by the SQ/CQ rings.
+func WithRingMemory(mem []byte) Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_NO_MMAP
+		p.ringMem = mem
+	}
+}
+
+// WithRegisteredFdOnly creates a ring that has no file descriptor
+// (IORING_SETUP_REGISTERED_FD_ONLY, 6.5+). Setup instead registers the
+// ring with the calling thread and returns its registered index, which
+// is used for every io_uring_enter and io_uring_register call. The ring
+// cannot be passed to other processes or inspected through /proc, which
+// narrows the attack surface of sandboxed processes. Implies WithNoMmap.
+//
+// Registered ring indexes are per thread: the goroutine that calls New
+// must hold runtime.LockOSThread for as long as it uses the ring,
+// including Close, and no other goroutine may use it.
+func WithRegisteredFdOnly() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_REGISTERED_FD_ONLY | sys.IORING_SETUP_NO_MMAP
+	}
+}
+
+// WithSQE128 makes every SQE 128 bytes (IORING_SETUP_SQE128, 5.19+).
+// The extra space extends the command area of IORING_OP_URING_CMD to 80
+// bytes, as required by NVMe passthrough and similar driver commands.
+func WithSQE128() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_SQE128
+	}
+}
+
+// WithCQE32 makes every CQE 32 bytes (IORING_SETUP_CQE32, 5.19+).
+// The extra 16 bytes carry operation-specific results, such as the NVMe
+// completion result of a passthrough command; read them with PeekCQE32
+// or ForEachCQE32.
+func WithCQE32() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_CQE32
+	}
+}
+
+// WithSubmitAll makes the kernel submit every SQE of a batch even if one
+// of them fails to submit (IORING_SETUP_SUBMIT_ALL, 5.18+). Without it a
+// submission error stops the batch; see Submit.
+func WithSubmitAll() Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_SUBMIT_ALL
+	}
+}
+
+// WithAutoFlush makes Prep calls that find the submission queue full
+// submit the pending SQEs and retry instead of returning ErrSQFull.
+// With SQPOLL the call waits for the kernel thread to free up space
+// (IORING_ENTER_SQ_WAIT). ErrSQFull is still returned if the kernel
+// consumes nothing, e.g. because the first pending SQE fails to submit.
+//
+// The flush can happen between any two Prep calls, so a chain of linked
+// SQEs is only guaranteed to be submitted together if SQSpace showed
+// room for all of it beforehand.
+func WithAutoFlush() Option {
+	return func(p *setupConfig) {
+		p.autoFlush = true
+	}
+}
+
+// WithAttachWQ shares the async worker pool (io-wq) of the ring with
+// file descriptor fd instead of creating a new one
+// (IORING_SETUP_ATTACH_WQ), bounding the worker threads of rings that
+// serve the same workload.
+func WithAttachWQ(fd int) Option {
+	return func(p *setupConfig) {
+		p.Flags |= sys.IORING_SETUP_ATTACH_WQ
+		p.WQFd = uint32(fd)
+	}
+}
+
 // WithFlags sets arbitrary setup flags.
 func WithFlags(flags uint32) Option {
-	return func(p *sys.Params) {
+	return func(p *setupConfig) {
 		p.Flags |= flags
 	}
 }
@@ -142,27 +362,84 @@ func New(entries uint32, opts ...Option) (*Ring, error) {
 		return nil, syscall.EINVAL
 	}
 
-	params := sys.Params{}
+	var cfg setupConfig
 	for _, opt := range opts {
-		opt(&params)
+		opt(&cfg)
+	}
+	if cfg.pollBackend {
+		return newPollRing(entries, &cfg)
+	}
+
+	r := &Ring{}
+	r.users.Store(1) // Dropped by Close
+	if cfg.Flags&sys.IORING_SETUP_NO_MMAP != 0 {
+		if err := r.setupRingMemory(entries, &cfg); err != nil {
+			return nil, err
+		}
 	}
 
-	fd, err := sys.Setup(entries, &params)
+	fd, err := sys.Setup(entries, &cfg.Params)
 	if err != nil {
+		r.freeRingMemory()
+		if cfg.pollFallback && (err == syscall.ENOSYS || err == syscall.EPERM) && cfg.Flags&^pollBackendFlags == 0 {
+			// No io_uring here, or it is blocked: emulate it
+			return newPollRing(entries, &cfg)
+		}
 		return nil, err
 	}
 
-	r := &Ring{
-		fd:       fd,
-		params:   params,
-		features: params.Features,
+	r.fd = fd
+	r.enterFd = fd
+	if cfg.Flags&sys.IORING_SETUP_REGISTERED_FD_ONLY != 0 {
+		r.fd = -1
+		r.enterFlags = sys.IORING_ENTER_REGISTERED_RING
+		r.registerFlags = sys.IORING_REGISTER_USE_REGISTERED_RING
+	}
+	r.params = cfg.Params
+	r.features = cfg.Params.Features
+	r.autoFlush = cfg.autoFlush
+	r.sqLock.shared = !cfg.autoFlush
+	r.sqpollFixed = r.params.Flags&sys.IORING_SETUP_SQPOLL != 0 && r.features&sys.IORING_FEAT_SQPOLL_NONFIXED == 0
+	r.sqLock.single = r.params.Flags&sys.IORING_SETUP_SINGLE_ISSUER != 0
+	r.iopoll = r.params.Flags&(sys.IORING_SETUP_IOPOLL|sys.IORING_SETUP_SQPOLL) == sys.IORING_SETUP_IOPOLL
+	r.sqLock.check = cfg.issuerCheck || issuerCheckAll
+	if cfg.adaptiveWait > 0 {
+		r.adapt = newAdaptiveWait(cfg.adaptiveWait, r.params.CQEntries)
+	}
+	if r.params.Flags&(sys.IORING_SETUP_DEFER_TASKRUN|sys.IORING_SETUP_IOPOLL) == 0 {
+		r.spin = cfg.spinWait
+	}
+	r.eintr = cfg.eintr
+	r.submitRetry = cfg.submitRetry
+	r.setHooks(&cfg)
+	if r.params.Flags&sys.IORING_SETUP_SQE128 != 0 {
+		r.sqeShift = 1
+	}
+	if r.params.Flags&sys.IORING_SETUP_CQE32 != 0 {
+		r.cqeShift = 1
 	}
 
 	if err := r.mapRings(); err != nil {
-		syscall.Close(fd)
+		r.closeFd()
+		r.freeRingMemory()
 		return nil, err
 	}
 
+	if cfg.netpoll {
+		if err := r.setupNotifier(); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	if cfg.opCheck {
+		ops, err := r.Probe()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.ops = ops
+	}
+
 	return r, nil
 }
 
@@ -172,7 +449,16 @@ func (r *Ring) mapRings() error {
 
 	// Calculate sizes
 	sqRingSize := p.SQOff.Array + p.SQEntries*4
-	cqRingSize := p.CQOff.CQEs + p.CQEntries*uint32(unsafe.Sizeof(sys.CQE{}))
+	cqRingSize := p.CQOff.CQEs + p.CQEntries*uint32(unsafe.Sizeof(sys.CQE{}))<<r.cqeShift
+
+	// With NO_MMAP the regions live in the memory handed to setup
+	if p.Flags&sys.IORING_SETUP_NO_MMAP != 0 {
+		r.sqesMmap = r.ringMem[:r.sqesSize]
+		r.sqRing = r.ringMem[r.sqesSize:]
+		r.cqRing = r.sqRing
+		r.setupPointers()
+		return nil
+	}
 
 	// If SINGLE_MMAP is supported, SQ and CQ share memory
 	singleMmap := p.Features&sys.IORING_FEAT_SINGLE_MMAP != 0
@@ -203,7 +489,7 @@ func (r *Ring) mapRings() error {
 	}
 
 	// Map SQE array
-	sqeSize := p.SQEntries * uint32(unsafe.Sizeof(sys.SQE{}))
+	sqeSize := p.SQEntries * uint32(unsafe.Sizeof(sys.SQE{})) << r.sqeShift
 	r.sqesMmap, err = sys.Mmap(r.fd, sys.IORING_OFF_SQES, int(sqeSize),
 		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
 	if err != nil {
@@ -214,6 +500,14 @@ func (r *Ring) mapRings() error {
 		return err
 	}
 
+	r.setupPointers()
+	return nil
+}
+
+// setupPointers derives the ring pointers from the mapped regions.
+func (r *Ring) setupPointers() {
+	p := &r.params
+
 	// Set up SQ pointers
 	r.sqEntries = *(*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.RingEntries]))
 	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.RingMask]))
@@ -221,14 +515,24 @@ func (r *Ring) mapRings() error {
 	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.Tail]))
 	r.sqFlags = (*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.Flags]))
 	r.sqDropped = (*uint32)(unsafe.Pointer(&r.sqRing[p.SQOff.Dropped]))
-
-	// SQ array is uint32 indices into the SQE array
-	sqArrayPtr := unsafe.Pointer(&r.sqRing[p.SQOff.Array])
-	r.sqArray = unsafe.Slice((*uint32)(sqArrayPtr), r.sqEntries)
+	r.sqReserved.Store(sys.LoadAcquire(r.sqTail))
+
+	// SQ array is uint32 indices into the SQE array. getSQE hands out
+	// the SQE with the same index as the SQ slot, so the array is filled
+	// once here rather than on every Prep call. With NO_SQARRAY there is
+	// none and the kernel maps slots to SQEs the same way.
+	r.sqArray = nil
+	if p.Flags&sys.IORING_SETUP_NO_SQARRAY == 0 {
+		sqArrayPtr := unsafe.Pointer(&r.sqRing[p.SQOff.Array])
+		r.sqArray = unsafe.Slice((*uint32)(sqArrayPtr), r.sqEntries)
+		for i := range r.sqArray {
+			r.sqArray[i] = uint32(i)
+		}
+	}
 
 	// SQE array
 	sqesPtr := unsafe.Pointer(&r.sqesMmap[0])
-	r.sqes = unsafe.Slice((*sys.SQE)(sqesPtr), p.SQEntries)
+	r.sqes = unsafe.Slice((*sys.SQE)(sqesPtr), p.SQEntries<<r.sqeShift)
 
 	// Set up CQ pointers
 	r.cqEntries = *(*uint32)(unsafe.Pointer(&r.cqRing[p.CQOff.RingEntries]))
@@ -240,17 +544,122 @@ func (r *Ring) mapRings() error {
 
 	// CQE array
 	cqesPtr := unsafe.Pointer(&r.cqRing[p.CQOff.CQEs])
-	r.cqes = unsafe.Slice((*sys.CQE)(cqesPtr), r.cqEntries)
-
-	return nil
+	r.cqes = unsafe.Slice((*sys.CQE)(cqesPtr), r.cqEntries<<r.cqeShift)
 }
 
-// Close closes the ring and releases all resources.
+// Close cancels the requests still in flight, waits for them to
+// complete so that the kernel is done with their memory, unregisters the
+// resources still registered, and closes the ring. Their completions are
+// not delivered. Calls racing with Close are safe: Prep calls and
+// submissions in progress finish first, later ones fail with
+// ErrRingClosed, CQ accessors see an empty ring, and the ring memory
+// stays mapped until the last call using it has returned.
+// On a ring set up with WithSingleIssuer it must be called by the
+// issuer, or once the issuer has stopped.
+//
+// Cancelling in-flight requests uses IORING_REGISTER_SYNC_CANCEL (6.0+);
+// on older kernels, or on a WithSingleIssuer ring closed from another
+// thread, they are left to the kernel's own teardown. A request that
+// cannot be cancelled, such as a regular file read in progress, is
+// waited for; use CloseTimeout to bound the wait.
 func (r *Ring) Close() error {
+	return r.close(-1)
+}
+
+// CloseTimeout is Close with the wait for in-flight requests bounded by
+// timeout. If some are still running when it expires, the ring is closed
+// anyway and CloseTimeout returns syscall.ETIME.
+func (r *Ring) CloseTimeout(timeout time.Duration) error {
+	return r.close(max(timeout, 0))
+}
+
+// close implements Close, waiting indefinitely if timeout is negative.
+func (r *Ring) close(timeout time.Duration) error {
 	if r.closed.Swap(true) {
 		return nil // Already closed
 	}
 
+	// Wait out the Prep calls and flushes in progress; later ones see
+	// closed before touching the SQ
+	r.sqLock.Lock()
+	r.sqLock.Unlock()
+
+	if r.notify != nil {
+		r.notify.f.Close() // Wakes the waiters
+	}
+	if r.emu != nil {
+		r.emu.close() // Before the rings it posts to go away
+	}
+	cancelErr := r.cancelAll(timeout)
+	r.unregisterAll(cancelErr == nil)
+
+	// Drop the ring's own reference
+	if err := r.drop(); err != nil {
+		return err
+	}
+	return cancelErr
+}
+
+// hold keeps the ring memory mapped for the caller until it calls drop,
+// and reports false if the ring is closed. CQ accessors and submissions
+// hold the ring; Prep calls are covered by sqLock instead.
+func (r *Ring) hold() bool {
+	r.users.Add(1)
+	if r.closed.Load() {
+		r.drop()
+		return false
+	}
+	return true
+}
+
+// drop ends hold. The last caller out of a closed ring releases it:
+// the count includes a reference of the ring's own until Close drops
+// it, so it only reaches zero once the ring is closed.
+func (r *Ring) drop() error {
+	if r.users.Add(-1) == 0 && r.released.CompareAndSwap(false, true) {
+		return r.release()
+	}
+	return nil
+}
+
+// cancelAll cancels the ring's in-flight requests and waits up to
+// timeout, or indefinitely if it is negative, for them to complete. It
+// only reports syscall.ETIME; a kernel that cannot cancel synchronously
+// leaves the requests to the ring's teardown.
+func (r *Ring) cancelAll(timeout time.Duration) error {
+	if r.emu != nil {
+		return nil
+	}
+	reg := sys.SyncCancelReg{
+		Fd:      -1,
+		Flags:   sys.IORING_ASYNC_CANCEL_ANY | sys.IORING_ASYNC_CANCEL_ALL,
+		Timeout: sys.Timespec{Sec: -1, Nsec: -1},
+	}
+	if timeout >= 0 {
+		reg.Timeout = sys.Timespec{Sec: int64(timeout / time.Second), Nsec: int64(timeout % time.Second)}
+	}
+	for {
+		_, err := r.registerClosing(sys.IORING_REGISTER_SYNC_CANCEL, unsafe.Pointer(&reg), 1)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.ETIME:
+			return err
+		}
+		return nil // Done, or nothing was in flight (ENOENT)
+	}
+}
+
+// release unmaps the ring memory and closes the fd, once nothing uses
+// either any more.
+func (r *Ring) release() error {
+	if r.params.Flags&sys.IORING_SETUP_NO_MMAP != 0 {
+		// Closing the fd unpins the memory before we release it
+		err := r.closeFd()
+		r.freeRingMemory()
+		return err
+	}
+
 	// Unmap CQ if separate from SQ
 	if r.params.Features&sys.IORING_FEAT_SINGLE_MMAP == 0 && r.cqRing != nil {
 		sys.Munmap(r.cqRing)
@@ -264,10 +673,25 @@ func (r *Ring) Close() error {
 		sys.Munmap(r.sqesMmap)
 	}
 
-	return syscall.Close(r.fd)
+	return r.closeFd()
+}
+
+// closeFd drops our reference to the ring: the file descriptor, or the
+// registered index for rings created with WithRegisteredFdOnly.
+func (r *Ring) closeFd() error {
+	if r.emu != nil {
+		return nil
+	}
+	if r.registerFlags == 0 {
+		return syscall.Close(r.fd)
+	}
+	up := sys.FilesUpdate{Offset: uint32(r.enterFd)}
+	_, err := r.registerClosing(sys.IORING_UNREGISTER_RING_FDS, unsafe.Pointer(&up), 1)
+	return err
 }
 
-// Fd returns the ring file descriptor.
+// Fd returns the ring file descriptor, or -1 for rings created with
+// WithRegisteredFdOnly.
 func (r *Ring) Fd() int {
 	return r.fd
 }
@@ -282,6 +706,22 @@ func (r *Ring) HasFeature(feat uint32) bool {
 	return r.features&feat != 0
 }
 
+// HugePages reports whether the ring memory is backed by huge pages
+// (see WithHugePageRings).
+func (r *Ring) HugePages() bool {
+	return r.ringMemHuge
+}
+
+// SQESize returns the size of an SQE in bytes (64, or 128 with WithSQE128).
+func (r *Ring) SQESize() int {
+	return int(unsafe.Sizeof(sys.SQE{})) << r.sqeShift
+}
+
+// CQESize returns the size of a CQE in bytes (16, or 32 with WithCQE32).
+func (r *Ring) CQESize() int {
+	return int(unsafe.Sizeof(sys.CQE{})) << r.cqeShift
+}
+
 // SQEntries returns the number of submission queue entries.
 func (r *Ring) SQEntries() uint32 {
 	return r.sqEntries
@@ -294,24 +734,49 @@ func (r *Ring) CQEntries() uint32 {
 
 // SQReady returns the number of SQEs ready for submission.
 func (r *Ring) SQReady() uint32 {
-	return r.sqPending
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	return r.sqReserved.Load() - sys.LoadAcquire(r.sqTail)
+}
+
+// sqPendingLocked returns the number of SQEs claimed but not published
+// yet, none once the ring is closed. Caller must hold sqLock exclusively,
+// so that none is being filled.
+func (r *Ring) sqPendingLocked() uint32 {
+	if r.closed.Load() {
+		return 0
+	}
+	return r.sqReserved.Load() - sys.LoadAcquire(r.sqTail)
 }
 
 // SQSpace returns the available space in the submission queue.
 func (r *Ring) SQSpace() uint32 {
-	head := atomic.LoadUint32(r.sqHead)
-	tail := atomic.LoadUint32(r.sqTail)
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := sys.LoadAcquire(r.sqHead)
+	tail := sys.LoadAcquire(r.sqTail)
 	return r.sqEntries - (tail - head)
 }
 
 // CQReady returns the number of CQEs ready for consumption.
 func (r *Ring) CQReady() uint32 {
-	head := atomic.LoadUint32(r.cqHead)
-	tail := atomic.LoadUint32(r.cqTail)
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	head := sys.LoadAcquire(r.cqHead)
+	tail := sys.LoadAcquire(r.cqTail)
 	return tail - head
 }
 
-// needsWakeup returns true if SQPOLL thread needs waking.
+// needsWakeup returns true if SQPOLL thread needs waking. Called after
+// the SQ tail is published, the load must not move before that store,
+// or the thread could go idle without seeing the new SQEs; Go's
+// sequentially consistent atomics order the two.
 func (r *Ring) needsWakeup() bool {
 	if r.params.Flags&sys.IORING_SETUP_SQPOLL == 0 {
 		return false
@@ -319,25 +784,55 @@ func (r *Ring) needsWakeup() bool {
 	return atomic.LoadUint32(r.sqFlags)&sys.IORING_SQ_NEED_WAKEUP != 0
 }
 
+// HasPendingTaskWork reports whether the kernel has task work queued
+// for this ring that will only run on the next io_uring_enter, e.g. via
+// SubmitAndWait or WaitCQE. It requires WithTaskrunFlag and always
+// returns false otherwise.
+func (r *Ring) HasPendingTaskWork() bool {
+	if !r.hold() {
+		return false
+	}
+	defer r.drop()
+	return atomic.LoadUint32(r.sqFlags)&sys.IORING_SQ_TASKRUN != 0
+}
+
+// CQOverflowPending reports whether completions are waiting in the
+// kernel's overflow list because the CQ ring was full
+// (IORING_SQ_CQ_OVERFLOW). Make room by consuming CQEs, then call
+// GetEvents or another wait to have them flushed into the ring.
+func (r *Ring) CQOverflowPending() bool {
+	if !r.hold() {
+		return false
+	}
+	defer r.drop()
+	return atomic.LoadUint32(r.sqFlags)&sys.IORING_SQ_CQ_OVERFLOW != 0
+}
+
 // Submit submits all pending SQEs to the kernel.
-// Returns the number of SQEs submitted.
+// Returns the number of SQEs the kernel consumed.
+//
+// By default the kernel stops consuming a batch at the first SQE that
+// fails to submit (for example an unsupported opcode). That SQE is
+// counted in the result and completes with an error CQE, but the SQEs
+// after it are not consumed, so the result is smaller than the number of
+// SQEs prepared. They stay queued and are submitted again, ahead of any
+// newer SQEs, by the next call that submits; Pending reports how many
+// are left. An error is only returned if nothing was consumed.
+// Rings created with WithSubmitAll keep going after such failures and
+// always consume the whole batch.
 func (r *Ring) Submit() (int, error) {
-	if r.closed.Load() {
+	if !r.hold() {
 		return 0, ErrRingClosed
 	}
+	defer r.drop()
 
-	r.sqLock.Lock()
-	submitted := r.sqPending
+	submitted := r.flushSQ()
 	if submitted == 0 {
-		r.sqLock.Unlock()
 		return 0, nil
 	}
-
-	// Update the SQ tail with release semantics
-	tail := atomic.LoadUint32(r.sqTail)
-	atomic.StoreUint32(r.sqTail, tail+submitted)
-	r.sqPending = 0
-	r.sqLock.Unlock()
+	if r.emu != nil {
+		return r.emu.submit()
+	}
 
 	// Determine if we need a syscall
 	var flags uint32
@@ -347,10 +842,11 @@ func (r *Ring) Submit() (int, error) {
 
 	// If SQPOLL and no wakeup needed, no syscall required
 	if r.params.Flags&sys.IORING_SETUP_SQPOLL != 0 && flags == 0 {
+		r.stats.noSyscall.Add(1)
 		return int(submitted), nil
 	}
 
-	n, err := sys.Enter(r.fd, submitted, 0, flags, nil)
+	n, err := r.submitEnter(submitted, 0, flags|r.enterFlags)
 	if err != nil {
 		return 0, err
 	}
@@ -358,79 +854,353 @@ func (r *Ring) Submit() (int, error) {
 }
 
 // SubmitAndWait submits pending SQEs and waits for at least n completions.
+// If n completions are already in the CQ ring it only submits, which
+// with SQPOLL usually needs no syscall at all.
 func (r *Ring) SubmitAndWait(n uint32) (int, error) {
-	if r.closed.Load() {
+	if !r.hold() {
 		return 0, ErrRingClosed
 	}
+	defer r.drop()
 
-	r.sqLock.Lock()
-	submitted := r.sqPending
-	if submitted > 0 {
-		tail := atomic.LoadUint32(r.sqTail)
-		atomic.StoreUint32(r.sqTail, tail+submitted)
-		r.sqPending = 0
+	if n > 0 && r.CQReady() >= n {
+		return r.Submit()
+	}
+	if r.notify != nil && n > 0 {
+		submitted, err := r.Submit()
+		if err != nil {
+			return 0, err
+		}
+		return submitted, r.waitNotify(n, 0, nil)
+	}
+	if r.emu != nil {
+		return r.Submit() // n is 0
+	}
+	if r.spin > 0 && n > 0 {
+		return r.submitAndSpin(n)
 	}
-	r.sqLock.Unlock()
+
+	submitted := r.flushSQ()
 
 	var flags uint32 = sys.IORING_ENTER_GETEVENTS
 	if r.needsWakeup() {
 		flags |= sys.IORING_ENTER_SQ_WAKEUP
 	}
 
-	result, err := sys.Enter(r.fd, submitted, n, flags, nil)
+	result, err := r.submitEnter(submitted, n, flags|r.enterFlags)
 	if err != nil {
 		return 0, err
 	}
+	if r.iopoll && n > 0 {
+		if err := r.iopollWait(n, time.Time{}); err != nil {
+			return 0, err
+		}
+	}
 	return result, nil
 }
 
-// RegisterEventfd registers an eventfd for completion notification.
-func (r *Ring) RegisterEventfd(eventfd int) error {
-	return sys.RegisterEventfd(r.fd, eventfd)
+// SubmitAndWaitSigmask is like SubmitAndWait but replaces the thread's
+// signal mask with mask for the duration of the wait. A signal outside
+// mask interrupts the wait with syscall.EINTR. The mask only applies
+// if the call actually waits; a nil mask leaves the signal mask alone.
+func (r *Ring) SubmitAndWaitSigmask(n uint32, mask *Sigset) (int, error) {
+	if !r.hold() {
+		return 0, ErrRingClosed
+	}
+	defer r.drop()
+	if r.emu != nil {
+		return 0, ErrNotSupported
+	}
+
+	submitted := r.flushSQ()
+
+	var flags uint32 = sys.IORING_ENTER_GETEVENTS
+	if r.needsWakeup() {
+		flags |= sys.IORING_ENTER_SQ_WAKEUP
+	}
+
+	var sig unsafe.Pointer
+	if mask != nil {
+		sig = unsafe.Pointer(&mask.val)
+	}
+
+	result, err := r.enter(submitted, n, flags|r.enterFlags, sig)
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// GetEvents enters the kernel to reap completions without submitting
+// pending SQEs and without waiting. This flushes overflowed CQEs into
+// the CQ ring and runs deferred task work (WithDeferTaskrun,
+// WithTaskrunFlag) while leaving prepared SQEs unpublished.
+func (r *Ring) GetEvents() error {
+	return r.getEvents(0)
 }
 
-// UnregisterEventfd removes the registered eventfd.
-func (r *Ring) UnregisterEventfd() error {
-	return sys.UnregisterEventfd(r.fd)
+// GetEventsArg is the extended argument to io_uring_enter
+// (IORING_ENTER_EXT_ARG). Sigmask and Ts hold the addresses of a Sigset's
+// mask and a Timespec.
+type GetEventsArg = sys.GetEventsArg
+
+// Flags for Enter (IORING_ENTER_*).
+const (
+	EnterGetEvents = sys.IORING_ENTER_GETEVENTS // Wait for minComplete CQEs
+	EnterSQWakeup  = sys.IORING_ENTER_SQ_WAKEUP // Wake the SQPOLL thread
+	EnterSQWait    = sys.IORING_ENTER_SQ_WAIT   // Wait for SQ space (SQPOLL)
+)
+
+// Enter calls io_uring_enter on the ring with caller-chosen arguments,
+// for flag combinations the other methods do not cover, e.g.
+//
+//	ring.Enter(0, 0, iouring.EnterSQWait, nil)
+//
+// Prepared SQEs are published first so toSubmit can count them. A
+// non-nil arg adds IORING_ENTER_EXT_ARG, and the memory its addresses
+// point to must stay alive and in place for the call: allocate it with
+// new rather than on the stack. IORING_ENTER_REGISTERED_RING is
+// added for rings created with WithRegisteredFdOnly.
+func (r *Ring) Enter(toSubmit, minComplete, flags uint32, arg *GetEventsArg) (int, error) {
+	if !r.hold() {
+		return 0, ErrRingClosed
+	}
+	defer r.drop()
+	if r.emu != nil {
+		return 0, ErrNotSupported
+	}
+
+	r.flushSQ()
+	if arg != nil {
+		return r.enterExt(toSubmit, minComplete, flags|r.enterFlags, arg)
+	}
+	return r.enter(toSubmit, minComplete, flags|r.enterFlags, nil)
 }
 
-// RegisterBuffers registers fixed buffers for I/O operations.
-func (r *Ring) RegisterBuffers(bufs [][]byte) error {
-	if len(bufs) == 0 {
-		return syscall.EINVAL
+// getEvents enters the kernel without submitting and waits for at least
+// minComplete CQEs.
+func (r *Ring) getEvents(minComplete uint32) error {
+	if !r.hold() {
+		return ErrRingClosed
+	}
+	defer r.drop()
+	if r.notify != nil && minComplete > 0 {
+		return r.waitNotify(minComplete, 0, nil)
+	}
+	if r.emu != nil {
+		r.emu.flushOverflow()
+		return nil
+	}
+	if r.iopoll && minComplete > 0 {
+		return r.iopollWait(minComplete, time.Time{})
+	}
+	if r.spin > 0 && minComplete > 0 && r.spinCQ(minComplete) {
+		return nil
+	}
+	if r.adapt != nil && minComplete == 1 {
+		return r.waitAdaptive()
 	}
 
-	iovecs := make([]syscall.Iovec, len(bufs))
-	for i, buf := range bufs {
-		if len(buf) > 0 {
-			iovecs[i].Base = &buf[0]
-			iovecs[i].Len = uint64(len(buf))
+	_, err := r.enter(0, minComplete, sys.IORING_ENTER_GETEVENTS|r.enterFlags, nil)
+	return err
+}
+
+// SubmitAndWaitTimeout is like SubmitAndWait but gives up waiting after
+// timeout, flushing submissions and bounding the wait in one syscall.
+// It requires IORING_FEAT_EXT_ARG (5.11+) and returns ErrNotSupported
+// without it.
+//
+// The kernel reports submission over the wait: if SQEs were submitted
+// the result is their count even when the timeout expired, so check
+// CQReady. If nothing was submitted, an expired timeout returns
+// syscall.ETIME.
+func (r *Ring) SubmitAndWaitTimeout(n uint32, timeout time.Duration) (int, error) {
+	if !r.hold() {
+		return 0, ErrRingClosed
+	}
+	defer r.drop()
+	if r.notify != nil {
+		submitted, err := r.Submit()
+		if err != nil {
+			return 0, err
 		}
+		err = r.waitNotify(n, timeout, nil)
+		if err == syscall.ETIME && submitted > 0 {
+			err = nil
+		}
+		return submitted, err
+	}
+	if !r.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		return 0, ErrNotSupported
+	}
+
+	submitted := r.flushSQ()
+
+	var flags uint32 = sys.IORING_ENTER_GETEVENTS
+	if r.needsWakeup() {
+		flags |= sys.IORING_ENTER_SQ_WAKEUP
+	}
+
+	result, err := r.enterTimeout(submitted, n, flags|r.enterFlags, nil, timeout)
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// setHooks copies the tracing, logging, recording and keep-alive
+// options of cfg.
+func (r *Ring) setHooks(cfg *setupConfig) {
+	r.trace = cfg.trace
+	r.log = cfg.log
+	r.rec = cfg.rec
+	if cfg.keepAlive {
+		r.keep = newKeepTable(r.params.SQEntries)
+	}
+	r.tapped = cfg.log != nil || cfg.rec != nil || r.keep != nil
+}
+
+// enter calls io_uring_enter on the ring, counting, tracing and
+// logging the syscall. Unless sig is set, it is retried after EINTR; see
+// WithEINTR.
+func (r *Ring) enter(toSubmit, minComplete, flags uint32, sig unsafe.Pointer) (int, error) {
+	r.stats.syscalls.Add(1)
+	if flags&sys.IORING_ENTER_SQ_WAKEUP != 0 {
+		r.stats.sqWakeups.Add(1)
+	}
+	if flags&sys.IORING_ENTER_REGISTERED_RING != 0 {
+		r.stats.regEnters.Add(1)
+	}
+	if region := r.traceEnter(flags); region != nil {
+		defer region.End()
+	}
+	n, err := sys.Enter(r.enterFd, toSubmit, minComplete, flags, sig)
+	for sig == nil && r.retryIntr(err) {
+		r.stats.syscalls.Add(1)
+		n, err = sys.Enter(r.enterFd, toSubmit, minComplete, flags, sig)
+	}
+	if r.log != nil {
+		r.logEnter(toSubmit, minComplete, flags, n, err)
+	}
+	return n, r.issuerErr(err)
+}
+
+// enterExt is enter with an extended argument. It is only retried after
+// EINTR if arg has neither a signal mask nor a timeout, which would
+// start over; see enterTimeout.
+func (r *Ring) enterExt(toSubmit, minComplete, flags uint32, arg *sys.GetEventsArg) (int, error) {
+	r.stats.syscalls.Add(1)
+	if flags&sys.IORING_ENTER_SQ_WAKEUP != 0 {
+		r.stats.sqWakeups.Add(1)
+	}
+	if flags&sys.IORING_ENTER_REGISTERED_RING != 0 {
+		r.stats.regEnters.Add(1)
+	}
+	if region := r.traceEnter(flags); region != nil {
+		defer region.End()
 	}
+	n, err := sys.EnterExt(r.enterFd, toSubmit, minComplete, flags, arg)
+	for arg.Sigmask == 0 && arg.Ts == 0 && r.retryIntr(err) {
+		r.stats.syscalls.Add(1)
+		n, err = sys.EnterExt(r.enterFd, toSubmit, minComplete, flags, arg)
+	}
+	if r.log != nil {
+		r.logEnter(toSubmit, minComplete, flags, n, err)
+	}
+	return n, r.issuerErr(err)
+}
 
-	return sys.RegisterBuffers(r.fd, iovecs)
+// issuerErr maps the kernel's refusal to let another thread enter a
+// single-issuer ring to ErrNotIssuer.
+func (r *Ring) issuerErr(err error) error {
+	if err == syscall.EEXIST && r.params.Flags&sys.IORING_SETUP_SINGLE_ISSUER != 0 {
+		return ErrNotIssuer
+	}
+	return err
 }
 
-// UnregisterBuffers removes registered buffers.
-func (r *Ring) UnregisterBuffers() error {
-	return sys.UnregisterBuffers(r.fd)
+// flushSQ publishes the pending SQEs to the kernel by advancing the SQ
+// tail, and returns how many published SQEs the kernel has yet to
+// consume. That includes SQEs left over from an earlier partial
+// submission, so passing the result to io_uring_enter resubmits them.
+func (r *Ring) flushSQ() uint32 {
+	r.sqLock.Lock()
+	defer r.sqLock.Unlock()
+	return r.flushSQLocked()
 }
 
-// RegisterFiles registers fixed file descriptors.
-func (r *Ring) RegisterFiles(fds []int) error {
-	if len(fds) == 0 {
-		return syscall.EINVAL
+// flushSQLocked is flushSQ for callers that hold sqLock exclusively.
+func (r *Ring) flushSQLocked() uint32 {
+	tail := sys.LoadAcquire(r.sqTail)
+	if pending := r.sqPendingLocked(); pending > 0 {
+		r.countOps(tail, pending)
+		r.stats.flushes.Add(1)
+		r.stats.published.Add(uint64(pending))
+		if r.tapped {
+			r.tapSQEs(tail, pending)
+		}
+
+		// Update the SQ tail with release semantics
+		tail += pending
+		sys.StoreRelease(r.sqTail, tail)
+		r.sqPublished += uint64(pending)
 	}
+	return tail - sys.LoadAcquire(r.sqHead)
+}
 
-	fds32 := make([]int32, len(fds))
-	for i, fd := range fds {
-		fds32[i] = int32(fd)
+// Submitted returns the total number of SQEs the kernel has consumed
+// over the life of the ring.
+func (r *Ring) Submitted() uint64 {
+	if !r.hold() {
+		return 0
 	}
+	defer r.drop()
+	r.sqLock.Lock()
+	defer r.sqLock.Unlock()
+	unconsumed := sys.LoadAcquire(r.sqTail) - sys.LoadAcquire(r.sqHead)
+	return r.sqPublished - uint64(unconsumed)
+}
 
-	return sys.RegisterFiles(r.fd, fds32)
+// Pending returns the number of prepared SQEs the kernel has not yet
+// consumed: those not submitted yet, plus any left in the SQ ring by a
+// partial submission or not yet picked up by the SQPOLL thread.
+func (r *Ring) Pending() uint32 {
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	r.sqLock.Lock()
+	defer r.sqLock.Unlock()
+	unconsumed := sys.LoadAcquire(r.sqTail) - sys.LoadAcquire(r.sqHead)
+	return unconsumed + r.sqPendingLocked()
 }
 
-// UnregisterFiles removes registered files.
-func (r *Ring) UnregisterFiles() error {
-	return sys.UnregisterFiles(r.fd)
+// flushFullLocked submits the pending SQEs to make room in a full SQ for
+// WithAutoFlush, waiting for the SQPOLL thread if necessary. It reports
+// whether any space was freed. Caller must hold sqLock exclusively.
+func (r *Ring) flushFullLocked() bool {
+	if r.closed.Load() {
+		return false
+	}
+
+	submitted := r.flushSQLocked()
+	if r.emu != nil {
+		r.emu.submit()
+		return r.SQSpace() > 0
+	}
+
+	var flags uint32
+	if r.params.Flags&sys.IORING_SETUP_SQPOLL != 0 {
+		flags |= sys.IORING_ENTER_SQ_WAIT
+		if r.needsWakeup() {
+			flags |= sys.IORING_ENTER_SQ_WAKEUP
+		}
+	}
+
+	for {
+		_, err := r.enter(submitted, 0, flags|r.enterFlags, nil)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	return r.SQSpace() > 0
 }
@@ -3,12 +3,32 @@
 package iouring
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/trace"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
 )
 
 func skipIfNoIOURing(t *testing.T) {
@@ -335,6 +355,164 @@ func TestForEachCQE(t *testing.T) {
 	}
 }
 
+func TestPeekCQEBatch(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	var batch [4]CQEView
+	if n := ring.PeekCQEBatch(batch[:]); n != 0 {
+		t.Fatalf("PeekCQEBatch on empty CQ = %d, want 0", n)
+	}
+
+	const numNops = 6
+	for i := 0; i < numNops; i++ {
+		ring.PrepNop(uint64(i + 1))
+	}
+	ring.SubmitAndWait(numNops)
+
+	// First batch is limited by len(dst)
+	n := ring.PeekCQEBatch(batch[:])
+	if n != len(batch) {
+		t.Fatalf("PeekCQEBatch = %d, want %d", n, len(batch))
+	}
+	for i, cqe := range batch[:n] {
+		if cqe.UserData != uint64(i+1) || cqe.Res != 0 {
+			t.Errorf("batch[%d] = %+v, want UserData %d, Res 0", i, cqe, i+1)
+		}
+	}
+
+	// Peeking does not consume
+	if ring.CQReady() != numNops {
+		t.Errorf("CQReady() = %d after peek, want %d", ring.CQReady(), numNops)
+	}
+	ring.SeenCQEs(uint32(n))
+
+	n = ring.PeekCQEBatch(batch[:])
+	if n != numNops-len(batch) {
+		t.Fatalf("second PeekCQEBatch = %d, want %d", n, numNops-len(batch))
+	}
+	if batch[0].UserData != uint64(len(batch)+1) {
+		t.Errorf("second batch starts at UserData %d, want %d", batch[0].UserData, len(batch)+1)
+	}
+	ring.SeenCQEs(uint32(n))
+
+	if ring.CQReady() != 0 {
+		t.Errorf("CQReady() = %d after SeenCQEs, want 0", ring.CQReady())
+	}
+}
+
+func TestGetEvents(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(4, WithCQSize(4))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if !ring.HasFeature(sys.IORING_FEAT_NODROP) {
+		t.Skip("IORING_FEAT_NODROP not supported")
+	}
+
+	// Complete more NOPs than the CQ ring holds
+	const total = 12
+	for i := 0; i < total; i += 4 {
+		for j := 0; j < 4; j++ {
+			ring.PrepNop(uint64(i + j + 1))
+		}
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+	}
+	if ready := ring.CQReady(); ready != 4 {
+		t.Fatalf("CQReady() = %d, want 4", ready)
+	}
+	if !ring.CQOverflowPending() {
+		t.Fatal("CQOverflowPending() = false with a full CQ ring")
+	}
+
+	// A pending SQE must not be submitted by GetEvents
+	ring.PrepNop(100)
+
+	reaped := 0
+	for reaped < total {
+		reaped += int(ring.CQReady())
+		ring.DrainCQEs()
+		if err := ring.GetEvents(); err != nil {
+			t.Fatalf("GetEvents error = %v", err)
+		}
+		if ring.CQReady() == 0 {
+			break
+		}
+	}
+	if reaped != total {
+		t.Errorf("reaped %d CQEs, want %d", reaped, total)
+	}
+	if ring.CQOverflowPending() {
+		t.Error("CQOverflowPending() = true after flushing")
+	}
+	if ring.SQReady() != 1 {
+		t.Errorf("SQReady() = %d after GetEvents, want 1", ring.SQReady())
+	}
+}
+
+func TestCQEView(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if _, ok := ring.PeekCQEv(); ok {
+		t.Fatal("PeekCQEv on empty CQ returned ok")
+	}
+
+	ring.PrepNop(1)
+	cqe, err := ring.WaitCQEv()
+	if err != nil {
+		t.Fatalf("WaitCQEv error = %v", err)
+	}
+	ring.SeenCQE()
+	if cqe.UserData != 1 || cqe.Err() != nil || cqe.HasMore() {
+		t.Errorf("NOP CQE = %+v, Err() = %v", cqe, cqe.Err())
+	}
+
+	buf := make([]byte, 8)
+	ring.PrepRead(-1, buf, 0, 2)
+	ring.Submit()
+	cqe, err = ring.WaitCQETimeoutv(time.Second)
+	if err != nil {
+		t.Fatalf("WaitCQETimeoutv error = %v", err)
+	}
+	if peeked, ok := ring.PeekCQEv(); !ok || peeked != cqe {
+		t.Errorf("PeekCQEv = %+v, %v, want %+v", peeked, ok, cqe)
+	}
+	ring.SeenCQE()
+	if cqe.Err() != syscall.EBADF {
+		t.Errorf("read on bad fd Err() = %v, want EBADF", cqe.Err())
+	}
+
+	// Flag decoding
+	v := CQEView{Flags: sys.IORING_CQE_F_BUFFER | sys.IORING_CQE_F_MORE | 7<<16}
+	if bid, ok := v.BufferID(); !ok || bid != 7 {
+		t.Errorf("BufferID() = %d, %v, want 7, true", bid, ok)
+	}
+	if !v.HasMore() || v.IsNotification() || v.SockNonEmpty() {
+		t.Errorf("flags decode wrong for %+v", v)
+	}
+	v = CQEView{Flags: sys.IORING_CQE_F_NOTIF}
+	if _, ok := v.BufferID(); ok || !v.IsNotification() {
+		t.Errorf("flags decode wrong for %+v", v)
+	}
+}
+
 func BenchmarkNopSubmit(b *testing.B) {
 	ring, err := New(1024)
 	if err != nil {
@@ -376,6 +554,58 @@ func BenchmarkNopBatch(b *testing.B) {
 	}
 }
 
+func BenchmarkNopBatchPeek(b *testing.B) {
+	ring, err := New(1024)
+	if err != nil {
+		b.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+
+	const batchSize = 32
+	var cqes [batchSize]CQEView
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		n := batchSize
+		if b.N-i < n {
+			n = b.N - i
+		}
+		for j := 0; j < n; j++ {
+			ring.PrepNop(uint64(i + j))
+		}
+		ring.SubmitAndWait(uint32(n))
+
+		// Collect completions in one pass
+		got := ring.PeekCQEBatch(cqes[:n])
+		ring.SeenCQEs(uint32(got))
+	}
+}
+
+func BenchmarkNopPrepBatch(b *testing.B) {
+	ring, err := New(1024)
+	if err != nil {
+		b.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+
+	const batchSize = 32
+	var cqes [batchSize]CQEView
+	var uds [batchSize]uint64
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		n := min(batchSize, b.N-i)
+		for j := 0; j < n; j++ {
+			uds[j] = uint64(i + j)
+		}
+		ring.PrepNopBatch(uds[:n])
+		ring.SubmitAndWait(uint32(n))
+
+		got := ring.PeekCQEBatch(cqes[:n])
+		ring.SeenCQEs(uint32(got))
+	}
+}
+
 func TestProbe(t *testing.T) {
 	skipIfNoIOURing(t)
 
@@ -450,6 +680,68 @@ func TestTimeout(t *testing.T) {
 	t.Logf("Timeout elapsed: %dms", elapsed/1_000_000)
 }
 
+func TestSubmitAndWaitTimeout(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if !ring.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		if _, err := ring.SubmitAndWaitTimeout(1, time.Millisecond); err != ErrNotSupported {
+			t.Errorf("SubmitAndWaitTimeout error = %v, want ErrNotSupported", err)
+		}
+		t.Skip("IORING_FEAT_EXT_ARG not supported (requires 5.11+)")
+	}
+
+	// Nothing to submit or reap: the wait times out
+	start := time.Now()
+	if _, err := ring.SubmitAndWaitTimeout(1, 20*time.Millisecond); err != syscall.ETIME {
+		t.Errorf("idle SubmitAndWaitTimeout error = %v, want ETIME", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("idle wait returned after %v, expected ~20ms", elapsed)
+	}
+
+	// Completions arrive before the timeout
+	ring.PrepNop(1)
+	ring.PrepNop(2)
+	n, err := ring.SubmitAndWaitTimeout(2, time.Second)
+	if err != nil {
+		t.Fatalf("SubmitAndWaitTimeout error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("SubmitAndWaitTimeout = %d, want 2", n)
+	}
+	if ready := ring.CQReady(); ready != 2 {
+		t.Errorf("CQReady() = %d, want 2", ready)
+	}
+	ring.SeenCQEs(2)
+
+	// A submission that cannot complete reports the submit count
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	buf := make([]byte, 8)
+	ring.PrepRead(p[0], buf, 0, 3)
+	n, err = ring.SubmitAndWaitTimeout(1, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("SubmitAndWaitTimeout error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("SubmitAndWaitTimeout = %d, want 1", n)
+	}
+	if ready := ring.CQReady(); ready != 0 {
+		t.Errorf("CQReady() = %d after timeout, want 0", ready)
+	}
+}
+
 func TestCancel(t *testing.T) {
 	skipIfNoIOURing(t)
 
@@ -1075,6 +1367,59 @@ func BenchmarkReadFixedBuffer(b *testing.B) {
 	}
 }
 
+// BenchmarkReadIOPoll compares queue depth 1 O_DIRECT reads completed by
+// interrupt with polled ones. It needs a file or block device on a
+// device with poll queues, e.g. NVMe loaded with nvme.poll_queues=N:
+//
+//	IOURING_IOPOLL_FILE=/dev/nvme0n1 go test -bench ReadIOPoll
+func BenchmarkReadIOPoll(b *testing.B) {
+	name := os.Getenv("IOURING_IOPOLL_FILE")
+	if name == "" {
+		b.Skip("IOURING_IOPOLL_FILE not set")
+	}
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		b.Fatalf("OpenFile error = %v", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	a, err := NewBufferAllocator(4096, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer a.Free()
+	bufs, err := a.Alloc(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"irq", nil},
+		{"poll", []Option{WithIOPoll()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ring, err := New(8, bc.opts...)
+			if err != nil {
+				b.Skipf("New error = %v", err)
+			}
+			defer ring.Close()
+
+			for i := 0; i < b.N; i++ {
+				ring.PrepRead(fd, bufs[0], uint64(i%256)*4096, uint64(i))
+				_, res, _, err := ring.WaitCQE()
+				ring.SeenCQE()
+				if err != nil || res != 4096 {
+					b.Fatalf("read = %d, %v", res, err)
+				}
+			}
+		})
+	}
+}
+
 // Network tests
 
 func TestAcceptConnect(t *testing.T) {
@@ -1314,8 +1659,14 @@ func TestCloseOperation(t *testing.T) {
 	name := f.Name()
 	defer os.Remove(name)
 
-	// Get fd and close the Go file handle without closing the underlying fd
-	fd := int(f.Fd())
+	// Close the Go file handle and keep a duplicate of its fd, so that
+	// its finalizer cannot close the fd again after io_uring has closed
+	// it, possibly by then reused by another test
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Dup error = %v", err)
+	}
 
 	// Close using io_uring
 	err = ring.PrepClose(fd, 1)
@@ -1799,3 +2150,6967 @@ func TestBindListen(t *testing.T) {
 	}
 	t.Logf("Bound to port %d", port)
 }
+
+func TestRegisterFilesSparse(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.RegisterFilesSparse(1024); err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("sparse file registration not supported")
+		}
+		t.Fatalf("RegisterFilesSparse error = %v", err)
+	}
+	defer ring.UnregisterFiles()
+
+	f, err := os.CreateTemp("", "iouring_test_sparse")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	want := "sparse slot data"
+	if _, err := f.WriteString(want); err != nil {
+		t.Fatalf("WriteString error = %v", err)
+	}
+
+	// Install the file into slot 7
+	const slot = 7
+	n, err := ring.RegisterFilesUpdate(slot, []int{int(f.Fd())})
+	if err != nil {
+		t.Fatalf("RegisterFilesUpdate error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("RegisterFilesUpdate = %d, want 1", n)
+	}
+
+	// Read through the fixed file slot
+	buf := make([]byte, len(want))
+	if err := ring.PrepRead(slot, buf, 0, 1); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	ring.SetSQEFlags(sys.IOSQE_FIXED_FILE)
+
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+
+	if res != int32(len(want)) {
+		t.Fatalf("fixed read res = %d, want %d (errno: %v)", res, len(want), syscall.Errno(-res))
+	}
+	if string(buf) != want {
+		t.Errorf("fixed read data = %q, want %q", buf, want)
+	}
+
+	// Clear the slot; reads through it must now fail with EBADF
+	if _, err := ring.RegisterFilesUpdate(slot, []int{-1}); err != nil {
+		t.Fatalf("RegisterFilesUpdate(clear) error = %v", err)
+	}
+	if err := ring.PrepRead(slot, buf, 0, 2); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	ring.SetSQEFlags(sys.IOSQE_FIXED_FILE)
+
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, res, _, err = ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+
+	if res != -int32(syscall.EBADF) {
+		t.Errorf("read from cleared slot res = %d, want -EBADF", res)
+	}
+}
+
+func TestRegisterFilesTags(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if !ring.HasRsrcTags() {
+		t.Skip("resource tags not supported")
+	}
+
+	f1, err := os.CreateTemp("", "iouring_test_tag1")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+
+	f2, err := os.CreateTemp("", "iouring_test_tag2")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+
+	const tag1, tag2 = 0xdead0001, 0xdead0002
+	err = ring.RegisterFilesTags([]int{int(f1.Fd()), -1}, []uint64{tag1, 0})
+	if err != nil {
+		t.Fatalf("RegisterFilesTags error = %v", err)
+	}
+
+	// Replacing slot 0 releases f1 and must post its tag
+	if _, err := ring.RegisterFilesUpdateTags(0, []int{int(f2.Fd())}, []uint64{tag2}); err != nil {
+		t.Fatalf("RegisterFilesUpdateTags error = %v", err)
+	}
+
+	userData, res, flags, err := ring.WaitCQETimeout(time.Second)
+	if err != nil {
+		t.Fatalf("WaitCQETimeout error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != tag1 || res != 0 || flags != 0 {
+		t.Errorf("tag CQE = (%#x, %d, %#x), want (%#x, 0, 0)", userData, res, flags, tag1)
+	}
+
+	// Unregistering releases f2 and posts its tag
+	if err := ring.UnregisterFiles(); err != nil {
+		t.Fatalf("UnregisterFiles error = %v", err)
+	}
+	userData, _, _, err = ring.WaitCQETimeout(time.Second)
+	if err != nil {
+		t.Fatalf("WaitCQETimeout error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != tag2 {
+		t.Errorf("tag CQE userData = %#x, want %#x", userData, tag2)
+	}
+
+	// Mismatched tag slice is rejected
+	if err := ring.RegisterFilesTags([]int{int(f1.Fd())}, []uint64{1, 2}); err != syscall.EINVAL {
+		t.Errorf("RegisterFilesTags(mismatched) error = %v, want EINVAL", err)
+	}
+}
+
+func TestRegisterBuffersUpdate(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.RegisterBuffersSparse(8); err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("sparse buffer registration not supported")
+		}
+		t.Fatalf("RegisterBuffersSparse error = %v", err)
+	}
+	defer ring.UnregisterBuffers()
+
+	f, err := os.CreateTemp("", "iouring_test_bufupd")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Fixed I/O against an empty slot must fail
+	buf := make([]byte, 4096)
+	if err := ring.PrepWriteFixed(int(f.Fd()), buf[:16], 0, 3, 1); err != nil {
+		t.Fatalf("PrepWriteFixed error = %v", err)
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if res >= 0 {
+		t.Errorf("write_fixed on empty slot res = %d, want error", res)
+	}
+
+	// Install a tagged buffer into slot 3 and use it
+	const tag = 0xbeef
+	data := "swapped in at runtime"
+	copy(buf, data)
+	n, err := ring.RegisterBuffersUpdateTags(3, [][]byte{buf}, []uint64{tag})
+	if err != nil {
+		t.Fatalf("RegisterBuffersUpdateTags error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("RegisterBuffersUpdateTags = %d, want 1", n)
+	}
+
+	if err := ring.PrepWriteFixed(int(f.Fd()), buf[:len(data)], 0, 3, 2); err != nil {
+		t.Fatalf("PrepWriteFixed error = %v", err)
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, res, _, err = ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if res != int32(len(data)) {
+		t.Fatalf("write_fixed res = %d, want %d (errno: %v)", res, len(data), syscall.Errno(-res))
+	}
+
+	got := make([]byte, len(data))
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatalf("ReadAt error = %v", err)
+	}
+	if string(got) != data {
+		t.Errorf("file data = %q, want %q", got, data)
+	}
+
+	// Clearing the slot releases the buffer and posts its tag
+	if _, err := ring.RegisterBuffersUpdate(3, [][]byte{nil}); err != nil {
+		t.Fatalf("RegisterBuffersUpdate(clear) error = %v", err)
+	}
+	userData, _, _, err := ring.WaitCQETimeout(time.Second)
+	if err != nil {
+		t.Fatalf("WaitCQETimeout error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != tag {
+		t.Errorf("tag CQE userData = %#x, want %#x", userData, tag)
+	}
+}
+
+func TestBufRing(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	const bgid = 7
+	br, err := ring.NewBufRing(8, bgid)
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("provided buffer rings not supported (requires 5.19+)")
+		}
+		t.Fatalf("NewBufRing error = %v", err)
+	}
+	defer br.Close()
+
+	if _, err := ring.NewBufRing(6, bgid+1); err != syscall.EINVAL {
+		t.Errorf("NewBufRing(6) error = %v, want EINVAL", err)
+	}
+
+	for i := 0; i < 8; i++ {
+		br.Add(make([]byte, 64), uint16(i), i)
+	}
+	br.Advance(8)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	if err := ring.PrepRecvMultishot(fds[1], bgid, 0, 1); err != nil {
+		t.Fatalf("PrepRecvMultishot error = %v", err)
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+
+	msgs := []string{"first", "second", "third"}
+	for _, msg := range msgs {
+		if _, err := syscall.Write(fds[0], []byte(msg)); err != nil {
+			t.Fatalf("Write error = %v", err)
+		}
+
+		userData, res, flags, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+
+		if userData != 1 {
+			t.Fatalf("recv userData = %d, want 1", userData)
+		}
+		if res < 0 {
+			t.Fatalf("recv res = %d (errno: %v)", res, syscall.Errno(-res))
+		}
+		if flags&sys.IORING_CQE_F_MORE == 0 {
+			t.Errorf("multishot recv terminated early (flags %#x)", flags)
+		}
+		bid, ok := BufferID(flags)
+		if !ok {
+			t.Fatalf("recv CQE has no buffer (flags %#x)", flags)
+		}
+		if got := string(br.Buffer(bid)[:res]); got != msg {
+			t.Errorf("buffer %d data = %q, want %q", bid, got, msg)
+		}
+		br.Recycle(bid)
+	}
+
+	if _, ok := BufferID(0); ok {
+		t.Error("BufferID(0) reported a buffer")
+	}
+}
+
+func TestRegisterClock(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.RegisterClock(ClockBoottime); err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_REGISTER_CLOCK not supported (requires 6.12+)")
+		}
+		t.Fatalf("RegisterClock error = %v", err)
+	}
+
+	// Waits must still time out on the new clock
+	start := time.Now()
+	_, _, _, err = ring.WaitCQETimeout(20 * time.Millisecond)
+	if err != syscall.ETIME {
+		t.Fatalf("WaitCQETimeout error = %v, want ETIME", err)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("WaitCQETimeout returned after %v, want >= 20ms", elapsed)
+	}
+
+	if err := ring.RegisterClock(sys.CLOCK_REALTIME); err != syscall.EINVAL {
+		t.Errorf("RegisterClock(CLOCK_REALTIME) error = %v, want EINVAL", err)
+	}
+	if err := ring.RegisterClock(ClockMonotonic); err != nil {
+		t.Errorf("RegisterClock(ClockMonotonic) error = %v", err)
+	}
+}
+
+func TestBufRingStatus(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	const bgid = 3
+	br, err := ring.NewBufRing(4, bgid)
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("provided buffer rings not supported (requires 5.19+)")
+		}
+		t.Fatalf("NewBufRing error = %v", err)
+	}
+	defer br.Close()
+
+	for i := 0; i < 4; i++ {
+		br.Add(make([]byte, 32), uint16(i), i)
+	}
+	br.Advance(4)
+
+	head, err := ring.BufRingStatus(bgid)
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_REGISTER_PBUF_STATUS not supported (requires 6.8+)")
+		}
+		t.Fatalf("BufRingStatus error = %v", err)
+	}
+	if head != 0 {
+		t.Errorf("initial head = %d, want 0", head)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// Consume one buffer with a single-shot buffer-select recv
+	if _, err := syscall.Write(fds[0], []byte("x")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	sqe := ring.GetSQE()
+	sqe.Opcode = uint8(sys.IORING_OP_RECV)
+	sqe.Fd = int32(fds[1])
+	sqe.Flags = sys.IOSQE_BUFFER_SELECT
+	sqe.SetBufGroup(bgid)
+	sqe.UserData = 1
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if res != 1 {
+		t.Fatalf("recv res = %d, want 1", res)
+	}
+
+	head, err = br.Head()
+	if err != nil {
+		t.Fatalf("Head error = %v", err)
+	}
+	if head != 1 {
+		t.Errorf("head after recv = %d, want 1", head)
+	}
+	avail, err := br.Available()
+	if err != nil {
+		t.Fatalf("Available error = %v", err)
+	}
+	if avail != 3 {
+		t.Errorf("Available = %d, want 3", avail)
+	}
+}
+
+func nopRoundTrip(t *testing.T, ring *Ring, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := ring.PrepNop(uint64(i + 1)); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	for i := 0; i < n; i++ {
+		_, res, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		if res != 0 {
+			t.Errorf("nop res = %d, want 0", res)
+		}
+		ring.SeenCQE()
+	}
+}
+
+func TestNoMmap(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64, WithNoMmap())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_NO_MMAP not supported (requires 6.5+)")
+		}
+		t.Fatalf("New(WithNoMmap) error = %v", err)
+	}
+	nopRoundTrip(t, ring, 32)
+	if err := ring.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+}
+
+func TestRingMemory(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	size, err := RingMemorySize(256, WithCQSize(1024))
+	if err != nil {
+		t.Fatalf("RingMemorySize error = %v", err)
+	}
+	// 256 SQEs (16KiB) + 1024 CQEs (16KiB) + header and SQ array
+	if size < 32<<10 || size%os.Getpagesize() != 0 {
+		t.Errorf("RingMemorySize = %d, want page-aligned >= 32KiB", size)
+	}
+
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_POPULATE)
+	if err != nil {
+		t.Fatalf("Mmap error = %v", err)
+	}
+	defer syscall.Munmap(mem)
+
+	if _, err := New(256, WithCQSize(1024), WithRingMemory(mem[:size-1])); err != syscall.EINVAL {
+		t.Errorf("New with short memory error = %v, want EINVAL", err)
+	}
+
+	ring, err := New(256, WithCQSize(1024), WithRingMemory(mem))
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("multi-page NO_MMAP regions not supported on this kernel")
+		}
+		t.Fatalf("New(WithRingMemory) error = %v", err)
+	}
+	defer ring.Close()
+
+	if ring.SQEntries() != 256 || ring.CQEntries() != 1024 {
+		t.Errorf("entries = %d/%d, want 256/1024", ring.SQEntries(), ring.CQEntries())
+	}
+	nopRoundTrip(t, ring, 256)
+}
+
+func TestHugePageRings(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(1024, WithHugePageRings())
+	if err != nil {
+		if err == syscall.ENOMEM || err == syscall.EINVAL {
+			t.Skipf("huge page rings unavailable: %v", err)
+		}
+		t.Fatalf("New(WithHugePageRings) error = %v", err)
+	}
+	defer ring.Close()
+	t.Logf("HugePages() = %v", ring.HugePages())
+	nopRoundTrip(t, ring, 64)
+}
+
+func TestHugeMem(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	mem, err := AllocHugeMem(1 << 20)
+	if err != nil {
+		t.Fatalf("AllocHugeMem error = %v", err)
+	}
+	defer mem.Free()
+	t.Logf("Huge() = %v, len = %d", mem.Huge(), len(mem.Bytes()))
+
+	if len(mem.Bytes()) < 1<<20 {
+		t.Fatalf("len(Bytes()) = %d, want >= %d", len(mem.Bytes()), 1<<20)
+	}
+	if _, err := mem.Buffers(1, len(mem.Bytes())+1); err != syscall.EINVAL {
+		t.Errorf("oversized Buffers error = %v, want EINVAL", err)
+	}
+
+	bufs, err := mem.Buffers(16, 64<<10)
+	if err != nil {
+		t.Fatalf("Buffers error = %v", err)
+	}
+	if len(bufs) != 16 || cap(bufs[0]) != 64<<10 {
+		t.Fatalf("Buffers = %d x %d, want 16 x %d", len(bufs), cap(bufs[0]), 64<<10)
+	}
+	bufs[15][len(bufs[15])-1] = 0xaa
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.RegisterBuffers(bufs); err != nil {
+		t.Fatalf("RegisterBuffers error = %v", err)
+	}
+	if err := ring.UnregisterBuffers(); err != nil {
+		t.Errorf("UnregisterBuffers error = %v", err)
+	}
+
+	if err := mem.Free(); err != nil {
+		t.Errorf("Free error = %v", err)
+	}
+	if err := mem.Free(); err != nil {
+		t.Errorf("second Free error = %v", err)
+	}
+}
+
+func TestSQE128(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16, WithSQE128())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_SQE128 not supported (requires 5.19+)")
+		}
+		t.Fatalf("New(WithSQE128) error = %v", err)
+	}
+	defer ring.Close()
+
+	if ring.SQESize() != 128 {
+		t.Errorf("SQESize = %d, want 128", ring.SQESize())
+	}
+
+	// Wrap the ring a few times so every slot is exercised
+	for i := 0; i < 4; i++ {
+		nopRoundTrip(t, ring, 16)
+	}
+
+	// The full 80-byte command area is available
+	cmd := make([]byte, 80)
+	for i := range cmd {
+		cmd[i] = byte(i + 1)
+	}
+	if err := ring.PrepUringCmd(0, 0x42, cmd, 9); err != nil {
+		t.Fatalf("PrepUringCmd error = %v", err)
+	}
+	tail := ring.sqReserved.Load() - 1
+	sqe := &ring.sqes[(tail&ring.sqMask)<<1]
+	if sqe.Off != 0x42 {
+		t.Errorf("cmd_op = %#x, want 0x42", sqe.Off)
+	}
+	if got := sqe.Cmd(true); string(got) != string(cmd) {
+		t.Errorf("cmd area = %v, want %v", got, cmd)
+	}
+	ring.sqReserved.Add(^uint32(0)) // Drop the unsubmitted command
+
+	if err := ring.PrepUringCmd(0, 0, make([]byte, 81), 1); err != syscall.EINVAL {
+		t.Errorf("PrepUringCmd(81 bytes) error = %v, want EINVAL", err)
+	}
+
+	small, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer small.Close()
+	if small.SQESize() != 64 {
+		t.Errorf("SQESize = %d, want 64", small.SQESize())
+	}
+	if err := small.PrepUringCmd(0, 0, cmd, 1); err != syscall.EINVAL {
+		t.Errorf("PrepUringCmd(80 bytes) on 64-byte SQEs error = %v, want EINVAL", err)
+	}
+}
+
+func TestCQE32(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithCQE32())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_CQE32 not supported (requires 5.19+)")
+		}
+		t.Fatalf("New(WithCQE32) error = %v", err)
+	}
+	defer ring.Close()
+
+	if ring.CQESize() != 32 {
+		t.Errorf("CQESize = %d, want 32", ring.CQESize())
+	}
+
+	// Wrap the CQ several times; with wrong indexing userData comes back garbled
+	next := uint64(1)
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 8; i++ {
+			if err := ring.PrepNop(next + uint64(i)); err != nil {
+				t.Fatalf("PrepNop error = %v", err)
+			}
+		}
+		if _, err := ring.SubmitAndWait(8); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+
+		if round%2 == 0 {
+			for i := 0; i < 8; i++ {
+				userData, res, _, big, ok := ring.PeekCQE32()
+				if !ok {
+					t.Fatalf("PeekCQE32: no CQE")
+				}
+				if userData != next || res != 0 || big != [2]uint64{} {
+					t.Errorf("CQE32 = (%d, %d, %v), want (%d, 0, [0 0])", userData, res, big, next)
+				}
+				ring.SeenCQE()
+				next++
+			}
+		} else {
+			n := ring.ForEachCQE32(func(userData uint64, res int32, flags uint32, big [2]uint64) bool {
+				if userData != next {
+					t.Errorf("CQE32 userData = %d, want %d", userData, next)
+				}
+				next++
+				return true
+			})
+			if n != 8 {
+				t.Errorf("ForEachCQE32 = %d, want 8", n)
+			}
+		}
+	}
+}
+
+func TestSubmitAll(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	// prepBatch queues NOP, an SQE with an invalid opcode, then NOP.
+	prepBatch := func(ring *Ring) {
+		t.Helper()
+		if err := ring.PrepNop(1); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+		sqe := ring.GetSQE()
+		sqe.Opcode = 0xff
+		sqe.UserData = 2
+		if err := ring.PrepNop(3); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		ring, err := New(8)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer ring.Close()
+
+		prepBatch(ring)
+		n, err := ring.Submit()
+		if err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+		// The failing SQE is consumed, the one after it is not
+		if n != 2 {
+			t.Errorf("Submit = %d, want 2", n)
+		}
+	})
+
+	t.Run("submit_all", func(t *testing.T) {
+		ring, err := New(8, WithSubmitAll())
+		if err != nil {
+			if err == syscall.EINVAL {
+				t.Skip("IORING_SETUP_SUBMIT_ALL not supported (requires 5.18+)")
+			}
+			t.Fatalf("New(WithSubmitAll) error = %v", err)
+		}
+		defer ring.Close()
+
+		prepBatch(ring)
+		n, err := ring.Submit()
+		if err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+		if n != 3 {
+			t.Errorf("Submit = %d, want 3", n)
+		}
+
+		results := make(map[uint64]int32)
+		for i := 0; i < 3; i++ {
+			userData, res, _, err := ring.WaitCQE()
+			if err != nil {
+				t.Fatalf("WaitCQE error = %v", err)
+			}
+			ring.SeenCQE()
+			results[userData] = res
+		}
+		if results[1] != 0 || results[3] != 0 {
+			t.Errorf("NOP results = %d, %d, want 0, 0", results[1], results[3])
+		}
+		if results[2] != -int32(syscall.EINVAL) {
+			t.Errorf("invalid opcode res = %d, want -EINVAL", results[2])
+		}
+	})
+}
+
+func TestTaskrunFlag(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	// DEFER_TASKRUN binds the ring to the submitting thread and only runs
+	// task work on enter, so the flag stays set until we wait.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := New(8, WithTaskrunFlag(), WithDeferTaskrun())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_DEFER_TASKRUN not supported (requires 6.1+)")
+		}
+		t.Fatalf("New(WithTaskrunFlag) error = %v", err)
+	}
+	defer ring.Close()
+
+	if ring.HasPendingTaskWork() {
+		t.Fatal("HasPendingTaskWork() = true on idle ring")
+	}
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// A read on an empty pipe is armed via poll and completes from task work
+	buf := make([]byte, 16)
+	if err := ring.PrepRead(p[0], buf, 0, 1); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if _, err := syscall.Write(p[1], []byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+
+	if !ring.HasPendingTaskWork() {
+		t.Fatal("HasPendingTaskWork() = false after pipe became readable")
+	}
+	if n := ring.CQReady(); n != 0 {
+		t.Fatalf("CQReady() = %d before enter, want 0", n)
+	}
+
+	userData, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != 1 || res != 5 {
+		t.Errorf("CQE = (%d, %d), want (1, 5)", userData, res)
+	}
+	if ring.HasPendingTaskWork() {
+		t.Error("HasPendingTaskWork() = true after task work ran")
+	}
+}
+
+func TestRegisteredFdOnly(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	// The registered index belongs to the thread that created the ring
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := New(8, WithRegisteredFdOnly())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_REGISTERED_FD_ONLY not supported (requires 6.5+)")
+		}
+		t.Fatalf("New(WithRegisteredFdOnly) error = %v", err)
+	}
+
+	if fd := ring.Fd(); fd != -1 {
+		t.Errorf("Fd() = %d, want -1", fd)
+	}
+
+	nopRoundTrip(t, ring, 4)
+
+	// Registration goes through the registered index as well
+	if _, err := ring.Probe(); err != nil {
+		t.Errorf("Probe error = %v", err)
+	}
+
+	if err := ring.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	caps, err := Capabilities()
+	if err != nil {
+		t.Fatalf("Capabilities() error = %v", err)
+	}
+	t.Logf("Kernel %s (%d.%d), features 0x%x, setup flags 0x%x",
+		caps.KernelRelease, caps.KernelMajor, caps.KernelMinor, caps.Features, caps.SetupFlags)
+
+	if caps.KernelMajor < 5 {
+		t.Errorf("KernelMajor = %d, want >= 5", caps.KernelMajor)
+	}
+	if !caps.KernelAtLeast(caps.KernelMajor, caps.KernelMinor) {
+		t.Error("KernelAtLeast(own version) = false")
+	}
+	if caps.KernelAtLeast(caps.KernelMajor+1, 0) {
+		t.Error("KernelAtLeast(next major) = true")
+	}
+	if !caps.SupportsOp(sys.IORING_OP_NOP) {
+		t.Error("SupportsOp(NOP) = false")
+	}
+	if caps.Features == 0 {
+		t.Error("Features = 0")
+	}
+	// CQSIZE has been around since 5.5
+	if !caps.SupportsSetupFlag(sys.IORING_SETUP_CQSIZE) {
+		t.Error("SupportsSetupFlag(CQSIZE) = false")
+	}
+
+	again, _ := Capabilities()
+	if again != caps {
+		t.Error("Capabilities() not cached")
+	}
+
+	for _, tc := range []struct {
+		release      string
+		major, minor int
+	}{
+		{"6.8.0-45-generic", 6, 8},
+		{"5.15.0", 5, 15},
+		{"6.1", 6, 1},
+		{"6", 6, 0},
+	} {
+		major, minor := parseKernelVersion(tc.release)
+		if major != tc.major || minor != tc.minor {
+			t.Errorf("parseKernelVersion(%q) = %d.%d, want %d.%d",
+				tc.release, major, minor, tc.major, tc.minor)
+		}
+	}
+}
+
+func TestWaitSigmask(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	s := SigsetOf(syscall.SIGUSR1, syscall.SIGUSR2)
+	if !s.Has(syscall.SIGUSR1) || !s.Has(syscall.SIGUSR2) || s.Has(syscall.SIGINT) {
+		t.Errorf("SigsetOf membership wrong: %+v", s)
+	}
+	s.Del(syscall.SIGUSR2)
+	if s.Has(syscall.SIGUSR2) {
+		t.Error("Del(SIGUSR2) left it in the set")
+	}
+
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	// Block SIGUSR1 on this thread so it stays pending until a wait
+	// installs a mask that allows it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	block := SigsetOf(syscall.SIGUSR1)
+	var old Sigset
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, 0, // SIG_BLOCK
+		uintptr(unsafe.Pointer(&block)), uintptr(unsafe.Pointer(&old)), sys.SigsetSize, 0, 0); errno != 0 {
+		t.Fatalf("rt_sigprocmask error = %v", errno)
+	}
+	defer syscall.RawSyscall6(syscall.SYS_RT_SIGPROCMASK, 2, // SIG_SETMASK
+		uintptr(unsafe.Pointer(&old)), 0, sys.SigsetSize, 0, 0)
+
+	raise := func() {
+		t.Helper()
+		if err := syscall.Tgkill(syscall.Getpid(), syscall.Gettid(), syscall.SIGUSR1); err != nil {
+			t.Fatalf("Tgkill error = %v", err)
+		}
+	}
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	// An empty mask unblocks the pending signal and interrupts the wait
+	raise()
+	var empty Sigset
+	if _, err := ring.SubmitAndWaitSigmask(1, &empty); err != syscall.EINTR {
+		t.Errorf("SubmitAndWaitSigmask error = %v, want EINTR", err)
+	}
+	<-sigs
+
+	if !ring.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		t.Skip("IORING_FEAT_EXT_ARG not supported (requires 5.11+)")
+	}
+
+	raise()
+	if _, _, _, err := ring.WaitCQETimeoutSigmask(time.Second, &empty); err != syscall.EINTR {
+		t.Errorf("WaitCQETimeoutSigmask error = %v, want EINTR", err)
+	}
+	<-sigs
+
+	// Keeping the signal blocked lets the wait run to its timeout
+	raise()
+	if _, _, _, err := ring.WaitCQETimeoutSigmask(20*time.Millisecond, &block); err != syscall.ETIME {
+		t.Errorf("WaitCQETimeoutSigmask error = %v, want ETIME", err)
+	}
+
+	// The signal is still pending and fires on the next unmasked wait
+	if _, _, _, err := ring.WaitCQETimeoutSigmask(time.Second, &empty); err != syscall.EINTR {
+		t.Errorf("WaitCQETimeoutSigmask error = %v, want EINTR", err)
+	}
+	<-sigs
+}
+
+func TestExecutor(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	e := NewExecutor(ring)
+
+	// Many goroutines awaiting their own operations
+	const workers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				op, err := e.Submit(func(ud uint64) error { return ring.PrepNop(ud) })
+				if err != nil {
+					t.Errorf("Submit error = %v", err)
+					return
+				}
+				if res, err := op.Result(); res != 0 || err != nil {
+					t.Errorf("NOP Result() = %d, %v", res, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// A read on an empty pipe blocks until canceled
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	buf := make([]byte, 16)
+	op, err := e.Submit(func(ud uint64) error { return ring.PrepRead(p[0], buf, 0, ud) })
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	select {
+	case <-op.Done():
+		t.Fatal("read on empty pipe completed early")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := op.Cancel(); err != nil {
+		t.Fatalf("Cancel error = %v", err)
+	}
+	if _, err := op.Result(); !errors.Is(err, syscall.ECANCELED) && !errors.Is(err, syscall.EINTR) {
+		t.Errorf("canceled read Result() error = %v, want ECANCELED", err)
+	}
+	if err := op.Cancel(); err != nil {
+		t.Errorf("Cancel after completion error = %v", err)
+	}
+
+	// Close cancels whatever is still in flight
+	op, err = e.Submit(func(ud uint64) error { return ring.PrepRead(p[0], buf, 0, ud) })
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	select {
+	case <-op.Done():
+	default:
+		t.Error("in-flight operation not completed by Close")
+	}
+	if _, err := e.Submit(func(ud uint64) error { return ring.PrepNop(ud) }); err != ErrExecutorClosed {
+		t.Errorf("Submit after Close error = %v, want ErrExecutorClosed", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Errorf("second Close error = %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var reg Registry[string]
+
+	a := reg.Register("a")
+	b := reg.Register("b")
+	if a == 0 || b == 0 || a == b {
+		t.Fatalf("tokens a=%#x b=%#x, want distinct non-zero", a, b)
+	}
+	if v, ok := reg.Lookup(a); !ok || v != "a" {
+		t.Errorf("Lookup(a) = %q, %v", v, ok)
+	}
+	if reg.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", reg.Len())
+	}
+
+	// Multishot CQEs keep the entry, the final one releases it
+	if v, ok := reg.Complete(a, sys.IORING_CQE_F_MORE); !ok || v != "a" {
+		t.Errorf("Complete(a, MORE) = %q, %v", v, ok)
+	}
+	if v, ok := reg.Complete(a, 0); !ok || v != "a" {
+		t.Errorf("Complete(a) = %q, %v", v, ok)
+	}
+	if _, ok := reg.Lookup(a); ok {
+		t.Error("Lookup after Complete found entry")
+	}
+
+	// The freed slot is reused with a new generation
+	c := reg.Register("c")
+	if c == a {
+		t.Errorf("reused token %#x for a new entry", c)
+	}
+	if uint32(c) != uint32(a) {
+		t.Errorf("slot not reused: c=%#x a=%#x", c, a)
+	}
+	if _, ok := reg.Release(a); ok {
+		t.Error("Release of stale token succeeded")
+	}
+	if _, ok := reg.Lookup(0); ok {
+		t.Error("Lookup(0) succeeded")
+	}
+
+	seen := map[string]bool{}
+	reg.Range(func(token uint64, v string) bool {
+		if token>>63 != 0 {
+			t.Errorf("token %#x has top bit set", token)
+		}
+		seen[v] = true
+		return true
+	})
+	if len(seen) != 2 || !seen["b"] || !seen["c"] {
+		t.Errorf("Range saw %v, want b and c", seen)
+	}
+
+	reg.Release(b)
+	reg.Release(c)
+	if reg.Len() != 0 {
+		t.Errorf("Len() = %d after releasing all, want 0", reg.Len())
+	}
+}
+
+func TestChain(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// The read only starts once the write has completed
+	msg := []byte("linked")
+	buf := make([]byte, 16)
+	chain, err := e.NewChain().
+		Add(func(ud uint64) error { return ring.PrepWrite(p[1], msg, 0, ud) }).
+		Add(func(ud uint64) error { return ring.PrepRead(p[0], buf, 0, ud) }).
+		Submit()
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	results, err := chain.Results()
+	if err != nil {
+		t.Fatalf("Results error = %v", err)
+	}
+	if chain.Len() != 2 || results[0] != int32(len(msg)) || results[1] != int32(len(msg)) {
+		t.Errorf("Results = %v, want [%d %d]", results, len(msg), len(msg))
+	}
+	if string(buf[:results[1]]) != "linked" {
+		t.Errorf("read %q, want %q", buf[:results[1]], "linked")
+	}
+
+	// A failing step cancels the rest of a soft-linked chain
+	chain, err = e.NewChain().
+		Add(func(ud uint64) error { return ring.PrepRead(-1, buf, 0, ud) }).
+		Add(func(ud uint64) error { return ring.PrepNop(ud) }).
+		Submit()
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	results, err = chain.Results()
+	if !errors.Is(err, syscall.EBADF) || results[1] != -int32(syscall.ECANCELED) {
+		t.Errorf("Results = %v, %v, want [-EBADF -ECANCELED], EBADF", results, err)
+	}
+
+	// Hard links keep going
+	chain, err = e.NewChain().Hardlink().
+		Add(func(ud uint64) error { return ring.PrepRead(-1, buf, 0, ud) }).
+		Add(func(ud uint64) error { return ring.PrepNop(ud) }).
+		Submit()
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	results, _ = chain.Results()
+	if results[1] != 0 {
+		t.Errorf("hardlinked NOP result = %d, want 0", results[1])
+	}
+
+	// The trailing timeout cancels a step that never completes
+	chain, err = e.NewChain().
+		Add(func(ud uint64) error { return ring.PrepRead(p[0], buf, 0, ud) }).
+		WithTimeout(20 * time.Millisecond).
+		Submit()
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	select {
+	case <-chain.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out chain did not complete")
+	}
+	if !chain.TimedOut() {
+		t.Error("TimedOut() = false")
+	}
+	if _, err := chain.Step(0).Result(); !errors.Is(err, syscall.ECANCELED) && !errors.Is(err, syscall.EINTR) {
+		t.Errorf("timed out step error = %v, want ECANCELED", err)
+	}
+
+	// Steps must queue exactly one SQE
+	_, err = e.NewChain().
+		Add(func(ud uint64) error {
+			ring.PrepNop(ud)
+			return ring.PrepNop(ud)
+		}).
+		Submit()
+	if err != syscall.EINVAL {
+		t.Errorf("two-SQE step error = %v, want EINVAL", err)
+	}
+	if _, err := e.NewChain().Submit(); err != syscall.EINVAL {
+		t.Errorf("empty chain error = %v, want EINVAL", err)
+	}
+
+	// The executor is still usable afterwards
+	op, err := e.Submit(func(ud uint64) error { return ring.PrepNop(ud) })
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if _, err := op.Result(); err != nil {
+		t.Errorf("NOP Result error = %v", err)
+	}
+}
+
+func TestOpOptions(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// Other goroutines preparing NOPs cannot steal the link flag
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; j < 8; j++ {
+				ring.PrepNop(100)
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	buf := make([]byte, 16)
+	close(start)
+	if err := ring.PrepRead(p[0], buf, 0, 1, WithLink()); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	wg.Wait()
+
+	// Only the SQE created with WithLink carries the flag
+	linked := 0
+	tail := atomic.LoadUint32(ring.sqTail)
+	for i := uint32(0); i < ring.SQReady(); i++ {
+		sqe := &ring.sqes[(tail+i)&ring.sqMask]
+		if sqe.Flags&sys.IOSQE_IO_LINK != 0 {
+			linked++
+			if sqe.UserData != 1 {
+				t.Errorf("link flag on SQE with userData %d", sqe.UserData)
+			}
+		}
+	}
+	if linked != 1 {
+		t.Errorf("%d linked SQEs, want 1", linked)
+	}
+	ring.discardSQEs(tail, nil)
+	ring.Submit()
+	ring.DrainCQEs()
+
+	// A linked timeout cancels the read on the empty pipe
+	if err := ring.PrepRead(p[0], buf, 0, 1, WithLink()); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	ts := &Timespec{Nsec: 20_000_000}
+	if err := ring.PrepLinkTimeout(ts, 0, 2); err != nil {
+		t.Fatalf("PrepLinkTimeout error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	results := map[uint64]int32{}
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		results[userData] = res
+		return true
+	})
+	if results[1] != -int32(syscall.ECANCELED) && results[1] != -int32(syscall.EINTR) {
+		t.Errorf("read res = %d, want -ECANCELED", results[1])
+	}
+	if results[2] != -int32(syscall.ETIME) {
+		t.Errorf("link timeout res = %d, want -ETIME", results[2])
+	}
+
+	// Options must not cost allocations
+	allocs := testing.AllocsPerRun(100, func() {
+		ring.PrepNop(3, WithSQEFlags(sys.IOSQE_ASYNC), WithDrain())
+		ring.discardSQEs(ring.sqMark()-1, nil)
+		ring.Submit()
+		ring.DrainCQEs()
+	})
+	if allocs != 0 {
+		t.Errorf("PrepNop with options allocated %.1f times per call", allocs)
+	}
+}
+
+func TestPerOpOptions(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// Fixed file: the fd argument is replaced by the table slot
+	if err := ring.RegisterFiles([]int{fds[1]}); err != nil {
+		t.Fatalf("RegisterFiles error = %v", err)
+	}
+	syscall.Write(fds[0], []byte("fixed"))
+	buf := make([]byte, 16)
+	if err := ring.PrepRecv(-1, buf, 0, 1, WithFixedFile(0)); err != nil {
+		t.Fatalf("PrepRecv error = %v", err)
+	}
+	cqe, err := ring.WaitCQEv()
+	if err != nil {
+		t.Fatalf("WaitCQEv error = %v", err)
+	}
+	ring.SeenCQE()
+	if cqe.Res != 5 || string(buf[:5]) != "fixed" {
+		t.Errorf("fixed-file recv = %d %q, want 5 %q", cqe.Res, buf[:5], "fixed")
+	}
+
+	// Buffer group: the kernel picks the buffer
+	br, err := ring.NewBufRing(2, 3)
+	if err == nil {
+		defer br.Close()
+		br.Add(make([]byte, 32), 0, 0)
+		br.Add(make([]byte, 32), 1, 1)
+		br.Advance(2)
+
+		syscall.Write(fds[0], []byte("group"))
+		placeholder := make([]byte, 32)
+		if err := ring.PrepRecv(fds[1], placeholder, 0, 2, WithBufferGroup(3)); err != nil {
+			t.Fatalf("PrepRecv error = %v", err)
+		}
+		cqe, err := ring.WaitCQEv()
+		if err != nil {
+			t.Fatalf("WaitCQEv error = %v", err)
+		}
+		ring.SeenCQE()
+		bid, ok := cqe.BufferID()
+		if !ok || cqe.Res != 5 {
+			t.Fatalf("buffer group recv = %+v, want a selected buffer", cqe)
+		}
+		if got := string(br.Buffer(bid)[:5]); got != "group" {
+			t.Errorf("selected buffer holds %q, want %q", got, "group")
+		}
+		if placeholder[0] != 0 {
+			t.Error("placeholder buffer was written")
+		}
+	} else {
+		t.Logf("skipping buffer group check: %v", err)
+	}
+
+	// CQE skip: only the failure posts a completion
+	if ring.HasFeature(sys.IORING_FEAT_CQE_SKIP) {
+		ring.PrepNop(3, WithCQESkip())
+		ring.PrepRead(-1, buf, 0, 4, WithCQESkip())
+		ring.PrepNop(5)
+		if _, err := ring.SubmitAndWait(2); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		var got []uint64
+		ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			got = append(got, userData)
+			return true
+		})
+		if len(got) != 2 || got[0] != 4 || got[1] != 5 {
+			t.Errorf("CQEs for %v, want [4 5]", got)
+		}
+	}
+
+	// Plain field setters
+	ring.PrepNop(6, WithOpFlags(0x10), WithIoprio(0x4000))
+	sqe := &ring.sqes[atomic.LoadUint32(ring.sqTail)&ring.sqMask]
+	if sqe.OpFlags != 0x10 || sqe.Ioprio != 0x4000 {
+		t.Errorf("SQE OpFlags=%#x Ioprio=%#x, want 0x10 0x4000", sqe.OpFlags, sqe.Ioprio)
+	}
+	ring.discardSQEs(ring.sqMark()-1, nil)
+}
+
+func TestAutoFlush(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	const numNops = 20
+
+	run := func(t *testing.T, ring *Ring) {
+		for i := 0; i < numNops; i++ {
+			if err := ring.PrepNop(uint64(i + 1)); err != nil {
+				t.Fatalf("PrepNop(%d) error = %v", i, err)
+			}
+		}
+		if ring.SQReady() >= numNops {
+			t.Errorf("SQReady = %d, want the full SQ to have been flushed", ring.SQReady())
+		}
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+
+		seen := make(map[uint64]bool)
+		for len(seen) < numNops {
+			userData, res, _, err := ring.WaitCQE()
+			if err != nil {
+				t.Fatalf("WaitCQE error = %v", err)
+			}
+			ring.SeenCQE()
+			if res != 0 {
+				t.Errorf("NOP %d res = %d", userData, res)
+			}
+			seen[userData] = true
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		ring, err := New(4, WithCQSize(64), WithAutoFlush())
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer ring.Close()
+		run(t, ring)
+	})
+
+	t.Run("sqpoll", func(t *testing.T) {
+		ring, err := New(4, WithCQSize(64), WithSQPoll(), WithAutoFlush())
+		if err != nil {
+			if err == syscall.EPERM {
+				t.Skip("SQPOLL requires elevated privileges")
+			}
+			t.Fatalf("New() error = %v", err)
+		}
+		defer ring.Close()
+		run(t, ring)
+	})
+
+	t.Run("off", func(t *testing.T) {
+		ring, err := New(4)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer ring.Close()
+
+		for i := 0; i < 4; i++ {
+			if err := ring.PrepNop(uint64(i + 1)); err != nil {
+				t.Fatalf("PrepNop(%d) error = %v", i, err)
+			}
+		}
+		if err := ring.PrepNop(5); err != ErrSQFull {
+			t.Errorf("PrepNop on full SQ error = %v, want ErrSQFull", err)
+		}
+	})
+}
+
+func TestPartialSubmit(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	// The invalid opcode stops the batch after itself
+	if err := ring.PrepNop(1); err != nil {
+		t.Fatalf("PrepNop error = %v", err)
+	}
+	sqe := ring.GetSQE()
+	sqe.Opcode = 0xff
+	sqe.UserData = 2
+	if err := ring.PrepNop(3); err != nil {
+		t.Fatalf("PrepNop error = %v", err)
+	}
+	if got := ring.Pending(); got != 3 {
+		t.Errorf("Pending before Submit = %d, want 3", got)
+	}
+
+	n, err := ring.Submit()
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("Submit = %d, want 2", n)
+	}
+	if got := ring.Pending(); got != 1 {
+		t.Errorf("Pending after partial Submit = %d, want 1", got)
+	}
+	if got := ring.Submitted(); got != 2 {
+		t.Errorf("Submitted after partial Submit = %d, want 2", got)
+	}
+
+	// The next Submit picks up the leftover SQE with nothing new queued
+	n, err = ring.Submit()
+	if err != nil {
+		t.Fatalf("second Submit error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("second Submit = %d, want 1", n)
+	}
+	if got := ring.Pending(); got != 0 {
+		t.Errorf("Pending after resubmit = %d, want 0", got)
+	}
+	if got := ring.Submitted(); got != 3 {
+		t.Errorf("Submitted after resubmit = %d, want 3", got)
+	}
+
+	results := make(map[uint64]int32)
+	for i := 0; i < 3; i++ {
+		userData, res, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+		results[userData] = res
+	}
+	if results[1] != 0 || results[3] != 0 {
+		t.Errorf("NOP results = %d, %d, want 0, 0", results[1], results[3])
+	}
+	if results[2] >= 0 {
+		t.Errorf("invalid opcode res = %d, want an error", results[2])
+	}
+}
+
+func TestCQOverflowFlush(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(4, WithCQSize(4))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if !ring.HasFeature(sys.IORING_FEAT_NODROP) {
+		t.Skip("IORING_FEAT_NODROP not supported")
+	}
+
+	// overflow completes more NOPs than the CQ ring holds.
+	overflow := func(total int) {
+		t.Helper()
+		for i := 0; i < total; i += 4 {
+			for j := 0; j < 4; j++ {
+				ring.PrepNop(uint64(i + j + 1))
+			}
+			if _, err := ring.Submit(); err != nil {
+				t.Fatalf("Submit error = %v", err)
+			}
+		}
+		if !ring.CQOverflowPending() {
+			t.Fatal("CQOverflowPending() = false with a full CQ ring")
+		}
+	}
+
+	const total = 12
+
+	overflow(total)
+	n := ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		return true
+	})
+	if n != total {
+		t.Errorf("ForEachCQE = %d, want %d", n, total)
+	}
+
+	overflow(total)
+	n = 0
+	for {
+		if _, _, _, ok := ring.PeekCQE(); !ok {
+			break
+		}
+		ring.SeenCQE()
+		n++
+	}
+	if n != total {
+		t.Errorf("PeekCQE reaped %d, want %d", n, total)
+	}
+
+	if ring.CQOverflowPending() {
+		t.Error("CQOverflowPending() = true after reaping")
+	}
+	if err := ring.CheckCQOverflow(); err != nil {
+		t.Errorf("CheckCQOverflow error = %v, want nil with NODROP", err)
+	}
+}
+
+func TestSQDropped(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if got := ring.SQDropped(); got != 0 {
+		t.Fatalf("SQDropped() = %d on a new ring, want 0", got)
+	}
+
+	// Point the SQ array entry past the SQE array
+	sqe := ring.GetSQE()
+	sqe.Opcode = uint8(sys.IORING_OP_NOP)
+	idx := atomic.LoadUint32(ring.sqTail) & ring.sqMask
+	ring.sqArray[idx] = ring.sqEntries + 1
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+
+	if got := ring.SQDropped(); got != 1 {
+		t.Errorf("SQDropped() = %d, want 1", got)
+	}
+	stats := ring.Stats()
+	if stats.SQDropped != 1 {
+		t.Errorf("Stats().SQDropped = %d, want 1", stats.SQDropped)
+	}
+	if stats.Pending != 0 {
+		t.Errorf("Stats().Pending = %d, want 0", stats.Pending)
+	}
+}
+
+func TestOpError(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	dir, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	fd := int(dir.Fd())
+
+	buf := make([]byte, 16)
+	op, err := e.Submit(func(ud uint64) error {
+		return ring.PrepRead(fd, buf, 0, ud)
+	})
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	_, err = op.Result()
+	if !errors.Is(err, syscall.EISDIR) {
+		t.Fatalf("read on directory error = %v, want EISDIR", err)
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("error %T is not an *OpError", err)
+	}
+	if opErr.Op != "read" || opErr.Fd != fd || opErr.Fixed || opErr.UserData != op.userData {
+		t.Errorf("OpError = %+v", *opErr)
+	}
+	t.Logf("%v", err)
+
+	// Operations without a file leave Fd out of the message
+	nopErr := opError(uint8(sys.IORING_OP_NOP), 0, 0, 42, -int32(syscall.EINVAL))
+	if got, want := nopErr.Error(), "iouring: nop (userData 42): "+syscall.EINVAL.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	fixedErr := opError(uint8(sys.IORING_OP_RECV), sys.IOSQE_FIXED_FILE, 3, 7, -int32(syscall.ECONNRESET))
+	if got, want := fixedErr.Error(), "iouring: recv on fixed file 3 (userData 7): "+syscall.ECONNRESET.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if opError(uint8(sys.IORING_OP_RECV), 0, 3, 7, 10) != nil {
+		t.Error("opError for a successful result is not nil")
+	}
+}
+
+func TestEnter(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.PrepNop(1); err != nil {
+		t.Fatalf("PrepNop error = %v", err)
+	}
+	n, err := ring.Enter(1, 1, EnterGetEvents, nil)
+	if err != nil {
+		t.Fatalf("Enter error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Enter = %d, want 1", n)
+	}
+	if ring.CQReady() != 1 {
+		t.Errorf("CQReady() = %d, want 1", ring.CQReady())
+	}
+	ring.DrainCQEs()
+
+	if !ring.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		t.Skip("IORING_FEAT_EXT_ARG not supported")
+	}
+	ts := Timespec{Nsec: int64(10 * time.Millisecond)}
+	arg := GetEventsArg{Ts: uint64(uintptr(unsafe.Pointer(&ts)))}
+	if _, err := ring.Enter(0, 1, EnterGetEvents, &arg); err != syscall.ETIME {
+		t.Errorf("Enter with timeout error = %v, want ETIME", err)
+	}
+	runtime.KeepAlive(&ts)
+}
+
+func TestWaitFor(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	// A read on an empty pipe stays in flight while the NOPs complete
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	buf := make([]byte, 8)
+	if err := ring.PrepRead(int(r.Fd()), buf, 0, 1); err != nil {
+		t.Fatalf("PrepRead error = %v", err)
+	}
+	for ud := uint64(2); ud <= 4; ud++ {
+		if err := ring.PrepNop(ud); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+
+	cqe, err := ring.WaitFor(3, time.Second)
+	if err != nil {
+		t.Fatalf("WaitFor(3) error = %v", err)
+	}
+	if cqe.UserData != 3 || cqe.Res != 0 {
+		t.Errorf("WaitFor(3) = %+v", cqe)
+	}
+
+	// Stashed completions are returned without waiting
+	if cqe, err := ring.WaitFor(2, time.Millisecond); err != nil || cqe.UserData != 2 {
+		t.Errorf("WaitFor(2) = %+v, %v", cqe, err)
+	}
+
+	if _, err := ring.WaitFor(1, 20*time.Millisecond); err != syscall.ETIME {
+		t.Errorf("WaitFor(1) on idle pipe error = %v, want ETIME", err)
+	}
+
+	go w.Write([]byte("ping"))
+	cqe, err = ring.WaitFor(1, 0)
+	if err != nil {
+		t.Fatalf("WaitFor(1) error = %v", err)
+	}
+	if cqe.Res != 4 {
+		t.Errorf("read res = %d, want 4", cqe.Res)
+	}
+
+	stashed := ring.TakeStashed()
+	if len(stashed) != 1 || stashed[0].UserData != 4 {
+		t.Errorf("TakeStashed = %+v, want the NOP with userData 4", stashed)
+	}
+	if len(ring.TakeStashed()) != 0 {
+		t.Error("TakeStashed did not empty the stash")
+	}
+
+	// Concurrent waiters each get their own completion, whichever of
+	// them reaps it
+	pipes := make([][2]*os.File, 4)
+	bufs := make([][]byte, len(pipes))
+	for i := range pipes {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		pipes[i] = [2]*os.File{r, w}
+		bufs[i] = make([]byte, 8)
+		if err := ring.PrepRead(int(r.Fd()), bufs[i], 0, uint64(10+i)); err != nil {
+			t.Fatalf("PrepRead error = %v", err)
+		}
+	}
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	errs := make(chan error, len(pipes))
+	for i := range pipes {
+		go func() {
+			_, err := ring.WaitFor(uint64(10+i), 0)
+			errs <- err
+		}()
+	}
+	for i := len(pipes) - 1; i >= 0; i-- {
+		time.Sleep(5 * time.Millisecond)
+		pipes[i][1].Write([]byte("ping"))
+	}
+	for range pipes {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("concurrent WaitFor error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("concurrent WaitFor did not return")
+		}
+	}
+}
+
+func TestDrainLoop(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	t.Run("late_arrivals", func(t *testing.T) {
+		ring, err := New(8)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer ring.Close()
+
+		ring.PrepNop(1)
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+
+		// A NOP submitted from the callback completes inline, after the
+		// iteration started
+		var seen []uint64
+		n := ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			seen = append(seen, userData)
+			if userData == 1 {
+				ring.PrepNop(2)
+				ring.Submit()
+			}
+			return true
+		})
+		if n != 2 || len(seen) != 2 || seen[1] != 2 {
+			t.Errorf("ForEachCQE = %d, saw %v, want both NOPs", n, seen)
+		}
+	})
+
+	t.Run("task_work", func(t *testing.T) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		ring, err := New(8, WithDeferTaskrun())
+		if err != nil {
+			if err == syscall.EINVAL {
+				t.Skip("IORING_SETUP_DEFER_TASKRUN not supported (requires 6.1+)")
+			}
+			t.Fatalf("New(WithDeferTaskrun) error = %v", err)
+		}
+		defer ring.Close()
+
+		var p [2]int
+		if err := syscall.Pipe(p[:]); err != nil {
+			t.Fatalf("Pipe error = %v", err)
+		}
+		defer syscall.Close(p[0])
+		defer syscall.Close(p[1])
+
+		buf := make([]byte, 16)
+		if err := ring.PrepRead(p[0], buf, 0, 1); err != nil {
+			t.Fatalf("PrepRead error = %v", err)
+		}
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+		if _, err := syscall.Write(p[1], []byte("hello")); err != nil {
+			t.Fatalf("Write error = %v", err)
+		}
+
+		count := func(userData uint64, res int32, flags uint32) bool { return true }
+		if n := ring.DrainLoop(false, count); n != 0 {
+			t.Fatalf("DrainLoop(false) = %d before task work ran, want 0", n)
+		}
+		if n := ring.DrainLoop(true, count); n != 1 {
+			t.Errorf("DrainLoop(true) = %d, want 1", n)
+		}
+	})
+}
+
+func TestSubmitAndWaitReady(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithSQPoll(), WithSQPollIdle(1000))
+	if err != nil {
+		if err == syscall.EPERM {
+			t.Skip("SQPOLL requires elevated privileges")
+		}
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	ring.PrepNop(1)
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if ring.CQReady() < 1 {
+		t.Fatalf("CQReady() = %d after SubmitAndWait(1)", ring.CQReady())
+	}
+
+	// With a completion already waiting, SubmitAndWait only submits
+	ring.PrepNop(2)
+	n, err := ring.SubmitAndWait(1)
+	if err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("SubmitAndWait = %d, want 1", n)
+	}
+	if got := ring.SQReady(); got != 0 {
+		t.Errorf("SQReady() = %d after SubmitAndWait, want 0", got)
+	}
+
+	for want := uint64(1); want <= 2; want++ {
+		userData, _, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+		if userData != want {
+			t.Errorf("CQE userData = %d, want %d", userData, want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	name := t.TempDir() + "/file"
+	if _, err := OpenFile(e, name, os.O_RDONLY, 0); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenFile of missing file error = %v, want ErrNotExist", err)
+	}
+
+	f, err := OpenFile(e, name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+
+	data := []byte("hello, io_uring")
+	if n, err := f.WriteAt(data, 4); err != nil || n != len(data) {
+		t.Fatalf("WriteAt = %d, %v", n, err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatalf("Sync error = %v", err)
+	}
+
+	buf := make([]byte, len(data))
+	if n, err := f.ReadAt(buf, 4); err != nil || n != len(data) || string(buf) != string(data) {
+		t.Fatalf("ReadAt = %d, %q, %v", n, buf[:n], err)
+	}
+	if n, err := f.ReadAt(buf, 10); err != io.EOF || n != len(data)-6 {
+		t.Errorf("ReadAt past end = %d, %v, want %d, EOF", n, err, len(data)-6)
+	}
+
+	// Async variants run concurrently
+	op1, err := f.ReadAtAsync(make([]byte, 5), 4)
+	if err != nil {
+		t.Fatalf("ReadAtAsync error = %v", err)
+	}
+	op2, err := f.WriteAtAsync([]byte("!"), 0)
+	if err != nil {
+		t.Fatalf("WriteAtAsync error = %v", err)
+	}
+	if res, err := op1.Result(); err != nil || res != 5 {
+		t.Errorf("ReadAtAsync result = %d, %v", res, err)
+	}
+	if res, err := op2.Result(); err != nil || res != 1 {
+		t.Errorf("WriteAtAsync result = %d, %v", res, err)
+	}
+	if _, err := f.ReadAtAsync(nil, 0); err != syscall.EINVAL {
+		t.Errorf("ReadAtAsync(nil) error = %v, want EINVAL", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	if err := f.Close(); err != os.ErrClosed {
+		t.Errorf("second Close error = %v, want ErrClosed", err)
+	}
+	if _, err := f.ReadAt(buf, 0); err != os.ErrClosed {
+		t.Errorf("ReadAt after Close error = %v, want ErrClosed", err)
+	}
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "!\x00\x00\x00" + string(data); string(got) != want {
+		t.Errorf("file contents = %q, want %q", got, want)
+	}
+}
+
+func TestFileIO(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	f, err := os.CreateTemp(t.TempDir(), "fileio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewFileIO(ring, fd)
+
+	// Concurrent positional writes, then reads, through io interfaces
+	var w io.WriterAt = a
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunk := []byte{byte('a' + i), byte('a' + i)}
+			if n, err := w.WriteAt(chunk, int64(2*i)); err != nil || n != 2 {
+				t.Errorf("WriteAt(%d) = %d, %v", i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var r io.ReaderAt = a
+	buf := make([]byte, 16)
+	if n, err := r.ReadAt(buf, 0); err != nil || n != 16 {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if want := "aabbccddeeffgghh"; string(buf) != want {
+		t.Errorf("contents = %q, want %q", buf, want)
+	}
+	if n, err := r.ReadAt(buf, 12); err != io.EOF || n != 4 {
+		t.Errorf("ReadAt past end = %d, %v, want 4, EOF", n, err)
+	}
+	if len(ring.TakeStashed()) != 0 {
+		t.Error("FileIO left completions in the stash")
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	if err := a.Close(); err != os.ErrClosed {
+		t.Errorf("second Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	data := make([]byte, 300<<10+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	dir := t.TempDir()
+	dst, err := OpenFile(e, dir+"/dst", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	defer dst.Close()
+
+	// Small chunks force many pipelined reads and writes
+	if n, err := io.Copy(NewWriter(dst, 0), &chunkReader{data: data, chunk: 5000}); err != nil || n != int64(len(data)) {
+		t.Fatalf("io.Copy to Writer = %d, %v", n, err)
+	}
+	r := NewReader(dst, 0, 4096, 4)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll error = %v", err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("read back %d bytes, mismatch with the %d written", len(got), len(data))
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Reader.Close error = %v", err)
+	}
+
+	// Offset -1 streams through a pipe at the current position
+	if !ring.HasFeature(sys.IORING_FEAT_RW_CUR_POS) {
+		t.Skip("IORING_FEAT_RW_CUR_POS not supported")
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	pr, pw := NewFile(e, p[0], "pipe"), NewFile(e, p[1], "pipe")
+	defer pr.Close()
+	go func() {
+		io.Copy(NewWriter(pw, -1), &chunkReader{data: data[:20000], chunk: 3000})
+		pw.Close()
+	}()
+	got, err = io.ReadAll(NewReader(pr, -1, 1024, 0))
+	if err != nil {
+		t.Fatalf("ReadAll from pipe error = %v", err)
+	}
+	if string(got) != string(data[:20000]) {
+		t.Errorf("read %d bytes from pipe, want %d matching", len(got), 20000)
+	}
+}
+
+// chunkReader returns data at most chunk bytes per Read, and hides any
+// WriterTo so io.Copy goes through Write.
+type chunkReader struct {
+	data  []byte
+	chunk int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestConn(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(32)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// pair returns a ring-backed server side and a stdlib client side.
+	pair := func() (*Conn, net.Conn) {
+		t.Helper()
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := server.(*net.TCPConn).File()
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewConn(e, fd)
+		if err != nil {
+			t.Fatalf("NewConn error = %v", err)
+		}
+		return c, client
+	}
+
+	c, client := pair()
+	defer client.Close()
+	if c.RemoteAddr().String() != client.LocalAddr().String() || c.LocalAddr().String() != client.RemoteAddr().String() {
+		t.Errorf("addrs = %v <- %v, want %v <- %v", c.LocalAddr(), c.RemoteAddr(), client.RemoteAddr(), client.LocalAddr())
+	}
+
+	client.Write([]byte("ping"))
+	buf := make([]byte, 16)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read = %q, %v", buf[:n], err)
+	}
+	if n, err := c.Write([]byte("pong")); err != nil || n != 4 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if n, err := io.ReadFull(client, buf[:4]); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("client read = %q, %v", buf[:n], err)
+	}
+
+	// Deadlines
+	c.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	start := time.Now()
+	_, err = c.Read(buf)
+	var nerr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatalf("Read past deadline error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Read timed out after %v, want about 30ms", elapsed)
+	}
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read with expired deadline error = %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Close unblocks a pending Read
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := c.Read(buf)
+		readErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Read during Close error = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock Read")
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close error = %v, want ErrClosed", err)
+	}
+
+	// Peer close reads as EOF
+	c2, client2 := pair()
+	defer c2.Close()
+	client2.Close()
+	if _, err := c2.Read(buf); err != io.EOF {
+		t.Errorf("Read after peer close error = %v, want EOF", err)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(32)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		syscall.Close(fd)
+		t.Fatal(err)
+	}
+	c, err := NewPacketConn(e, fd)
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatalf("NewPacketConn error = %v", err)
+	}
+	defer c.Close()
+
+	laddr, ok := c.LocalAddr().(*net.UDPAddr)
+	if !ok || laddr.Port == 0 {
+		t.Fatalf("LocalAddr = %v, want a bound UDP address", c.LocalAddr())
+	}
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if n, err := c.WriteTo([]byte("ping"), peer.LocalAddr()); err != nil || n != 4 {
+		t.Fatalf("WriteTo = %d, %v", n, err)
+	}
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("peer read = %q, %v", buf[:n], err)
+	}
+	if from.Port != laddr.Port {
+		t.Errorf("peer read from %v, want %v", from, laddr)
+	}
+
+	if _, err := peer.WriteToUDP([]byte("pong"), laddr); err != nil {
+		t.Fatal(err)
+	}
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("ReadFrom = %q, %v", buf[:n], err)
+	}
+	if addr.String() != peer.LocalAddr().String() {
+		t.Errorf("ReadFrom addr = %v, want %v", addr, peer.LocalAddr())
+	}
+
+	// Deadlines
+	c.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	if _, _, err := c.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom past deadline error = %v, want ErrDeadlineExceeded", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Close unblocks a pending ReadFrom
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(buf)
+		readErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("ReadFrom during Close error = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock ReadFrom")
+	}
+	if _, err := c.WriteTo([]byte("x"), peer.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteTo after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestSockaddr(t *testing.T) {
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(10, 1, 2, 3).To4(), Port: 53},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+		&net.UnixAddr{Name: "@abstract", Net: "unixgram"},
+	} {
+		sa, err := FromNetAddr(addr)
+		if err != nil {
+			t.Errorf("FromNetAddr(%v) error = %v", addr, err)
+			continue
+		}
+		if got := sa.ToNetAddr(addr.Network()); got == nil || got.String() != addr.String() || got.Network() != addr.Network() {
+			t.Errorf("FromNetAddr(%v).ToNetAddr = %v", addr, got)
+		}
+	}
+	if got := new(Sockaddr).ToNetAddr("tcp"); got != nil {
+		t.Errorf("zero Sockaddr ToNetAddr = %v, want nil", got)
+	}
+
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnFile.Close()
+
+	clientFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(clientFd)
+
+	target, err := FromNetAddr(ln.Addr())
+	if err != nil {
+		t.Fatalf("FromNetAddr error = %v", err)
+	}
+	var peer Sockaddr
+	if err := ring.PrepAcceptSockaddr(int(lnFile.Fd()), &peer, 0, 1); err != nil {
+		t.Fatalf("PrepAcceptSockaddr error = %v", err)
+	}
+	if err := ring.PrepConnectSockaddr(clientFd, target, 2); err != nil {
+		t.Fatalf("PrepConnectSockaddr error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		userData, res, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+		if res < 0 {
+			t.Fatalf("op %d failed: %v", userData, syscall.Errno(-res))
+		}
+		if userData == 1 {
+			syscall.Close(int(res))
+		}
+	}
+
+	local, err := syscall.Getsockname(clientFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: local.(*syscall.SockaddrInet4).Port}
+	if got := peer.ToNetAddr("tcp"); got == nil || got.String() != want.String() {
+		t.Errorf("accepted peer = %v, want %v", got, want)
+	}
+}
+
+func TestLoop(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"single-issuer", []Option{WithSingleIssuer()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := NewLoop(8, tc.opts...)
+			if err == syscall.EINVAL {
+				t.Skip("ring options not supported")
+			}
+			if err != nil {
+				t.Fatalf("NewLoop error = %v", err)
+			}
+			defer l.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			runErr := make(chan error, 1)
+			go func() { runErr <- l.Run(ctx) }()
+
+			// Submissions from many goroutines, more than the SQ holds
+			const n = 64
+			var wg sync.WaitGroup
+			var count atomic.Int32
+			done := make(chan struct{})
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := l.Submit(func(ud uint64) error {
+						return l.Ring().PrepNop(ud)
+					}, func(cqe CQEView) {
+						if cqe.Res != 0 {
+							t.Errorf("NOP res = %d, want 0", cqe.Res)
+						}
+						if count.Add(1) == n {
+							close(done)
+						}
+					})
+					if err != nil {
+						t.Errorf("Submit error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d of %d callbacks", count.Load(), n)
+			}
+
+			// A failing prep reaches the callback as an error CQE
+			failed := make(chan CQEView, 1)
+			l.Submit(func(uint64) error { return syscall.EINVAL }, func(cqe CQEView) { failed <- cqe })
+			select {
+			case cqe := <-failed:
+				if cqe.Err() != syscall.EINVAL {
+					t.Errorf("failed prep CQE error = %v, want EINVAL", cqe.Err())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no callback for failed prep")
+			}
+
+			posted := make(chan struct{})
+			if err := l.Post(func() { close(posted) }); err != nil {
+				t.Fatalf("Post error = %v", err)
+			}
+			select {
+			case <-posted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("posted function did not run")
+			}
+
+			if err := l.Close(); err != ErrLoopRunning {
+				t.Errorf("Close while running error = %v, want ErrLoopRunning", err)
+			}
+			cancel()
+			select {
+			case err := <-runErr:
+				if err != context.Canceled {
+					t.Errorf("Run error = %v, want Canceled", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run did not return after cancel")
+			}
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	l, err := NewLoop(64)
+	if err != nil {
+		t.Fatalf("NewLoop error = %v", err)
+	}
+	defer l.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnFile.Close()
+
+	accepted := make(chan *ServerConn, 4)
+	closed := make(chan error, 4)
+	srv, err := l.RegisterHandler(int(lnFile.Fd()), Handler{
+		OnAccept: func(c *ServerConn) { accepted <- c },
+		OnData: func(c *ServerConn, data []byte) {
+			if err := c.Write(data); err != nil {
+				t.Errorf("Write error = %v", err)
+			}
+		},
+		OnClose: func(c *ServerConn, err error) { closed <- err },
+		OnError: func(err error) { t.Errorf("server error = %v", err) },
+		Buffers: 4,
+	})
+	if err != nil {
+		t.Fatalf("RegisterHandler error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-runErr
+	}()
+
+	// Echo more data than the buffer ring holds at once
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg := make([]byte, 64<<10)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go client.Write(msg)
+	got := make([]byte, len(msg))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("echo read error = %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Error("echoed data differs")
+	}
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Error("OnAccept not called")
+	}
+
+	// Peer close reaches OnClose without an error
+	client.Close()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("OnClose error = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called after peer close")
+	}
+
+	// Server.Close closes the remaining connections
+	client2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not accepted")
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Server.Close error = %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called after Server.Close")
+	}
+	client2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read after Server.Close error = %v, want EOF", err)
+	}
+}
+
+func TestRingPool(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	p, err := NewRingPool(RingPoolConfig{Rings: 2, Entries: 8, Files: 4, ShareWQ: true})
+	if err == syscall.EINVAL {
+		t.Skip("ATTACH_WQ or sparse file tables not supported")
+	}
+	if err != nil {
+		t.Fatalf("NewRingPool error = %v", err)
+	}
+	defer p.Close()
+	if p.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", p.Len())
+	}
+
+	// Aggregate submit and reap
+	for i := 0; i < p.Len(); i++ {
+		if err := p.Ring(i).PrepNop(uint64(10 + i)); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+	if n, err := p.Submit(); err != nil || n != 2 {
+		t.Fatalf("Submit = %d, %v", n, err)
+	}
+	seen := map[int]uint64{}
+	deadline := time.Now().Add(time.Second)
+	for len(seen) < 2 && time.Now().Before(deadline) {
+		p.ForEachCQE(func(ring int, userData uint64, res int32, flags uint32) bool {
+			seen[ring] = userData
+			return true
+		})
+	}
+	if seen[0] != 10 || seen[1] != 11 {
+		t.Errorf("reaped %v, want ring 0: 10, ring 1: 11", seen)
+	}
+
+	// A connection handed to a ring is usable as a registered file there
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	i, err := p.Distribute(fds[0], 42)
+	if err != nil {
+		syscall.Close(fds[0])
+		t.Fatalf("Distribute error = %v", err)
+	}
+	ring := p.Ring(i)
+	userData, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != 42 || res < 0 {
+		t.Fatalf("fd message CQE = %d, %d, want 42 and a slot", userData, res)
+	}
+	if err := ring.PrepSend(0, []byte("hi"), 0, 1, WithFixedFile(int(res))); err != nil {
+		t.Fatalf("PrepSend error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if _, res, _, err := ring.WaitCQE(); err != nil || res != 2 {
+		t.Fatalf("send on passed file = %d, %v", res, err)
+	}
+	ring.SeenCQE()
+	buf := make([]byte, 2)
+	if n, err := syscall.Read(fds[1], buf); err != nil || string(buf[:n]) != "hi" {
+		t.Errorf("peer read = %q, %v", buf[:n], err)
+	}
+	if next := p.Next(); next == i {
+		t.Errorf("Next = %d after Distribute to %d, want the other ring", next, i)
+	}
+}
+
+func TestShardedRing(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	for _, mode := range []ShardMode{ShardPerCPU, ShardPerThread} {
+		s, err := NewShardedRing(mode, 8)
+		if err != nil {
+			t.Fatalf("NewShardedRing(%d) error = %v", mode, err)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+				for i := 0; i < 50; i++ {
+					err := s.Do(func(r *Ring) error {
+						if err := r.PrepNop(uint64(i)); err != nil {
+							return err
+						}
+						if _, err := r.SubmitAndWait(1); err != nil {
+							return err
+						}
+						_, res, _, err := r.WaitCQE()
+						r.SeenCQE()
+						if res != 0 {
+							return syscall.Errno(-res)
+						}
+						return err
+					})
+					if err == syscall.EINVAL && mode == ShardPerThread {
+						return // No SINGLE_ISSUER
+					}
+					if err != nil {
+						t.Errorf("mode %d: Do error = %v", mode, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if mode == ShardPerCPU && len(s.Rings()) != runtime.NumCPU() {
+			t.Errorf("per-CPU rings = %d, want %d", len(s.Rings()), runtime.NumCPU())
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("Close error = %v", err)
+		}
+	}
+}
+
+func TestCopyFD(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	dir := t.TempDir()
+	data := make([]byte, 200<<10+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(dir+"/src", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := OpenFile(e, dir+"/src", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	defer src.Close()
+	dst, err := OpenFile(e, dir+"/dst", os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	defer dst.Close()
+
+	// A bounded copy, then the rest
+	if n, err := CopyFD(e, dst.Fd(), src.Fd(), 1000); err != nil || n != 1000 {
+		t.Fatalf("CopyFD(1000) = %d, %v", n, err)
+	}
+	if n, err := CopyFD(e, dst.Fd(), src.Fd(), -1); err != nil || n != int64(len(data)-1000) {
+		t.Fatalf("CopyFD(-1) = %d, %v, want %d", n, err, len(data)-1000)
+	}
+	if got, err := os.ReadFile(dir + "/dst"); err != nil || string(got) != string(data) {
+		t.Errorf("copied file differs (%d bytes, %v)", len(got), err)
+	}
+
+	// Sendfile to a socket
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := server.(*net.TCPConn).File()
+	server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(sf.Fd()))
+	sf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewConn(e, fd)
+	if err != nil {
+		t.Fatalf("NewConn error = %v", err)
+	}
+	defer conn.Close()
+
+	f, err := OpenFile(e, dir+"/src", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	defer f.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(client)
+		received <- got
+	}()
+	if n, err := Sendfile(conn, f); err != nil || n != int64(len(data)) {
+		t.Fatalf("Sendfile = %d, %v, want %d", n, err, len(data))
+	}
+	conn.Close()
+	select {
+	case got := <-received:
+		if string(got) != string(data) {
+			t.Errorf("received %d bytes, want the %d sent", len(got), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not receive the file")
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	dir := t.TempDir()
+	for _, size := range []int{0, 1, 128 << 10, 3<<20 + 17} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i*31 + size)
+		}
+		src, dst := dir+"/src", dir+"/dst"
+		if err := os.WriteFile(src, data, 0o640); err != nil {
+			t.Fatal(err)
+		}
+		n, err := CopyFile(e, dst, src, 4)
+		if err != nil || n != int64(size) {
+			t.Errorf("CopyFile(%d bytes) = %d, %v", size, n, err)
+			continue
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil || string(got) != string(data) {
+			t.Errorf("copy of %d bytes differs (%d bytes, %v)", size, len(got), err)
+		}
+		if fi, err := os.Stat(dst); err != nil || fi.Mode().Perm() != 0o640 {
+			t.Errorf("copy mode = %v, %v, want 0640", fi.Mode().Perm(), err)
+		}
+		os.Remove(dst)
+	}
+
+	if _, err := CopyFile(e, dir+"/out", dir+"/missing", 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CopyFile of missing file error = %v, want ErrNotExist", err)
+	}
+}
+
+func TestBufferAllocator(t *testing.T) {
+	if _, err := NewBufferAllocator(4096, 3); err != syscall.EINVAL {
+		t.Errorf("NewBufferAllocator with odd align error = %v, want EINVAL", err)
+	}
+
+	for _, align := range []int{0, 512, 64 << 10} {
+		a, err := NewBufferAllocator(1000, align)
+		if err != nil {
+			t.Fatalf("NewBufferAllocator(1000, %d) error = %v", align, err)
+		}
+		want := align
+		if want == 0 {
+			want = os.Getpagesize()
+		}
+		if a.Size()%want != 0 || a.Size() < 1000 {
+			t.Errorf("align %d: Size = %d", align, a.Size())
+		}
+		bufs, err := a.Alloc(2000)
+		if err != nil {
+			t.Fatalf("Alloc error = %v", err)
+		}
+		for _, b := range bufs {
+			if uintptr(unsafe.Pointer(&b[0]))%uintptr(want) != 0 || len(b) != a.Size() {
+				t.Fatalf("align %d: buffer at %p len %d misaligned", align, &b[0], len(b))
+			}
+		}
+		first := &bufs[0][0]
+		a.Put(bufs[0][:10])
+		if b, _ := a.Get(); &b[0] != first || len(b) != a.Size() {
+			t.Errorf("align %d: Get after Put did not reuse the buffer", align)
+		}
+		if err := a.Free(); err != nil {
+			t.Errorf("Free error = %v", err)
+		}
+	}
+
+	skipIfNoIOURing(t)
+
+	// Aligned buffers are accepted for O_DIRECT reads into registered buffers
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	a, err := NewBufferAllocator(4096, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Free()
+	bufs, err := a.Alloc(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.RegisterBuffers(bufs); err != nil {
+		t.Fatalf("RegisterBuffers error = %v", err)
+	}
+	defer ring.UnregisterBuffers()
+
+	name := t.TempDir() + "/direct"
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_DIRECT|syscall.O_CLOEXEC, 0)
+	if err == syscall.EINVAL {
+		t.Skip("O_DIRECT not supported on the temp filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if err := ring.PrepReadFixed(fd, bufs[1], 0, 1, 1); err != nil {
+		t.Fatalf("PrepReadFixed error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	_, res, _, err := ring.WaitCQE()
+	ring.SeenCQE()
+	if err != nil || res != 4096 || string(bufs[1]) != string(data) {
+		t.Errorf("O_DIRECT read = %d, %v", res, err)
+	}
+}
+
+func TestWalker(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	root := t.TempDir()
+	want := map[string]int64{}
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(root, fmt.Sprintf("f%03d", i))
+		if err := os.WriteFile(name, make([]byte, i), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		want[name] = int64(i)
+	}
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	want[sub] = -1
+	if err := os.WriteFile(filepath.Join(sub, "x"), []byte("xyz"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want[filepath.Join(sub, "x")] = 3
+	if err := os.Symlink("missing", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	want[filepath.Join(root, "link")] = int64(len("missing"))
+
+	// A small batch spreads the directory over several submissions
+	w := NewWalker(ring, 7, 0)
+	got := 0
+	for e, err := range w.Walk(root) {
+		if err != nil {
+			t.Fatalf("Walk error = %v", err)
+		}
+		size, ok := want[e.Path]
+		if !ok {
+			t.Errorf("Walk yielded unexpected %q", e.Path)
+			continue
+		}
+		if e.IsDir() != (size < 0) || (size >= 0 && int64(e.Stat.Size) != size) {
+			t.Errorf("%s: dir %v size %d, want size %d", e.Path, e.IsDir(), e.Stat.Size, size)
+		}
+		got++
+	}
+	if got != len(want) {
+		t.Errorf("Walk yielded %d entries, want %d", got, len(want))
+	}
+
+	n := 0
+	for e, err := range w.ReadDir(sub) {
+		if err != nil || e.Name != "x" {
+			t.Errorf("ReadDir = %q, %v", e.Name, err)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("ReadDir yielded %d entries, want 1", n)
+	}
+
+	// Stopping early leaves the ring clean
+	for range w.Walk(root) {
+		break
+	}
+	if ready := ring.CQReady(); ready != 0 {
+		t.Errorf("CQReady after break = %d, want 0", ready)
+	}
+
+	for _, err := range w.ReadDir(filepath.Join(root, "nope")) {
+		if !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("ReadDir of missing dir error = %v, want ENOENT", err)
+		}
+	}
+}
+
+func TestTimer(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	l, err := NewLoop(64)
+	if err != nil {
+		t.Fatalf("NewLoop error = %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-runErr
+	}()
+
+	start := time.Now()
+	c, err := l.After(20 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("After error = %v", err)
+	}
+	select {
+	case <-c:
+		if d := time.Since(start); d < 20*time.Millisecond {
+			t.Errorf("After fired after %v, want >= 20ms", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("After did not fire")
+	}
+
+	// Reset moves a pending timer, Stop cancels one
+	fired := make(chan time.Time, 4)
+	start = time.Now()
+	tm, err := l.AfterFunc(time.Hour, func() { fired <- time.Now() })
+	if err != nil {
+		t.Fatalf("AfterFunc error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !tm.Reset(20 * time.Millisecond) {
+		t.Error("Reset of pending timer = false, want true")
+	}
+	select {
+	case at := <-fired:
+		if d := at.Sub(start); d < 30*time.Millisecond {
+			t.Errorf("reset timer fired after %v, want >= 30ms", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset timer did not fire")
+	}
+	if tm.Stop() {
+		t.Error("Stop of fired timer = true, want false")
+	}
+
+	stopped, err := l.AfterFunc(20*time.Millisecond, func() { fired <- time.Now() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stopped.Stop() {
+		t.Error("Stop of pending timer = false, want true")
+	}
+
+	many := make([]*Timer, 1000)
+	for i := range many {
+		if many[i], err = l.AfterFunc(time.Hour, func() { fired <- time.Now() }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tm := range many {
+		tm.Stop()
+	}
+
+	tk, err := l.NewTicker(10 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewTicker error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-tk.C:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tick %d missing", i)
+		}
+	}
+	tk.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Errorf("%d stopped timers fired", len(fired))
+	}
+
+	// Idle connections of a Server are closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnFile.Close()
+	closed := make(chan error, 1)
+	if _, err := l.RegisterHandler(int(lnFile.Fd()), Handler{
+		OnAccept: func(c *ServerConn) {
+			if err := c.SetIdleTimeout(50 * time.Millisecond); err != nil {
+				t.Errorf("SetIdleTimeout error = %v", err)
+			}
+		},
+		OnClose: func(c *ServerConn, err error) { closed <- err },
+		Buffers: 4,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		client.Write([]byte("x"))
+	}
+	select {
+	case err := <-closed:
+		if err != syscall.ETIMEDOUT {
+			t.Errorf("idle close error = %v, want ETIMEDOUT", err)
+		}
+		if d := time.Since(start); d < 120*time.Millisecond {
+			t.Errorf("active connection closed after %v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestSubmitContext(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[1])
+	f := NewFile(e, p[0], "pipe")
+	defer f.Close()
+
+	// Canceling the context cancels the pending read
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := make([]byte, 16)
+	op, err := e.SubmitContext(ctx, func(ud uint64) error {
+		return ring.PrepRead(p[0], buf, 0, ud)
+	})
+	if err != nil {
+		t.Fatalf("SubmitContext error = %v", err)
+	}
+	cancel()
+	if _, err := op.Result(); err != context.Canceled {
+		t.Errorf("Result after cancel error = %v, want context.Canceled", err)
+	}
+
+	if _, err := e.SubmitContext(ctx, func(ud uint64) error {
+		t.Error("prep called with a done context")
+		return ring.PrepNop(ud)
+	}); err != context.Canceled {
+		t.Errorf("SubmitContext with done context error = %v, want context.Canceled", err)
+	}
+
+	// Deadlines apply to the blocking forms
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.ReadAtContext(ctx, buf, 0); err != context.DeadlineExceeded {
+		t.Errorf("ReadAtContext error = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("ReadAtContext returned after %v", d)
+	}
+
+	// Operations completing normally are unaffected
+	syscall.Write(p[1], []byte("hello"))
+	n, err := f.ReadAtContext(context.Background(), buf[:5], 0)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadAtContext = %q, %v, want hello", buf[:n], err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	op, err = e.SubmitContext(ctx, func(ud uint64) error { return ring.PrepNop(ud) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := op.Result(); res != 0 || err != nil {
+		t.Errorf("Nop Result = %d, %v", res, err)
+	}
+	cancel()
+}
+
+func TestNetpollWait(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	if _, err := New(8, WithNetpollWait(), WithSingleIssuer(), WithDeferTaskrun()); err != syscall.EINVAL {
+		t.Errorf("New with DEFER_TASKRUN error = %v, want EINVAL", err)
+	}
+
+	ring, err := New(8, WithNetpollWait())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	start := time.Now()
+	if _, _, _, err := ring.WaitCQETimeout(20 * time.Millisecond); err != syscall.ETIME {
+		t.Errorf("WaitCQETimeout error = %v, want ETIME", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("WaitCQETimeout returned after %v", d)
+	}
+
+	// A completion arriving later wakes the waiter
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	buf := make([]byte, 8)
+	if err := ring.PrepRead(p[0], buf, 0, 7); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { syscall.Write(p[1], []byte("ok")) })
+	ud, res, _, err := ring.WaitCQE()
+	ring.SeenCQE()
+	if err != nil || ud != 7 || res != 2 {
+		t.Errorf("WaitCQE = %d, %d, %v, want 7, 2, nil", ud, res, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := ring.WaitCQEContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitCQEContext error = %v, want DeadlineExceeded", err)
+	}
+
+	// Closing the ring releases a waiter
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := ring.WaitCQE()
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ring.Close()
+	select {
+	case err := <-done:
+		if err != ErrRingClosed {
+			t.Errorf("WaitCQE after Close error = %v, want ErrRingClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release the waiter")
+	}
+
+	// Idle executors park goroutines, not threads
+	threads := func() int {
+		data, _ := os.ReadFile("/proc/self/status")
+		var n int
+		for _, line := range strings.Split(string(data), "\n") {
+			fmt.Sscanf(line, "Threads: %d", &n)
+		}
+		return n
+	}
+	before := threads()
+	const rings = 64
+	var execs []*Executor
+	for i := 0; i < rings; i++ {
+		r, err := New(4, WithNetpollWait())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		e := NewExecutor(r)
+		defer e.Close()
+		execs = append(execs, e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := threads(); after-before >= rings/2 {
+		t.Errorf("%d waiting executors took %d threads", rings, after-before)
+	}
+	for _, e := range execs {
+		op, err := e.Submit(func(ud uint64) error { return e.ring.PrepNop(ud) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := op.Result(); err != nil {
+			t.Errorf("Nop error = %v", err)
+		}
+	}
+}
+
+func TestPollBackend(t *testing.T) {
+	ring, err := New(8, WithPollBackend())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	if !ring.PollBackend() {
+		t.Fatal("PollBackend() = false, want true")
+	}
+	if _, err := New(8, WithPollBackend(), WithSQPoll()); err != syscall.EINVAL {
+		t.Errorf("New with SQPOLL error = %v, want EINVAL", err)
+	}
+	if real, err := New(8, WithPollFallback()); err == nil {
+		// io_uring is available: no emulation
+		if real.PollBackend() {
+			t.Error("PollBackend() with WithPollFallback = true, want false")
+		}
+		real.Close()
+	}
+
+	// A read linked after a write sees its data
+	path := filepath.Join(t.TempDir(), "f")
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CREAT, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	out := make([]byte, 5)
+	if err := ring.PrepWrite(fd, []byte("hello"), 0, 1, WithLink()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.PrepRead(fd, out, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		ud, res, _, err := ring.WaitCQE()
+		ring.SeenCQE()
+		if err != nil || res != 5 {
+			t.Errorf("CQE %d = %d, %v, want 5", ud, res, err)
+		}
+	}
+	if string(out) != "hello" {
+		t.Errorf("read %q, want hello", out)
+	}
+
+	// A read of an empty pipe waits in epoll until canceled
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	buf := make([]byte, 8)
+	ring.PrepRead(p[0], buf, ^uint64(0), 3)
+	ring.PrepCancel(3, 0, 4)
+	got := map[uint64]int32{}
+	ring.SubmitAndWait(2)
+	ring.ForEachCQE(func(ud uint64, res int32, _ uint32) bool {
+		got[ud] = res
+		return true
+	})
+	if got[3] != -int32(syscall.ECANCELED) || got[4] != 0 {
+		t.Errorf("read, cancel = %d, %d, want -ECANCELED, 0", got[3], got[4])
+	}
+
+	// A link timeout cancels the read; a timeout expires
+	ts := Timespec{Nsec: int64(20 * time.Millisecond)}
+	ring.PrepRead(p[0], buf, ^uint64(0), 5, WithLink())
+	ring.PrepLinkTimeout(&ts, 0, 6)
+	ring.PrepTimeout(&ts, 0, 0, 7)
+	start := time.Now()
+	got = map[uint64]int32{}
+	for len(got) < 3 {
+		if _, err := ring.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		ring.ForEachCQE(func(ud uint64, res int32, _ uint32) bool {
+			got[ud] = res
+			return true
+		})
+	}
+	if got[5] != -int32(syscall.ECANCELED) || got[6] != -int32(syscall.ETIME) || got[7] != -int32(syscall.ETIME) {
+		t.Errorf("read, link timeout, timeout = %d, %d, %d, want -ECANCELED, -ETIME, -ETIME", got[5], got[6], got[7])
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("timeouts expired after %v", d)
+	}
+
+	// Conn and File work on top of it
+	e := NewExecutor(ring)
+	defer e.Close()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewConn(e, fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewConn(e, fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	time.AfterFunc(10*time.Millisecond, func() { a.Write([]byte("ping")) })
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Read = %q, %v, want ping", buf[:n], err)
+	}
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := b.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read past deadline error = %v, want ErrDeadlineExceeded", err)
+	}
+
+	f, err := OpenFile(e, path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 5); err != nil {
+		t.Errorf("WriteAt error = %v", err)
+	}
+	out = make([]byte, 10)
+	if n, err := f.ReadAt(out, 0); n != 10 || string(out) != "helloworld" {
+		t.Errorf("ReadAt = %q, %v, want helloworld", out[:n], err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("File.Close error = %v", err)
+	}
+}
+
+func TestPollBackendLoop(t *testing.T) {
+	l, err := NewLoop(8, WithPollBackend(), WithSingleIssuer())
+	if err != nil {
+		t.Fatalf("NewLoop error = %v", err)
+	}
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+
+	c, err := l.After(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer did not fire")
+	}
+}
+
+func TestNvme(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	if n := unsafe.Sizeof(NvmeCmd{}); n != 72 {
+		t.Errorf("sizeof(NvmeCmd) = %d, want 72", n)
+	}
+	buf := make([]byte, 4096)
+
+	small, err := New(4, WithSQE128())
+	if err != nil {
+		t.Skipf("New(WithSQE128) error = %v", err)
+	}
+	defer small.Close()
+	if err := small.PrepNvmeFlush(0, 1, 1); err != syscall.EINVAL {
+		t.Errorf("PrepNvmeFlush without CQE32 error = %v, want EINVAL", err)
+	}
+
+	ring, err := New(4, WithSQE128(), WithCQE32())
+	if err != nil {
+		t.Skipf("New(WithSQE128, WithCQE32) error = %v", err)
+	}
+	defer ring.Close()
+	if err := ring.PrepNvmeRead(0, 1, buf[:1000], 0, 9, 1); err != syscall.EINVAL {
+		t.Errorf("PrepNvmeRead of a partial block error = %v, want EINVAL", err)
+	}
+
+	// The command lands in the SQE's command area
+	if err := ring.PrepNvmeWrite(0, 3, buf, 1<<33|5, 9, 7); err != nil {
+		t.Fatalf("PrepNvmeWrite error = %v", err)
+	}
+	tail := ring.sqReserved.Load() - 1
+	sqe := &ring.sqes[(tail&ring.sqMask)<<1]
+	cmd := (*NvmeCmd)(unsafe.Pointer(&sqe.Cmd(true)[0]))
+	if uint32(sqe.Off) != NvmeURingCmdIO || cmd.Opcode != NvmeOpWrite || cmd.Nsid != 3 {
+		t.Errorf("cmd_op, opcode, nsid = %#x, %d, %d, want %#x, %d, 3", sqe.Off, cmd.Opcode, cmd.Nsid, NvmeURingCmdIO, NvmeOpWrite)
+	}
+	if cmd.Cdw10 != 5 || cmd.Cdw11 != 2 || cmd.Cdw12 != 7 || cmd.DataLen != 4096 {
+		t.Errorf("cdw10-12, data_len = %d, %d, %d, %d, want 5, 2, 7, 4096", cmd.Cdw10, cmd.Cdw11, cmd.Cdw12, cmd.DataLen)
+	}
+	ring.sqReserved.Add(^uint32(0)) // Drop the unsubmitted command
+
+	// Other files reject passthrough commands
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	if err := ring.PrepNvmeIdentify(p[0], NvmeIdentifyController, 0, buf, 9); err != nil {
+		t.Fatalf("PrepNvmeIdentify error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.ForEachCQE32(func(_ uint64, res int32, _ uint32, big [2]uint64) bool {
+		if _, err := NvmeResult(res, big); err == nil {
+			t.Errorf("identify on a pipe res = %d, want an error", res)
+		}
+		return true
+	})
+
+	var se *NvmeStatusError
+	if _, err := NvmeResult(0x4281, [2]uint64{}); !errors.As(err, &se) || se.Type() != 2 || se.Code() != 0x81 || !se.DoNotRetry() {
+		t.Errorf("NvmeResult(0x4281) error = %v, want media status 0x81 with DNR", err)
+	}
+	if v, err := NvmeResult(0, [2]uint64{42}); v != 42 || err != nil {
+		t.Errorf("NvmeResult(0) = %d, %v, want 42, nil", v, err)
+	}
+
+	id := make([]byte, 4096)
+	id[26] = 0x21 // Format 17
+	id[128+4*17+2] = 12
+	if shift, err := NvmeLBAShift(id); shift != 12 || err != nil {
+		t.Errorf("NvmeLBAShift = %d, %v, want 12, nil", shift, err)
+	}
+}
+
+func TestSockopt(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sock)
+
+	// Set TCP_NODELAY, then read back SO_TYPE, in one chain
+	one := int32(1)
+	var typ int32
+	if err := ring.PrepSetsockoptInt(sock, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, &one, 1, WithLink()); err != nil {
+		t.Fatalf("PrepSetsockoptInt error = %v", err)
+	}
+	if err := ring.PrepGetsockopt(sock, syscall.SOL_SOCKET, syscall.SO_TYPE, unsafe.Pointer(&typ), 4, 2); err != nil {
+		t.Fatalf("PrepGetsockopt error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	res := map[uint64]int32{}
+	ring.ForEachCQE(func(ud uint64, r int32, _ uint32) bool {
+		res[ud] = r
+		return true
+	})
+	if res[1] == -int32(syscall.EINVAL) || res[1] == -int32(syscall.EOPNOTSUPP) {
+		t.Skip("socket commands not supported (requires 6.7+)")
+	}
+	if res[1] != 0 || res[2] != 4 {
+		t.Errorf("setsockopt, getsockopt = %d, %d, want 0, 4", res[1], res[2])
+	}
+	if v, _ := syscall.GetsockoptInt(sock, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 1 {
+		t.Errorf("TCP_NODELAY = %d, want 1", v)
+	}
+	if typ != syscall.SOCK_STREAM {
+		t.Errorf("SO_TYPE = %d, want SOCK_STREAM", typ)
+	}
+
+	// Queued bytes of a UDP socket connected to itself
+	udp, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(udp)
+	if err := syscall.Bind(udp, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := syscall.Getsockname(udp)
+	if err := syscall.Connect(udp, sa); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Write(udp, []byte("hello"))
+	ring.PrepSIOCINQ(udp, 3)
+	ring.PrepSIOCOUTQ(udp, 4)
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.ForEachCQE(func(ud uint64, r int32, _ uint32) bool {
+		res[ud] = r
+		return true
+	})
+	if res[3] != 5 || res[4] != 0 {
+		t.Errorf("SIOCINQ, SIOCOUTQ = %d, %d, want 5, 0", res[3], res[4])
+	}
+}
+
+func TestKTLS(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both ends as ring-backed Conns
+	conns := make([]*Conn, 2)
+	for i, nc := range []net.Conn{server, client} {
+		f, err := nc.(*net.TCPConn).File()
+		nc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(int(f.Fd()))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conns[i], err = NewConn(e, fd); err != nil {
+			t.Fatalf("NewConn error = %v", err)
+		}
+		defer conns[i].Close()
+	}
+	s, c := conns[0], conns[1]
+
+	if tx, rx := s.KTLS(); tx || rx {
+		t.Errorf("KTLS() on plain TCP = %v, %v, want false, false", tx, rx)
+	}
+
+	// A zero-copy write completes with the bytes sent
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		if n, err := s.WriteZC(data); n != len(data) || err != nil {
+			t.Errorf("WriteZC = %d, %v, want %d, nil", n, err, len(data))
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != string(data) {
+		t.Fatalf("ReadFull after WriteZC error = %v, data equal = %v", err, string(got) == string(data))
+	}
+
+	// Kernel TLS with a fixed AES-GCM-128 key, sending from s to c
+	if err := syscall.SetsockoptString(s.Fd(), syscall.IPPROTO_TCP, sys.TCP_ULP, "tls"); err != nil {
+		t.Skipf("kernel TLS not available: %v", err)
+	}
+	if err := syscall.SetsockoptString(c.Fd(), syscall.IPPROTO_TCP, sys.TCP_ULP, "tls"); err != nil {
+		t.Fatal(err)
+	}
+	// struct tls12_crypto_info_aes_gcm_128
+	info := make([]byte, 40)
+	info[0], info[1] = 0x03, 0x03 // TLS 1.2
+	info[2] = 51                  // TLS_CIPHER_AES_GCM_128
+	for i := 4; i < 40; i++ {
+		info[i] = byte(i)
+	}
+	if err := syscall.SetsockoptString(s.Fd(), sys.SOL_TLS, sys.TLS_TX, string(info)); err != nil {
+		t.Skipf("TLS_TX error = %v", err)
+	}
+	if err := syscall.SetsockoptString(c.Fd(), sys.SOL_TLS, sys.TLS_RX, string(info)); err != nil {
+		t.Skipf("TLS_RX error = %v", err)
+	}
+	if tx, rx := s.KTLS(); !tx || rx {
+		t.Errorf("KTLS() of sender = %v, %v, want true, false", tx, rx)
+	}
+	if tx, rx := c.KTLS(); tx || !rx {
+		t.Errorf("KTLS() of receiver = %v, %v, want false, true", tx, rx)
+	}
+
+	if n, err := s.WriteZC([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("WriteZC on kernel TLS = %d, %v, want 5, nil", n, err)
+	}
+	buf := make([]byte, 64)
+	if n, err := c.Read(buf); string(buf[:n]) != "hello" || err != nil {
+		t.Errorf("Read = %q, %v, want hello", buf[:n], err)
+	}
+
+	// An alert is not application data
+	if _, err := s.WriteRecord(TLSRecordAlert, []byte{1, 0}); err != nil {
+		t.Fatalf("WriteRecord error = %v", err)
+	}
+	if _, err := c.Read(buf); !errors.Is(err, ErrTLSRecord) {
+		t.Errorf("Read of an alert error = %v, want ErrTLSRecord", err)
+	}
+	if n, typ, err := c.ReadRecord(buf); n != 2 || typ != TLSRecordAlert || err != nil {
+		t.Errorf("ReadRecord = %d, %d, %v, want 2, alert", n, typ, err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(32)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"a.txt":         "hello, world\n",
+		"dir/b.txt":     "bee",
+		"dir/sub/empty": "",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := NewFS(e, root)
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+	defer fsys.Close()
+
+	if data, err := fsys.ReadFile("a.txt"); string(data) != "hello, world\n" || err != nil {
+		t.Errorf("ReadFile = %q, %v, want hello, world", data, err)
+	}
+	if fi, err := fsys.Stat("dir"); err != nil || !fi.IsDir() || fi.Name() != "dir" {
+		t.Errorf("Stat(dir) = %v, %v, want a directory", fi, err)
+	}
+	if _, err := fsys.Open("../a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open(../a.txt) error = %v, want ErrInvalid", err)
+	}
+	if _, err := fsys.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(missing) error = %v, want ErrNotExist", err)
+	}
+	// The absolute symlink resolves outside the root
+	if _, err := fsys.ReadFile("escape"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("ReadFile(escape) error = %v, want EXDEV", err)
+	}
+
+	entries, err := fs.ReadDir(fsys, "dir")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadDir(dir) = %v, %v, want 2 entries", entries, err)
+	}
+	if entries[0].Name() != "b.txt" || entries[0].IsDir() || !entries[1].IsDir() {
+		t.Errorf("ReadDir(dir) = %v, want b.txt and sub/", entries)
+	}
+
+	if err := os.Remove(filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "dir/b.txt", "dir/sub/empty"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFdRef(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+
+	ref, err := ring.PrepWriteConn(pw, []byte("hello"), 0, 1)
+	if err != nil {
+		t.Fatalf("PrepWriteConn error = %v", err)
+	}
+	// Close waits for the operation to release the descriptor
+	closed := make(chan error, 1)
+	go func() { closed <- pw.Close() }()
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if _, res, _, ok := ring.PeekCQE(); !ok || res != 5 {
+		t.Fatalf("write CQE = %d, %v, want 5", res, ok)
+	}
+	ring.SeenCQE()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v while the descriptor was held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ref.Release()
+	if err := <-closed; err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+	if _, err := HoldFd(pw); err == nil {
+		t.Error("HoldFd of closed file succeeded")
+	}
+
+	e := NewExecutor(ring)
+	defer e.Close()
+	buf := make([]byte, 16)
+	op, err := e.SubmitConn(pr, func(fd int, ud uint64) error {
+		return ring.PrepRead(fd, buf, 0, ud)
+	})
+	if err != nil {
+		t.Fatalf("SubmitConn error = %v", err)
+	}
+	if n, err := op.Result(); string(buf[:n]) != "hello" || err != nil {
+		t.Errorf("read = %q, %v, want hello", buf[:n], err)
+	}
+	// The completed operation no longer holds the descriptor
+	if err := pr.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(4)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := ring.PrepNop(uint64(i)); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+	if err := ring.PrepNop(4); err != ErrSQFull {
+		t.Fatalf("PrepNop on a full SQ error = %v, want ErrSQFull", err)
+	}
+	if _, err := ring.SubmitAndWait(4); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 4 {
+		t.Fatalf("ForEachCQE = %d, want 4", n)
+	}
+
+	st := ring.Stats()
+	if st.Submitted != 4 || st.Completed != 4 {
+		t.Errorf("Submitted, Completed = %d, %d, want 4, 4", st.Submitted, st.Completed)
+	}
+	if st.SQFull != 1 {
+		t.Errorf("SQFull = %d, want 1", st.SQFull)
+	}
+	if st.Syscalls != 1 {
+		t.Errorf("Syscalls = %d, want 1", st.Syscalls)
+	}
+	if len(st.Ops) != 1 || st.Ops["nop"] != 4 {
+		t.Errorf("Ops = %v, want nop: 4", st.Ops)
+	}
+
+	if err := ring.PublishExpvar("iouring_test_ring"); err != nil {
+		t.Fatalf("PublishExpvar error = %v", err)
+	}
+	if err := ring.PublishExpvar("iouring_test_ring"); err != syscall.EEXIST {
+		t.Errorf("PublishExpvar twice error = %v, want EEXIST", err)
+	}
+	if s := expvar.Get("iouring_test_ring").String(); !strings.Contains(s, `"Completed":4`) {
+		t.Errorf("expvar = %s, want Completed 4", s)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	skipIfNoIOURing(t)
+	if trace.IsEnabled() {
+		t.Skip("already tracing")
+	}
+
+	ring, err := New(8, WithTrace())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Fatalf("trace.Start error = %v", err)
+	}
+	ctx, task := trace.NewTask(context.Background(), "request")
+	op, err := e.SubmitContext(ctx, func(ud uint64) error {
+		return ring.PrepNop(ud)
+	})
+	if err != nil {
+		t.Fatalf("SubmitContext error = %v", err)
+	}
+	if _, err := op.Result(); err != nil {
+		t.Errorf("Result error = %v", err)
+	}
+	task.End()
+	trace.Stop()
+
+	for _, name := range []string{"iouring.nop", "iouring.submit", "iouring.wait"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("trace has no %s", name)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	ring, err := New(8, WithLogger(log))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.PrepClose(-1, 7); err != nil {
+		t.Fatalf("PrepClose error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+
+	out := buf.String()
+	for _, want := range []string{
+		`msg="iouring sqe" op=close fd=-1`,
+		`msg="iouring enter" to_submit=1 min_complete=1`,
+		`msg="iouring cqe" user_data=7 res=-9`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log has no %s; got\n%s", want, out)
+		}
+	}
+
+	// Records below the handler's level are not built
+	buf.Reset()
+	quiet, err := New(8, WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer quiet.Close()
+	quiet.PrepNop(1)
+	quiet.SubmitAndWait(1)
+	quiet.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+	if buf.Len() != 0 {
+		t.Errorf("Info logger got %s", buf.String())
+	}
+}
+
+func TestFakeRing(t *testing.T) {
+	f, err := NewFakeRing(3)
+	if err != nil {
+		t.Fatalf("NewFakeRing error = %v", err)
+	}
+	defer f.Close()
+	var _ Ringer = f
+
+	// Reads of fd 3 return data after 10ms; fd 4 fails
+	f.SetHandler(func(op *FakeOp) FakeResult {
+		switch op.SQE.Fd {
+		case 3:
+			return FakeResult{Res: int32(copy(op.Buf, "data")), Delay: 10 * time.Millisecond}
+		case 4:
+			return FakeResult{Res: -int32(syscall.EIO)}
+		}
+		return FakeResult{}
+	})
+
+	buf := make([]byte, 8)
+	f.PrepRead(3, buf, 0, 1)
+	f.PrepNop(2)
+	if f.SQSpace() != 2 {
+		t.Errorf("SQSpace() = %d, want 2", f.SQSpace())
+	}
+	if _, err := f.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	var got []uint64
+	f.ForEachCQE(func(ud uint64, res int32, _ uint32) bool {
+		got = append(got, ud)
+		return true
+	})
+	if len(got) != 2 || got[0] != 2 || got[1] != 1 || string(buf[:4]) != "data" {
+		t.Errorf("completions = %v, buf %q, want [2 1], data", got, buf)
+	}
+	if f.Now() != 10*time.Millisecond {
+		t.Errorf("Now() = %v, want 10ms", f.Now())
+	}
+
+	// A failed link cancels the rest of the chain
+	f.PrepRead(4, buf, 0, 3, WithLink())
+	f.PrepNop(4, WithLink())
+	f.PrepNop(5)
+	f.PrepNop(6)
+	if err := f.PrepNop(10); err != ErrSQFull {
+		t.Errorf("PrepNop on full SQ error = %v, want ErrSQFull", err)
+	}
+	f.SubmitAndWait(4)
+	want := map[uint64]int32{3: -int32(syscall.EIO), 4: -int32(syscall.ECANCELED), 5: -int32(syscall.ECANCELED), 6: 0}
+	for i := 0; i < 4; i++ {
+		ud, res, _, err := f.WaitCQE()
+		if err != nil || res != want[ud] {
+			t.Errorf("CQE %d = %d, %v, want %d", ud, res, err, want[ud])
+		}
+		f.SeenCQE()
+	}
+
+	// Timeouts run on the virtual clock, and can be canceled
+	ts := Timespec{Sec: 1}
+	f.PrepTimeout(&ts, 0, 0, 7)
+	if _, err := f.SubmitAndWaitTimeout(1, 500*time.Millisecond); err != nil {
+		t.Errorf("SubmitAndWaitTimeout error = %v, want nil after submitting", err)
+	}
+	if _, _, _, err := f.WaitCQETimeout(100 * time.Millisecond); err != syscall.ETIME {
+		t.Errorf("WaitCQETimeout error = %v, want ETIME", err)
+	}
+	f.PrepCancel(7, 0, 8)
+	f.SubmitAndWait(2)
+	want = map[uint64]int32{7: -int32(syscall.ECANCELED), 8: 0}
+	if n := f.ForEachCQE(func(ud uint64, res int32, _ uint32) bool {
+		if res != want[ud] {
+			t.Errorf("CQE %d = %d, want %d", ud, res, want[ud])
+		}
+		return true
+	}); n != 2 {
+		t.Errorf("ForEachCQE = %d, want 2", n)
+	}
+
+	if _, err := f.SubmitAndWait(1); err != syscall.EDEADLK {
+		t.Errorf("SubmitAndWait with nothing in flight error = %v, want EDEADLK", err)
+	}
+	f.FailSubmit(syscall.EBUSY)
+	f.PrepNop(9)
+	if _, err := f.Submit(); err != syscall.EBUSY {
+		t.Errorf("Submit error = %v, want injected EBUSY", err)
+	}
+	if n, err := f.Submit(); n != 1 || err != nil {
+		t.Errorf("Submit after failure = %d, %v, want 1", n, err)
+	}
+	if h := f.History(); len(h) != 9 || h[8].SQE.UserData != 9 {
+		t.Errorf("History() has %d ops, want 9", len(h))
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	var file bytes.Buffer
+	rec := NewRecorder(&file)
+	ring, err := New(8, WithRecorder(rec))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	pw.Write([]byte("abc"))
+
+	// What the code under test does, on either ring
+	run := func(r Ringer, fd int) map[uint64]int32 {
+		buf := make([]byte, 8)
+		ts := Timespec{Nsec: int64(time.Millisecond)}
+		r.PrepRead(fd, buf, 0, 1)
+		r.PrepClose(-1, 2)
+		r.PrepTimeout(&ts, 0, 0, 3)
+		if _, err := r.SubmitAndWait(3); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		got := map[uint64]int32{}
+		for len(got) < 3 {
+			ud, res, _, err := r.WaitCQE()
+			if err != nil {
+				t.Fatalf("WaitCQE error = %v", err)
+			}
+			got[ud] = res
+			r.SeenCQE()
+		}
+		return got
+	}
+	want := run(ring, int(pr.Fd()))
+	ring.Close()
+	if err := rec.Flush(); err != nil {
+		t.Fatalf("Flush error = %v", err)
+	}
+	if want[1] != 3 || want[2] != -int32(syscall.EBADF) || want[3] != -int32(syscall.ETIME) {
+		t.Fatalf("recorded results = %v", want)
+	}
+
+	rp, err := NewReplayer(&file)
+	if err != nil {
+		t.Fatalf("NewReplayer error = %v", err)
+	}
+	f, err := rp.NewRing(8)
+	if err != nil {
+		t.Fatalf("NewRing error = %v", err)
+	}
+	// The replay needs no pipe: results come from the recording
+	got := run(f, 99)
+	for ud, res := range want {
+		if got[ud] != res {
+			t.Errorf("replayed result of %d = %d, want %d", ud, got[ud], res)
+		}
+	}
+	if rp.Err() != nil || rp.Remaining() != 0 {
+		t.Errorf("replay Err() = %v, Remaining() = %d, want nil, 0", rp.Err(), rp.Remaining())
+	}
+
+	f.PrepNop(4)
+	f.Submit()
+	if rp.Err() == nil {
+		t.Error("Err() = nil after running past the recording")
+	}
+
+	if _, err := NewReplayer(strings.NewReader("not a recording")); err == nil {
+		t.Error("NewReplayer of garbage succeeded")
+	}
+}
+
+func FuzzParseCQE(f *testing.F) {
+	f.Add(make([]byte, 16))
+	f.Add(make([]byte, 32))
+	f.Add([]byte{7, 0, 0, 0, 0, 0, 0, 0, 0xf7, 0xff, 0xff, 0xff, 3, 0, 1, 0})
+	f.Add([]byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c, err := ParseCQE(b)
+		if len(b) != 16 && len(b) != 32 {
+			if err == nil {
+				t.Fatalf("ParseCQE of %d bytes succeeded", len(b))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("ParseCQE of %d bytes error = %v", len(b), err)
+		}
+		var cqe sys.CQE
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&cqe)), 16), b)
+		if c.UserData != cqe.UserData || c.Res != cqe.Res || c.Flags != cqe.Flags {
+			t.Errorf("ParseCQE = %+v, want %+v", c, cqe)
+		}
+		c.Err()
+		c.BufferID()
+	})
+}
+
+func FuzzParseSockaddr(f *testing.F) {
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 53, Zone: "1"},
+		&net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+		&net.UnixAddr{Name: "@abstract", Net: "unix"},
+	} {
+		sa, err := FromNetAddr(addr)
+		if err != nil {
+			f.Fatalf("FromNetAddr(%v) error = %v", addr, err)
+		}
+		f.Add(unsafe.Slice((*byte)(unsafe.Pointer(&sa.raw)), sa.Len()))
+	}
+	f.Add([]byte{syscall.AF_UNIX, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		sa, err := ParseSockaddr(b)
+		if err != nil {
+			return
+		}
+		if sa.Len() != uint32(len(b)) {
+			t.Errorf("Len() = %d, want %d", sa.Len(), len(b))
+		}
+		for _, network := range []string{"tcp", "udp", "unix", "unixgram"} {
+			sa.ToNetAddr(network)
+		}
+		// IP addresses survive a round trip through the kernel layout
+		decoded := rawToSockaddr(&sa.raw, sa.len)
+		if sa.raw.Addr.Family == syscall.AF_UNIX {
+			return
+		}
+		var raw syscall.RawSockaddrAny
+		n, err := sockaddrToRaw(decoded, &raw)
+		if err != nil {
+			t.Fatalf("sockaddrToRaw(%+v) error = %v", decoded, err)
+		}
+		if again := rawToSockaddr(&raw, n); fmt.Sprintf("%+v", again) != fmt.Sprintf("%+v", decoded) {
+			t.Errorf("round trip = %+v, want %+v", again, decoded)
+		}
+	})
+}
+
+// FuzzBufRing drives the buffer ring bookkeeping on plain memory with a
+// sequence of 3-byte Add, Advance and Recycle steps, and checks the
+// entries and tail the kernel would read against a model.
+func FuzzBufRing(f *testing.F) {
+	f.Add(byte(3), []byte{0, 0, 1, 0, 1, 2, 1, 2, 0, 2, 0, 1})
+	f.Add(byte(0), []byte{0, 5, 0xff, 1, 1, 0, 2, 0, 0xff})
+	f.Add(byte(5), bytes.Repeat([]byte{0, 3, 9, 1, 1, 0, 2, 0, 9}, 40))
+	f.Fuzz(func(t *testing.T, shift byte, steps []byte) {
+		entries := uint32(1) << (shift % 6)
+		mem := make([]byte, int(entries)*int(unsafe.Sizeof(sys.Buf{})))
+		br := newBufRing(nil, mem, entries, 1)
+
+		var tail uint16
+		slots := make([]sys.Buf, entries)
+		bufs := map[uint16][]byte{}
+		add := func(buf []byte, bid uint16, offset int) {
+			s := &slots[(tail+uint16(offset))&uint16(entries-1)]
+			s.Len, s.Bid = uint32(len(buf)), bid
+			bufs[bid] = buf
+		}
+		for ; len(steps) >= 3; steps = steps[3:] {
+			a, b := steps[1], steps[2]
+			switch steps[0] % 3 {
+			case 0:
+				buf := make([]byte, a)
+				br.Add(buf, uint16(b), int(a))
+				add(buf, uint16(b), int(a))
+			case 1:
+				br.Advance(int(a))
+				tail += uint16(a)
+			case 2:
+				br.Recycle(uint16(b))
+				add(bufs[uint16(b)], uint16(b), 0)
+				tail++
+			}
+
+			if got := *(*uint16)(unsafe.Pointer(&mem[14])); got != tail {
+				t.Fatalf("published tail = %d, want %d", got, tail)
+			}
+			for i := range slots {
+				e := br.bufs[i]
+				if e.Bid != slots[i].Bid || e.Len != slots[i].Len {
+					t.Fatalf("entry %d = bid %d len %d, want bid %d len %d", i, e.Bid, e.Len, slots[i].Bid, slots[i].Len)
+				}
+			}
+			for bid, buf := range bufs {
+				if got := br.Buffer(bid); len(got) != len(buf) {
+					t.Fatalf("Buffer(%d) has %d bytes, want %d", bid, len(got), len(buf))
+				}
+			}
+		}
+	})
+}
+
+func FuzzReplayer(f *testing.F) {
+	var file bytes.Buffer
+	rec := NewRecorder(&file)
+	rec.recordSQE(&sys.SQE{Opcode: uint8(sys.IORING_OP_NOP), UserData: 1})
+	rec.recordSQE(&sys.SQE{Opcode: uint8(sys.IORING_OP_READ), UserData: 2})
+	rec.recordCQE(2, 4, 0)
+	rec.recordCQE(1, 0, sys.IORING_CQE_F_MORE)
+	rec.Flush()
+	f.Add(file.Bytes())
+	f.Add([]byte(recordMagic))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		rp, err := NewReplayer(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		r, err := rp.NewRing(4)
+		if err != nil {
+			t.Fatalf("NewRing error = %v", err)
+		}
+		for i := 0; i < 4; i++ {
+			r.PrepNop(uint64(i))
+		}
+		r.Submit()
+		r.Advance(time.Hour)
+		r.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+		rp.Err()
+	})
+}
+
+func TestMultiRing(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	m, err := NewMultiRing(3, BalanceRoundRobin, 8)
+	if err != nil {
+		t.Fatalf("NewMultiRing error = %v", err)
+	}
+	defer m.Close()
+	for i := 0; i < 6; i++ {
+		idx, err := m.Submit(func(r *Ring) error { return r.PrepNop(uint64(i)) })
+		if err != nil || idx != i%3 {
+			t.Fatalf("Submit %d = %d, %v, want ring %d", i, idx, err, i%3)
+		}
+	}
+	if err := m.Wait(6, time.Second); err != nil {
+		t.Fatalf("Wait error = %v", err)
+	}
+	seen := map[uint64]int{}
+	if n := m.ForEachCQE(func(ring int, cqe CQEView) bool {
+		seen[cqe.UserData] = ring
+		return true
+	}); n != 6 || len(seen) != 6 {
+		t.Fatalf("ForEachCQE consumed %d, saw %v, want 6", n, seen)
+	}
+	for ud, ring := range seen {
+		if ring != int(ud)%3 {
+			t.Errorf("CQE %d came from ring %d, want %d", ud, ring, ud%3)
+		}
+	}
+	if err := m.Wait(1, 20*time.Millisecond); err != syscall.ETIME {
+		t.Errorf("Wait on idle rings = %v, want ETIME", err)
+	}
+
+	_, err = m.Submit(func(r *Ring) error {
+		r.PrepNop(100)
+		return syscall.EBADF
+	})
+	if err != syscall.EBADF {
+		t.Errorf("failed prep = %v, want EBADF", err)
+	}
+	m.Wait(1, time.Second)
+	m.ForEachCQE(func(ring int, cqe CQEView) bool {
+		if cqe.UserData != 0 {
+			t.Errorf("discarded SQE completed with user data %d, want 0", cqe.UserData)
+		}
+		return true
+	})
+	if m.Load(0) != 0 {
+		t.Errorf("Load(0) = %d after reaping, want 0", m.Load(0))
+	}
+
+	if _, err := NewMultiRing(2, BalanceRoundRobin, 8, WithDeferTaskrun()); err != syscall.EINVAL {
+		t.Errorf("NewMultiRing with DEFER_TASKRUN = %v, want EINVAL", err)
+	}
+}
+
+func TestMultiRingLeastLoaded(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	m, err := NewMultiRing(3, BalanceLeastLoaded, 8)
+	if err != nil {
+		t.Fatalf("NewMultiRing error = %v", err)
+	}
+	defer m.Close()
+
+	ts := Timespec{Sec: 10}
+	busy, err := m.Submit(func(r *Ring) error { return r.PrepTimeout(&ts, 0, 0, 1) })
+	if err != nil {
+		t.Fatalf("Submit timeout error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		idx, err := m.Submit(func(r *Ring) error { return r.PrepNop(2) })
+		if err != nil || idx == busy {
+			t.Fatalf("Submit NOP = %d, %v, want a ring other than %d", idx, err, busy)
+		}
+	}
+	if err := m.Wait(2, time.Second); err != nil {
+		t.Fatalf("Wait error = %v", err)
+	}
+	m.ForEachCQE(func(int, CQEView) bool { return true })
+	for i := 0; i < 4; i++ {
+		idx, err := m.Submit(func(r *Ring) error { return r.PrepNop(2) })
+		if err != nil || idx == busy {
+			t.Fatalf("Submit NOP after reaping = %d, %v, want a ring other than %d", idx, err, busy)
+		}
+		m.Wait(1, time.Second)
+		m.ForEachCQE(func(int, CQEView) bool { return true })
+	}
+	if m.Load(busy) != 1 {
+		t.Errorf("Load(%d) = %d, want 1", busy, m.Load(busy))
+	}
+}
+
+func TestSubmitter(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(4, WithCQSize(8))
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	s := NewSubmitter(ring, 4)
+
+	// 8 fit in the CQ, the next 4 wait in the queue, the last is refused
+	for i := 0; i < 13; i++ {
+		err := s.Prep(func(r *Ring) error { return r.PrepNop(uint64(i + 1)) })
+		if want := error(nil); i == 12 {
+			if err != ErrQueueFull {
+				t.Errorf("Prep %d = %v, want ErrQueueFull", i, err)
+			}
+		} else if err != want {
+			t.Errorf("Prep %d = %v, want nil", i, err)
+		}
+	}
+	st := s.Stats()
+	if st.Queued != 4 || st.Inflight != 8 || st.Deferred != 4 || st.Rejected != 1 || st.MaxQueued != 4 {
+		t.Errorf("Stats() = %+v, want 4 queued, 8 in flight, 4 deferred, 1 rejected", st)
+	}
+
+	var seen []uint64
+	for len(seen) < 12 {
+		if _, err := s.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		s.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			seen = append(seen, userData)
+			return true
+		})
+	}
+	for i, ud := range seen {
+		if ud != uint64(i+1) {
+			t.Fatalf("completions = %v, want 1 to 12 in order", seen)
+		}
+	}
+	if st := s.Stats(); st.Queued != 0 || st.Inflight != 0 {
+		t.Errorf("Stats() after draining = %+v, want nothing queued or in flight", st)
+	}
+
+	// A queued request that fails is reported by the next Submit
+	for i := 0; i < 8; i++ {
+		s.Prep(func(r *Ring) error { return r.PrepNop(0) })
+	}
+	s.Prep(func(r *Ring) error { return syscall.EBADF })
+	s.SubmitAndWait(8)
+	s.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+	if _, err := s.Submit(); err != syscall.EBADF {
+		t.Errorf("Submit after failed queued prep = %v, want EBADF", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(32)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	pair := func() [2]int {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			t.Fatalf("Socketpair error = %v", err)
+		}
+		t.Cleanup(func() { syscall.Close(fds[0]); syscall.Close(fds[1]) })
+		return [2]int{fds[0], fds[1]}
+	}
+	client, server := pair(), pair()
+	p := NewProxy(e, client[1], server[0])
+	done := make(chan error, 1)
+	go func() { done <- p.Run(context.Background()) }()
+
+	// Client to server, then end of file, which the proxy passes on
+	req := bytes.Repeat([]byte("request "), 20000)
+	go func() {
+		syscall.Write(client[0], req)
+		syscall.Shutdown(client[0], syscall.SHUT_WR)
+	}()
+	var got []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.Read(server[1], buf)
+		if n <= 0 || err != nil {
+			break
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, req) {
+		t.Fatalf("server read %d bytes, want %d", len(got), len(req))
+	}
+	if n, _ := syscall.Write(server[1], []byte("response")); n != 8 {
+		t.Fatalf("server write = %d", n)
+	}
+	syscall.Shutdown(server[1], syscall.SHUT_WR)
+	if n, _ := syscall.Read(client[0], buf); string(buf[:n]) != "response" {
+		t.Errorf("client read %q, want response", buf[:n])
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after both sides closed")
+	}
+	if aToB, bToA := p.Transferred(); aToB != int64(len(req)) || bToA != 8 {
+		t.Errorf("Transferred() = %d, %d, want %d, 8", aToB, bToA, len(req))
+	}
+
+	// An idle proxy times out
+	idleClient, idleServer := pair(), pair()
+	p = NewProxy(e, idleClient[1], idleServer[0])
+	p.SetIdleTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if err := p.Run(context.Background()); err != syscall.ETIMEDOUT {
+		t.Errorf("idle Run error = %v, want ETIMEDOUT", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle Run took %v", d)
+	}
+}
+
+func TestFileTable(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	files, err := NewFileTable(ring, 2)
+	if err != nil {
+		t.Skipf("sparse file table not supported: %v", err)
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		t.Fatalf("Pipe2 error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	if slot, err := files.Register(p[1]); slot != 0 || err != nil {
+		t.Fatalf("Register = %d, %v, want slot 0", slot, err)
+	}
+	if _, err := files.Register(p[1]); err != syscall.EEXIST {
+		t.Errorf("Register twice = %v, want EEXIST", err)
+	}
+	if slot, err := files.Register(p[0]); slot != 1 || err != nil {
+		t.Fatalf("Register = %d, %v, want slot 1", slot, err)
+	}
+	if _, err := files.Register(0); err != syscall.ENFILE {
+		t.Errorf("Register in full table = %v, want ENFILE", err)
+	}
+	if fd, ok := files.Fd(1); fd != p[0] || !ok {
+		t.Errorf("Fd(1) = %d, %v, want %d", fd, ok, p[0])
+	}
+
+	// The write goes through the slot even with a bogus fd
+	ring.PrepWrite(-1, []byte("fixed"), 0, 1, files.UseFixed(p[1]))
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if _, res, _, _ := ring.PeekCQE(); res != 5 {
+		t.Errorf("fixed write res = %d, want 5", res)
+	}
+	ring.SeenCQE()
+	buf := make([]byte, 8)
+	if n, _ := syscall.Read(p[0], buf); string(buf[:n]) != "fixed" {
+		t.Errorf("read %q, want fixed", buf[:n])
+	}
+
+	if err := files.Unregister(0); err != nil {
+		t.Fatalf("Unregister error = %v", err)
+	}
+	if err := files.Unregister(0); err != syscall.EINVAL {
+		t.Errorf("Unregister of free slot = %v, want EINVAL", err)
+	}
+	if _, ok := files.Slot(p[1]); ok || files.Len() != 1 {
+		t.Errorf("after Unregister Slot ok = %v, Len() = %d, want false, 1", ok, files.Len())
+	}
+	// Unregistered descriptors fall back to the plain fd
+	ring.PrepWrite(p[1], []byte("plain"), 0, 2, files.UseFixed(p[1]))
+	ring.SubmitAndWait(1)
+	if _, res, _, _ := ring.PeekCQE(); res != 5 {
+		t.Errorf("plain write res = %d, want 5", res)
+	}
+	ring.SeenCQE()
+	if slot, err := files.Register(p[1]); slot != 0 || err != nil {
+		t.Errorf("Register after Unregister = %d, %v, want slot 0", slot, err)
+	}
+}
+
+func TestDirectFd(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	if err := ring.RegisterFilesSparse(4); err != nil {
+		t.Skipf("sparse file table not supported: %v", err)
+	}
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error = %v", err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File error = %v", err)
+	}
+	defer lnFile.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer client.Close()
+
+	conn, err := AcceptDirect(e, int(lnFile.Fd()))
+	if err != nil {
+		t.Fatalf("AcceptDirect error = %v", err)
+	}
+	if n, err := conn.Send([]byte("ping"), 0); n != 4 || err != nil {
+		t.Fatalf("Send = %d, %v, want 4", n, err)
+	}
+	buf := make([]byte, 8)
+	if n, _ := client.Read(buf); string(buf[:n]) != "ping" {
+		t.Errorf("client read %q, want ping", buf[:n])
+	}
+	client.Write([]byte("pong"))
+	if n, err := conn.Recv(buf, 0); string(buf[:n]) != "pong" || err != nil {
+		t.Errorf("Recv = %q, %v, want pong", buf[:n], err)
+	}
+
+	fd, err := conn.InstallFd()
+	if errors.Is(err, syscall.EINVAL) {
+		t.Log("IORING_OP_FIXED_FD_INSTALL not supported")
+	} else if err != nil {
+		t.Fatalf("InstallFd error = %v", err)
+	} else {
+		client.Write([]byte("raw"))
+		if n, _ := syscall.Read(fd, buf); string(buf[:n]) != "raw" {
+			t.Errorf("read from installed fd %q, want raw", buf[:n])
+		}
+		syscall.Close(fd)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	if err := conn.Close(); err != os.ErrClosed {
+		t.Errorf("second Close = %v, want os.ErrClosed", err)
+	}
+	if _, err := conn.Send([]byte("x"), 0); err != os.ErrClosed {
+		t.Errorf("Send after Close = %v, want os.ErrClosed", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "direct")
+	f, err := OpenDirect(e, path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("OpenDirect error = %v", err)
+	}
+	if n, err := f.WriteAt([]byte("direct data"), 3); n != 11 || err != nil {
+		t.Fatalf("WriteAt = %d, %v, want 11", n, err)
+	}
+	got := make([]byte, 6)
+	if n, err := f.ReadAt(got, 3); string(got[:n]) != "direct" || err != nil {
+		t.Errorf("ReadAt = %q, %v, want direct", got[:n], err)
+	}
+	if n, err := f.ReadAt(got, 10); n != 4 || err != io.EOF {
+		t.Errorf("ReadAt past end = %d, %v, want 4, EOF", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+	if _, err := OpenDirect(e, filepath.Join(path, "missing"), os.O_RDONLY, 0); err == nil {
+		t.Error("OpenDirect of missing file succeeded")
+	}
+
+	sock, err := SocketDirect(e, syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("direct socket not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("SocketDirect error = %v", err)
+	}
+	if err := sock.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+}
+
+func TestPrefetcher(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(16)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	data := make([]byte, 1<<20+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "scan")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	// A sequential scan to end of file through io.Reader
+	p := NewPrefetcher(e, fd, SequentialAccess(0, 64<<10, -1), 4)
+	got, err := io.ReadAll(p)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("sequential scan read %d bytes, %v, want %d", len(got), err, len(data))
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close error = %v", err)
+	}
+
+	// Every other 4K block
+	p = NewPrefetcher(e, fd, StridedAccess(4096, 4096, 8192, 10), 3)
+	for i := 0; i < 10; i++ {
+		ext, b, err := p.Next()
+		off := int64(4096 + i*8192)
+		if err != nil || ext.Off != off || !bytes.Equal(b, data[off:off+4096]) {
+			t.Fatalf("extent %d = %+v, %v, want offset %d", i, ext, err, off)
+		}
+	}
+	if _, _, err := p.Next(); err != io.EOF {
+		t.Errorf("Next after pattern = %v, want EOF", err)
+	}
+	p.Close()
+
+	// Extents crossing end of file are served truncated, then EOF
+	end := int64(len(data))
+	p = NewPrefetcher(e, fd, ExtentAccess([]Extent{{Off: 10, Len: 5}, {Off: end - 3, Len: 100}, {Off: end + 10, Len: 4}}), 0)
+	defer p.Close()
+	if ext, b, err := p.Next(); err != nil || ext.Len != 5 || !bytes.Equal(b, data[10:15]) {
+		t.Errorf("first extent = %+v, %v", ext, err)
+	}
+	if ext, b, err := p.Next(); err != nil || ext.Len != 3 || !bytes.Equal(b, data[end-3:]) {
+		t.Errorf("extent at end = %+v, %v, want 3 bytes", ext, err)
+	}
+	if _, _, err := p.Next(); err != io.EOF {
+		t.Errorf("Next past end = %v, want EOF", err)
+	}
+}
+
+func TestWritevBuffers(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// More buffers than one writev takes, and more data than the socket
+	// buffer holds, so the write is split and continued
+	var bufs net.Buffers
+	var want []byte
+	for i := 0; i < 3000; i++ {
+		b := []byte(fmt.Sprintf("msg %d;", i))
+		bufs = append(bufs, b, nil)
+		want = append(want, b...)
+	}
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	bufs = append(bufs, big)
+	want = append(want, big...)
+	first := bufs[0]
+
+	got := make(chan []byte)
+	go func() {
+		var all []byte
+		buf := make([]byte, 64<<10)
+		for len(all) < len(want) {
+			n, err := syscall.Read(fds[1], buf)
+			if n <= 0 || err != nil {
+				break
+			}
+			all = append(all, buf[:n]...)
+		}
+		got <- all
+	}()
+
+	n, err := WritevBuffers(e, fds[0], bufs)
+	if n != int64(len(want)) || err != nil {
+		t.Fatalf("WritevBuffers = %d, %v, want %d", n, err, len(want))
+	}
+	if all := <-got; !bytes.Equal(all, want) {
+		t.Errorf("read %d bytes, differing from the %d written", len(all), len(want))
+	}
+	if len(bufs) != 6001 || &bufs[0][0] != &first[0] || len(bufs[0]) != len(first) {
+		t.Error("WritevBuffers modified bufs")
+	}
+
+	if n, err := WritevBuffers(e, fds[0], net.Buffers{nil, {}}); n != 0 || err != nil {
+		t.Errorf("WritevBuffers of empty buffers = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestSingleIssuerLockFree(t *testing.T) {
+	skipIfNoIOURing(t)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := New(8, WithSingleIssuer(), WithIssuerCheck())
+	if err == syscall.EINVAL {
+		t.Skip("IORING_SETUP_SINGLE_ISSUER not supported")
+	}
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	for i := uint64(1); i <= 4; i++ {
+		if err := ring.PrepNop(i); err != nil {
+			t.Fatalf("PrepNop error = %v", err)
+		}
+	}
+	if n, err := ring.SubmitAndWait(4); n != 4 || err != nil {
+		t.Fatalf("SubmitAndWait = %d, %v, want 4", n, err)
+	}
+	if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 4 {
+		t.Errorf("ForEachCQE = %d, want 4", n)
+	}
+
+	// Another goroutine in the SQ at the same time is caught
+	ring.sqLock.Lock()
+	defer ring.sqLock.Unlock()
+	got := make(chan any)
+	go func() {
+		defer func() { got <- recover() }()
+		ring.PrepNop(5)
+	}()
+	if r := <-got; r != ErrConcurrentIssuer {
+		t.Errorf("concurrent PrepNop panicked with %v, want ErrConcurrentIssuer", r)
+	}
+}
+
+func TestConcurrentPrep(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64, WithCQSize(1024))
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	// Producers fill SQEs side by side while another goroutine keeps
+	// publishing them
+	const producers, each = 8, 100
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; {
+				switch err := ring.PrepNop(uint64(p*each + i + 1)); err {
+				case nil:
+					i++
+				case ErrSQFull:
+					runtime.Gosched()
+				default:
+					t.Errorf("PrepNop error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for submitting := true; submitting; {
+		select {
+		case <-done:
+			submitting = false
+		default:
+		}
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+	}
+
+	seen := make(map[uint64]bool)
+	for len(seen) < producers*each {
+		if _, err := ring.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			if seen[userData] || userData == 0 || userData > producers*each {
+				t.Errorf("unexpected CQE userData %d", userData)
+			}
+			seen[userData] = true
+			return true
+		})
+	}
+	if n := ring.SQReady(); n != 0 {
+		t.Errorf("SQReady() = %d after submitting all, want 0", n)
+	}
+}
+
+func TestNoSQArray(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(4, WithFlags(sys.IORING_SETUP_NO_SQARRAY))
+	if err == syscall.EINVAL {
+		t.Skip("IORING_SETUP_NO_SQARRAY not supported (requires 6.6+)")
+	}
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	if ring.sqArray != nil {
+		t.Fatal("sqArray set on a NO_SQARRAY ring")
+	}
+
+	// Wrap around the SQ a few times; each slot must reach its own SQE
+	ud := uint64(0)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 3; i++ {
+			ud++
+			if err := ring.PrepNop(ud); err != nil {
+				t.Fatalf("PrepNop error = %v", err)
+			}
+		}
+		if n, err := ring.SubmitAndWait(3); n != 3 || err != nil {
+			t.Fatalf("SubmitAndWait = %d, %v, want 3", n, err)
+		}
+		want := ud - 2
+		ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+			if userData != want || res != 0 {
+				t.Errorf("CQE userData, res = %d, %d, want %d, 0", userData, res, want)
+			}
+			want++
+			return true
+		})
+	}
+}
+
+func TestPrepBatch(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	path := filepath.Join(t.TempDir(), "batch")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	// Write three blocks, then read them back, in one batch each
+	writes := make([]IORequest, 3)
+	for i := range writes {
+		writes[i] = IORequest{Fd: fd, Buf: bytes.Repeat([]byte{byte('a' + i)}, 512), Offset: uint64(i * 512), UserData: uint64(i + 1)}
+	}
+	if n, err := ring.PrepWriteBatch(writes); n != 3 || err != nil {
+		t.Fatalf("PrepWriteBatch = %d, %v, want 3", n, err)
+	}
+	if _, err := ring.SubmitAndWait(3); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		if res != 512 {
+			t.Errorf("write %d res = %d, want 512", userData, res)
+		}
+		return true
+	})
+
+	reads := make([]IORequest, 4)
+	for i := range reads {
+		reads[i] = IORequest{Fd: fd, Buf: make([]byte, 512), Offset: uint64(i * 512), UserData: uint64(10 + i)}
+	}
+	reads[3].Buf = nil // Still issued, completing with 0
+	if n, err := ring.PrepReadBatch(reads); n != 4 || err != nil {
+		t.Fatalf("PrepReadBatch = %d, %v, want 4", n, err)
+	}
+	if _, err := ring.SubmitAndWait(4); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		want := int32(512)
+		if userData == 13 {
+			want = 0
+		}
+		if res != want {
+			t.Errorf("read %d res = %d, want %d", userData, res, want)
+		}
+		return true
+	})
+	for i := 0; i < 3; i++ {
+		if reads[i].Buf[0] != byte('a'+i) || reads[i].Buf[511] != byte('a'+i) {
+			t.Errorf("read %d got %q..., want %c", i, reads[i].Buf[:4], 'a'+i)
+		}
+	}
+
+	// A batch larger than the free space prepares what fits
+	uds := make([]uint64, 10)
+	for i := range uds {
+		uds[i] = uint64(100 + i)
+	}
+	if n, err := ring.PrepNopBatch(uds, WithSQEFlags(sys.IOSQE_ASYNC)); n != 8 || err != ErrSQFull {
+		t.Fatalf("PrepNopBatch of 10 = %d, %v, want 8, ErrSQFull", n, err)
+	}
+	if sqe, ok := ring.pendingSQE(107); !ok || sqe.Flags&sys.IOSQE_ASYNC == 0 {
+		t.Errorf("last NOP of batch = %+v, %v, want IOSQE_ASYNC set", sqe, ok)
+	}
+	if _, err := ring.SubmitAndWait(8); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	want := uint64(100)
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		if userData != want {
+			t.Errorf("NOP userData = %d, want %d", userData, want)
+		}
+		want++
+		return true
+	})
+
+	// With WithAutoFlush the batch goes through in several rounds
+	auto, err := New(4, WithAutoFlush(), WithCQSize(16))
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer auto.Close()
+	if n, err := auto.PrepNopBatch(uds); n != 10 || err != nil {
+		t.Fatalf("PrepNopBatch with auto-flush = %d, %v, want 10", n, err)
+	}
+	if _, err := auto.SubmitAndWait(10); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if n := auto.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 10 {
+		t.Errorf("auto-flush completions = %d, want 10", n)
+	}
+}
+
+func TestSQPollFixedFiles(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	if _, err := ring.SQPollStats(); err != syscall.EINVAL {
+		t.Errorf("SQPollStats without SQPOLL = %v, want EINVAL", err)
+	}
+
+	// Act as an SQPOLL ring on a kernel without SQPOLL_NONFIXED
+	ring.sqpollFixed = true
+	buf := make([]byte, 8)
+	if err := ring.PrepRead(0, buf, 0, 1); err != ErrFixedFileRequired {
+		t.Errorf("PrepRead of plain fd = %v, want ErrFixedFileRequired", err)
+	}
+	if sqe, ok := ring.pendingSQE(1); !ok || sqe.Opcode != uint8(sys.IORING_OP_READV) || sqe.Fd != -1 {
+		t.Errorf("rejected SQE = %+v, %v, want a readv of fd -1 with userData 1", sqe, ok)
+	}
+	if err := ring.PrepRead(0, buf, 0, 2, WithFixedFile(0)); err != nil {
+		t.Errorf("PrepRead of fixed file error = %v", err)
+	}
+	if err := ring.PrepNop(3); err != nil {
+		t.Errorf("PrepNop error = %v", err)
+	}
+	reqs := []IORequest{{Fd: 0, Buf: buf, UserData: 4}, {Fd: 0, Buf: buf, UserData: 5}}
+	if n, err := ring.PrepReadBatch(reqs); n != 0 || err != ErrFixedFileRequired {
+		t.Errorf("PrepReadBatch of plain fds = %d, %v, want 0, ErrFixedFileRequired", n, err)
+	}
+	if n := ring.SQReady(); n != 5 {
+		t.Errorf("SQReady() = %d, want 5", n)
+	}
+	if _, ok := ring.pendingSQE(5); ok {
+		t.Error("rejected batch left an SQE with its userData")
+	}
+}
+
+func TestSQPollStats(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithSQPoll(), WithSQPollIdle(1))
+	if err != nil {
+		t.Skipf("SQPOLL not available: %v", err)
+	}
+	defer ring.Close()
+
+	for i := uint64(1); i <= 3; i++ {
+		ring.PrepNop(i)
+		if _, err := ring.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		ring.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+		time.Sleep(5 * time.Millisecond) // Past the idle time
+	}
+	st, err := ring.SQPollStats()
+	if err != nil {
+		t.Fatalf("SQPollStats error = %v", err)
+	}
+	if st.Thread <= 0 {
+		t.Errorf("Thread = %d, want a thread ID", st.Thread)
+	}
+	if st.Wakeups == 0 {
+		t.Error("Wakeups = 0 after submitting to an idle thread")
+	}
+}
+
+func TestDeferTaskrunReap(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := New(8, WithDeferTaskrun())
+	if err != nil {
+		if err == syscall.EINVAL {
+			t.Skip("IORING_SETUP_DEFER_TASKRUN not supported (requires 6.1+)")
+		}
+		t.Fatalf("New(WithDeferTaskrun) error = %v", err)
+	}
+	defer ring.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	buf := make([]byte, 16)
+	count := func(uint64, int32, uint32) bool { return true }
+	ring.PrepRead(p[0], buf, 0, 1)
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if _, err := syscall.Write(p[1], []byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+
+	if n := ring.ForEachCQE(count); n != 0 {
+		t.Fatalf("ForEachCQE() = %d before task work ran, want 0", n)
+	}
+	if n, err := ring.Reap(count); n != 1 || err != nil {
+		t.Fatalf("Reap() = %d, %v, want 1, nil", n, err)
+	}
+
+	// Another thread can't run the ring's task work
+	ring.PrepRead(p[0], buf, 0, 2)
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if _, err := syscall.Write(p[1], []byte("hello")); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		runtime.LockOSThread() // Never the test's thread
+		defer runtime.UnlockOSThread()
+		_, err := ring.Reap(count)
+		done <- err
+	}()
+	if err := <-done; err != ErrNotIssuer {
+		t.Errorf("Reap from another thread error = %v, want ErrNotIssuer", err)
+	}
+	if n, err := ring.Reap(count); n != 1 || err != nil {
+		t.Errorf("Reap() = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestAdaptiveWaitBatch(t *testing.T) {
+	a := newAdaptiveWait(time.Millisecond, 256)
+	now := time.Now()
+	if n := a.batch(now, 0); n != 1 {
+		t.Errorf("first batch = %d, want 1", n)
+	}
+
+	// 50 completions per ms
+	var completed uint64
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Millisecond)
+		completed += 50
+		a.batch(now, completed)
+	}
+	if n := a.batch(now.Add(time.Millisecond), completed+50); n < 40 || n > 60 {
+		t.Errorf("batch at 50/ms = %d, want about 50", n)
+	}
+
+	// Past the limit
+	now = now.Add(time.Millisecond)
+	completed += 50
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Millisecond)
+		completed += 1000
+		a.batch(now, completed)
+	}
+	if n := a.batch(now.Add(time.Millisecond), completed+1000); n != 128 {
+		t.Errorf("batch at 1000/ms = %d, want the limit of 128", n)
+	}
+
+	// An idle second forgets the rate
+	if n := a.batch(now.Add(time.Second), completed+1001); n != 1 {
+		t.Errorf("batch after idling = %d, want 1", n)
+	}
+}
+
+func TestAdaptiveWait(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	const maxDelay = 20 * time.Millisecond
+	ring, err := New(8, WithAdaptiveWait(maxDelay))
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+	if !ring.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		t.Skip("IORING_FEAT_EXT_ARG not supported")
+	}
+
+	// A predicted batch that never comes holds the completion for
+	// maxDelay, with the kernel's min timeout and with the fallback
+	for _, feat := range []uint32{ring.features, ring.features &^ sys.IORING_FEAT_MIN_TIMEOUT} {
+		ring.features = feat
+		ring.adapt.rate = 1e6
+		ring.adapt.last = time.Now()
+
+		ring.PrepNop(1)
+		if _, err := ring.Submit(); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+		start := time.Now()
+		if err := ring.getEvents(1); err != nil {
+			t.Fatalf("getEvents error = %v", err)
+		}
+		if d := time.Since(start); d < maxDelay/2 || d > maxDelay+time.Second/2 {
+			t.Errorf("wait took %v, want about %v", d, maxDelay)
+		}
+		if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 1 {
+			t.Errorf("ForEachCQE() = %d, want 1", n)
+		}
+	}
+}
+
+func TestSpinWait(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithSpinWait(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// One write lands within the spin, the other after it
+	buf := make([]byte, 16)
+	for i, delay := range []time.Duration{time.Millisecond, 100 * time.Millisecond} {
+		ring.PrepRead(p[0], buf, 0, uint64(i+1))
+		go func() {
+			time.Sleep(delay)
+			syscall.Write(p[1], []byte("hello"))
+		}()
+		userData, res, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+		if userData != uint64(i+1) || res != 5 {
+			t.Errorf("CQE = (%d, %d), want (%d, 5)", userData, res, i+1)
+		}
+		if hits := ring.Stats().SpinHits; hits != 1 {
+			t.Errorf("SpinHits after write %d = %d, want 1", i, hits)
+		}
+	}
+}
+
+func TestIOPoll(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithIOPoll())
+	if err != nil {
+		t.Skipf("IOPOLL not available: %v", err)
+	}
+	defer ring.Close()
+
+	name := t.TempDir() + "/iopoll"
+	if err := os.WriteFile(name, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	buffered, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(buffered)
+	if err := CheckIOPollFd(buffered); err != ErrDirectIORequired {
+		t.Errorf("CheckIOPollFd(buffered) = %v, want ErrDirectIORequired", err)
+	}
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	if err := CheckIOPollFd(p[0]); err != syscall.EOPNOTSUPP {
+		t.Errorf("CheckIOPollFd(pipe) = %v, want EOPNOTSUPP", err)
+	}
+
+	direct, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_DIRECT|syscall.O_CLOEXEC, 0)
+	if err == syscall.EINVAL {
+		t.Skip("O_DIRECT not supported on the temp filesystem")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(direct)
+	if err := CheckIOPollFd(direct); err != nil {
+		t.Errorf("CheckIOPollFd(direct) = %v", err)
+	}
+
+	// Without poll queues the read fails, but its completion still has to
+	// be polled for, possibly after the kernel's poll returned early
+	a, err := NewBufferAllocator(4096, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Free()
+	bufs, err := a.Alloc(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.PrepRead(direct, bufs[0], 0, 1)
+	userData, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if userData != 1 || (res != 4096 && res != -int32(syscall.EOPNOTSUPP)) {
+		t.Errorf("CQE = (%d, %d), want (1, 4096 or -EOPNOTSUPP)", userData, res)
+	}
+
+	// An idle executor parks instead of polling
+	e := NewExecutor(ring)
+	defer e.Close()
+	before := ring.Stats().Syscalls
+	time.Sleep(20 * time.Millisecond)
+	if n := ring.Stats().Syscalls - before; n > 10 {
+		t.Errorf("idle executor made %d syscalls", n)
+	}
+	op, err := e.Submit(func(ud uint64) error { return ring.PrepNop(ud) })
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if _, err := op.Result(); err != nil {
+		t.Errorf("NOP error = %v", err)
+	}
+}
+
+func TestRegisterBuffersRetained(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	// The ring alone keeps the buffers alive while they are registered
+	type page struct{ b [4096]byte }
+	freed := make(chan struct{}, 2)
+	register := func() {
+		bufs := make([][]byte, 2)
+		for i := range bufs {
+			p := new(page)
+			runtime.SetFinalizer(p, func(*page) { freed <- struct{}{} })
+			bufs[i] = p.b[:]
+		}
+		if err := ring.RegisterBuffers(bufs); err != nil {
+			t.Fatalf("RegisterBuffers error = %v", err)
+		}
+	}
+	register()
+	collected := func() bool {
+		for i := 0; i < 5; i++ {
+			runtime.GC()
+			select {
+			case <-freed:
+				return true
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return false
+	}
+	if collected() {
+		t.Fatal("registered buffer was collected")
+	}
+	if err := ring.UnregisterBuffers(); err != nil {
+		t.Fatalf("UnregisterBuffers error = %v", err)
+	}
+	if !collected() {
+		t.Error("unregistered buffer was not collected")
+	}
+
+	// Registering again reuses the ring's table
+	bufs := [][]byte{make([]byte, 4096), make([]byte, 4096)}
+	allocs := testing.AllocsPerRun(10, func() {
+		if err := ring.RegisterBuffers(bufs); err != nil {
+			t.Fatalf("RegisterBuffers error = %v", err)
+		}
+		if err := ring.UnregisterBuffers(); err != nil {
+			t.Fatalf("UnregisterBuffers error = %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("RegisterBuffers allocs = %v, want 0", allocs)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithKeepAlive())
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	// Reads whose buffer, and iovec array, only the ring refers to
+	type page struct{ b [64]byte }
+	freed := make(chan struct{}, 2)
+	newBuf := func() []byte {
+		pg := new(page)
+		runtime.SetFinalizer(pg, func(*page) { freed <- struct{}{} })
+		return pg.b[:]
+	}
+	func() {
+		ring.PrepRead(p[0], newBuf(), 0, 1)
+		ring.PrepReadv(p[0], []syscall.Iovec{{Base: &newBuf()[0], Len: 64}}, 0, 2)
+	}()
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	collected := func() int {
+		n := 0
+		for i := 0; i < 5; i++ {
+			runtime.GC()
+			select {
+			case <-freed:
+				n++
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return n
+	}
+	if n := collected(); n != 0 {
+		t.Fatalf("%d in-flight buffers were collected", n)
+	}
+
+	if _, err := syscall.Write(p[1], make([]byte, 128)); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	for reaped := 0; reaped < 2; {
+		if _, err := ring.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		reaped += ring.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+	}
+	if n := collected(); n != 2 {
+		t.Errorf("%d of 2 completed buffers were collected", n)
+	}
+	if n := len(ring.keep.inflight); n != 0 {
+		t.Errorf("%d requests still held", n)
+	}
+}
+
+func TestWaitCQETimeoutFallback(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	if ring.HasFeature(sys.IORING_FEAT_EXT_ARG) {
+		if allocs := testing.AllocsPerRun(10, func() {
+			ring.WaitCQETimeout(time.Microsecond)
+		}); allocs != 0 {
+			t.Errorf("WaitCQETimeout allocs = %v, want 0", allocs)
+		}
+	}
+
+	// As on a kernel without EXT_ARG, bounded by a timeout SQE
+	ring.features &^= sys.IORING_FEAT_EXT_ARG
+	start := time.Now()
+	if _, _, _, err := ring.WaitCQETimeout(20 * time.Millisecond); err != syscall.ETIME {
+		t.Fatalf("WaitCQETimeout error = %v, want ETIME", err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("WaitCQETimeout returned after %v, want 20ms", d)
+	}
+	if _, _, _, ok := ring.PeekCQE(); ok {
+		t.Error("timeout's CQE was left in the CQ")
+	}
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	buf := make([]byte, 16)
+	ring.PrepRead(p[0], buf, 0, 1)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		syscall.Write(p[1], []byte("hello"))
+	}()
+	userData, res, _, err := ring.WaitCQETimeout(time.Second)
+	if err != nil || userData != 1 || res != 5 {
+		t.Fatalf("WaitCQETimeout = (%d, %d, %v), want (1, 5, nil)", userData, res, err)
+	}
+	ring.SeenCQE()
+
+	// The timeout completes along with the read, unseen
+	time.Sleep(5 * time.Millisecond)
+	if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 0 {
+		t.Errorf("ForEachCQE() = %d after the read, want 0", n)
+	}
+}
+
+func TestStatsSubmission(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	ring.PrepNopBatch([]uint64{1, 2, 3})
+	ring.Submit()
+	ring.PrepNop(4)
+	if _, err := ring.SubmitAndWait(4); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if _, err := ring.Submit(); err != nil { // Nothing to publish
+		t.Fatalf("Submit error = %v", err)
+	}
+	st := ring.Stats()
+	if st.Flushes != 2 || st.Published != 4 || st.BatchSize() != 2 {
+		t.Errorf("Flushes, Published, BatchSize() = %d, %d, %v, want 2, 4, 2", st.Flushes, st.Published, st.BatchSize())
+	}
+	if st.NoSyscallSubmits != 0 || st.RegisteredEnters != 0 {
+		t.Errorf("NoSyscallSubmits, RegisteredEnters = %d, %d, want 0, 0", st.NoSyscallSubmits, st.RegisteredEnters)
+	}
+
+	sq, err := New(8, WithSQPoll(), WithSQPollIdle(100))
+	if err != nil {
+		t.Skipf("SQPOLL not available: %v", err)
+	}
+	defer sq.Close()
+	for i := uint64(1); i <= 3; i++ {
+		sq.PrepNop(i)
+		if _, err := sq.SubmitAndWait(1); err != nil {
+			t.Fatalf("SubmitAndWait error = %v", err)
+		}
+		sq.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+	}
+	// The thread polls for 100ms after each request, so this needs no syscall
+	sq.PrepNop(4)
+	if _, err := sq.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	if st := sq.Stats(); st.NoSyscallSubmits == 0 {
+		t.Errorf("NoSyscallSubmits = 0 with the SQPOLL thread awake, stats %+v", st)
+	}
+
+	// The registered index belongs to the thread that created the ring
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	reg, err := New(8, WithRegisteredFdOnly())
+	if err != nil {
+		t.Skipf("IORING_SETUP_REGISTERED_FD_ONLY not supported: %v", err)
+	}
+	defer reg.Close()
+	reg.PrepNop(1)
+	if _, err := reg.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if n := reg.Stats().RegisteredEnters; n != 1 {
+		t.Errorf("RegisteredEnters = %d, want 1", n)
+	}
+}
+
+func TestLockThread(t *testing.T) {
+	if cpus, err := parseCPUList("0-2,5,7-8"); err != nil || !slices.Equal(cpus, []int{0, 1, 2, 5, 7, 8}) {
+		t.Errorf("parseCPUList = %v, %v, want [0 1 2 5 7 8]", cpus, err)
+	}
+	if _, err := parseCPUList("0-x"); err == nil {
+		t.Error("parseCPUList(\"0-x\") succeeded")
+	}
+
+	var all cpuSet
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &all); err != nil {
+		t.Fatalf("sched_getaffinity error = %v", err)
+	}
+	cpu := 0
+	for all[cpu/64]&(1<<(cpu%64)) == 0 {
+		cpu++
+	}
+
+	unlock, err := LockThread(cpu)
+	if err != nil {
+		t.Fatalf("LockThread(%d) error = %v", cpu, err)
+	}
+	var set cpuSet
+	schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &set)
+	var want cpuSet
+	want[cpu/64] = 1 << (cpu % 64)
+	if set != want {
+		t.Errorf("CPUs after LockThread(%d) = %x, want %x", cpu, set, want)
+	}
+	unlock()
+
+	runtime.LockOSThread()
+	schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &set)
+	runtime.UnlockOSThread()
+	if set != all {
+		t.Errorf("CPUs after unlock = %x, want %x", set, all)
+	}
+
+	if _, err := LockThread(-1); err != syscall.EINVAL {
+		t.Errorf("LockThread(-1) error = %v, want EINVAL", err)
+	}
+	if near, err := NearCPUs(cpu); err != nil || slices.Contains(near, cpu) {
+		t.Errorf("NearCPUs(%d) = %v, %v, want the others sharing a cache", cpu, near, err)
+	}
+}
+
+func TestCloseQuiesces(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatalf("Pipe error = %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	buf := make([]byte, 16)
+	ring.PrepRead(p[0], buf, 0, 1)
+	if _, err := ring.Submit(); err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+
+	// A caller still using the ring keeps it mapped past Close
+	if !ring.hold() {
+		t.Fatal("hold() on an open ring = false")
+	}
+	if err := ring.CloseTimeout(time.Second); err != nil {
+		t.Fatalf("CloseTimeout error = %v", err)
+	}
+	if ring.released.Load() {
+		t.Error("ring released while held")
+	}
+	ring.drop()
+	if !ring.released.Load() {
+		t.Error("ring not released by the last caller")
+	}
+
+	// The read was cancelled, so the pipe is free for others
+	syscall.Write(p[1], []byte("x"))
+	var b [1]byte
+	if n, err := syscall.Read(p[0], b[:]); n != 1 || err != nil {
+		t.Errorf("Read after Close = %d, %v, want 1, nil", n, err)
+	}
+
+	if err := ring.PrepNop(2); err != ErrRingClosed {
+		t.Errorf("PrepNop after Close error = %v, want ErrRingClosed", err)
+	}
+	if _, err := ring.Submit(); err != ErrRingClosed {
+		t.Errorf("Submit after Close error = %v, want ErrRingClosed", err)
+	}
+	if _, _, _, ok := ring.PeekCQE(); ok || ring.CQReady() != 0 {
+		t.Error("CQ not empty after Close")
+	}
+	if err := ring.Close(); err != nil {
+		t.Errorf("Close twice error = %v", err)
+	}
+}
+
+func TestCloseRacingCalls(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	for i := 0; i < 20; i++ {
+		ring, err := New(16)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if err := ring.PrepNop(1); err == ErrRingClosed {
+						return
+					}
+					if _, err := ring.Submit(); err == ErrRingClosed {
+						return
+					}
+					ring.ForEachCQE(func(uint64, int32, uint32) bool { return true })
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		if err := ring.Close(); err != nil {
+			t.Fatalf("Close error = %v", err)
+		}
+		wg.Wait()
+		if !ring.released.Load() {
+			t.Fatal("ring not released after its callers returned")
+		}
+	}
+}
+
+func TestClosedRingAPI(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := ring.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+
+	// A new ring likely reuses the fd; the closed one must not reach it
+	other, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer other.Close()
+
+	buf := make([]byte, 8)
+	errs := map[string]error{
+		"PrepNop":         ring.PrepNop(1),
+		"PrepRead":        ring.PrepRead(0, buf, 0, 1),
+		"RegisterFiles":   ring.RegisterFiles([]int{0}),
+		"RegisterEventfd": ring.RegisterEventfd(0),
+		"GetEvents":       ring.GetEvents(),
+	}
+	_, errs["PrepNopBatch"] = ring.PrepNopBatch([]uint64{1, 2})
+	_, errs["Submit"] = ring.Submit()
+	_, errs["SubmitAndWait"] = ring.SubmitAndWait(1)
+	_, _, _, errs["WaitCQE"] = ring.WaitCQE()
+	_, _, _, errs["WaitCQETimeout"] = ring.WaitCQETimeout(time.Millisecond)
+	_, errs["Probe"] = ring.Probe()
+	_, errs["Enter"] = ring.Enter(0, 0, 0, nil)
+	for name, err := range errs {
+		if err != ErrRingClosed {
+			t.Errorf("%s after Close error = %v, want ErrRingClosed", name, err)
+		}
+	}
+
+	if ring.GetSQE() != nil {
+		t.Error("GetSQE after Close returned an SQE")
+	}
+	ring.SetSQELink()
+	if _, _, _, ok := ring.PeekCQE(); ok {
+		t.Error("PeekCQE after Close = ok")
+	}
+	if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 0 {
+		t.Errorf("ForEachCQE after Close = %d, want 0", n)
+	}
+	if st := ring.Stats(); st.Pending != 0 || st.Submitted != 0 {
+		t.Errorf("Stats after Close = %+v, want nothing pending or submitted", st)
+	}
+
+	if _, err := other.register(sys.IORING_UNREGISTER_FILES, nil, 0); err != syscall.ENXIO {
+		t.Errorf("unregistering files on the other ring error = %v, want ENXIO", err)
+	}
+}
+
+func TestEnterRetriesEINTR(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	tid := syscall.Gettid()
+
+	// SIGURG, as the runtime sends to preempt goroutines
+	interrupt := func() (stop func()) {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(2 * time.Millisecond):
+					syscall.Tgkill(syscall.Getpid(), tid, syscall.SIGURG)
+				}
+			}
+		}()
+		return func() { close(done) }
+	}
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	stop := interrupt()
+	start := time.Now()
+	_, _, _, err = ring.WaitCQETimeout(50 * time.Millisecond)
+	stop()
+	if err != syscall.ETIME {
+		t.Errorf("WaitCQETimeout while signalled error = %v, want ETIME", err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Errorf("WaitCQETimeout while signalled took %v, want about 50ms", d)
+	}
+
+	raw, err := New(8, WithEINTR())
+	if err != nil {
+		t.Fatalf("New(WithEINTR) error = %v", err)
+	}
+	defer raw.Close()
+
+	stop = interrupt()
+	_, _, _, err = raw.WaitCQETimeout(time.Second)
+	stop()
+	if err != syscall.EINTR {
+		t.Errorf("WaitCQETimeout with WithEINTR error = %v, want EINTR", err)
+	}
+}
+
+func TestSubmitRetry(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithSubmitRetry(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New(WithSubmitRetry) error = %v", err)
+	}
+	defer ring.Close()
+
+	for i := uint64(1); i <= 4; i++ {
+		ring.PrepNop(i)
+	}
+	if n, err := ring.SubmitAndWait(4); n != 4 || err != nil {
+		t.Fatalf("SubmitAndWait = %d, %v, want 4, nil", n, err)
+	}
+	if n := ring.ForEachCQE(func(uint64, int32, uint32) bool { return true }); n != 4 {
+		t.Errorf("ForEachCQE = %d, want 4", n)
+	}
+
+	// Errors other than EBUSY and EAGAIN are returned at once
+	fd := ring.enterFd
+	ring.enterFd = -1
+	ring.PrepNop(5)
+	start := time.Now()
+	_, err = ring.Submit()
+	ring.enterFd = fd
+	if err != syscall.EBADF {
+		t.Errorf("Submit on a bad fd error = %v, want EBADF", err)
+	}
+	if d := time.Since(start); d >= 10*time.Millisecond {
+		t.Errorf("Submit on a bad fd took %v, want no retries", d)
+	}
+}
+
+func TestOpCheck(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8, WithOpCheck())
+	if err != nil {
+		t.Fatalf("New(WithOpCheck) error = %v", err)
+	}
+	defer ring.Close()
+
+	if err := ring.PrepNop(1); err != nil {
+		t.Fatalf("PrepNop error = %v", err)
+	}
+
+	// As on a kernel without IORING_OP_READ
+	ring.ops.probe.Ops[sys.IORING_OP_READ].Flags = 0
+	buf := make([]byte, 8)
+	err = ring.PrepRead(3, buf, 0, 2, WithLink())
+	var opErr *OpError
+	if !errors.Is(err, ErrNotSupported) || !errors.As(err, &opErr) || opErr.Op != "read" || opErr.Fd != 3 || opErr.UserData != 2 {
+		t.Fatalf("PrepRead of an unsupported op error = %v, want an OpError for read on fd 3 wrapping ErrNotSupported", err)
+	}
+	if err := ring.PrepNop(3); err != nil {
+		t.Fatalf("PrepNop error = %v", err)
+	}
+
+	// The rejected read fails under its own userData and breaks its link
+	if _, err := ring.SubmitAndWait(3); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	got := map[uint64]int32{}
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		got[userData] = res
+		return true
+	})
+	want := map[uint64]int32{1: 0, 2: -int32(syscall.EBADF), 3: -int32(syscall.ECANCELED)}
+	if !maps.Equal(got, want) {
+		t.Errorf("completions = %v, want %v", got, want)
+	}
+}
+
+func TestLargeIO(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	f, err := os.CreateTemp("", "iouring_test_large")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(bytes.Repeat([]byte{'x'}, 100)); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	fd := int(f.Fd())
+
+	// A short file keeps the kernel from touching more than a page
+	backing := make([]byte, 4096)
+	huge := reserveIO(t, MaxIOSize+4096, syscall.PROT_READ|syscall.PROT_WRITE)
+
+	if err := ring.PrepRead(fd, huge, 0, 1); err != ErrIOTooLarge {
+		t.Errorf("PrepRead error = %v, want ErrIOTooLarge", err)
+	}
+	if err := ring.PrepSend(fd, huge, 0, 1); err != ErrIOTooLarge {
+		t.Errorf("PrepSend error = %v, want ErrIOTooLarge", err)
+	}
+	reqs := []IORequest{{Fd: fd, Buf: backing, UserData: 2}, {Fd: fd, Buf: huge, UserData: 3}}
+	if n, err := ring.PrepReadBatch(reqs); n != 1 || err != ErrIOTooLarge {
+		t.Errorf("PrepReadBatch = %d, %v, want 1, ErrIOTooLarge", n, err)
+	}
+	if got := ChunkCount(len(huge)); got != 2 {
+		t.Errorf("ChunkCount = %d, want 2", got)
+	}
+
+	n, err := ring.PrepReadChunked(fd, huge, 0, 4)
+	if n != 2 || err != nil {
+		t.Fatalf("PrepReadChunked = %d, %v, want 2, nil", n, err)
+	}
+	if _, err := ring.SubmitAndWait(4); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+
+	var results []int32
+	for len(results) < 2 {
+		userData, res, _, err := ring.WaitCQE()
+		if err != nil {
+			t.Fatalf("WaitCQE error = %v", err)
+		}
+		ring.SeenCQE()
+		switch userData {
+		case 2:
+			if res != 100 {
+				t.Errorf("batch read res = %d, want 100", res)
+			}
+		case 0:
+			// The NOP the rejected batch request became
+		case 4:
+			results = append(results, res)
+		default:
+			t.Fatalf("unexpected userData %d", userData)
+		}
+	}
+	if results[1] != -int32(syscall.ECANCELED) {
+		t.Errorf("second chunk res = %d, want -ECANCELED", results[1])
+	}
+	if got, err := ChunkedResult(len(huge), results); got != 100 || err != nil {
+		t.Errorf("ChunkedResult = %d, %v, want 100, nil", got, err)
+	}
+	if got, err := ChunkedResult(len(huge), []int32{MaxIOSize, -int32(syscall.EIO)}); got != MaxIOSize || err != syscall.EIO {
+		t.Errorf("ChunkedResult with a failed chunk = %d, %v, want %d, EIO", got, err, MaxIOSize)
+	}
+
+	// A chain that does not fit is not prepared at all
+	short := reserveIO(t, 9*MaxIOSize, syscall.PROT_NONE)
+	if n, err := ring.PrepReadChunked(fd, short, 0, 5); n != 0 || err != ErrSQFull {
+		t.Errorf("PrepReadChunked over the SQ = %d, %v, want 0, ErrSQFull", n, err)
+	}
+}
+
+// reserveIO maps n bytes of anonymous memory for buffers larger than
+// MaxIOSize, which cost nothing until touched.
+func reserveIO(t *testing.T, n int, prot int) []byte {
+	t.Helper()
+	b, err := syscall.Mmap(-1, 0, n, prot, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_NORESERVE)
+	if err != nil {
+		t.Skipf("mmap of %d bytes error = %v", n, err)
+	}
+	t.Cleanup(func() { syscall.Munmap(b) })
+	return b
+}
+
+func TestLargeIOLoops(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	// Writes to /dev/null never touch the data
+	huge := reserveIO(t, MaxIOSize+4096, syscall.PROT_READ|syscall.PROT_WRITE)
+	null, err := OpenFile(e, "/dev/null", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile error = %v", err)
+	}
+	defer null.Close()
+	if n, err := null.WriteAt(huge, 0); n != len(huge) || err != nil {
+		t.Errorf("File.WriteAt = %d, %v, want %d, nil", n, err, len(huge))
+	}
+	if n, err := NewWriter(null, 0).Write(huge); n != len(huge) || err != nil {
+		t.Errorf("Writer.Write = %d, %v, want %d, nil", n, err, len(huge))
+	}
+	nullFd, err := syscall.Open("/dev/null", syscall.O_WRONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fioRing, err := New(8) // FileIO needs a ring no Executor owns
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer fioRing.Close()
+	fio := NewFileIO(fioRing, nullFd)
+	defer fio.Close()
+	if n, err := fio.WriteAt(huge, 0); n != len(huge) || err != nil {
+		t.Errorf("FileIO.WriteAt = %d, %v, want %d, nil", n, err, len(huge))
+	}
+
+	// A short file keeps the read to a page
+	f, err := os.CreateTemp("", "iouring_test_large")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(bytes.Repeat([]byte{'x'}, 100)); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	short := NewFile(e, int(f.Fd()), f.Name())
+	if n, err := short.ReadAt(huge, 0); n != 100 || err != io.EOF {
+		t.Errorf("File.ReadAt = %d, %v, want 100, EOF", n, err)
+	}
+}
+
+func TestReadWriteCur(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	if !ring.HasRWCurPos() {
+		if err := ring.PrepReadCur(0, make([]byte, 1), 1); err != ErrNotSupported {
+			t.Errorf("PrepReadCur error = %v, want ErrNotSupported", err)
+		}
+		t.Skip("IORING_FEAT_RW_CUR_POS not supported")
+	}
+
+	f, err := os.CreateTemp("", "iouring_test_cur")
+	if err != nil {
+		t.Fatalf("CreateTemp error = %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fd := int(f.Fd())
+
+	// Linked, so the second write starts where the first left off
+	ring.PrepWriteCur(fd, []byte("hello, "), 1, WithLink())
+	ring.PrepWriteCur(fd, []byte("world"), 2)
+	if _, err := ring.SubmitAndWait(2); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	ring.DrainCQEs()
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 12 {
+		t.Errorf("file position after writes = %d, want 12", pos)
+	}
+
+	f.Seek(7, io.SeekStart)
+	buf := make([]byte, 16)
+	if err := ring.PrepReadCur(fd, buf, 3); err != nil {
+		t.Fatalf("PrepReadCur error = %v", err)
+	}
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	_, res, _, err := ring.WaitCQE()
+	if err != nil {
+		t.Fatalf("WaitCQE error = %v", err)
+	}
+	ring.SeenCQE()
+	if got := string(buf[:max(res, 0)]); got != "world" {
+		t.Errorf("PrepReadCur read %q, want %q", got, "world")
+	}
+	if pos, _ := f.Seek(0, io.SeekCurrent); pos != 12 {
+		t.Errorf("file position after read = %d, want 12", pos)
+	}
+}
+
+func TestRegistrationState(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+
+	if st := ring.RegistrationState(); st.Buffers != 0 || st.Files != 0 || st.Eventfd != -1 || st.BufRings != nil || st.Personalities != nil {
+		t.Errorf("RegistrationState of a new ring = %+v, want nothing registered", st)
+	}
+	// Nothing to unregister is not an error
+	for name, err := range map[string]error{
+		"UnregisterBuffers":     ring.UnregisterBuffers(),
+		"UnregisterFiles":       ring.UnregisterFiles(),
+		"UnregisterEventfd":     ring.UnregisterEventfd(),
+		"UnregisterPersonality": ring.UnregisterPersonality(1),
+	} {
+		if err != nil {
+			t.Errorf("%s with nothing registered error = %v", name, err)
+		}
+	}
+
+	efd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		t.Fatalf("eventfd error = %v", errno)
+	}
+	defer syscall.Close(int(efd))
+
+	if err := ring.RegisterFiles([]int{0, 1}); err != nil {
+		t.Fatalf("RegisterFiles error = %v", err)
+	}
+	if err := ring.RegisterBuffers([][]byte{make([]byte, 4096)}); err != nil {
+		t.Fatalf("RegisterBuffers error = %v", err)
+	}
+	if err := ring.RegisterEventfd(int(efd)); err != nil {
+		t.Fatalf("RegisterEventfd error = %v", err)
+	}
+	id, err := ring.RegisterPersonality()
+	if err != nil {
+		t.Fatalf("RegisterPersonality error = %v", err)
+	}
+	br, err := ring.NewBufRing(8, 7)
+	if err != nil {
+		t.Skipf("NewBufRing error = %v", err)
+	}
+
+	st := ring.RegistrationState()
+	if st.Buffers != 1 || st.Files != 2 || st.Eventfd != int(efd) || !slices.Equal(st.BufRings, []uint16{7}) || !slices.Equal(st.Personalities, []uint16{id}) {
+		t.Errorf("RegistrationState = %+v, want 1 buffer, 2 files, eventfd %d, buffer ring 7 and personality %d", st, efd, id)
+	}
+
+	ring.PrepNop(1, WithPersonality(id))
+	if _, err := ring.SubmitAndWait(1); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	if _, res, _, err := ring.WaitCQE(); err != nil || res != 0 {
+		t.Errorf("NOP with personality = %d, %v, want 0, nil", res, err)
+	}
+	ring.SeenCQE()
+
+	for i := 0; i < 2; i++ {
+		if err := ring.UnregisterFiles(); err != nil {
+			t.Errorf("UnregisterFiles #%d error = %v", i+1, err)
+		}
+		if err := ring.UnregisterPersonality(id); err != nil {
+			t.Errorf("UnregisterPersonality #%d error = %v", i+1, err)
+		}
+	}
+	if st := ring.RegistrationState(); st.Files != 0 || len(st.Personalities) != 0 {
+		t.Errorf("RegistrationState after unregistering = %+v, want no files or personalities", st)
+	}
+
+	// Close unregisters the rest; closing the buffer ring after is fine
+	if err := ring.Close(); err != nil {
+		t.Fatalf("Close error = %v", err)
+	}
+	if st := ring.RegistrationState(); st.Buffers != 0 || st.Eventfd != -1 || len(st.BufRings) != 0 {
+		t.Errorf("RegistrationState after Close = %+v, want nothing registered", st)
+	}
+	if err := br.Close(); err != nil {
+		t.Errorf("BufRing.Close after Close error = %v", err)
+	}
+	if err := ring.UnregisterBuffers(); err != nil {
+		t.Errorf("UnregisterBuffers after Close error = %v", err)
+	}
+}
+
+func TestReceiveStream(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(128)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConn(e, fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// More messages than buffers, so the recv runs dry while the first
+	// ones are held
+	const msgs = recvStreamBuffers + 6
+	for i := 0; i < msgs; i++ {
+		if _, err := syscall.Write(fds[0], fmt.Appendf(nil, "msg%02d", i)); err != nil {
+			t.Fatalf("Write error = %v", err)
+		}
+	}
+
+	stream := c.ReceiveStream(context.Background())
+	var got []string
+	var held []func()
+	for data, release := range stream.All() {
+		got = append(got, string(data))
+		held = append(held, release)
+		if len(held) == recvStreamBuffers {
+			toRelease := held
+			time.AfterFunc(20*time.Millisecond, func() {
+				for _, release := range toRelease {
+					release()
+				}
+			})
+			held = nil
+		}
+		if len(got) == msgs {
+			syscall.Close(fds[0]) // Ends the stream
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Err = %v, want nil at the end of the stream", err)
+	}
+	if len(got) != msgs {
+		t.Fatalf("received %d messages, want %d", len(got), msgs)
+	}
+	for i, m := range got {
+		if want := fmt.Sprintf("msg%02d", i); m != want {
+			t.Errorf("message %d = %q, want %q", i, m, want)
+		}
+	}
+	for _, release := range held {
+		release()
+	}
+	if st := ring.RegistrationState(); len(st.BufRings) != 0 {
+		t.Errorf("buffer rings after the stream ended = %v, want none", st.BufRings)
+	}
+
+	// A done context ends a stream waiting for data
+	fds, err = syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	c2, err := NewConn(e, fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream = c2.ReceiveStream(ctx)
+	for range stream.All() {
+		t.Error("received data on an idle connection")
+	}
+	if err := stream.Err(); err != context.DeadlineExceeded {
+		t.Errorf("Err = %v, want DeadlineExceeded", err)
+	}
+	for range stream.All() {
+	}
+	if stream.Err() == nil {
+		t.Error("second iteration of a stream did not fail")
+	}
+}
+
+func TestListener(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewListener(e, int(f.Fd()))
+	if err != nil {
+		t.Fatalf("NewListener error = %v", err)
+	}
+	defer f.Close()
+	addr := l.Addr().String()
+
+	dial := func() net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	client := dial()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error = %v", err)
+	}
+	client.Write([]byte("ping"))
+	buf := make([]byte, 8)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("Read of accepted conn = %q, %v, want ping", buf[:n], err)
+	}
+	c.Close()
+
+	for i := 0; i < 3; i++ {
+		dial()
+	}
+	stream := l.AcceptStream(context.Background())
+	accepted := 0
+	for fd := range stream.All() {
+		if _, err := syscall.Getpeername(fd); err != nil {
+			t.Errorf("accepted fd %d: Getpeername error = %v", fd, err)
+		}
+		syscall.Close(fd)
+		if accepted++; accepted == 3 {
+			break
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Err after break = %v, want nil", err)
+	}
+
+	// With a one-slot file table the kernel drops the second connection
+	// for want of a slot, failing the accept with ENFILE; the stream
+	// carries on with the third once the first frees its slot
+	if err := ring.RegisterFilesSparse(1); err != nil {
+		t.Skipf("RegisterFilesSparse error = %v", err)
+	}
+	dial()
+	dial()
+	stream = l.AcceptStream(context.Background()).Direct()
+	var slots []int
+	for slot := range stream.All() {
+		slots = append(slots, slot)
+		if len(slots) == 2 {
+			break
+		}
+		time.AfterFunc(30*time.Millisecond, func() {
+			NewDirectFd(e, slot).Close()
+			if c, err := net.Dial("tcp", addr); err == nil {
+				t.Cleanup(func() { c.Close() })
+			}
+		})
+	}
+	if err := stream.Err(); err != nil || !slices.Equal(slots, []int{0, 0}) {
+		t.Errorf("direct stream = %v, %v, want slots [0 0], nil", slots, err)
+	}
+	NewDirectFd(e, 0).Close()
+
+	// A done context, and closing the Listener, end a waiting stream
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream = l.AcceptStream(ctx)
+	for range stream.All() {
+		t.Error("accepted a connection nobody made")
+	}
+	if err := stream.Err(); err != context.DeadlineExceeded {
+		t.Errorf("Err = %v, want DeadlineExceeded", err)
+	}
+
+	stream = l.AcceptStream(context.Background())
+	time.AfterFunc(20*time.Millisecond, func() { l.Close() })
+	for range stream.All() {
+		t.Error("accepted a connection nobody made")
+	}
+	if err := stream.Err(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Err after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	var a, b [2]int
+	for _, p := range []*[2]int{&a, &b} {
+		if err := syscall.Pipe(p[:]); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(p[0])
+		defer syscall.Close(p[1])
+	}
+
+	w := NewWatcher(e)
+	for _, fd := range []int{a[0], b[0]} {
+		if err := w.Add(fd, syscall.EPOLLIN); err != nil {
+			t.Fatalf("Add(%d) error = %v", fd, err)
+		}
+	}
+	if err := w.Add(a[0], syscall.EPOLLIN); err != syscall.EEXIST {
+		t.Errorf("Add twice error = %v, want EEXIST", err)
+	}
+
+	next := func(timeout time.Duration) (WatchEvent, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return w.Next(ctx)
+	}
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		syscall.Write(a[1], []byte{byte(i)})
+		ev, err := next(5 * time.Second)
+		if err != nil {
+			t.Fatalf("Next() #%d error = %v", i, err)
+		}
+		if ev.Fd != a[0] || ev.Events&syscall.EPOLLIN == 0 || ev.Err != nil {
+			t.Errorf("Next() #%d = %+v, want EPOLLIN on fd %d", i, ev, a[0])
+		}
+		syscall.Read(a[0], buf)
+	}
+
+	if err := w.Remove(b[0]); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := w.Remove(b[0]); err != syscall.ENOENT {
+		t.Errorf("Remove twice error = %v, want ENOENT", err)
+	}
+	syscall.Write(b[1], []byte{0})
+	if ev, err := next(50 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("Next() after Remove = %+v, %v, want DeadlineExceeded", ev, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Next(context.Background())
+		done <- err
+	}()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := <-done; err != os.ErrClosed {
+		t.Errorf("Next() during Close error = %v, want os.ErrClosed", err)
+	}
+	if _, err := w.Next(context.Background()); err != os.ErrClosed {
+		t.Errorf("Next() after Close error = %v, want os.ErrClosed", err)
+	}
+	if err := w.Add(a[0], syscall.EPOLLIN); err != os.ErrClosed {
+		t.Errorf("Add() after Close error = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestLoopTicker(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	// With a multishot timeout and with the re-armed fallback
+	for _, noMultishot := range []bool{false, true} {
+		l, err := NewLoop(64)
+		if err != nil {
+			t.Fatalf("NewLoop error = %v", err)
+		}
+		l.noTimeoutMultishot = noMultishot
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr := make(chan error, 1)
+		go func() { runErr <- l.Run(ctx) }()
+
+		tick := func(tk *Ticker) time.Time {
+			t.Helper()
+			select {
+			case at := <-tk.C:
+				return at
+			case <-time.After(5 * time.Second):
+				t.Fatalf("noMultishot %v: tick missing", noMultishot)
+				return time.Time{}
+			}
+		}
+
+		tk, err := l.NewTicker(10 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("NewTicker error = %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			tick(tk)
+		}
+
+		if err := tk.Reset(40 * time.Millisecond); err != nil {
+			t.Fatalf("Reset error = %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		select {
+		case <-tk.C: // Sent before the Reset
+		default:
+		}
+		prev := tick(tk)
+		for i := 0; i < 3; i++ {
+			at := tick(tk)
+			if d := at.Sub(prev); d < 30*time.Millisecond {
+				t.Errorf("noMultishot %v: tick after Reset(40ms) came %v after the last", noMultishot, d)
+			}
+			prev = at
+		}
+
+		tk.Stop()
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-tk.C:
+		default:
+		}
+		select {
+		case <-tk.C:
+			t.Errorf("noMultishot %v: tick after Stop", noMultishot)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		cancel()
+		<-runErr
+		l.Close()
+	}
+}
+
+func TestTimeoutOps(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	buf := make([]byte, 8)
+	start := time.Now()
+	n, err := e.ReadTimeout(p[0], buf, 0, 20*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadTimeout on empty pipe = %d, %v, want ErrDeadlineExceeded", n, err)
+	}
+	var oe *OpError
+	if !errors.As(err, &oe) || oe.Op != "read" {
+		t.Errorf("ReadTimeout error = %#v, want *OpError of read", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("ReadTimeout returned after %v, want >= 20ms", d)
+	}
+
+	if n, err := e.WriteTimeout(p[1], []byte("hello"), 0, time.Second); n != 5 || err != nil {
+		t.Fatalf("WriteTimeout = %d, %v, want 5, nil", n, err)
+	}
+	if n, err := e.ReadTimeout(p[0], buf, 0, time.Second); n != 5 || err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("ReadTimeout = %d, %q, %v, want 5, hello, nil", n, buf[:n], err)
+	}
+	_, err = e.ReadTimeout(p[0], buf, 0, 0)
+	if !errors.As(err, &oe) || oe.Op != "read" || oe.Fd != p[0] || oe.Err != os.ErrDeadlineExceeded {
+		t.Errorf("ReadTimeout(0) error = %#v, want *OpError of read wrapping ErrDeadlineExceeded", err)
+	}
+
+	sp, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sp[0])
+	defer syscall.Close(sp[1])
+	if _, err := e.RecvTimeout(sp[0], buf, 0, 20*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("RecvTimeout with nothing sent error = %v, want ErrDeadlineExceeded", err)
+	}
+	if n, err := e.SendTimeout(sp[1], []byte("ping"), 0, time.Second); n != 4 || err != nil {
+		t.Fatalf("SendTimeout = %d, %v, want 4, nil", n, err)
+	}
+	if n, err := e.RecvTimeout(sp[0], buf, 0, time.Second); n != 4 || err != nil {
+		t.Errorf("RecvTimeout = %d, %v, want 4, nil", n, err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := e.AcceptTimeout(int(f.Fd()), syscall.SOCK_CLOEXEC, 20*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("AcceptTimeout with no client error = %v, want ErrDeadlineExceeded", err)
+	}
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fd, err := e.AcceptTimeout(int(f.Fd()), syscall.SOCK_CLOEXEC, time.Second)
+	if err != nil {
+		t.Fatalf("AcceptTimeout error = %v", err)
+	}
+	syscall.Close(fd)
+}
+
+func TestDeadlineInFlight(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(64)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer ring.Close()
+	e := NewExecutor(ring)
+	defer e.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socketpair error = %v", err)
+	}
+	defer syscall.Close(fds[1])
+	c, err := NewConn(e, fds[0])
+	if err != nil {
+		t.Fatalf("NewConn error = %v", err)
+	}
+	defer c.Close()
+
+	read := func(r func([]byte) (int, error)) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := r(make([]byte, 8))
+			done <- err
+		}()
+		time.Sleep(20 * time.Millisecond) // Let it block
+		return done
+	}
+	wait := func(name string, done <-chan error) error {
+		t.Helper()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still blocked", name)
+			return nil
+		}
+	}
+
+	// A read without a deadline is canceled by one set later
+	done := read(c.Read)
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := wait("Read without deadline", done); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after SetReadDeadline error = %v, want ErrDeadlineExceeded", err)
+	}
+
+	// The linked timeout of a read is moved earlier...
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	start := time.Now()
+	done = read(c.Read)
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if err := wait("Read with deadline", done); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after earlier deadline error = %v, want ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read timed out after %v, want about 40ms", d)
+	}
+
+	// ...later, or out of reach
+	c.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+	done = read(c.Read)
+	c.SetReadDeadline(time.Time{})
+	time.Sleep(50 * time.Millisecond)
+	syscall.Write(fds[1], []byte("x"))
+	if err := wait("Read with cleared deadline", done); err != nil {
+		t.Errorf("Read after clearing deadline error = %v", err)
+	}
+
+	// A failed update of the linked timeout falls back to canceling
+	c.SetReadDeadline(time.Now().Add(time.Hour))
+	start = time.Now()
+	done = read(c.Read)
+	upd, err := e.Submit(func(ud uint64) error {
+		return ring.PrepTimeoutRemove(^uint64(0)>>1, ud) // Fails with ENOENT
+	})
+	if err != nil {
+		t.Fatalf("Submit error = %v", err)
+	}
+	c.mu.Lock()
+	var op *Operation
+	var pending *pendingIO
+	for o, pi := range c.inflight {
+		op, pending = o, pi // The read
+	}
+	c.read = time.Now().Add(20 * time.Millisecond)
+	moves, deadline := pending.moves, c.read
+	c.mu.Unlock()
+	c.checkUpdate(op, pending, moves, upd, deadline)
+	if err := wait("Read with failed update", done); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after failed update error = %v, want ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read timed out after %v, want about 40ms", d)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Deadlines of a File
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[1])
+	f := NewFile(e, p[0], "pipe")
+	defer f.Close()
+	done = read(func(b []byte) (int, error) { return f.ReadAt(b, 0) })
+	f.SetReadDeadline(time.Now().Add(-time.Second))
+	if err := wait("File.ReadAt", done); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("File.ReadAt after SetReadDeadline error = %v, want ErrDeadlineExceeded", err)
+	}
+	if _, err := f.ReadAt(make([]byte, 8), 0); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("File.ReadAt past deadline error = %v, want ErrDeadlineExceeded", err)
+	}
+	f.SetDeadline(time.Time{})
+	syscall.Write(p[1], []byte("y"))
+	if n, err := f.ReadAt(make([]byte, 1), 0); n != 1 || err != nil {
+		t.Errorf("File.ReadAt without deadline = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestLoopPrepError(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	l, err := NewLoop(64)
+	if err != nil {
+		t.Fatalf("NewLoop error = %v", err)
+	}
+	defer l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-runErr
+	}()
+
+	// Every prep error reaches the callback, errno or not
+	for _, tc := range []struct {
+		err  error
+		want syscall.Errno
+	}{
+		{syscall.EBADF, syscall.EBADF},
+		{&OpError{Op: "read", Fd: -1, Err: syscall.ENOENT}, syscall.ENOENT},
+		{ErrIOTooLarge, syscall.EINVAL},
+	} {
+		got := make(chan int32, 1)
+		if err := l.Submit(func(uint64) error { return tc.err }, func(cqe CQEView) {
+			got <- cqe.Res
+		}); err != nil {
+			t.Fatalf("Submit error = %v", err)
+		}
+		select {
+		case res := <-got:
+			if res != -int32(tc.want) {
+				t.Errorf("prep error %v: callback Res = %d, want %d", tc.err, res, -int32(tc.want))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("prep error %v: callback not called", tc.err)
+		}
+	}
+}
+
+func TestDiscardSQEs(t *testing.T) {
+	skipIfNoIOURing(t)
+
+	ring, err := New(8)
+	if err != nil {
+		t.Fatalf("New error = %v", err)
+	}
+	defer ring.Close()
+
+	// Only the failed batch's SQEs become NOPs, not those another
+	// producer claimed meanwhile
+	ring.PrepNop(1)
+	mark := ring.sqMark()
+	ring.PrepNop(2, WithLink())
+	ring.PrepNop(3)
+	ring.PrepNop(2)
+	ring.discardSQEs(mark, func(userData uint64) bool { return userData == 2 })
+
+	// SQEs published since mark are left alone
+	ring.Submit()
+	ring.discardSQEs(mark, nil)
+
+	if _, err := ring.SubmitAndWait(4); err != nil {
+		t.Fatalf("SubmitAndWait error = %v", err)
+	}
+	var got []uint64
+	ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		got = append(got, userData)
+		return true
+	})
+	if want := []uint64{1, 0, 3, 0}; !slices.Equal(got, want) {
+		t.Errorf("CQEs for %v, want %v", got, want)
+	}
+}
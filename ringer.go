@@ -0,0 +1,47 @@
+package iouring
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Timespec is a time specification for timeout operations.
+type Timespec = sys.Timespec
+
+// Ringer is the Prep, Submit and completion surface of a Ring, for code
+// that wants to run against FakeRing in tests. Ringer, FakeRing and the
+// OpOption helpers build outside Linux too, so such code can be
+// unit-tested on a developer's machine and in CI without io_uring; only
+// Ring needs Linux.
+//
+// Ringer covers the common operations. Code needing more can assert the
+// concrete type, or keep those calls out of the code under test.
+type Ringer interface {
+	PrepNop(userData uint64, opts ...OpOption) error
+	PrepRead(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error
+	PrepWrite(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error
+	PrepFsync(fd int, flags uint32, userData uint64, opts ...OpOption) error
+	PrepTimeout(ts *Timespec, count uint64, flags uint32, userData uint64, opts ...OpOption) error
+	PrepCancel(targetUserData uint64, flags uint32, userData uint64, opts ...OpOption) error
+	PrepAccept(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64, opts ...OpOption) error
+	PrepConnect(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64, opts ...OpOption) error
+	PrepSend(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error
+	PrepRecv(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error
+	PrepClose(fd int, userData uint64, opts ...OpOption) error
+
+	Submit() (int, error)
+	SubmitAndWait(n uint32) (int, error)
+	SubmitAndWaitTimeout(n uint32, timeout time.Duration) (int, error)
+	SQSpace() uint32
+	CQReady() uint32
+
+	PeekCQE() (userData uint64, res int32, flags uint32, ok bool)
+	WaitCQE() (userData uint64, res int32, flags uint32, err error)
+	WaitCQETimeout(timeout time.Duration) (userData uint64, res int32, flags uint32, err error)
+	SeenCQE()
+	ForEachCQE(fn func(userData uint64, res int32, flags uint32) bool) int
+
+	Close() error
+}
@@ -0,0 +1,161 @@
+//go:build linux
+
+package iouring
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Kernel limits on ring sizes (IORING_MAX_ENTRIES, IORING_MAX_CQ_ENTRIES).
+const (
+	maxSQEntries = 32768
+	maxCQEntries = 2 * maxSQEntries
+)
+
+// hugePageSize is the default huge page size on x86_64 and arm64.
+const hugePageSize = 2 << 20
+
+// ringLayout describes the memory needed by a NO_MMAP ring.
+type ringLayout struct {
+	sqEntries uint32
+	cqEntries uint32
+	sqesSize  uint32 // SQE array, page aligned
+	ringsSize uint32 // SQ/CQ ring headers, CQEs and SQ array, page aligned
+}
+
+// computeRingLayout mirrors the kernel's sizing of the ring regions for the
+// given entries and setup flags.
+func computeRingLayout(entries uint32, p *sys.Params) (ringLayout, error) {
+	var l ringLayout
+
+	sq := entries
+	if sq == 0 {
+		return l, syscall.EINVAL
+	}
+	if sq > maxSQEntries {
+		if p.Flags&sys.IORING_SETUP_CLAMP == 0 {
+			return l, syscall.EINVAL
+		}
+		sq = maxSQEntries
+	}
+	sq = roundUpPow2(sq)
+
+	cq := 2 * sq
+	if p.Flags&sys.IORING_SETUP_CQSIZE != 0 {
+		cq = p.CQEntries
+		if cq == 0 {
+			return l, syscall.EINVAL
+		}
+		if cq > maxCQEntries {
+			if p.Flags&sys.IORING_SETUP_CLAMP == 0 {
+				return l, syscall.EINVAL
+			}
+			cq = maxCQEntries
+		}
+		cq = roundUpPow2(cq)
+		if cq < sq {
+			return l, syscall.EINVAL
+		}
+	}
+
+	sqeSize := uint32(unsafe.Sizeof(sys.SQE{}))
+	if p.Flags&sys.IORING_SETUP_SQE128 != 0 {
+		sqeSize *= 2
+	}
+	cqeSize := uint32(unsafe.Sizeof(sys.CQE{}))
+	if p.Flags&sys.IORING_SETUP_CQE32 != 0 {
+		cqeSize *= 2
+	}
+
+	// struct io_rings is one cache line followed by the CQEs; the SQ
+	// array starts at the next cache line boundary.
+	rings := alignUp(64+cq*cqeSize, 64)
+	if p.Flags&sys.IORING_SETUP_NO_SQARRAY == 0 {
+		rings += sq * 4
+	}
+
+	page := uint32(os.Getpagesize())
+	l.sqEntries = sq
+	l.cqEntries = cq
+	l.sqesSize = alignUp(sq*sqeSize, page)
+	l.ringsSize = alignUp(rings, page)
+	return l, nil
+}
+
+// RingMemorySize returns how many bytes of memory WithRingMemory needs for
+// a ring created with the same entries and options.
+func RingMemorySize(entries uint32, opts ...Option) (int, error) {
+	var cfg setupConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	l, err := computeRingLayout(entries, &cfg.Params)
+	if err != nil {
+		return 0, err
+	}
+	return int(l.sqesSize + l.ringsSize), nil
+}
+
+// setupRingMemory prepares the NO_MMAP regions and points the setup
+// parameters at them.
+func (r *Ring) setupRingMemory(entries uint32, cfg *setupConfig) error {
+	l, err := computeRingLayout(entries, &cfg.Params)
+	if err != nil {
+		return err
+	}
+	size := int(l.sqesSize + l.ringsSize)
+
+	mem := cfg.ringMem
+	if mem != nil {
+		if len(mem) < size || uintptr(unsafe.Pointer(&mem[0]))%uintptr(os.Getpagesize()) != 0 {
+			return syscall.EINVAL
+		}
+	} else if cfg.hugePages {
+		mem, r.ringMemHuge, err = allocHugeMem(size)
+		if err != nil {
+			return err
+		}
+		r.ringMemOwned = true
+	} else {
+		mem, err = syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE,
+			syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_POPULATE)
+		if err != nil {
+			return err
+		}
+		r.ringMemOwned = true
+	}
+
+	r.ringMem = mem
+	r.sqesSize = l.sqesSize
+	cfg.SQOff.UserAddr = uint64(uintptr(unsafe.Pointer(&mem[0])))
+	cfg.CQOff.UserAddr = uint64(uintptr(unsafe.Pointer(&mem[l.sqesSize])))
+	return nil
+}
+
+// freeRingMemory releases NO_MMAP memory allocated by setupRingMemory.
+func (r *Ring) freeRingMemory() {
+	if r.ringMemOwned {
+		syscall.Munmap(r.ringMem)
+	}
+	r.ringMem = nil
+	r.ringMemOwned = false
+	r.ringMemHuge = false
+}
+
+// roundUpPow2 rounds v up to the next power of two.
+func roundUpPow2(v uint32) uint32 {
+	n := uint32(1)
+	for n < v {
+		n <<= 1
+	}
+	return n
+}
+
+// alignUp rounds v up to a multiple of align, which must be a power of two.
+func alignUp(v, align uint32) uint32 {
+	return (v + align - 1) &^ (align - 1)
+}
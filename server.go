@@ -0,0 +1,395 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+	"time"
+)
+
+// Default buffer ring of a Server.
+const (
+	defaultServerBuffers    = 256
+	defaultServerBufferSize = 4096
+)
+
+// pendingUserData stands for the userData of a request that Run has not
+// prepared yet.
+const pendingUserData = ^uint64(0)
+
+// Handler is the set of callbacks of a Server. They all run on the
+// Loop's goroutine; nil callbacks are skipped.
+type Handler struct {
+	// OnAccept is called for each new connection before its first read.
+	OnAccept func(c *ServerConn)
+	// OnData is called with each chunk received on a connection. data is
+	// only valid during the call: its buffer goes back to the kernel
+	// afterwards.
+	OnData func(c *ServerConn, data []byte)
+	// OnClose is called once a connection is closed, with the error that
+	// closed it, or nil after end of file or ServerConn.Close.
+	OnClose func(c *ServerConn, err error)
+	// OnError is called if the server stops accepting because of err.
+	OnError func(err error)
+
+	// Buffers and BufferSize size the server's provided buffer ring;
+	// zero values pick defaults. Buffers must be a power of two.
+	Buffers    int
+	BufferSize int
+}
+
+// Server accepts connections on a listening socket with a multishot
+// accept and reads each of them with a multishot recv into a provided
+// buffer ring, calling its Handler for every event. An echo server is
+//
+//	loop.RegisterHandler(lnFd, iouring.Handler{
+//		OnData: func(c *iouring.ServerConn, data []byte) { c.Write(data) },
+//	})
+//
+// All of a Server's state belongs to the Loop's goroutine.
+type Server struct {
+	loop    *Loop
+	fd      int
+	h       Handler
+	bufs    *BufRing
+	conns   map[*ServerConn]struct{}
+	accept  uint64 // userData of the accept request; 0 if none
+	closing bool
+}
+
+// ServerConn is a connection accepted by a Server. Its methods must be
+// called on the Loop's goroutine, e.g. from the Server's callbacks or
+// through Loop.Post.
+type ServerConn struct {
+	s   *Server
+	fd  int
+	ctx any
+
+	recv   uint64   // userData of the recv request; 0 if none
+	send   uint64   // userData of the send in flight; 0 if none
+	wq     [][]byte // Data not yet sent, oldest first
+	closed bool     // Close was called or the connection failed
+	err    error    // Why the connection closed
+
+	idle        *Timer // Idle timeout; nil if never set
+	idleTimeout time.Duration
+	lastRecv    time.Time
+}
+
+// RegisterHandler starts serving the listening socket fd with h. The
+// Server does not take ownership of fd. Setup happens on the Loop's
+// goroutine once Run picks it up; failures go to h.OnError.
+//
+// Servers use provided buffer groups counting down from 65535.
+func (l *Loop) RegisterHandler(fd int, h Handler) (*Server, error) {
+	if h.Buffers <= 0 {
+		h.Buffers = defaultServerBuffers
+	}
+	if h.BufferSize <= 0 {
+		h.BufferSize = defaultServerBufferSize
+	}
+	if h.Buffers > 32768 || h.Buffers&(h.Buffers-1) != 0 {
+		return nil, syscall.EINVAL
+	}
+
+	s := &Server{loop: l, fd: fd, h: h, conns: make(map[*ServerConn]struct{})}
+	if err := l.Post(s.start); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start sets up the buffer ring and arms the accept.
+func (s *Server) start() {
+	if s.closing {
+		return
+	}
+	l := s.loop
+	l.nextBgid--
+	bufs, err := l.ring.NewBufRing(uint32(s.h.Buffers), l.nextBgid)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	slab := make([]byte, s.h.Buffers*s.h.BufferSize)
+	for i := 0; i < s.h.Buffers; i++ {
+		bufs.Add(slab[i*s.h.BufferSize:(i+1)*s.h.BufferSize], uint16(i), i)
+	}
+	bufs.Advance(s.h.Buffers)
+	s.bufs = bufs
+	s.armAccept()
+}
+
+// armAccept submits the multishot accept.
+func (s *Server) armAccept() {
+	s.accept = pendingUserData
+	s.loop.Submit(func(ud uint64) error {
+		s.accept = ud
+		return s.loop.ring.PrepAcceptMultishot(s.fd, nil, nil, syscall.SOCK_CLOEXEC, ud)
+	}, s.onAccept)
+}
+
+// onAccept handles a CQE of the accept.
+func (s *Server) onAccept(cqe CQEView) {
+	more := cqe.HasMore()
+	if !more {
+		s.accept = 0
+	}
+
+	if cqe.Res >= 0 {
+		s.open(int(cqe.Res))
+	} else if err := cqe.Err(); !s.closing && err != syscall.ECONNABORTED && err != syscall.EINTR {
+		s.fail(err)
+		return
+	}
+
+	if !more {
+		if s.closing {
+			s.release()
+		} else {
+			s.armAccept()
+		}
+	}
+}
+
+// open starts serving an accepted connection.
+func (s *Server) open(fd int) {
+	if s.closing {
+		syscall.Close(fd)
+		return
+	}
+	c := &ServerConn{s: s, fd: fd}
+	s.conns[c] = struct{}{}
+	if s.h.OnAccept != nil {
+		s.h.OnAccept(c)
+	}
+	if !c.closed {
+		c.armRecv()
+	}
+}
+
+// fail stops the server after an error.
+func (s *Server) fail(err error) {
+	if s.h.OnError != nil {
+		s.h.OnError(err)
+	}
+	s.stop()
+}
+
+// Close stops accepting and closes all connections of the server. It
+// may be called from any goroutine; the listening socket stays open.
+func (s *Server) Close() error {
+	return s.loop.Post(s.stop)
+}
+
+// stop cancels the accept and closes the connections.
+func (s *Server) stop() {
+	if s.closing {
+		return
+	}
+	s.closing = true
+	if s.accept != 0 {
+		s.loop.cancel(&s.accept)
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.release()
+}
+
+// release frees the buffer ring once nothing uses it.
+func (s *Server) release() {
+	if s.closing && s.accept == 0 && len(s.conns) == 0 && s.bufs != nil {
+		s.bufs.Close()
+		s.bufs = nil
+	}
+}
+
+// Fd returns the connection's socket.
+func (c *ServerConn) Fd() int {
+	return c.fd
+}
+
+// Context returns the value set with SetContext.
+func (c *ServerConn) Context() any {
+	return c.ctx
+}
+
+// SetContext attaches a value of the caller's choosing to the
+// connection, such as per-connection protocol state.
+func (c *ServerConn) SetContext(v any) {
+	c.ctx = v
+}
+
+// SetIdleTimeout makes the connection close with syscall.ETIMEDOUT once
+// no data has arrived for d; zero turns the timeout off. Received data
+// does not touch the timer, which checks for activity when it expires.
+func (c *ServerConn) SetIdleTimeout(d time.Duration) error {
+	c.idleTimeout = d
+	c.lastRecv = time.Now()
+	switch {
+	case d <= 0:
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+	case c.idle != nil:
+		c.idle.Reset(d)
+	default:
+		t, err := c.s.loop.AfterFunc(d, c.onIdle)
+		if err != nil {
+			return err
+		}
+		c.idle = t
+	}
+	return nil
+}
+
+// onIdle closes the connection if it was idle for the whole timeout.
+func (c *ServerConn) onIdle() {
+	if c.closed || c.idleTimeout <= 0 {
+		return
+	}
+	if left := c.idleTimeout - time.Since(c.lastRecv); left > 0 {
+		c.idle.Reset(left)
+		return
+	}
+	c.closeWith(syscall.ETIMEDOUT)
+}
+
+// armRecv submits the multishot recv.
+func (c *ServerConn) armRecv() {
+	c.recv = pendingUserData
+	c.s.loop.Submit(func(ud uint64) error {
+		c.recv = ud
+		return c.s.loop.ring.PrepRecvMultishot(c.fd, c.s.bufs.BGid(), 0, ud)
+	}, c.onRecv)
+}
+
+// onRecv handles a CQE of the recv.
+func (c *ServerConn) onRecv(cqe CQEView) {
+	more := cqe.HasMore()
+	if !more {
+		c.recv = 0
+	}
+
+	if cqe.Res > 0 && c.idleTimeout > 0 {
+		c.lastRecv = time.Now()
+	}
+	if bid, ok := cqe.BufferID(); ok {
+		if cqe.Res > 0 && !c.closed && c.s.h.OnData != nil {
+			c.s.h.OnData(c, c.s.bufs.Buffer(bid)[:cqe.Res])
+		}
+		c.s.bufs.Recycle(bid)
+	}
+
+	switch {
+	case cqe.Res == 0:
+		c.Close()
+	case cqe.Res == -int32(syscall.ENOBUFS):
+		// Out of buffers; the ones just recycled are enough to go on
+	case cqe.Res < 0 && !c.closed:
+		c.closeWith(cqe.Err())
+	}
+
+	if !more {
+		if c.closed {
+			c.finish()
+		} else {
+			c.armRecv()
+		}
+	}
+}
+
+// Write queues a copy of b to be sent after the data already queued.
+func (c *ServerConn) Write(b []byte) error {
+	if c.closed {
+		return syscall.EBADF
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	c.wq = append(c.wq, append([]byte(nil), b...))
+	if c.send == 0 {
+		c.sendNext()
+	}
+	return nil
+}
+
+// sendNext sends the head of the write queue.
+func (c *ServerConn) sendNext() {
+	buf := c.wq[0]
+	c.send = pendingUserData
+	c.s.loop.Submit(func(ud uint64) error {
+		c.send = ud
+		return c.s.loop.ring.PrepSend(c.fd, buf, syscall.MSG_NOSIGNAL, ud)
+	}, c.onSend)
+}
+
+// onSend handles the completion of a send.
+func (c *ServerConn) onSend(cqe CQEView) {
+	c.send = 0
+	if cqe.Res < 0 {
+		if !c.closed {
+			c.closeWith(cqe.Err())
+		}
+		c.wq = nil
+		c.finish()
+		return
+	}
+
+	if n := int(cqe.Res); n < len(c.wq[0]) {
+		c.wq[0] = c.wq[0][n:]
+	} else {
+		c.wq[0] = nil
+		c.wq = c.wq[1:]
+	}
+	if len(c.wq) > 0 && !c.closed {
+		c.sendNext()
+		return
+	}
+	c.finish()
+}
+
+// Close stops reading, drops unsent data and closes the socket; OnClose
+// follows once the requests in flight are done.
+func (c *ServerConn) Close() {
+	c.closeWith(nil)
+}
+
+// closeWith closes the connection because of err.
+func (c *ServerConn) closeWith(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	if c.idle != nil {
+		c.idle.Stop()
+	}
+	if c.recv != 0 {
+		c.s.loop.cancel(&c.recv)
+	}
+	if c.send != 0 {
+		c.s.loop.cancel(&c.send)
+	}
+	c.finish()
+}
+
+// finish closes the socket once the connection is closed and idle.
+func (c *ServerConn) finish() {
+	if !c.closed || c.recv != 0 || c.send != 0 || c.fd < 0 {
+		return
+	}
+	fd := c.fd
+	c.fd = -1
+	c.s.loop.Submit(func(ud uint64) error {
+		return c.s.loop.ring.PrepClose(fd, ud)
+	}, func(CQEView) {
+		s := c.s
+		delete(s.conns, c)
+		if s.h.OnClose != nil {
+			s.h.OnClose(c, c.err)
+		}
+		s.release()
+	})
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package iouring
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// ShardMode selects how a ShardedRing maps callers to rings.
+type ShardMode int
+
+const (
+	// ShardPerCPU keeps one ring per CPU and picks the ring of the CPU
+	// the caller runs on. A goroutine can migrate at any time, so each
+	// ring is still guarded by a mutex, but callers on different CPUs
+	// rarely meet on it.
+	ShardPerCPU ShardMode = iota
+
+	// ShardPerThread gives every OS thread its own SINGLE_ISSUER ring,
+	// created on the thread's first call. Callers must hold
+	// runtime.LockOSThread for as long as they use the ring. Rings are
+	// never shared, so their SQ takes no lock; Do only takes an
+	// uncontended lock that orders goroutines taking turns on a thread.
+	ShardPerThread
+)
+
+// ShardedRing spreads submissions over several rings so that concurrent
+// submitters do not all contend on one ring's SQ lock.
+type ShardedRing struct {
+	mode    ShardMode
+	entries uint32
+	opts    []Option
+
+	cpus []*ringShard // ShardPerCPU
+
+	mu      sync.Mutex
+	threads map[int]*ringShard // ShardPerThread, by thread ID
+}
+
+// ringShard is one ring of a ShardedRing.
+type ringShard struct {
+	mu   sync.Mutex // Held by Do; uncontended in ShardPerThread mode
+	ring *Ring
+}
+
+// NewShardedRing creates a sharded ring whose rings have the given
+// entries and options. In ShardPerCPU mode the rings are created up
+// front, one per CPU usable by the process; in ShardPerThread mode they
+// are created on demand.
+func NewShardedRing(mode ShardMode, entries uint32, opts ...Option) (*ShardedRing, error) {
+	s := &ShardedRing{mode: mode, entries: entries, opts: opts}
+	switch mode {
+	case ShardPerCPU:
+		for i := 0; i < runtime.NumCPU(); i++ {
+			ring, err := New(entries, opts...)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			s.cpus = append(s.cpus, &ringShard{ring: ring})
+		}
+	case ShardPerThread:
+		s.threads = make(map[int]*ringShard)
+		s.opts = append(opts[:len(opts):len(opts)], WithSingleIssuer())
+	default:
+		return nil, syscall.EINVAL
+	}
+	return s, nil
+}
+
+// Do calls fn with the calling CPU's or thread's ring, on which fn may
+// prepare and submit SQEs and reap completions. In ShardPerCPU mode fn
+// runs under the ring's lock and must not block for long.
+func (s *ShardedRing) Do(fn func(r *Ring) error) error {
+	if s.mode == ShardPerThread {
+		sh, err := s.threadShard()
+		if err != nil {
+			return err
+		}
+		// A goroutine that locks the thread later is not otherwise
+		// ordered after the one that used the ring before it
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		return fn(sh.ring)
+	}
+
+	cpu, _ := sys.Getcpu()
+	sh := s.cpus[cpu%len(s.cpus)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return fn(sh.ring)
+}
+
+// threadShard returns the calling thread's ring, creating it if needed.
+func (s *ShardedRing) threadShard() (*ringShard, error) {
+	tid := syscall.Gettid()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.threads == nil {
+		return nil, ErrRingClosed
+	}
+	if sh, ok := s.threads[tid]; ok {
+		return sh, nil
+	}
+	// Created on this thread, which becomes its single issuer
+	ring, err := New(s.entries, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	sh := &ringShard{ring: ring}
+	s.threads[tid] = sh
+	return sh, nil
+}
+
+// Rings returns the rings created so far, e.g. to reap them from one
+// place. Rings of ShardPerThread mode may only be submitted to from
+// their own thread.
+func (s *ShardedRing) Rings() []*Ring {
+	var rings []*Ring
+	for _, sh := range s.cpus {
+		rings = append(rings, sh.ring)
+	}
+	s.mu.Lock()
+	for _, sh := range s.threads {
+		rings = append(rings, sh.ring)
+	}
+	s.mu.Unlock()
+	return rings
+}
+
+// Close closes all rings.
+func (s *ShardedRing) Close() error {
+	var first error
+	for _, ring := range s.Rings() {
+		if err := ring.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	s.mu.Lock()
+	s.threads = nil
+	s.mu.Unlock()
+	return first
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+)
+
+// Sigset is a kernel signal set for waits that atomically replace the
+// calling thread's signal mask, the way ppoll and epoll_pwait do.
+// Signals in the set are blocked during the wait; all others may
+// interrupt it with EINTR.
+//
+// The Go runtime normally leaves signals unblocked, so this matters for
+// threads pinned with runtime.LockOSThread that block signals themselves
+// and only want them delivered while waiting for completions.
+type Sigset struct {
+	val uint64
+}
+
+// SigsetOf returns a set containing sigs.
+func SigsetOf(sigs ...syscall.Signal) Sigset {
+	var s Sigset
+	for _, sig := range sigs {
+		s.Add(sig)
+	}
+	return s
+}
+
+// Add adds sig to the set. Signals outside 1-64 are ignored.
+func (s *Sigset) Add(sig syscall.Signal) {
+	if sig >= 1 && sig <= 64 {
+		s.val |= 1 << (sig - 1)
+	}
+}
+
+// Del removes sig from the set.
+func (s *Sigset) Del(sig syscall.Signal) {
+	if sig >= 1 && sig <= 64 {
+		s.val &^= 1 << (sig - 1)
+	}
+}
+
+// Has reports whether sig is in the set.
+func (s *Sigset) Has(sig syscall.Signal) bool {
+	return sig >= 1 && sig <= 64 && s.val&(1<<(sig-1)) != 0
+}
@@ -0,0 +1,303 @@
+//go:build linux
+
+package iouring
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Sockaddr holds a socket address in the form the kernel reads and
+// writes, for PrepAcceptSockaddr, PrepConnectSockaddr and
+// PrepBindSockaddr. The storage lives inside the Sockaddr, so keeping the
+// Sockaddr reachable until the operation completes is all that is needed.
+//
+// The zero value is an empty address, ready to receive the peer address
+// of an accept.
+type Sockaddr struct {
+	raw syscall.RawSockaddrAny
+	len uint32 // Length of the address in raw; updated by accept
+}
+
+// FromNetAddr converts a UDP, TCP, IP or Unix address. IPv4 addresses
+// become AF_INET addresses, others AF_INET6.
+func FromNetAddr(addr net.Addr) (*Sockaddr, error) {
+	family := syscall.AF_INET
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		family = ipFamily(a.IP)
+	case *net.TCPAddr:
+		family = ipFamily(a.IP)
+	case *net.IPAddr:
+		family = ipFamily(a.IP)
+	}
+	sa, err := addrToSockaddr(addr, family)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sockaddr{}
+	if err := s.set(sa); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ipFamily returns the address family for ip; nil counts as IPv4.
+func ipFamily(ip net.IP) int {
+	if ip == nil || ip.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// ToNetAddr converts the address for a socket of the given network
+// ("tcp", "udp", "unix", "unixgram", "unixpacket", optionally with a 4 or
+// 6 suffix), or returns nil if the address is empty or of an unknown
+// family.
+func (s *Sockaddr) ToNetAddr(network string) net.Addr {
+	sotype := syscall.SOCK_STREAM
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		sotype = syscall.SOCK_DGRAM
+	case "unixpacket":
+		sotype = syscall.SOCK_SEQPACKET
+	}
+	return s.addr(sotype)
+}
+
+// ParseSockaddr copies a socket address in the kernel's struct sockaddr
+// layout, e.g. the source address in a received message, into a
+// Sockaddr. It checks that b is long enough for its AF_INET, AF_INET6 or
+// AF_UNIX family and returns EINVAL otherwise, or EAFNOSUPPORT for
+// other families.
+func ParseSockaddr(b []byte) (*Sockaddr, error) {
+	s := &Sockaddr{}
+	if len(b) < 2 || len(b) > syscall.SizeofSockaddrAny {
+		return nil, syscall.EINVAL
+	}
+	raw := unsafe.Slice((*byte)(unsafe.Pointer(&s.raw)), syscall.SizeofSockaddrAny)
+	copy(raw, b)
+	min := 0
+	switch s.raw.Addr.Family {
+	case syscall.AF_INET:
+		min = syscall.SizeofSockaddrInet4
+	case syscall.AF_INET6:
+		min = syscall.SizeofSockaddrInet6
+	case syscall.AF_UNIX:
+		if len(b) > syscall.SizeofSockaddrUnix {
+			return nil, syscall.EINVAL
+		}
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+	if len(b) < min {
+		return nil, syscall.EINVAL
+	}
+	s.len = uint32(len(b))
+	return s, nil
+}
+
+// Len returns the length of the address in bytes.
+func (s *Sockaddr) Len() uint32 {
+	return s.len
+}
+
+// set encodes sa into s.
+func (s *Sockaddr) set(sa syscall.Sockaddr) error {
+	n, err := sockaddrToRaw(sa, &s.raw)
+	if err != nil {
+		return err
+	}
+	s.len = n
+	return nil
+}
+
+// addr decodes s for a socket of type sotype.
+func (s *Sockaddr) addr(sotype int) net.Addr {
+	if s.len == 0 {
+		return nil
+	}
+	return sockaddrToAddr(rawToSockaddr(&s.raw, s.len), sotype)
+}
+
+// reset prepares s to receive an address.
+func (s *Sockaddr) reset() {
+	s.raw = syscall.RawSockaddrAny{}
+	s.len = syscall.SizeofSockaddrAny
+}
+
+// sockaddrToAddr converts a socket address of a socket of type sotype
+// (SOCK_STREAM, SOCK_DGRAM) into the matching net.Addr, or nil.
+func sockaddrToAddr(sa syscall.Sockaddr, sotype int) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		ip := net.IP(append([]byte(nil), sa.Addr[:]...))
+		if sotype == syscall.SOCK_DGRAM {
+			return &net.UDPAddr{IP: ip, Port: sa.Port}
+		}
+		return &net.TCPAddr{IP: ip, Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		ip := net.IP(append([]byte(nil), sa.Addr[:]...))
+		zone := zoneName(sa.ZoneId)
+		if sotype == syscall.SOCK_DGRAM {
+			return &net.UDPAddr{IP: ip, Port: sa.Port, Zone: zone}
+		}
+		return &net.TCPAddr{IP: ip, Port: sa.Port, Zone: zone}
+	case *syscall.SockaddrUnix:
+		network := "unix"
+		switch sotype {
+		case syscall.SOCK_DGRAM:
+			network = "unixgram"
+		case syscall.SOCK_SEQPACKET:
+			network = "unixpacket"
+		}
+		return &net.UnixAddr{Name: sa.Name, Net: network}
+	}
+	return nil
+}
+
+// zoneName returns the IPv6 zone for an interface index.
+func zoneName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(index)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+// rawToSockaddr decodes an address of addrLen bytes filled in by the
+// kernel, such as the source address of recvmsg, or returns nil for
+// unknown families.
+func rawToSockaddr(rsa *syscall.RawSockaddrAny, addrLen uint32) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet4{Port: portOf(pp.Port)}
+		sa.Addr = pp.Addr
+		return sa
+	case syscall.AF_INET6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet6{Port: portOf(pp.Port), ZoneId: pp.Scope_id}
+		sa.Addr = pp.Addr
+		return sa
+	case syscall.AF_UNIX:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(addrLen) - 2
+		if n < 0 {
+			n = 0
+		} else if n > len(pp.Path) {
+			n = len(pp.Path)
+		}
+		path := make([]byte, n)
+		for i := range path {
+			path[i] = byte(pp.Path[i])
+		}
+		switch {
+		case n > 0 && path[0] == 0:
+			path[0] = '@' // Abstract socket
+		case n > 0 && path[n-1] == 0:
+			path = path[:n-1]
+		}
+		return &syscall.SockaddrUnix{Name: string(path)}
+	}
+	return nil
+}
+
+// sockaddrToRaw encodes sa for the kernel and returns the length of the
+// encoded address.
+func sockaddrToRaw(sa syscall.Sockaddr, rsa *syscall.RawSockaddrAny) (uint32, error) {
+	*rsa = syscall.RawSockaddrAny{}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		pp.Family = syscall.AF_INET
+		pp.Port = rawPort(sa.Port)
+		pp.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet4, nil
+	case *syscall.SockaddrInet6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		pp.Family = syscall.AF_INET6
+		pp.Port = rawPort(sa.Port)
+		pp.Scope_id = sa.ZoneId
+		pp.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet6, nil
+	case *syscall.SockaddrUnix:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		name := sa.Name
+		if len(name) >= len(pp.Path) {
+			return 0, syscall.EINVAL
+		}
+		pp.Family = syscall.AF_UNIX
+		for i := 0; i < len(name); i++ {
+			pp.Path[i] = int8(name[i])
+		}
+		n := 2 + len(name)
+		if len(name) > 0 && name[0] == '@' {
+			// Abstract socket: no trailing NUL is counted
+			pp.Path[0] = 0
+		} else if len(name) > 0 {
+			n++
+		}
+		return uint32(n), nil
+	}
+	return 0, syscall.EAFNOSUPPORT
+}
+
+// addrToSockaddr converts a UDP, TCP, IP or Unix address for sockets of
+// the given family (AF_INET or AF_INET6).
+func addrToSockaddr(addr net.Addr, family int) (syscall.Sockaddr, error) {
+	var ip net.IP
+	var port int
+	var zone string
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.TCPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.IPAddr:
+		ip, zone = a.IP, a.Zone
+	case *net.UnixAddr:
+		return &syscall.SockaddrUnix{Name: a.Name}, nil
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+
+	if family == syscall.AF_INET6 {
+		sa := &syscall.SockaddrInet6{Port: port}
+		copy(sa.Addr[:], ip.To16())
+		if zone != "" {
+			if ifi, err := net.InterfaceByName(zone); err == nil {
+				sa.ZoneId = uint32(ifi.Index)
+			} else if n, err := strconv.Atoi(zone); err == nil {
+				sa.ZoneId = uint32(n)
+			}
+		}
+		return sa, nil
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		if ip != nil {
+			return nil, syscall.EAFNOSUPPORT
+		}
+		ip4 = net.IPv4zero.To4()
+	}
+	sa := &syscall.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], ip4)
+	return sa, nil
+}
+
+// rawPort converts a port to network byte order as stored in a sockaddr.
+func rawPort(port int) uint16 {
+	b := [2]byte{byte(port >> 8), byte(port)}
+	return *(*uint16)(unsafe.Pointer(&b))
+}
+
+// portOf converts a port in network byte order from a sockaddr.
+func portOf(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
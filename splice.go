@@ -0,0 +1,196 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// spliceChunk is the most a splice chain moves at once: the default
+// capacity of a pipe.
+const spliceChunk = 64 << 10
+
+// maxIdlePipes bounds the pipes kept for reuse by splice chains.
+const maxIdlePipes = 16
+
+// pipePool holds empty pipes for splice chains, so a copy does not cost
+// a pipe2 and two closes.
+var pipePool struct {
+	mu   sync.Mutex
+	free [][2]int
+}
+
+// getPipe returns an empty pipe as {read end, write end}.
+func getPipe() ([2]int, error) {
+	pipePool.mu.Lock()
+	if n := len(pipePool.free); n > 0 {
+		p := pipePool.free[n-1]
+		pipePool.free = pipePool.free[:n-1]
+		pipePool.mu.Unlock()
+		return p, nil
+	}
+	pipePool.mu.Unlock()
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// putPipe returns an empty pipe to the pool, or closes it if the pool is
+// full or the pipe may still hold data.
+func putPipe(p [2]int, empty bool) {
+	if empty {
+		pipePool.mu.Lock()
+		if len(pipePool.free) < maxIdlePipes {
+			pipePool.free = append(pipePool.free, p)
+			pipePool.mu.Unlock()
+			return
+		}
+		pipePool.mu.Unlock()
+	}
+	syscall.Close(p[0])
+	syscall.Close(p[1])
+}
+
+// CopyFD copies n bytes, or until end of file if n is negative, from
+// src to dst without passing the data through user space: each chunk is
+// a linked pair of splices through a pipe, src into the pipe and the
+// pipe into dst. Both descriptors are read and written at their current
+// positions. It returns the number of bytes copied.
+func CopyFD(e *Executor, dst, src int, n int64) (int64, error) {
+	p, err := getPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	empty := true
+	for n < 0 || copied < n {
+		chunk := int64(spliceChunk)
+		if n >= 0 && n-copied < chunk {
+			chunk = n - copied
+		}
+
+		var in, out int32
+		in, out, err = spliceChunkOnce(e, dst, src, p, uint32(chunk))
+		if errors.Is(err, syscall.EAGAIN) {
+			// Nonblocking source without data yet
+			if err = waitFd(e, src, syscall.EPOLLIN); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			empty = false
+			break
+		}
+		copied += int64(out)
+		if in == 0 {
+			break // End of file
+		}
+
+		// A short splice into the pipe breaks the link; move the rest
+		for out < in {
+			var k int32
+			k, err = spliceOut(e, dst, p, uint32(in-out))
+			if err != nil {
+				empty = false
+				break
+			}
+			out += k
+			copied += int64(k)
+		}
+		if err != nil {
+			break
+		}
+	}
+	putPipe(p, empty)
+	return copied, err
+}
+
+// spliceChunkOnce runs one linked splice pair of up to chunk bytes and
+// returns how much went into the pipe and how much out of it.
+func spliceChunkOnce(e *Executor, dst, src int, p [2]int, chunk uint32) (in, out int32, err error) {
+	chain, err := e.NewChain().
+		Add(func(ud uint64) error {
+			return e.ring.PrepSplice(src, -1, p[1], -1, chunk, 0, ud)
+		}).
+		Add(func(ud uint64) error {
+			// Nonblocking, so an empty pipe after end of file fails
+			// rather than waiting for data that never comes
+			return e.ring.PrepSplice(p[0], -1, dst, -1, chunk, sys.SPLICE_F_NONBLOCK, ud)
+		}).
+		Submit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	in, err = chain.Step(0).Result()
+	if err != nil {
+		<-chain.Done()
+		return 0, 0, err
+	}
+	out, err = chain.Step(1).Result()
+	switch {
+	case err == nil:
+		return in, out, nil
+	case errors.Is(err, syscall.ECANCELED), errors.Is(err, syscall.EAGAIN):
+		// Short or empty splice into the pipe, or a full nonblocking
+		// destination; the caller moves what is in the pipe
+		return in, 0, nil
+	}
+	return in, 0, err
+}
+
+// spliceOut moves up to n bytes from the pipe to dst.
+func spliceOut(e *Executor, dst int, p [2]int, n uint32) (int32, error) {
+	op, err := e.Submit(func(ud uint64) error {
+		return e.ring.PrepSplice(p[0], -1, dst, -1, n, 0, ud)
+	})
+	if err != nil {
+		return 0, err
+	}
+	res, err := op.Result()
+	if errors.Is(err, syscall.EAGAIN) {
+		// Nonblocking destination that is full
+		return 0, waitFd(e, dst, syscall.EPOLLOUT)
+	}
+	if err == nil && res == 0 {
+		err = syscall.EPIPE
+	}
+	return res, err
+}
+
+// waitFd waits until fd is ready for events.
+func waitFd(e *Executor, fd int, events uint32) error {
+	op, err := e.Submit(func(ud uint64) error {
+		return e.ring.PrepPollAdd(fd, events, ud)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = op.Result()
+	return err
+}
+
+// Sendfile sends the rest of f from its current position over conn with
+// CopyFD, and returns the number of bytes sent. On a kernel TLS
+// connection the kernel encrypts straight from the spliced pages.
+func Sendfile(conn *Conn, f *File) (int64, error) {
+	if conn.closed.Load() {
+		return 0, conn.opError("write", syscall.EBADF)
+	}
+	if f.closed.Load() {
+		return 0, syscall.EBADF
+	}
+	n, err := CopyFD(conn.e, conn.fd, f.fd, -1)
+	if err != nil {
+		return n, conn.opError("sendfile", err)
+	}
+	return n, nil
+}
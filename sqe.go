@@ -3,7 +3,6 @@
 package iouring
 
 import (
-	"sync/atomic"
 	"syscall"
 	"unsafe"
 
@@ -11,29 +10,72 @@ import (
 )
 
 // getSQE returns the next available SQE, or nil if the queue is full.
+// With WithAutoFlush a full queue is submitted first.
 // The returned SQE is zeroed and ready for use.
-// NOT thread-safe; caller must hold sqLock.
+// Caller must hold sqLock, shared or exclusive: concurrent callers
+// claim distinct slots by advancing sqReserved with a CAS, and the SQEs
+// are only published by flushSQ, which waits for them to be filled.
 func (r *Ring) getSQE() *sys.SQE {
-	head := atomic.LoadUint32(r.sqHead)
-	tail := atomic.LoadUint32(r.sqTail) + r.sqPending
-
-	// Check if queue is full
-	if tail-head >= r.sqEntries {
+	pos, n := r.getSQEs(1)
+	if n == 0 {
 		return nil
 	}
+	return r.sqeAt(pos)
+}
 
-	idx := tail & r.sqMask
-	sqe := &r.sqes[idx]
-	sqe.Reset()
-
-	// Update the SQ array to point to this SQE
-	r.sqArray[idx] = uint32(idx)
-	r.sqPending++
+// getSQEs claims up to n consecutive SQ slots like getSQE, and returns
+// the SQ position of the first and how many it claimed; none if the
+// queue is full or the ring closed. Caller must hold sqLock, shared or
+// exclusive.
+func (r *Ring) getSQEs(n uint32) (uint32, uint32) {
+	if r.closed.Load() {
+		// Close waits for sqLock, so the SQ is still mapped if it
+		// was open when the lock was taken
+		return 0, 0
+	}
+	for {
+		head := sys.LoadAcquire(r.sqHead)
+		tail := r.sqReserved.Load()
+
+		// Check if queue is full
+		space := r.sqEntries - (tail - head)
+		if space == 0 {
+			// Only taken exclusively on WithAutoFlush rings
+			if !r.autoFlush || !r.flushFullLocked() {
+				r.stats.sqFull.Add(1)
+				return tail, 0
+			}
+			continue
+		}
+		k := min(n, space)
+		if r.sqReserved.CompareAndSwap(tail, tail+k) {
+			return tail, k
+		}
+	}
+}
 
+// sqeAt returns the SQE of SQ position pos, zeroed. The SQ array maps
+// each slot to the SQE of the same index.
+func (r *Ring) sqeAt(pos uint32) *sys.SQE {
+	idx := pos & r.sqMask
+	sqe := &r.sqes[idx<<r.sqeShift]
+	sqe.Reset()
+	if r.sqeShift != 0 {
+		r.sqes[idx<<1+1].Reset()
+	}
 	return sqe
 }
 
-// GetSQE returns the next available SQE, or nil if the queue is full.
+// errNoSQE returns the error of a Prep call that got no SQE.
+func (r *Ring) errNoSQE() error {
+	if r.closed.Load() {
+		return ErrRingClosed
+	}
+	return ErrSQFull
+}
+
+// GetSQE returns the next available SQE, or nil if the queue is full
+// or the ring closed. The SQE must not be touched after Close.
 // Thread-safe.
 func (r *Ring) GetSQE() *sys.SQE {
 	r.sqLock.Lock()
@@ -42,181 +84,238 @@ func (r *Ring) GetSQE() *sys.SQE {
 	return sqe
 }
 
+// applyOpOptions applies opts to sqe. Caller must hold sqLock.
+func applyOpOptions(sqe *sys.SQE, opts []OpOption) {
+	for _, opt := range opts {
+		opt(sqe)
+	}
+}
+
 // PrepNop prepares a NOP operation.
 // Useful for testing and waking SQPOLL.
-func (r *Ring) PrepNop(userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepNop(userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 	sqe.Opcode = uint8(sys.IORING_OP_NOP)
 	sqe.UserData = userData
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepRead prepares a read operation.
-// Reads up to len(buf) bytes from fd at offset into buf.
-func (r *Ring) PrepRead(fd int, buf []byte, offset uint64, userData uint64) error {
+// Reads up to len(buf) bytes from fd at offset into buf. buf may hold
+// at most MaxIOSize bytes; see PrepReadChunked for larger reads.
+func (r *Ring) PrepRead(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_READ)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.Off = offset
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepWrite prepares a write operation.
-// Writes len(buf) bytes from buf to fd at offset.
-func (r *Ring) PrepWrite(fd int, buf []byte, offset uint64, userData uint64) error {
+// Writes len(buf) bytes from buf to fd at offset. buf may hold at most
+// MaxIOSize bytes; see PrepWriteChunked for larger writes.
+func (r *Ring) PrepWrite(fd int, buf []byte, offset uint64, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_WRITE)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.Off = offset
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepReadCur prepares a read at fd's file position, which the read
+// advances, like read(2), so a consumer reading a stream need not track
+// its offset. It needs IORING_FEAT_RW_CUR_POS (5.6+) and returns
+// ErrNotSupported without it; see HasRWCurPos. Keep one request at a
+// time in flight on a file's position, or link them with WithLink:
+// requests running at once may start from the same position.
+func (r *Ring) PrepReadCur(fd int, buf []byte, userData uint64, opts ...OpOption) error {
+	if !r.HasRWCurPos() {
+		return ErrNotSupported
+	}
+	return r.PrepRead(fd, buf, curPosOffset, userData, opts...)
+}
+
+// PrepWriteCur prepares a write at fd's file position, like write(2).
+// See PrepReadCur.
+func (r *Ring) PrepWriteCur(fd int, buf []byte, userData uint64, opts ...OpOption) error {
+	if !r.HasRWCurPos() {
+		return ErrNotSupported
+	}
+	return r.PrepWrite(fd, buf, curPosOffset, userData, opts...)
 }
 
 // PrepReadFixed prepares a read using a pre-registered buffer.
 // bufIndex is the index into the registered buffer array.
-func (r *Ring) PrepReadFixed(fd int, buf []byte, offset uint64, bufIndex uint16, userData uint64) error {
+func (r *Ring) PrepReadFixed(fd int, buf []byte, offset uint64, bufIndex uint16, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_READ_FIXED)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.Off = offset
 	sqe.BufIndex = bufIndex
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepWriteFixed prepares a write using a pre-registered buffer.
 // bufIndex is the index into the registered buffer array.
-func (r *Ring) PrepWriteFixed(fd int, buf []byte, offset uint64, bufIndex uint16, userData uint64) error {
+func (r *Ring) PrepWriteFixed(fd int, buf []byte, offset uint64, bufIndex uint16, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_WRITE_FIXED)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.Off = offset
 	sqe.BufIndex = bufIndex
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepReadv prepares a vectored read operation.
 // iovecs must remain valid until the operation completes.
-func (r *Ring) PrepReadv(fd int, iovecs []syscall.Iovec, offset uint64, userData uint64) error {
+func (r *Ring) PrepReadv(fd int, iovecs []syscall.Iovec, offset uint64, userData uint64, opts ...OpOption) error {
 	if len(iovecs) == 0 {
 		return nil
 	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_READV)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&iovecs[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&iovecs[0]))
 	sqe.Len = uint32(len(iovecs))
 	sqe.Off = offset
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepWritev prepares a vectored write operation.
 // iovecs must remain valid until the operation completes.
-func (r *Ring) PrepWritev(fd int, iovecs []syscall.Iovec, offset uint64, userData uint64) error {
+func (r *Ring) PrepWritev(fd int, iovecs []syscall.Iovec, offset uint64, userData uint64, opts ...OpOption) error {
 	if len(iovecs) == 0 {
 		return nil
 	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_WRITEV)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&iovecs[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&iovecs[0]))
 	sqe.Len = uint32(len(iovecs))
 	sqe.Off = offset
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepFsync prepares an fsync operation.
 // flags can be 0 or IORING_FSYNC_DATASYNC.
-func (r *Ring) PrepFsync(fd int, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepFsync(fd int, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_FSYNC)
@@ -224,42 +323,70 @@ func (r *Ring) PrepFsync(fd int, flags uint32, userData uint64) error {
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepFallocate prepares an fallocate operation (5.6+), allocating or,
+// depending on the FALLOC_FL_* mode, punching or zeroing length bytes at
+// offset.
+func (r *Ring) PrepFallocate(fd int, mode uint32, offset, length uint64, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_FALLOCATE)
+	sqe.Fd = int32(fd)
+	sqe.Off = offset
+	sqe.Addr = length
+	sqe.Len = mode
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepTimeout prepares a timeout operation.
 // ts specifies the timeout duration.
 // count specifies the number of completions to wait for (0 = just timeout).
 // flags can include IORING_TIMEOUT_ABS, IORING_TIMEOUT_BOOTTIME, etc.
-func (r *Ring) PrepTimeout(ts *sys.Timespec, count uint64, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepTimeout(ts *sys.Timespec, count uint64, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_TIMEOUT)
 	sqe.Fd = -1
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(ts)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(ts))
 	sqe.Len = 1
 	sqe.Off = count
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepTimeoutRemove prepares a timeout removal operation.
 // targetUserData is the userData of the timeout to remove.
-func (r *Ring) PrepTimeoutRemove(targetUserData uint64, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepTimeoutRemove(targetUserData uint64, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_TIMEOUT_REMOVE)
@@ -267,42 +394,74 @@ func (r *Ring) PrepTimeoutRemove(targetUserData uint64, userData uint64) error {
 	sqe.Addr = targetUserData
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepTimeoutUpdate prepares an update of a pending timeout to expire
+// after ts instead (IORING_TIMEOUT_UPDATE). targetUserData is the
+// userData of the timeout; the update completes with -ENOENT if it
+// already expired.
+// flags can include IORING_TIMEOUT_ABS and the clock flags, and
+// IORING_LINK_TIMEOUT_UPDATE (5.15+) to update a linked timeout.
+func (r *Ring) PrepTimeoutUpdate(ts *sys.Timespec, targetUserData uint64, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_TIMEOUT_REMOVE)
+	sqe.Fd = -1
+	sqe.Addr = targetUserData
+	sqe.Off = r.pin(sqe, unsafe.Pointer(ts))
+	sqe.OpFlags = flags | sys.IORING_TIMEOUT_UPDATE
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepLinkTimeout prepares a linked timeout operation.
-// Must be used after PrepXxx + SetSQELink to timeout the linked operation.
+// Must directly follow a Prep call made with WithLink to time out that
+// operation.
 // ts specifies the timeout duration.
 // flags can include IORING_TIMEOUT_ABS, IORING_TIMEOUT_BOOTTIME, etc.
-func (r *Ring) PrepLinkTimeout(ts *sys.Timespec, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepLinkTimeout(ts *sys.Timespec, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_LINK_TIMEOUT)
 	sqe.Fd = -1
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(ts)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(ts))
 	sqe.Len = 1
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepCancel prepares an async cancel operation.
 // targetUserData is the userData of the operation to cancel.
 // flags can include IORING_ASYNC_CANCEL_*.
-func (r *Ring) PrepCancel(targetUserData uint64, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepCancel(targetUserData uint64, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_ASYNC_CANCEL)
@@ -311,129 +470,220 @@ func (r *Ring) PrepCancel(targetUserData uint64, flags uint32, userData uint64)
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepMsgRing prepares a message to another ring (5.18+): a CQE with
+// the given res and userData data is posted to the ring whose fd is
+// targetFd, waking anyone waiting on it. The sending ring gets its own
+// CQE carrying userData.
+func (r *Ring) PrepMsgRing(targetFd int, res int32, data uint64, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_MSG_RING)
+	sqe.Fd = int32(targetFd)
+	sqe.Addr = uint64(sys.IORING_MSG_DATA)
+	sqe.Len = uint32(res)
+	sqe.Off = data
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// FileIndexAlloc as a target slot lets the kernel pick a free slot in
+// the registered file table.
+const FileIndexAlloc = sys.IORING_FILE_INDEX_ALLOC
+
+// PrepMsgRingFd prepares passing a registered file to another ring
+// (6.0+): slot srcSlot of this ring's file table is installed in slot
+// targetSlot of the table of the ring whose fd is targetFd, or in a free
+// slot with FileIndexAlloc. That ring gets a CQE carrying userData data
+// whose res is the slot used.
+func (r *Ring) PrepMsgRingFd(targetFd int, srcSlot, targetSlot uint32, data uint64, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_MSG_RING)
+	sqe.Fd = int32(targetFd)
+	sqe.Addr = uint64(sys.IORING_MSG_SEND_FD)
+	sqe.Off = data
+	sqe.Addr3 = uint64(srcSlot)
+	sqe.SetFileIndex(int32(targetSlot + 1))
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepAccept prepares an accept operation.
 // addr and addrLen can be nil if peer address isn't needed.
 // flags are accept4 flags (e.g., syscall.SOCK_NONBLOCK).
-func (r *Ring) PrepAccept(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepAccept(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_ACCEPT)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(addr))
-	sqe.Off = uint64(uintptr(unsafe.Pointer(addrLen)))
+	sqe.Addr = r.pin(sqe, addr)
+	sqe.Off = r.pin(sqe, unsafe.Pointer(addrLen))
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepAcceptSockaddr prepares an accept operation that stores the peer
+// address in sa, which must stay reachable until the operation
+// completes. sa may be nil.
+func (r *Ring) PrepAcceptSockaddr(fd int, sa *Sockaddr, flags uint32, userData uint64, opts ...OpOption) error {
+	if sa == nil {
+		return r.PrepAccept(fd, nil, nil, flags, userData, opts...)
+	}
+	sa.reset()
+	return r.PrepAccept(fd, unsafe.Pointer(&sa.raw), &sa.len, flags, userData, opts...)
 }
 
 // PrepAcceptMultishot prepares a multishot accept operation.
 // Each accept generates a CQE with IORING_CQE_F_MORE flag.
-func (r *Ring) PrepAcceptMultishot(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepAcceptMultishot(fd int, addr unsafe.Pointer, addrLen *uint32, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_ACCEPT)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(addr))
-	sqe.Off = uint64(uintptr(unsafe.Pointer(addrLen)))
+	sqe.Addr = r.pin(sqe, addr)
+	sqe.Off = r.pin(sqe, unsafe.Pointer(addrLen))
 	sqe.OpFlags = flags
 	sqe.Ioprio = uint16(sys.IORING_ACCEPT_MULTISHOT)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepConnect prepares a connect operation.
-func (r *Ring) PrepConnect(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepConnect(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_CONNECT)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(addr))
+	sqe.Addr = r.pin(sqe, addr)
 	sqe.Off = uint64(addrLen)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepConnectSockaddr prepares a connect operation to sa, which must
+// stay reachable until the operation completes.
+func (r *Ring) PrepConnectSockaddr(fd int, sa *Sockaddr, userData uint64, opts ...OpOption) error {
+	return r.PrepConnect(fd, unsafe.Pointer(&sa.raw), sa.len, userData, opts...)
 }
 
 // PrepSend prepares a send operation.
-func (r *Ring) PrepSend(fd int, buf []byte, flags int, userData uint64) error {
+func (r *Ring) PrepSend(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SEND)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepRecv prepares a recv operation.
-func (r *Ring) PrepRecv(fd int, buf []byte, flags int, userData uint64) error {
+func (r *Ring) PrepRecv(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_RECV)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepRecvMultishot prepares a multishot recv operation.
 // Requires buffer group selection (bufGroup).
-func (r *Ring) PrepRecvMultishot(fd int, bufGroup uint16, flags int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepRecvMultishot(fd int, bufGroup uint16, flags int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_RECV)
@@ -444,35 +694,64 @@ func (r *Ring) PrepRecvMultishot(fd int, bufGroup uint16, flags int, userData ui
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepClose prepares a close operation.
-func (r *Ring) PrepClose(fd int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepClose(fd int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_CLOSE)
 	sqe.Fd = int32(fd)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepFixedFdInstall prepares turning the direct descriptor in slot of
+// the registered file table into a regular file descriptor
+// (IORING_OP_FIXED_FD_INSTALL, 6.8+), returned in the CQE result. The
+// descriptor is O_CLOEXEC unless flags has IORING_FIXED_FD_NO_CLOEXEC.
+// The slot stays occupied.
+func (r *Ring) PrepFixedFdInstall(slot int, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_FIXED_FD_INSTALL)
+	sqe.Fd = int32(slot)
+	sqe.Flags = sys.IOSQE_FIXED_FILE
+	sqe.OpFlags = flags
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepShutdown prepares a shutdown operation.
 // how is SHUT_RD, SHUT_WR, or SHUT_RDWR.
-func (r *Ring) PrepShutdown(fd int, how int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepShutdown(fd int, how int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SHUTDOWN)
@@ -480,60 +759,66 @@ func (r *Ring) PrepShutdown(fd int, how int, userData uint64) error {
 	sqe.Len = uint32(how)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSendmsg prepares a sendmsg operation.
 // msg must remain valid until the operation completes.
-func (r *Ring) PrepSendmsg(fd int, msg *syscall.Msghdr, flags int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepSendmsg(fd int, msg *syscall.Msghdr, flags int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SENDMSG)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(msg)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(msg))
 	sqe.Len = 1
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepRecvmsg prepares a recvmsg operation.
 // msg must remain valid until the operation completes.
-func (r *Ring) PrepRecvmsg(fd int, msg *syscall.Msghdr, flags int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepRecvmsg(fd int, msg *syscall.Msghdr, flags int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_RECVMSG)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(msg)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(msg))
 	sqe.Len = 1
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSocket prepares an async socket creation operation (5.19+).
 // Returns the new socket fd in the CQE result.
-func (r *Ring) PrepSocket(domain, typ, protocol int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepSocket(domain, typ, protocol int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SOCKET)
@@ -542,18 +827,20 @@ func (r *Ring) PrepSocket(domain, typ, protocol int, userData uint64) error {
 	sqe.Len = uint32(protocol)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepPollAdd prepares a poll add operation.
 // pollMask is POLLIN, POLLOUT, etc.
-func (r *Ring) PrepPollAdd(fd int, pollMask uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepPollAdd(fd int, pollMask uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_POLL_ADD)
@@ -561,18 +848,20 @@ func (r *Ring) PrepPollAdd(fd int, pollMask uint32, userData uint64) error {
 	sqe.OpFlags = pollMask
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepPollAddMultishot prepares a multishot poll operation.
 // Generates multiple CQEs until explicitly removed.
-func (r *Ring) PrepPollAddMultishot(fd int, pollMask uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepPollAddMultishot(fd int, pollMask uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_POLL_ADD)
@@ -581,18 +870,20 @@ func (r *Ring) PrepPollAddMultishot(fd int, pollMask uint32, userData uint64) er
 	sqe.Len = uint32(sys.IORING_POLL_ADD_MULTI)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepPollRemove prepares a poll remove operation.
 // targetUserData is the userData of the poll to remove.
-func (r *Ring) PrepPollRemove(targetUserData uint64, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepPollRemove(targetUserData uint64, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_POLL_REMOVE)
@@ -600,60 +891,103 @@ func (r *Ring) PrepPollRemove(targetUserData uint64, userData uint64) error {
 	sqe.Addr = targetUserData
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepOpenat prepares an openat operation.
 // path must be a null-terminated string that remains valid until completion.
-func (r *Ring) PrepOpenat(dirfd int, path *byte, flags int, mode uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepOpenat(dirfd int, path *byte, flags int, mode uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_OPENAT)
 	sqe.Fd = int32(dirfd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(path)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(path))
 	sqe.Len = uint32(mode)
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// OpenHow is the argument of PrepOpenat2 (struct open_how).
+type OpenHow = sys.OpenHow
+
+// Resolve flags for OpenHow (RESOLVE_*).
+const (
+	ResolveNoXdev       = sys.RESOLVE_NO_XDEV
+	ResolveNoMagiclinks = sys.RESOLVE_NO_MAGICLINKS
+	ResolveNoSymlinks   = sys.RESOLVE_NO_SYMLINKS
+	ResolveBeneath      = sys.RESOLVE_BENEATH
+	ResolveInRoot       = sys.RESOLVE_IN_ROOT
+	ResolveCached       = sys.RESOLVE_CACHED
+)
+
+// PrepOpenat2 prepares an openat2 operation (5.6+), which adds resolve
+// flags to openat, e.g. ResolveBeneath to keep path under dirfd.
+// path and how must remain valid until completion.
+func (r *Ring) PrepOpenat2(dirfd int, path *byte, how *OpenHow, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_OPENAT2)
+	sqe.Fd = int32(dirfd)
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(path))
+	sqe.Len = uint32(unsafe.Sizeof(*how))
+	sqe.Off = r.pin(sqe, unsafe.Pointer(how))
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepStatx prepares a statx operation.
 // path and statxbuf must remain valid until completion.
-func (r *Ring) PrepStatx(dirfd int, path *byte, flags, mask int, statxbuf unsafe.Pointer, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepStatx(dirfd int, path *byte, flags, mask int, statxbuf unsafe.Pointer, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_STATX)
 	sqe.Fd = int32(dirfd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(path)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(path))
 	sqe.Len = uint32(mask)
 	sqe.OpFlags = uint32(flags)
-	sqe.Off = uint64(uintptr(statxbuf))
+	sqe.Off = r.pin(sqe, statxbuf)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSplice prepares a splice operation.
-func (r *Ring) PrepSplice(fdIn int, offIn int64, fdOut int, offOut int64, nbytes uint32, flags uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepSplice(fdIn int, offIn int64, fdOut int, offOut int64, nbytes uint32, flags uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SPLICE)
@@ -665,23 +999,74 @@ func (r *Ring) PrepSplice(fdIn int, offIn int64, fdOut int, offOut int64, nbytes
 	sqe.OpFlags = flags
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // SetSQEFlags sets flags on the most recently prepared SQE.
 // Must be called immediately after a Prep* function.
-// NOT thread-safe with other Prep calls.
+// NOT thread-safe with other Prep calls: if another goroutine prepares an
+// SQE in between, the flags land on that one. Prefer passing WithSQEFlags
+// or WithLink to the Prep call.
 func (r *Ring) SetSQEFlags(flags uint8) {
 	r.sqLock.Lock()
-	if r.sqPending > 0 {
-		tail := atomic.LoadUint32(r.sqTail) + r.sqPending - 1
+	if r.sqPendingLocked() > 0 {
+		tail := r.sqReserved.Load() - 1
 		idx := tail & r.sqMask
-		r.sqes[idx].Flags |= flags
+		r.sqes[idx<<r.sqeShift].Flags |= flags
 	}
 	r.sqLock.Unlock()
 }
 
+// sqMark returns the SQ position the next SQE claimed takes, from which
+// discardSQEs can abandon the SQEs of a failed batch.
+func (r *Ring) sqMark() uint32 {
+	return r.sqReserved.Load()
+}
+
+// discardSQEs turns the SQEs claimed since mark that are not published
+// yet into unlinked NOPs with a userData of zero, so a partially
+// prepared batch can be abandoned without retracting the SQ tail. If
+// owns is not nil, only the SQEs whose userData it reports as the
+// batch's are discarded, leaving those other goroutines claimed
+// meanwhile alone; a nil owns is for callers that are the only
+// producer.
+func (r *Ring) discardSQEs(mark uint32, owns func(userData uint64) bool) {
+	r.sqLock.Lock()
+	tail := r.sqReserved.Load()
+	pos := tail - r.sqPendingLocked()
+	if int32(mark-pos) > 0 {
+		pos = mark // Earlier SQEs are not the batch's
+	}
+	for ; pos != tail; pos++ {
+		sqe := &r.sqes[(pos&r.sqMask)<<r.sqeShift]
+		if owns != nil && !owns(sqe.UserData) {
+			continue
+		}
+		sqe.Reset()
+		sqe.Opcode = uint8(sys.IORING_OP_NOP)
+	}
+	r.sqLock.Unlock()
+}
+
+// pendingSQE copies the most recently prepared SQE carrying userData
+// that has not been submitted yet, and reports whether there was one.
+func (r *Ring) pendingSQE(userData uint64) (sqe sys.SQE, ok bool) {
+	r.sqLock.Lock()
+	defer r.sqLock.Unlock()
+
+	tail := r.sqReserved.Load()
+	for i := uint32(1); i <= r.sqPendingLocked(); i++ {
+		idx := (tail - i) & r.sqMask
+		if p := &r.sqes[idx<<r.sqeShift]; p.UserData == userData {
+			return *p, true
+		}
+	}
+	return sqe, false
+}
+
 // SetSQELink links the most recently prepared SQE to the next one.
 // The next SQE will not start until this one completes.
 // If this SQE fails, the chain is broken and subsequent SQEs are cancelled.
@@ -708,33 +1093,41 @@ func (r *Ring) SetSQEDrain() {
 
 // PrepBind prepares an async bind operation (6.11+).
 // Binds the socket fd to the address specified by addr.
-func (r *Ring) PrepBind(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepBind(fd int, addr unsafe.Pointer, addrLen uint32, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_BIND)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(addr))
+	sqe.Addr = r.pin(sqe, addr)
 	sqe.Off = uint64(addrLen)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepBindSockaddr prepares an async bind to sa (6.11+), which must stay
+// reachable until the operation completes.
+func (r *Ring) PrepBindSockaddr(fd int, sa *Sockaddr, userData uint64, opts ...OpOption) error {
+	return r.PrepBind(fd, unsafe.Pointer(&sa.raw), sa.len, userData, opts...)
 }
 
 // PrepListen prepares an async listen operation (6.11+).
 // Marks the socket as a passive socket to accept connections.
 // backlog specifies the maximum pending connections queue length.
-func (r *Ring) PrepListen(fd int, backlog int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepListen(fd int, backlog int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_LISTEN)
@@ -742,42 +1135,46 @@ func (r *Ring) PrepListen(fd int, backlog int, userData uint64) error {
 	sqe.Len = uint32(backlog)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepProvideBuffers registers buffers for automatic buffer selection (5.7+).
 // buffers is a contiguous memory region containing count buffers of bufSize each.
 // bgid is the buffer group ID, bid is the starting buffer ID.
 // After registration, recv operations with IOSQE_BUFFER_SELECT will pick buffers from this group.
-func (r *Ring) PrepProvideBuffers(buffers unsafe.Pointer, count int, bufSize int, bgid uint16, bid int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepProvideBuffers(buffers unsafe.Pointer, count int, bufSize int, bgid uint16, bid int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_PROVIDE_BUFFERS)
 	sqe.Fd = int32(count)
-	sqe.Addr = uint64(uintptr(buffers))
+	sqe.Addr = r.pin(sqe, buffers)
 	sqe.Len = uint32(bufSize)
 	sqe.SetBufGroup(bgid)
 	sqe.Off = uint64(bid)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepRemoveBuffers removes previously provided buffers from a buffer group (5.7+).
 // count is the number of buffers to remove, bgid is the buffer group ID.
-func (r *Ring) PrepRemoveBuffers(count int, bgid uint16, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepRemoveBuffers(count int, bgid uint16, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_REMOVE_BUFFERS)
@@ -785,82 +1182,201 @@ func (r *Ring) PrepRemoveBuffers(count int, bgid uint16, userData uint64) error
 	sqe.SetBufGroup(bgid)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSendZC prepares a zero-copy send operation (6.0+).
 // This produces TWO CQEs: the completion and a notification (with IORING_CQE_F_NOTIF)
 // indicating when the buffer can be safely reused.
 // flags are MSG_* flags for send.
-func (r *Ring) PrepSendZC(fd int, buf []byte, flags int, userData uint64) error {
+func (r *Ring) PrepSendZC(fd int, buf []byte, flags int, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SEND_ZC)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSendZCTo prepares a zero-copy send to a specific address (6.0+).
 // Used for sendto semantics with UDP or unconnected sockets.
-func (r *Ring) PrepSendZCTo(fd int, buf []byte, flags int, addr unsafe.Pointer, addrLen uint32, userData uint64) error {
+func (r *Ring) PrepSendZCTo(fd int, buf []byte, flags int, addr unsafe.Pointer, addrLen uint32, userData uint64, opts ...OpOption) error {
 	if len(buf) == 0 {
 		return nil
 	}
+	if len(buf) > MaxIOSize {
+		return ErrIOTooLarge
+	}
 
-	r.sqLock.Lock()
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SEND_ZC)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(&buf[0])))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(&buf[0]))
 	sqe.Len = uint32(len(buf))
 	sqe.OpFlags = uint32(flags)
-	sqe.Off = uint64(uintptr(addr))   // addr2 for destination
+	sqe.Off = r.pin(sqe, addr)   // addr2 for destination
 	sqe.Addr3 = uint64(addrLen)       // addr_len
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
 }
 
 // PrepSendmsgZC prepares a zero-copy sendmsg operation (6.1+).
 // msg must remain valid until the notification CQE is received.
 // This produces TWO CQEs like PrepSendZC.
-func (r *Ring) PrepSendmsgZC(fd int, msg *syscall.Msghdr, flags int, userData uint64) error {
-	r.sqLock.Lock()
+func (r *Ring) PrepSendmsgZC(fd int, msg *syscall.Msghdr, flags int, userData uint64, opts ...OpOption) error {
+	r.sqLock.RLock()
 	sqe := r.getSQE()
 	if sqe == nil {
-		r.sqLock.Unlock()
-		return ErrSQFull
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
 	}
 
 	sqe.Opcode = uint8(sys.IORING_OP_SENDMSG_ZC)
 	sqe.Fd = int32(fd)
-	sqe.Addr = uint64(uintptr(unsafe.Pointer(msg)))
+	sqe.Addr = r.pin(sqe, unsafe.Pointer(msg))
 	sqe.Len = 1
 	sqe.OpFlags = uint32(flags)
 	sqe.UserData = userData
 
-	r.sqLock.Unlock()
-	return nil
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepUringCmd prepares a driver passthrough command (IORING_OP_URING_CMD, 5.19+).
+// cmdOp selects the command and cmd is copied into the SQE's command area,
+// which holds 16 bytes, or 80 bytes on rings created with WithSQE128.
+// Returns EINVAL if cmd does not fit.
+func (r *Ring) PrepUringCmd(fd int, cmdOp uint32, cmd []byte, userData uint64, opts ...OpOption) error {
+	return r.prepUringCmd(fd, cmdOp, cmd, nil, userData, opts)
+}
+
+// prepUringCmd is PrepUringCmd for a command pointing to the memory at
+// data, which is held with the request.
+func (r *Ring) prepUringCmd(fd int, cmdOp uint32, cmd []byte, data unsafe.Pointer, userData uint64, opts []OpOption) error {
+	if len(cmd) > r.cmdSize() {
+		return syscall.EINVAL
+	}
+
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_URING_CMD)
+	sqe.Fd = int32(fd)
+	sqe.SetCmdOp(cmdOp)
+	copy(sqe.Cmd(r.sqeShift != 0), cmd)
+	r.pin(sqe, data)
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// PrepSetsockopt prepares a setsockopt on socket fd as a socket command
+// (IORING_OP_URING_CMD with SOCKET_URING_OP_SETSOCKOPT, 6.7+), e.g. to
+// set TCP_NODELAY in a chain right after the accept that made the
+// socket. optval points to optlen bytes and must remain valid until
+// completion.
+func (r *Ring) PrepSetsockopt(fd, level, optname int, optval unsafe.Pointer, optlen int, userData uint64, opts ...OpOption) error {
+	return r.prepSockCmd(fd, sys.SOCKET_URING_OP_SETSOCKOPT, level, optname, optval, optlen, userData, opts)
+}
+
+// PrepSetsockoptInt is PrepSetsockopt for an int option such as
+// TCP_NODELAY. value must remain valid until completion.
+func (r *Ring) PrepSetsockoptInt(fd, level, optname int, value *int32, userData uint64, opts ...OpOption) error {
+	return r.prepSockCmd(fd, sys.SOCKET_URING_OP_SETSOCKOPT, level, optname, unsafe.Pointer(value), 4, userData, opts)
+}
+
+// PrepGetsockopt prepares a getsockopt on socket fd as a socket command
+// (SOCKET_URING_OP_GETSOCKOPT, 6.7+). The kernel only supports
+// SOL_SOCKET options this way. The option is stored in the optlen bytes
+// at optval, which must remain valid until completion, and the CQE
+// result is the option's length.
+func (r *Ring) PrepGetsockopt(fd, level, optname int, optval unsafe.Pointer, optlen int, userData uint64, opts ...OpOption) error {
+	return r.prepSockCmd(fd, sys.SOCKET_URING_OP_GETSOCKOPT, level, optname, optval, optlen, userData, opts)
+}
+
+// PrepSIOCINQ prepares a query of the bytes queued for reading on
+// socket fd (SOCKET_URING_OP_SIOCINQ, 6.7+), returned as the CQE result.
+// Protocols without the ioctl, such as AF_UNIX, fail with EOPNOTSUPP.
+func (r *Ring) PrepSIOCINQ(fd int, userData uint64, opts ...OpOption) error {
+	return r.prepSockCmd(fd, sys.SOCKET_URING_OP_SIOCINQ, 0, 0, nil, 0, userData, opts)
+}
+
+// PrepSIOCOUTQ prepares a query of the bytes not yet sent, or for TCP
+// not yet acknowledged, on socket fd (SOCKET_URING_OP_SIOCOUTQ, 6.7+),
+// returned as the CQE result.
+func (r *Ring) PrepSIOCOUTQ(fd int, userData uint64, opts ...OpOption) error {
+	return r.prepSockCmd(fd, sys.SOCKET_URING_OP_SIOCOUTQ, 0, 0, nil, 0, userData, opts)
+}
+
+// prepSockCmd prepares a socket command. The option fields overlay the
+// SQE's addr (level, optname), file_index (optlen) and addr3 (optval).
+func (r *Ring) prepSockCmd(fd int, cmdOp uint32, level, optname int, optval unsafe.Pointer, optlen int, userData uint64, opts []OpOption) error {
+	r.sqLock.RLock()
+	sqe := r.getSQE()
+	if sqe == nil {
+		r.sqLock.RUnlock()
+		return r.errNoSQE()
+	}
+
+	sqe.Opcode = uint8(sys.IORING_OP_URING_CMD)
+	sqe.Fd = int32(fd)
+	sqe.SetCmdOp(cmdOp)
+	sqe.Addr = uint64(uint32(level)) | uint64(uint32(optname))<<32
+	sqe.SpliceFdIn = int32(optlen)
+	sqe.Addr3 = r.pin(sqe, optval)
+	sqe.UserData = userData
+
+	applyOpOptions(sqe, opts)
+	err := r.checkSQE(sqe)
+	r.sqLock.RUnlock()
+	return err
+}
+
+// cmdSize returns the size of the uring_cmd payload area of an SQE.
+func (r *Ring) cmdSize() int {
+	if r.sqeShift != 0 {
+		return sys.SQE128CmdSize
+	}
+	return sys.SQECmdSize
 }
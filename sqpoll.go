@@ -0,0 +1,103 @@
+//go:build linux
+
+package iouring
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// checkSQE enforces the ring's restrictions on a prepared SQE. An SQE
+// that breaks one is rejected with rejectSQE. Caller must hold sqLock.
+func (r *Ring) checkSQE(sqe *sys.SQE) error {
+	if r.ops != nil {
+		if err := r.checkOp(sqe); err != nil {
+			rejectSQE(sqe)
+			return err
+		}
+	}
+	if !r.sqpollFixed || sqe.Flags&sys.IOSQE_FIXED_FILE != 0 {
+		return nil
+	}
+	// The SQPOLL thread has no file table to look plain fds up in; a
+	// close names the fd to close rather than a file to operate on
+	if int(sqe.Opcode) < len(opInfos) && opInfos[sqe.Opcode].usesFd && sqe.Opcode != uint8(sys.IORING_OP_CLOSE) {
+		rejectSQE(sqe)
+		return ErrFixedFileRequired
+	}
+	return nil
+}
+
+// rejectSQE turns a prepared SQE the ring refuses into a readv of fd -1,
+// which fails with EBADF, keeping its userData and link flags: the CQE
+// is the caller's, and a chain the SQE is part of is broken as if the
+// request had failed, rather than carrying on without it.
+func rejectSQE(sqe *sys.SQE) {
+	userData, flags := sqe.UserData, sqe.Flags&(sys.IOSQE_IO_LINK|sys.IOSQE_IO_HARDLINK)
+	sqe.Reset()
+	sqe.Opcode = uint8(sys.IORING_OP_READV)
+	sqe.Fd = -1
+	sqe.Flags = flags
+	sqe.UserData = userData
+}
+
+// SQPollStats describes the SQPOLL kernel thread of a ring.
+type SQPollStats struct {
+	Thread    int           // Thread ID; -1 if the thread has exited
+	CPU       int           // CPU the thread last ran on; -1 if unknown
+	TotalTime time.Duration // CPU time the thread used (6.10+)
+	WorkTime  time.Duration // Part of TotalTime spent submitting rather than polling (6.10+)
+	Wakeups   uint64        // Enters by this ring that woke the idle thread
+}
+
+// SQPollStats reports on the ring's SQPOLL thread, read from the ring's
+// /proc fdinfo. A Wakeups count close to the number of Submit calls
+// means the thread idles between them and WithSQPollIdle is too short
+// for the workload. It returns EINVAL if the ring was not set up with
+// WithSQPoll.
+func (r *Ring) SQPollStats() (SQPollStats, error) {
+	if r.params.Flags&sys.IORING_SETUP_SQPOLL == 0 {
+		return SQPollStats{}, syscall.EINVAL
+	}
+	if r.fd < 0 {
+		return SQPollStats{}, ErrNotSupported // WithRegisteredFdOnly
+	}
+	if !r.hold() {
+		return SQPollStats{}, ErrRingClosed
+	}
+	defer r.drop()
+	info, err := os.ReadFile("/proc/self/fdinfo/" + strconv.Itoa(r.fd))
+	if err != nil {
+		return SQPollStats{}, err
+	}
+
+	st := SQPollStats{Thread: -1, CPU: -1, Wakeups: r.stats.sqWakeups.Load()}
+	sc := bufio.NewScanner(bytes.NewReader(info))
+	for sc.Scan() {
+		key, val, ok := bytes.Cut(sc.Bytes(), []byte(":"))
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(val)), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch string(key) {
+		case "SqThread":
+			st.Thread = int(n)
+		case "SqThreadCpu":
+			st.CPU = int(n)
+		case "SqTotalTime":
+			st.TotalTime = time.Duration(n) * time.Microsecond
+		case "SqWorkTime":
+			st.WorkTime = time.Duration(n) * time.Microsecond
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+package iouring
+
+import (
+	"expvar"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Stats is a snapshot of a ring's counters. All but Pending only grow
+// over the life of the ring, so they can be exported as counters and
+// rates computed from the difference of two snapshots.
+type Stats struct {
+	Submitted  uint64 // SQEs consumed by the kernel; see Submitted
+	Published  uint64 // SQEs published to the SQ, consumed or not
+	Pending    uint32 // SQEs prepared but not yet consumed; see Pending
+	SQDropped  uint32 // Invalid SQ array entries skipped by the kernel
+	CQOverflow uint32 // Completions dropped because the CQ was full
+
+	Completed uint64            // CQEs consumed from the CQ
+	Syscalls  uint64            // io_uring_enter and io_uring_register calls
+	SQFull    uint64            // Prep calls that found the SQ full
+	SpinHits  uint64            // Waits that spinning completed (WithSpinWait)
+	Ops       map[string]uint64 // SQEs submitted by opcode name, e.g. "read"
+
+	// How well submission amortizes syscalls; see BatchSize
+	Flushes          uint64 // Submissions that published SQEs to the kernel
+	NoSyscallSubmits uint64 // Submit calls the SQPOLL thread served without a syscall
+	SQWakeups        uint64 // Enters that had to wake an idle SQPOLL thread
+	RegisteredEnters uint64 // io_uring_enter calls made through the registered ring fd
+}
+
+// BatchSize returns the average number of SQEs published per flush, or
+// 0 if none were. Together with NoSyscallSubmits and SQWakeups it tells
+// whether WithSQPoll is paying off: a good SQPOLL ring has large batches
+// and few wakeups, as most Submit calls reach the thread while it polls.
+func (s Stats) BatchSize() float64 {
+	if s.Flushes == 0 {
+		return 0
+	}
+	return float64(s.Published) / float64(s.Flushes)
+}
+
+// ringStats holds the counters the ring keeps for Stats.
+type ringStats struct {
+	completed atomic.Uint64
+	syscalls  atomic.Uint64
+	sqFull    atomic.Uint64
+	sqWakeups atomic.Uint64 // Enters that woke the SQPOLL thread
+	spinHits  atomic.Uint64
+	flushes   atomic.Uint64 // flushSQLocked calls that published SQEs
+	published atomic.Uint64 // SQEs published by them
+	noSyscall atomic.Uint64 // Submit calls that skipped io_uring_enter
+	regEnters atomic.Uint64 // Enters with IORING_ENTER_REGISTERED_RING
+
+	ops [sys.IORING_OP_LAST]atomic.Uint64 // By opcode
+}
+
+// Stats returns a snapshot of the ring's counters. The fields are read
+// one at a time, so they are not mutually consistent while other
+// goroutines use the ring. Ops only lists opcodes that were submitted.
+func (r *Ring) Stats() Stats {
+	st := Stats{
+		Submitted:  r.Submitted(),
+		Pending:    r.Pending(),
+		SQDropped:  r.SQDropped(),
+		CQOverflow: r.CQOverflow(),
+		Completed:  r.stats.completed.Load(),
+		Syscalls:   r.stats.syscalls.Load(),
+		SQFull:     r.stats.sqFull.Load(),
+		SpinHits:   r.stats.spinHits.Load(),
+		Ops:        make(map[string]uint64),
+
+		Published:        r.stats.published.Load(),
+		Flushes:          r.stats.flushes.Load(),
+		NoSyscallSubmits: r.stats.noSyscall.Load(),
+		SQWakeups:        r.stats.sqWakeups.Load(),
+		RegisteredEnters: r.stats.regEnters.Load(),
+	}
+	for op := range r.stats.ops {
+		if n := r.stats.ops[op].Load(); n > 0 {
+			st.Ops[opName(uint8(op))] = n
+		}
+	}
+	return st
+}
+
+// countOps counts the opcodes of n pending SQEs from SQ position tail
+// on. Caller must hold sqLock.
+func (r *Ring) countOps(tail, n uint32) {
+	for i := uint32(0); i < n; i++ {
+		// getSQE maps each SQ slot to the SQE of the same index
+		idx := (tail + i) & r.sqMask
+		if op := r.sqes[idx<<r.sqeShift].Opcode; op < uint8(sys.IORING_OP_LAST) {
+			r.stats.ops[op].Add(1)
+		}
+	}
+}
+
+// PublishExpvar publishes the ring's Stats as the expvar variable name,
+// served as JSON under /debug/vars and readable by Prometheus expvar
+// exporters. The snapshot is taken when the variable is read, so the
+// ring must stay reachable; after Close the counters stop changing. It
+// returns syscall.EEXIST if name is taken, as expvar names cannot be
+// reused.
+func (r *Ring) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return syscall.EEXIST
+	}
+	expvar.Publish(name, expvar.Func(func() any { return r.Stats() }))
+	return nil
+}
+
+// SQDropped returns the number of SQ array entries the kernel skipped
+// because they referenced an SQE index outside the ring. Such entries
+// never produce a completion, so a nonzero count means requests were
+// lost. It stays zero on rings without an SQ array.
+func (r *Ring) SQDropped() uint32 {
+	if !r.hold() {
+		return 0
+	}
+	defer r.drop()
+	return atomic.LoadUint32(r.sqDropped)
+}
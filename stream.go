@@ -0,0 +1,219 @@
+//go:build linux
+
+package iouring
+
+import (
+	"io"
+	"os"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// curPosOffset as a read or write offset uses and advances the file
+// position, like read(2) and write(2) (IORING_FEAT_RW_CUR_POS).
+const curPosOffset = ^uint64(0)
+
+// Default read-ahead of a Reader.
+const (
+	defaultReadChunk = 64 << 10
+	defaultReadDepth = 4
+)
+
+// Reader reads a File sequentially, keeping several reads of the
+// following chunks in flight so that io.Copy and similar loops rarely
+// wait on the device. It is not safe for concurrent use.
+type Reader struct {
+	f      *File
+	next   int64 // Offset of the next read to issue; -1 for the file position
+	chunk  int
+	depth  int
+	ahead  []readAhead // In-flight reads, oldest first
+	buf    []byte      // Unread part of cur
+	cur    []byte      // Buffer of the read being consumed
+	free   [][]byte    // Buffers no longer used by any read
+	err    error       // Sticky error, returned once buf is drained
+	closed bool
+}
+
+// readAhead is a read issued by a Reader.
+type readAhead struct {
+	op  *Operation
+	off int64
+	buf []byte
+}
+
+// NewReader returns a Reader starting at offset off. Each read is chunk
+// bytes, at most MaxIOSize, and up to depth of them are in flight; zero
+// values pick defaults. A negative off reads from the file position instead
+// (IORING_FEAT_RW_CUR_POS), which also works for pipes and sockets; reads
+// then cannot be pipelined, so depth is 1.
+func NewReader(f *File, off int64, chunk, depth int) *Reader {
+	if chunk <= 0 {
+		chunk = defaultReadChunk
+	}
+	chunk = min(chunk, MaxIOSize)
+	if depth <= 0 {
+		depth = defaultReadDepth
+	}
+	if off < 0 {
+		off, depth = -1, 1
+	}
+	return &Reader{f: f, next: off, chunk: chunk, depth: depth}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+		if len(r.ahead) == 0 {
+			continue // fill recorded why nothing is in flight
+		}
+		r.complete()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill issues reads until depth of them are in flight.
+func (r *Reader) fill() {
+	if r.next < 0 && !r.f.e.ring.HasFeature(sys.IORING_FEAT_RW_CUR_POS) {
+		r.err = ErrNotSupported
+		return
+	}
+	for len(r.ahead) < r.depth {
+		var buf []byte
+		if n := len(r.free); n > 0 {
+			buf, r.free = r.free[n-1], r.free[:n-1]
+		} else {
+			buf = make([]byte, r.chunk)
+		}
+
+		off := curPosOffset
+		if r.next >= 0 {
+			off = uint64(r.next)
+		}
+		op, err := r.f.read(buf, off)
+		if err != nil {
+			r.free = append(r.free, buf)
+			if len(r.ahead) == 0 {
+				r.err = err
+			}
+			return
+		}
+		r.ahead = append(r.ahead, readAhead{op: op, off: r.next, buf: buf})
+		if r.next >= 0 {
+			r.next += int64(r.chunk)
+		}
+	}
+}
+
+// complete waits for the oldest read and makes its data current.
+func (r *Reader) complete() {
+	ra := r.ahead[0]
+	r.ahead = r.ahead[1:]
+	if r.cur != nil {
+		r.free = append(r.free, r.cur)
+	}
+	r.cur = ra.buf
+
+	res, err := ra.op.Result()
+	switch {
+	case err != nil:
+		r.err = err
+		r.discard()
+	case res == 0:
+		r.err = io.EOF
+		r.discard()
+	case ra.off >= 0 && int(res) < len(ra.buf):
+		// The reads behind a short one started at the wrong offsets
+		r.discard()
+		r.next = ra.off + int64(res)
+	}
+	r.buf = ra.buf[:res]
+}
+
+// discard cancels the reads in flight; their buffers stay with them.
+func (r *Reader) discard() {
+	for _, ra := range r.ahead {
+		ra.op.Cancel()
+	}
+	r.ahead = r.ahead[:0]
+}
+
+// Close cancels the read-ahead and waits for it to finish. It does not
+// close the File.
+func (r *Reader) Close() error {
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	ahead := r.ahead
+	r.discard()
+	for _, ra := range ahead {
+		<-ra.op.Done()
+	}
+	return nil
+}
+
+// Writer writes a File sequentially from a managed offset.
+// It is not safe for concurrent use.
+type Writer struct {
+	f   *File
+	off int64 // -1 for the file position
+}
+
+// NewWriter returns a Writer starting at offset off. A negative off
+// writes at the file position instead (IORING_FEAT_RW_CUR_POS), as
+// needed for pipes, sockets and files opened with O_APPEND.
+func NewWriter(f *File, off int64) *Writer {
+	if off < 0 {
+		off = -1
+	}
+	return &Writer{f: f, off: off}
+}
+
+// Write implements io.Writer. It issues further writes after a short
+// one until all of p is written.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.off < 0 && !w.f.e.ring.HasFeature(sys.IORING_FEAT_RW_CUR_POS) {
+		return 0, ErrNotSupported
+	}
+	if w.f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+
+	n := 0
+	for n < len(p) {
+		off := curPosOffset
+		if w.off >= 0 {
+			off = uint64(w.off)
+		}
+		op, err := w.f.write(p[n:min(len(p), n+MaxIOSize)], off)
+		if err != nil {
+			return n, err
+		}
+		res, err := op.Result()
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(res)
+		if w.off >= 0 {
+			w.off += int64(res)
+		}
+	}
+	return n, nil
+}
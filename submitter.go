@@ -0,0 +1,196 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Submitter puts a bounded in-memory queue in front of a ring's SQ, so
+// that bursty producers are smoothed out instead of seeing ErrSQFull.
+// Requests are prepared straight into the SQ while there is room and
+// the ring has fewer operations in flight than its CQ holds; otherwise
+// they wait in the queue, in order, and are flushed as completions are
+// reaped through the Submitter. Only once the queue holds its limit are
+// requests refused, with ErrQueueFull.
+//
+// Operations are counted in flight from the SQEs prepared until their
+// final CQE (without IORING_CQE_F_MORE), so all CQEs of the ring must be
+// consumed through ForEachCQE. SQEs that post no CQE, such as with
+// IOSQE_CQE_SKIP_SUCCESS, are never counted out.
+//
+// A Submitter is safe for concurrent use by producers; ForEachCQE must
+// be called by one consumer at a time.
+type Submitter struct {
+	ring        *Ring
+	limit       int // Most requests queued
+	maxInflight int // Most SQEs in flight, the CQ size
+
+	mu       sync.Mutex
+	queue    []func(r *Ring) error // Requests waiting for room, oldest first
+	inflight int
+	err      error // First failure of a queued request, until reported
+	stats    SubmitterStats
+}
+
+// SubmitterStats reports the queueing of a Submitter.
+type SubmitterStats struct {
+	Queued    int    // Requests waiting in the queue
+	MaxQueued int    // Most requests ever waiting at once
+	Inflight  int    // SQEs prepared whose final CQE was not reaped
+	Deferred  uint64 // Requests that had to wait in the queue
+	Rejected  uint64 // Requests refused with ErrQueueFull
+}
+
+// NewSubmitter returns a Submitter for ring that queues up to limit
+// requests.
+func NewSubmitter(ring *Ring, limit int) *Submitter {
+	return &Submitter{ring: ring, limit: limit, maxInflight: int(ring.CQEntries())}
+}
+
+// Prep prepares a request, calling prep to queue its SQEs on the ring,
+// or queues the request if there is no room for it yet. Like the ring's
+// Prep methods it does not submit; call Submit. It returns ErrQueueFull
+// if the queue is at its limit, and prep's error if prep ran and
+// failed. A queued request that fails when it is flushed is dropped,
+// and its error is returned by the next Submit or SubmitAndWait. When
+// prep fails, the SQEs it queued become NOPs with a user data of zero.
+func (s *Submitter) Prep(prep func(r *Ring) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		if done, err := s.tryLocked(prep); done {
+			return err
+		}
+	}
+	if len(s.queue) >= s.limit {
+		s.stats.Rejected++
+		return ErrQueueFull
+	}
+	s.queue = append(s.queue, prep)
+	s.stats.Deferred++
+	s.stats.MaxQueued = max(s.stats.MaxQueued, len(s.queue))
+	return nil
+}
+
+// tryLocked runs prep if the ring has room for it, submitting once to
+// make room in the SQ, and reports whether it ran. Caller must hold
+// s.mu.
+func (s *Submitter) tryLocked(prep func(r *Ring) error) (bool, error) {
+	if s.inflight >= s.maxInflight {
+		return false, nil
+	}
+	mark := s.ring.sqMark()
+	err := prep(s.ring)
+	if err == ErrSQFull {
+		s.ring.discardSQEs(mark, nil)
+		s.ring.Submit()
+		mark = s.ring.sqMark()
+		if err = prep(s.ring); err == ErrSQFull {
+			s.ring.discardSQEs(mark, nil)
+			return false, nil
+		}
+	}
+	if err != nil {
+		s.ring.discardSQEs(mark, nil)
+	}
+	// Discarded SQEs are submitted as NOPs and complete too
+	s.inflight += int(s.ring.sqMark() - mark)
+	return true, err
+}
+
+// flushLocked prepares queued requests while there is room and returns
+// how many it prepared. Caller must hold s.mu.
+func (s *Submitter) flushLocked() int {
+	n := 0
+	for len(s.queue) > 0 {
+		done, err := s.tryLocked(s.queue[0])
+		if !done {
+			break
+		}
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		n++
+	}
+	return n
+}
+
+// takeErrLocked returns and clears the failure of a queued request.
+// Caller must hold s.mu.
+func (s *Submitter) takeErrLocked() error {
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// Submit prepares queued requests there is room for and submits. A
+// queued request that failed to prepare is reported here, after the
+// submission.
+func (s *Submitter) Submit() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flushLocked()
+	n, err := s.ring.Submit()
+	if err == nil {
+		err = s.takeErrLocked()
+	}
+	return n, err
+}
+
+// SubmitAndWait is Submit, then waits for at least n completions.
+// Producers are not blocked during the wait.
+func (s *Submitter) SubmitAndWait(n uint32) (int, error) {
+	s.mu.Lock()
+	s.flushLocked()
+	qerr := s.takeErrLocked()
+	s.mu.Unlock()
+
+	submitted, err := s.ring.SubmitAndWait(n)
+	if err == nil {
+		err = qerr
+	}
+	return submitted, err
+}
+
+// ForEachCQE is the ring's ForEachCQE, counting operations out as they
+// complete. Afterwards it prepares and submits as many queued requests
+// as there now is room for.
+func (s *Submitter) ForEachCQE(fn func(userData uint64, res int32, flags uint32) bool) int {
+	final := 0
+	n := s.ring.ForEachCQE(func(userData uint64, res int32, flags uint32) bool {
+		if !fn(userData, res, flags) {
+			return false
+		}
+		if flags&sys.IORING_CQE_F_MORE == 0 {
+			final++
+		}
+		return true
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight = max(s.inflight-final, 0)
+	if s.flushLocked() > 0 {
+		if _, err := s.ring.Submit(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+	return n
+}
+
+// Stats returns the current queueing statistics.
+func (s *Submitter) Stats() SubmitterStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Queued = len(s.queue)
+	st.Inflight = s.inflight
+	return st
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package iouring
+
+// WithRecorder captures every SQE the ring publishes and every CQE
+// consumed from it into rec, to be replayed with a Replayer. Call
+// rec.Flush once done, e.g. after closing the ring.
+func WithRecorder(rec *Recorder) Option {
+	return func(p *setupConfig) {
+		p.rec = rec
+	}
+}
+
+// tapSQEs shows n SQEs being published from SQ position tail on to the
+// logger, recorder and keep-alive table. Caller must hold sqLock.
+func (r *Ring) tapSQEs(tail, n uint32) {
+	if r.keep != nil {
+		r.keep.publish(r, tail, n)
+	}
+	if r.log != nil {
+		r.logSQEs(tail, n)
+	}
+	if r.rec != nil {
+		for i := uint32(0); i < n; i++ {
+			r.rec.recordSQE(&r.sqes[((tail+i)&r.sqMask)<<r.sqeShift])
+		}
+	}
+}
+
+// tapCQEs shows n CQEs from CQ position head on, which must not have
+// been released to the kernel yet, to the logger, recorder and
+// keep-alive table.
+func (r *Ring) tapCQEs(head, n uint32) {
+	if r.keep != nil {
+		r.keep.release(r, head, n)
+	}
+	if r.log != nil {
+		r.logCQEs(head, n)
+	}
+	if r.rec != nil {
+		for i := uint32(0); i < n; i++ {
+			cqe := &r.cqes[((head+i)&r.cqMask)<<r.cqeShift]
+			r.rec.recordCQE(cqe.UserData, cqe.Res, cqe.Flags)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+//go:build linux
+
+package iouring
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Timer is a timer of a Loop, backed by an IORING_OP_TIMEOUT on the
+// loop's ring rather than by the Go runtime: Reset moves the pending
+// timeout with IORING_TIMEOUT_UPDATE and Stop removes it. Many timers
+// thus cost kernel hrtimers and no extra wakeups of Run.
+//
+// Stop and Reset may be called from any goroutine. Function timers run
+// on the Loop's goroutine.
+type Timer struct {
+	C <-chan time.Time // Nil for timers made by AfterFunc
+
+	l      *Loop
+	fn     func()
+	c      chan time.Time
+	period time.Duration // Non-zero for tickers
+
+	mu     sync.Mutex
+	gen    uint64 // Bumped by Stop and Reset
+	active bool
+	when   time.Time // Next expiry, while active
+
+	// Owned by the Loop's goroutine
+	ud        uint64       // userData of the kernel timeout; 0 if none
+	armed     uint64       // gen of the kernel timeout's expiry
+	busy      bool         // An update or remove is in flight
+	multishot bool         // The kernel timeout fires every period
+	ts        sys.Timespec // Read by the kernel when the timeout is issued
+	uts       sys.Timespec // Likewise for the update
+}
+
+// Ticker delivers ticks on C at intervals, like time.Ticker, dropping
+// ticks for slow receivers. It is backed by a multishot timeout (6.4+),
+// a single request that completes at every tick until stopped; on older
+// kernels, by a Timer re-armed at each tick without drifting.
+type Ticker struct {
+	C <-chan time.Time
+
+	t *Timer
+}
+
+// NewTimer returns a timer that sends the current time on its channel
+// after d.
+func (l *Loop) NewTimer(d time.Duration) (*Timer, error) {
+	c := make(chan time.Time, 1)
+	t := &Timer{C: c, l: l, c: c}
+	return t, t.start(d)
+}
+
+// After waits for d to elapse and then sends the current time on the
+// returned channel.
+func (l *Loop) After(d time.Duration) (<-chan time.Time, error) {
+	t, err := l.NewTimer(d)
+	if err != nil {
+		return nil, err
+	}
+	return t.C, nil
+}
+
+// AfterFunc returns a timer that calls fn on the Loop's goroutine after
+// d, e.g. to time out an idle connection.
+func (l *Loop) AfterFunc(d time.Duration, fn func()) (*Timer, error) {
+	t := &Timer{l: l, fn: fn}
+	return t, t.start(d)
+}
+
+// NewTicker returns a ticker with period d, which must be positive.
+func (l *Loop) NewTicker(d time.Duration) (*Ticker, error) {
+	if d <= 0 {
+		return nil, syscall.EINVAL
+	}
+	c := make(chan time.Time, 1)
+	t := &Timer{l: l, c: c, period: d}
+	if err := t.start(d); err != nil {
+		return nil, err
+	}
+	return &Ticker{C: c, t: t}, nil
+}
+
+// start arms a new timer.
+func (t *Timer) start(d time.Duration) error {
+	t.mu.Lock()
+	t.gen++
+	t.active = true
+	t.when = time.Now().Add(d)
+	t.mu.Unlock()
+	return t.l.Post(t.sync)
+}
+
+// Stop prevents the timer from firing. It reports whether it stopped an
+// active timer, as opposed to one that already fired or was stopped. A
+// function timer already running is not waited for.
+func (t *Timer) Stop() bool {
+	t.mu.Lock()
+	active := t.active
+	t.gen++
+	t.active = false
+	t.mu.Unlock()
+	if active {
+		t.l.Post(t.sync)
+	}
+	return active
+}
+
+// Reset changes the timer to expire after d, reporting whether it was
+// active. For a ticker d becomes the period.
+func (t *Timer) Reset(d time.Duration) bool {
+	t.mu.Lock()
+	active := t.active
+	t.gen++
+	t.active = true
+	t.when = time.Now().Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.mu.Unlock()
+	t.l.Post(t.sync)
+	return active
+}
+
+// sync brings the kernel timeout in line with the timer: it arms,
+// updates or removes it. Whatever it starts calls sync again once done.
+// Must run on the Loop's goroutine.
+func (t *Timer) sync() {
+	if t.busy || t.ud == pendingUserData {
+		return
+	}
+	t.mu.Lock()
+	active, gen, when, period := t.active, t.gen, t.when, t.period
+	t.mu.Unlock()
+
+	l := t.l
+	switch {
+	case t.ud != 0 && active && t.armed != gen:
+		t.busy = true
+		l.Submit(func(ud uint64) error {
+			if t.ud == 0 {
+				return syscall.ENOENT // Expired meanwhile
+			}
+			if t.multishot {
+				t.uts = timespecOf(period) // Also the new period
+			} else {
+				t.uts = timespecUntil(when)
+			}
+			return l.ring.PrepTimeoutUpdate(&t.uts, t.ud, 0, ud)
+		}, func(cqe CQEView) {
+			t.busy = false
+			if cqe.Res == 0 {
+				t.armed = gen
+			}
+			t.sync()
+		})
+	case t.ud != 0 && !active:
+		t.busy = true
+		l.Submit(func(ud uint64) error {
+			if t.ud == 0 {
+				return syscall.ENOENT
+			}
+			return l.ring.PrepTimeoutRemove(t.ud, ud)
+		}, func(CQEView) {
+			t.busy = false
+			t.sync()
+		})
+	case t.ud == 0 && active:
+		t.ud = pendingUserData
+		t.armed = gen
+		t.multishot = period > 0 && !l.noTimeoutMultishot
+		l.Submit(func(ud uint64) error {
+			t.ud = ud
+			if t.multishot {
+				t.ts = timespecOf(period)
+				return l.ring.PrepTimeout(&t.ts, 0, sys.IORING_TIMEOUT_MULTISHOT, ud)
+			}
+			t.ts = timespecUntil(when)
+			return l.ring.PrepTimeout(&t.ts, 0, 0, ud)
+		}, t.onExpire)
+	}
+}
+
+// onExpire handles a completion of the kernel timeout, the only one of
+// a single-shot timeout or a tick of a multishot one.
+func (t *Timer) onExpire(cqe CQEView) {
+	if !cqe.HasMore() {
+		t.ud = 0
+		if t.multishot && cqe.Res == -int32(syscall.EINVAL) {
+			// Multishot timeouts need 6.4; re-arm single shots instead
+			t.l.noTimeoutMultishot = true
+			t.sync()
+			return
+		}
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	fire := cqe.Res == -int32(syscall.ETIME) && t.active && t.gen == t.armed
+	switch {
+	case fire && t.period > 0:
+		for t.when = t.when.Add(t.period); !t.when.After(now); {
+			t.when = t.when.Add(t.period) // Skip ticks missed
+		}
+	case fire:
+		t.active = false
+	case cqe.Res != -int32(syscall.ETIME) && cqe.Res != -int32(syscall.ECANCELED) && t.gen == t.armed:
+		t.active = false // Not retried
+	}
+	t.mu.Unlock()
+
+	if fire {
+		if t.fn != nil {
+			t.fn()
+		} else {
+			select {
+			case t.c <- now:
+			default:
+			}
+		}
+	}
+	t.sync()
+}
+
+// timespecUntil returns the time left until when, at least zero.
+func timespecUntil(when time.Time) sys.Timespec {
+	return timespecOf(max(time.Until(when), 0))
+}
+
+// timespecOf converts d to a Timespec.
+func timespecOf(d time.Duration) sys.Timespec {
+	return sys.Timespec{
+		Sec:  int64(d / time.Second),
+		Nsec: int64(d % time.Second),
+	}
+}
+
+// Stop turns off the ticker.
+func (t *Ticker) Stop() {
+	t.t.Stop()
+}
+
+// Reset stops the ticker and restarts it with period d, which must be
+// positive.
+func (t *Ticker) Reset(d time.Duration) error {
+	if d <= 0 {
+		return syscall.EINVAL
+	}
+	t.t.Reset(d)
+	return nil
+}
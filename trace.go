@@ -0,0 +1,60 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WithTrace annotates the ring's activity for the execution tracer
+// (runtime/trace, go tool trace) while a trace is being taken:
+//
+//   - io_uring_enter calls are "iouring.submit" regions, or
+//     "iouring.wait" ones if they wait for completions
+//   - each operation of an Executor is a task named after its opcode,
+//     e.g. "iouring.read", from submission until its completion is
+//     reaped; with SubmitContext it is a subtask of the context's task
+//   - the Executor's reaper goroutine runs with the pprof label
+//     iouring=executor, telling its CPU time apart from the callers'
+//
+// While no trace is running the annotations cost a check each.
+func WithTrace() Option {
+	return func(p *setupConfig) {
+		p.trace = true
+	}
+}
+
+// traceEnter starts the region of an io_uring_enter call with flags, or
+// returns nil if the ring is not traced.
+func (r *Ring) traceEnter(flags uint32) *trace.Region {
+	if !r.trace || !trace.IsEnabled() {
+		return nil
+	}
+	if flags&sys.IORING_ENTER_GETEVENTS != 0 {
+		return trace.StartRegion(context.Background(), "iouring.wait")
+	}
+	return trace.StartRegion(context.Background(), "iouring.submit")
+}
+
+// startTrace begins the task of an operation whose SQE was recorded.
+// Caller must hold e.mu.
+func (op *Operation) startTrace(ctx context.Context) {
+	if op.e.ring.trace && trace.IsEnabled() {
+		_, op.task = trace.NewTask(ctx, "iouring."+opName(op.opcode))
+	}
+}
+
+// runReaper runs reap, labeled for profiles on traced rings.
+func (e *Executor) runReaper() {
+	if !e.ring.trace {
+		e.reap()
+		return
+	}
+	pprof.Do(context.Background(), pprof.Labels("iouring", "executor"), func(context.Context) {
+		e.reap()
+	})
+}
@@ -0,0 +1,155 @@
+//go:build linux
+
+package iouring
+
+import (
+	"syscall"
+	"time"
+)
+
+// WaitFor waits for the completion with the given userData and consumes
+// it, so a synchronous call site can wait for its own request while
+// others are in flight on the same ring. Pending SQEs are submitted.
+// Completions for other requests that are reaped along the way are
+// stashed: later WaitFor calls for them return immediately, and
+// TakeStashed hands them to whoever else is reaping the ring.
+//
+// A timeout <= 0 waits indefinitely; otherwise syscall.ETIME is returned
+// once it expires. WaitFor is safe for concurrent use with itself, but
+// not with other consumers of the CQ such as ForEachCQE or an Executor.
+func (r *Ring) WaitFor(userData uint64, timeout time.Duration) (CQEView, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	// One caller at a time waits in the kernel and reaps for the others,
+	// which wait for it to stash their completions; otherwise a caller
+	// could block in the kernel for a CQE another one just stashed
+	for {
+		r.stashMu.Lock()
+		cqe, ok := r.reapForLocked(userData)
+		if ok {
+			r.stashMu.Unlock()
+			return cqe, nil
+		}
+		var remaining time.Duration
+		if !deadline.IsZero() {
+			if remaining = time.Until(deadline); remaining <= 0 {
+				r.stashMu.Unlock()
+				return CQEView{}, syscall.ETIME
+			}
+		}
+		if r.stashReaper {
+			wake := r.stashWaitLocked()
+			r.stashMu.Unlock()
+			waitWake(wake, remaining)
+			continue
+		}
+		r.stashReaper = true
+		r.stashMu.Unlock()
+
+		var err error
+		if deadline.IsZero() {
+			_, _, _, err = r.WaitCQE()
+		} else {
+			_, _, _, err = r.WaitCQETimeout(remaining)
+		}
+
+		r.stashMu.Lock()
+		r.stashReaper = false
+		r.stashNotifyLocked() // Another caller may have to take over
+		r.stashMu.Unlock()
+		switch err {
+		case nil, syscall.EINTR, syscall.ETIME, syscall.EAGAIN:
+			// Reap what arrived, if anything
+		default:
+			return CQEView{}, err
+		}
+	}
+}
+
+// reapForLocked takes the completion for userData from the stash, or
+// from the CQ ring while stashing everything else that is ready. The CQ
+// is left to the reaper if there is one. Caller must hold stashMu.
+func (r *Ring) reapForLocked(userData uint64) (cqe CQEView, ok bool) {
+	if cqes := r.stash[userData]; len(cqes) > 0 {
+		cqe = cqes[0]
+		if len(cqes) == 1 {
+			delete(r.stash, userData)
+		} else {
+			r.stash[userData] = cqes[1:]
+		}
+		return cqe, true
+	}
+	if r.stashReaper {
+		return cqe, false
+	}
+
+	stashed := false
+	r.ForEachCQE(func(ud uint64, res int32, flags uint32) bool {
+		c := CQEView{UserData: ud, Res: res, Flags: flags}
+		if !ok && ud == userData {
+			cqe, ok = c, true
+			return true
+		}
+		if r.stash == nil {
+			r.stash = make(map[uint64][]CQEView)
+		}
+		r.stash[ud] = append(r.stash[ud], c)
+		stashed = true
+		return true
+	})
+	if stashed {
+		r.stashNotifyLocked()
+	}
+	return cqe, ok
+}
+
+// stashWaitLocked returns a channel that is closed by the next
+// stashNotifyLocked. Caller must hold stashMu.
+func (r *Ring) stashWaitLocked() <-chan struct{} {
+	if r.stashWake == nil {
+		r.stashWake = make(chan struct{})
+	}
+	return r.stashWake
+}
+
+// stashNotifyLocked wakes the callers of WaitFor waiting for the reaper.
+// Caller must hold stashMu.
+func (r *Ring) stashNotifyLocked() {
+	if r.stashWake != nil {
+		close(r.stashWake)
+		r.stashWake = nil
+	}
+}
+
+// waitWake waits until wake is closed, or for at most timeout if it is
+// positive.
+func waitWake(wake <-chan struct{}, timeout time.Duration) {
+	if timeout <= 0 {
+		<-wake
+		return
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-wake:
+	case <-t.C:
+	}
+}
+
+// TakeStashed removes and returns the completions WaitFor reaped on
+// behalf of other requests, in no particular order across userData
+// values but in arrival order for each.
+func (r *Ring) TakeStashed() []CQEView {
+	r.stashMu.Lock()
+	defer r.stashMu.Unlock()
+
+	var cqes []CQEView
+	for ud, list := range r.stash {
+		cqes = append(cqes, list...)
+		delete(r.stash, ud)
+	}
+	return cqes
+}
@@ -0,0 +1,223 @@
+//go:build linux
+
+package iouring
+
+import (
+	"errors"
+	"iter"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// Defaults of a Walker.
+const (
+	defaultWalkBatch = 256
+	walkDirentBuf    = 32 << 10
+)
+
+// WalkEntry is a directory entry found by a Walker.
+type WalkEntry struct {
+	Path string // Root joined with the entry's relative path
+	Name string // Base name
+	Stat Statx  // Not following symlinks
+}
+
+// IsDir reports whether the entry is a directory.
+func (e *WalkEntry) IsDir() bool {
+	return e.Stat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// Walker lists directories, stating their entries with batches of
+// IORING_OP_STATX relative to the directory's descriptor, so that a
+// directory of N entries costs about N/batch submissions rather than N
+// stat calls.
+//
+// A Walker uses its ring exclusively while iterating: nothing else may
+// submit to it or consume its CQEs, and iterations must not overlap.
+type Walker struct {
+	ring  *Ring
+	batch int
+	mask  uint32
+
+	names []*byte // Reused across batches
+	stats []Statx
+	buf   []byte
+}
+
+// NewWalker returns a Walker that issues up to batch statx requests per
+// submission (a default if batch is zero, and at most the ring's CQ
+// size), requesting the fields in mask (STATX_BASIC_STATS if zero).
+func NewWalker(ring *Ring, batch int, mask uint32) *Walker {
+	if batch <= 0 {
+		batch = defaultWalkBatch
+	}
+	if cq := int(ring.CQEntries()); batch > cq {
+		batch = cq
+	}
+	if mask == 0 {
+		mask = sys.STATX_BASIC_STATS
+	}
+	return &Walker{ring: ring, batch: batch, mask: mask}
+}
+
+// ReadDir yields the entries of dir, in directory order. An entry that
+// cannot be stated is yielded with its error; one that vanished since
+// the directory was read is skipped. A failure to read dir is yielded
+// with dir's path and ends the iteration.
+func (w *Walker) ReadDir(dir string) iter.Seq2[WalkEntry, error] {
+	return func(yield func(WalkEntry, error) bool) {
+		w.walk(dir, false, yield)
+	}
+}
+
+// Walk yields the entries below root, depth first, without following
+// symlinks. Directories are yielded before their contents. A directory
+// that cannot be read is yielded as an entry with its path and error,
+// and the walk goes on with the next one.
+func (w *Walker) Walk(root string) iter.Seq2[WalkEntry, error] {
+	return func(yield func(WalkEntry, error) bool) {
+		w.walk(root, true, yield)
+	}
+}
+
+// walk lists root and, if recursive, the directories below it.
+func (w *Walker) walk(root string, recursive bool, yield func(WalkEntry, error) bool) {
+	stack := []string{root}
+	for len(stack) > 0 {
+		dir := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var subdirs []string
+		err := w.readDir(dir, func(e WalkEntry, err error) bool {
+			if recursive && err == nil && e.IsDir() {
+				subdirs = append(subdirs, e.Path)
+			}
+			return yield(e, err)
+		})
+		if err == errWalkStopped {
+			return
+		}
+		if err != nil {
+			if !yield(WalkEntry{Path: dir, Name: filepath.Base(dir)}, &os.PathError{Op: "readdir", Path: dir, Err: err}) || !recursive {
+				return
+			}
+		}
+		// Push in reverse so that the first subdirectory is walked first
+		for i := len(subdirs) - 1; i >= 0; i-- {
+			stack = append(stack, subdirs[i])
+		}
+	}
+}
+
+// errWalkStopped reports that the consumer of an iteration stopped it.
+var errWalkStopped = errors.New("iouring: walk stopped")
+
+// readDir reads dir and passes its stated entries to fn.
+func (w *Walker) readDir(dir string, fn func(WalkEntry, error) bool) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if w.buf == nil {
+		w.buf = make([]byte, walkDirentBuf)
+	}
+	var names []string
+	for {
+		n, err := syscall.ReadDirent(fd, w.buf)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			break
+		}
+		_, _, names = syscall.ParseDirent(w.buf[:n], -1, names)
+		for len(names) >= w.batch {
+			if err := w.statBatch(fd, dir, names[:w.batch], fn); err != nil {
+				return err
+			}
+			names = names[w.batch:]
+		}
+	}
+	if len(names) > 0 {
+		return w.statBatch(fd, dir, names, fn)
+	}
+	return nil
+}
+
+// statBatch states names relative to dirfd in one submission and passes
+// the results to fn in order.
+func (w *Walker) statBatch(dirfd int, dir string, names []string, fn func(WalkEntry, error) bool) error {
+	r := w.ring
+	if cap(w.stats) < len(names) {
+		w.stats = make([]Statx, len(names))
+		w.names = make([]*byte, len(names))
+	}
+	stats := w.stats[:len(names)]
+	paths := w.names[:len(names)]
+	res := make([]int32, len(names))
+
+	prepped := 0
+	for i, name := range names {
+		p, err := syscall.BytePtrFromString(name) // Dirents hold no NULs
+		if err == nil {
+			paths[i] = p
+			err = r.PrepStatx(dirfd, p, sys.AT_SYMLINK_NOFOLLOW, int(w.mask), unsafe.Pointer(&stats[i]), uint64(i))
+			if err == ErrSQFull {
+				if _, err = r.Submit(); err == nil {
+					err = r.PrepStatx(dirfd, p, sys.AT_SYMLINK_NOFOLLOW, int(w.mask), unsafe.Pointer(&stats[i]), uint64(i))
+				}
+			}
+		}
+		if err != nil {
+			// Wait for the requests already queued, which use stats
+			w.reap(res, prepped)
+			return err
+		}
+		prepped++
+	}
+	err := w.reap(res, prepped)
+	runtime.KeepAlive(paths)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		e := WalkEntry{Path: filepath.Join(dir, name), Name: name}
+		var err error
+		switch {
+		case res[i] == -int32(syscall.ENOENT):
+			continue // Removed since the directory was read
+		case res[i] < 0:
+			err = &os.PathError{Op: "statx", Path: e.Path, Err: syscall.Errno(-res[i])}
+		default:
+			e.Stat = stats[i]
+		}
+		if !fn(e, err) {
+			return errWalkStopped
+		}
+	}
+	return nil
+}
+
+// reap submits the prepared statx requests and collects n completions
+// into res by their index.
+func (w *Walker) reap(res []int32, n int) error {
+	r := w.ring
+	for n > 0 {
+		if _, err := r.SubmitAndWait(1); err != nil && err != syscall.EINTR {
+			return err
+		}
+		n -= r.ForEachCQE(func(userData uint64, r int32, flags uint32) bool {
+			res[userData] = r
+			return true
+		})
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+//go:build linux
+
+package iouring
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// WatchEvent is a readiness event of a Watcher.
+type WatchEvent struct {
+	Fd     int    // Descriptor the event is for
+	Events uint32 // Poll events fd is ready for, e.g. EPOLLIN; 0 on error
+	Err    error  // Why fd is no longer watched, if it failed
+}
+
+// Watcher waits for descriptors that have no operation of their own to
+// become ready, such as an inotify fd, a signalfd, a pidfd or a timerfd,
+// with a multishot poll (5.13+) per descriptor on an Executor's ring, in
+// place of an epoll set. The poll is rearmed whenever the kernel ends it,
+// so a descriptor stays watched until Remove or Close. Events are queued
+// as they arrive, until Next takes them.
+//
+// Like epoll, a watch reports readiness, it does not consume it: the
+// caller reads the descriptor to clear it before waiting again, or it is
+// reported again. The Watcher does not own the descriptors.
+type Watcher struct {
+	e      *Executor
+	events eventQueue[watchCQE]
+
+	mu      sync.Mutex
+	watches map[int]*watch
+	closed  bool
+}
+
+// watch is a descriptor of a Watcher.
+type watch struct {
+	fd     int
+	events uint32
+	op     *Operation // The poll in flight
+}
+
+// watchCQE is a CQE of the poll of w; w is nil for the wakeup of Close.
+type watchCQE struct {
+	w     *watch
+	res   int32
+	flags uint32
+}
+
+// NewWatcher returns an empty Watcher on e.
+func NewWatcher(e *Executor) *Watcher {
+	return &Watcher{
+		e:       e,
+		events:  newEventQueue[watchCQE](),
+		watches: make(map[int]*watch),
+	}
+}
+
+// Add starts watching fd for events, a mask of poll events such as
+// EPOLLIN or EPOLLOUT. Errors and hangups are reported whatever the mask.
+// It returns EEXIST if fd is already watched, as epoll_ctl does.
+func (w *Watcher) Add(fd int, events uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	if _, ok := w.watches[fd]; ok {
+		return syscall.EEXIST
+	}
+	wt := &watch{fd: fd, events: events}
+	if err := w.armLocked(wt); err != nil {
+		return err
+	}
+	w.watches[fd] = wt
+	return nil
+}
+
+// Remove stops watching fd. Events of fd still queued are dropped. It
+// returns ENOENT if fd is not watched, as epoll_ctl does.
+func (w *Watcher) Remove(fd int) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return os.ErrClosed
+	}
+	wt, ok := w.watches[fd]
+	if !ok {
+		w.mu.Unlock()
+		return syscall.ENOENT
+	}
+	delete(w.watches, fd)
+	w.mu.Unlock()
+
+	wt.op.Cancel()
+	return nil
+}
+
+// Next waits until ctx is done for the next event. An event with Err set
+// means its descriptor failed and is no longer watched. After Close, Next
+// returns os.ErrClosed.
+func (w *Watcher) Next(ctx context.Context) (WatchEvent, error) {
+	for {
+		cqe, err := w.events.next(ctx)
+		if err != nil {
+			return WatchEvent{}, err
+		}
+		if cqe.w == nil {
+			// Pass the wakeup of Close on to the other callers
+			w.events.push(cqe)
+			return WatchEvent{}, os.ErrClosed
+		}
+
+		w.mu.Lock()
+		ev, ok := w.eventLocked(cqe)
+		w.mu.Unlock()
+		if ok {
+			return ev, nil
+		}
+	}
+}
+
+// eventLocked turns a CQE into the event to deliver, if any, and rearms
+// the poll it ends. Caller must hold mu.
+func (w *Watcher) eventLocked(cqe watchCQE) (WatchEvent, bool) {
+	wt := cqe.w
+	if w.closed || w.watches[wt.fd] != wt {
+		return WatchEvent{}, false // Removed
+	}
+	ev := WatchEvent{Fd: wt.fd}
+	if cqe.res < 0 {
+		ev.Err = syscall.Errno(-cqe.res)
+	} else {
+		ev.Events = uint32(cqe.res)
+	}
+	if cqe.flags&sys.IORING_CQE_F_MORE == 0 {
+		if ev.Err == nil {
+			ev.Err = w.armLocked(wt)
+		}
+		if ev.Err != nil {
+			delete(w.watches, wt.fd)
+		}
+	}
+	return ev, true
+}
+
+// armLocked submits the multishot poll of wt. Caller must hold mu.
+func (w *Watcher) armLocked(wt *watch) error {
+	op, err := w.e.submitEach(func(ud uint64) error {
+		return w.e.ring.PrepPollAddMultishot(wt.fd, wt.events, ud)
+	}, func(res int32, flags uint32) {
+		w.events.push(watchCQE{wt, res, flags})
+	})
+	if err != nil {
+		return err
+	}
+	wt.op = op
+	return nil
+}
+
+// Close stops watching every descriptor and waits for the polls to end.
+// Callers blocked in Next return os.ErrClosed.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return os.ErrClosed
+	}
+	w.closed = true
+	watches := w.watches
+	w.watches = nil
+	w.mu.Unlock()
+
+	for _, wt := range watches {
+		wt.op.Cancel()
+	}
+	for _, wt := range watches {
+		<-wt.op.Done()
+	}
+	w.events.drain()
+	w.events.push(watchCQE{})
+	return nil
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package iouring
+
+import (
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/behrlich/go-iouring/internal/sys"
+)
+
+// maxIovecs is the most iovecs a single readv or writev takes (IOV_MAX).
+const maxIovecs = 1024
+
+// WritevBuffers writes the contents of bufs to fd at its file position
+// with writev, so a message encoded into several slices, such as a
+// header and a payload, goes out in one request without first being
+// copied into one buffer. A short write is continued with the rest,
+// and at most IOV_MAX buffers go into each request. It returns the
+// number of bytes written. bufs is not modified.
+func WritevBuffers(e *Executor, fd int, bufs net.Buffers) (int64, error) {
+	if !e.ring.HasFeature(sys.IORING_FEAT_RW_CUR_POS) {
+		return 0, ErrNotSupported
+	}
+
+	var written int64
+	skip := 0 // Bytes of bufs[0] already written
+	iovecs := make([]syscall.Iovec, 0, min(len(bufs), maxIovecs))
+	for {
+		iovecs = iovecs[:0]
+		for i, b := range bufs {
+			if i == 0 {
+				b = b[skip:]
+			}
+			if len(b) == 0 {
+				continue
+			}
+			if len(iovecs) == maxIovecs {
+				break
+			}
+			iovecs = append(iovecs, syscall.Iovec{Base: &b[0], Len: uint64(len(b))})
+		}
+		if len(iovecs) == 0 {
+			return written, nil
+		}
+
+		// iovecs points into bufs, so keeping it keeps them alive too
+		op, err := e.submit(func(ud uint64) error {
+			return e.ring.PrepWritev(fd, iovecs, curPosOffset, ud)
+		}, iovecs)
+		if err != nil {
+			return written, err
+		}
+		res, err := op.Result()
+		if err != nil {
+			return written, err
+		}
+		if res == 0 {
+			return written, io.ErrShortWrite
+		}
+		written += int64(res)
+
+		// Drop what was written, without touching the caller's slices
+		n := int(res)
+		for n > 0 {
+			left := len(bufs[0]) - skip
+			if n < left {
+				skip += n
+				break
+			}
+			n -= left
+			bufs, skip = bufs[1:], 0
+		}
+	}
+}